@@ -1,36 +1,49 @@
 module NT106/Group01/MusicStreamingAPI
 
-go 1.20
+go 1.21
 
 require (
+	github.com/coreos/go-oidc/v3 v3.9.0
+	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8
 	github.com/gbrlsnchs/jwt/v3 v3.0.1
+	github.com/go-webauthn/webauthn v0.9.4
 	github.com/gorilla/mux v1.8.0
 	github.com/howeyc/fsnotify v0.9.0
 	github.com/ironsmile/sql-migrate v0.0.0-20180302150855-e167f4809da4
-	github.com/liyue201/goqr v0.0.0-20200803022322-df443203d4ea
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/maxbrunsfeld/counterfeiter/v6 v6.6.1
 	github.com/pborman/uuid v1.2.1
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/afero v1.9.5
 	github.com/wtolson/go-taglib v0.0.0-20210406152913-79209c280058
+	golang.org/x/crypto v0.16.0
 	golang.org/x/image v0.7.0
+	golang.org/x/oauth2 v0.13.0
 	golang.org/x/sync v0.2.0
+	golang.org/x/text v0.14.0
 	gopkg.in/mineo/gocaa.v1 v1.0.0-20180225115936-2500f801cd83
-	gorm.io/gorm v1.25.1
 	gorm.io/driver/sqlite v1.5.1
+	gorm.io/gorm v1.25.1
 )
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/fxamacker/cbor/v2 v2.5.0 // indirect
+	github.com/go-jose/go-jose/v3 v3.0.1 // indirect
+	github.com/go-webauthn/x v0.1.5 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/go-tpm v0.9.0 // indirect
+	github.com/google/uuid v1.4.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/magefile/mage v1.9.0 // indirect
-	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/mod v0.8.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 	gopkg.in/gorp.v1 v1.7.2 // indirect
 )
@@ -0,0 +1,22 @@
+-- +migrate Up
+
+-- Every play of a track by a user. The times are unix timestamps, `played` and
+-- `position` are in milliseconds. The user is one from the authentication
+-- database so there is no foreign key for it.
+create table `plays` (
+    `id` integer not null primary key,
+    `user_id` integer not null,
+    `track_id` integer not null,
+    `started_at` integer not null,
+    `updated_at` integer not null,
+    `played` integer not null default 0,
+    `position` integer not null default 0,
+    `client` text
+);
+
+create index plays_users on `plays` (`user_id`, `started_at`);
+create index plays_tracks on `plays` (`track_id`);
+
+-- +migrate Down
+
+drop table `plays`;
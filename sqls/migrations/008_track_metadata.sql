@@ -0,0 +1,34 @@
+-- +migrate Up
+
+-- The tags of the tracks besides artist, album, title and track number. The
+-- MusicBrainz IDs are the ones written by MusicBrainz Picard, the track ID is
+-- the ID of the recording.
+alter table tracks add column genre text not null default '';
+alter table tracks add column year integer not null default 0;
+alter table tracks add column album_artist text not null default '';
+alter table tracks add column disc integer not null default 0;
+alter table tracks add column disc_total integer not null default 0;
+alter table tracks add column composer text not null default '';
+alter table tracks add column comment text not null default '';
+alter table tracks add column musicbrainz_track_id text not null default '';
+alter table tracks add column musicbrainz_album_id text not null default '';
+alter table tracks add column musicbrainz_artist_id text not null default '';
+alter table tracks add column musicbrainz_album_artist_id text not null default '';
+
+create index tracks_genres on `tracks` (`genre`);
+
+-- +migrate Down
+
+drop index tracks_genres;
+
+alter table tracks drop column genre;
+alter table tracks drop column year;
+alter table tracks drop column album_artist;
+alter table tracks drop column disc;
+alter table tracks drop column disc_total;
+alter table tracks drop column composer;
+alter table tracks drop column comment;
+alter table tracks drop column musicbrainz_track_id;
+alter table tracks drop column musicbrainz_album_id;
+alter table tracks drop column musicbrainz_artist_id;
+alter table tracks drop column musicbrainz_album_artist_id;
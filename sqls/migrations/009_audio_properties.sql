@@ -0,0 +1,17 @@
+-- +migrate Up
+
+-- The technical properties of the tracks' audio. The bitrate is in kbit/s and
+-- the sample rate in Hz. The bit depth is known only for lossless codecs.
+alter table tracks add column bitrate integer not null default 0;
+alter table tracks add column sample_rate integer not null default 0;
+alter table tracks add column bit_depth integer not null default 0;
+alter table tracks add column channels integer not null default 0;
+alter table tracks add column codec text not null default '';
+
+-- +migrate Down
+
+alter table tracks drop column bitrate;
+alter table tracks drop column sample_rate;
+alter table tracks drop column bit_depth;
+alter table tracks drop column channels;
+alter table tracks drop column codec;
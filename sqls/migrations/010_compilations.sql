@@ -0,0 +1,55 @@
+-- +migrate Up
+
+-- Albums are grouped by their album artist too. Otherwise two albums with the
+-- same name by different artists which are in the same directory would be one.
+alter table albums add column album_artist text not null default '';
+
+drop index if exists unique_albums;
+create unique index if not exists unique_albums on `albums` (`name`, `fs_path`, `album_artist`);
+
+-- Whether the track is tagged as part of a compilation.
+alter table tracks add column compilation integer not null default 0;
+
+-- +migrate Down
+
+alter table tracks drop column compilation;
+
+drop index if exists unique_albums;
+alter table albums drop column album_artist;
+
+-- Albums which differ only by their album artist become one again. Their tracks
+-- are moved to the album with the smallest ID and the rest are removed so that
+-- the old unique index could be created.
+update tracks set album_id = (
+    select min(same.id)
+    from albums as album
+    join albums as same on same.name = album.name and same.fs_path = album.fs_path
+    where album.id = tracks.album_id
+)
+where album_id in (
+    select album.id from albums as album
+    where exists (
+        select 1 from albums as same
+        where same.name = album.name and same.fs_path = album.fs_path
+            and same.id < album.id
+    )
+);
+
+delete from albums_artworks
+where album_id in (
+    select album.id from albums as album
+    where exists (
+        select 1 from albums as same
+        where same.name = album.name and same.fs_path = album.fs_path
+            and same.id < album.id
+    )
+);
+
+delete from albums
+where exists (
+    select 1 from albums as same
+    where same.name = albums.name and same.fs_path = albums.fs_path
+        and same.id < albums.id
+);
+
+create unique index if not exists unique_albums on `albums` (`name`, `fs_path`);
@@ -0,0 +1,32 @@
+-- +migrate Up
+
+-- Whether the play has reached the listen threshold. Only these plays are counted
+-- in the charts. Requesting a file records a play too, even when it is only
+-- prefetched by the client.
+alter table plays add column counted integer not null default 0;
+
+-- The imported plays have been scrobbled so they are listens. How long they have
+-- been played is not known and the duration of the track is used instead.
+update plays
+set
+    counted = 1,
+    played = (select IFNULL(duration, 0) from tracks where tracks.id = plays.track_id)
+where
+    client in ('Last.fm import', 'ListenBrainz import');
+
+-- For the other plays the default listen threshold is used: half of the track or
+-- four minutes, whichever comes first.
+update plays
+set counted = 1
+where
+    played >= 240000 or exists (
+        select 1 from tracks
+        where
+            tracks.id = plays.track_id and
+            tracks.duration > 0 and
+            plays.played * 2 >= tracks.duration
+    );
+
+-- +migrate Down
+
+alter table plays drop column counted;
@@ -0,0 +1,13 @@
+-- +migrate Up
+
+-- The state of the library which has to survive restarts of the server. For
+-- example, whether the meta data of the tracks has still to be read again after
+-- a migration.
+create table if not exists settings (
+    name text primary key,
+    value text not null
+);
+
+-- +migrate Down
+
+drop table if exists settings;
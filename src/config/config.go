@@ -17,6 +17,7 @@ import (
 	"path/filepath"
 
 	"NT106/Group01/MusicStreamingAPI/src/helpers"
+	"NT106/Group01/MusicStreamingAPI/src/transcode"
 
 	"github.com/spf13/afero"
 )
@@ -28,6 +29,21 @@ const (
 
 	defaultlistAddress = "localhost:9996"
 	defaultSecretBytes = 64
+
+	defaultListenPercent = 50
+	defaultListenSeconds = 240
+)
+
+// The following are the possible values for the registration mode.
+const (
+	// RegistrationOpen allows anyone to create an account.
+	RegistrationOpen = "open"
+
+	// RegistrationInviteOnly requires a valid invite code for creating an account.
+	RegistrationInviteOnly = "invite-only"
+
+	// RegistrationDisabled means new accounts cannot be created at all.
+	RegistrationDisabled = "disabled"
 )
 
 var configFileName string
@@ -45,6 +61,11 @@ var defaultConfig = Config{
 	Listen:             defaultlistAddress,
 	SqliteDatabase:     "musicstreaming.db",
 	SqliteDatabaseAuth: "auth.db",
+	Registration:       RegistrationOpen,
+	ListenThreshold: ListenThreshold{
+		Percent: defaultListenPercent,
+		Seconds: defaultListenSeconds,
+	},
 }
 
 // Config contains representation for everything in config.json
@@ -56,6 +77,138 @@ type Config struct {
 	SqliteDatabase     string   `json:"sqlite_database,omitempty"`
 	SqliteDatabaseAuth string   `json:"sqlite_database_auth,omitempty"`
 	DiscogsAuthToken   string   `json:"discogs_auth_token,omitempty"`
+
+	// Registration controls who is able to create new accounts. Possible values
+	// are "open", "invite-only" and "disabled".
+	Registration string `json:"registration,omitempty"`
+
+	// WebAuthn configures logging in with passkeys. Passkeys are not available
+	// when it is missing.
+	WebAuthn *WebAuthnConfig `json:"webauthn,omitempty"`
+
+	// OIDC configures logging in with an external OpenID Connect provider. Only
+	// the local accounts could be used when it is missing.
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+
+	// Transcoding enables converting files to other formats while they are being
+	// streamed. The files are always served as they are when it is missing.
+	Transcoding *TranscodingConfig `json:"transcoding,omitempty"`
+
+	// ListenThreshold is how much of a track has to be played before the play
+	// is counted as a listen. By default it is half of the track or 4 minutes,
+	// whichever comes first.
+	ListenThreshold ListenThreshold `json:"listen_threshold"`
+
+	// Scrobbling lets users submit their plays to ListenBrainz and Last.fm.
+	// It is not available when missing.
+	Scrobbling *ScrobblingConfig `json:"scrobbling,omitempty"`
+}
+
+// ListenThreshold describes when a play of a track is counted as a listen. It is
+// counted once either of the limits is reached. A zero value disables a limit.
+type ListenThreshold struct {
+	// Percent is the part of the track's duration which has to be played.
+	Percent int `json:"percent"`
+
+	// Seconds is the playing time after which the play is counted regardless
+	// of the track's duration.
+	Seconds int `json:"seconds"`
+}
+
+// WebAuthnConfig describes the server as a WebAuthn relying party.
+type WebAuthnConfig struct {
+	// RPID is the domain name of the server as seen by the clients, for example
+	// "music.example.com". Passkeys are bound to it.
+	RPID string `json:"rp_id"`
+
+	// RPDisplayName is shown by authenticators during registration.
+	RPDisplayName string `json:"rp_display_name,omitempty"`
+
+	// Origins are the fully qualified origins from which the web clients are
+	// served, for example "https://music.example.com".
+	Origins []string `json:"origins"`
+}
+
+// OIDCConfig describes the OpenID Connect provider and how this server is
+// registered with it.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, for example "https://id.example.com".
+	// The rest of its configuration is discovered from it.
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// RedirectURL is the full URL of the callback endpoint of this server as
+	// registered with the provider.
+	RedirectURL string `json:"redirect_url"`
+
+	// Scopes are requested in addition to "openid". When empty "profile" and
+	// "email" are requested.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// AutoProvision creates a local user on the first login of every identity
+	// which is not linked with one yet. Only already linked identities could log
+	// in when it is false. The registration mode applies to the created users the
+	// same way it applies to the registration endpoint.
+	AutoProvision bool `json:"auto_provision,omitempty"`
+
+	// DefaultRole is given to users which are created on their first login.
+	// It is "listener" when empty.
+	DefaultRole string `json:"default_role,omitempty"`
+}
+
+// TranscodingConfig configures the ffmpeg transcoder.
+type TranscodingConfig struct {
+	// FFmpeg is the path to the ffmpeg binary. It is looked up in $PATH when
+	// empty.
+	FFmpeg string `json:"ffmpeg,omitempty"`
+
+	// Profiles are named transcoding settings which clients could request
+	// instead of giving the format and the bit rate themselves.
+	Profiles map[string]TranscodingProfile `json:"profiles,omitempty"`
+
+	// HLSBitRates are the bit rates in kbit/s of the HTTP Live Streaming
+	// variants. By default they are 64, 128 and 256.
+	HLSBitRates []int `json:"hls_bitrates,omitempty"`
+
+	// HLSCacheSize is the maximal size in megabytes of the cached HLS segments.
+	// By default it is 1024.
+	HLSCacheSize int64 `json:"hls_cache_size,omitempty"`
+
+	// MaxConcurrent is the maximal number of ffmpeg processes running at the
+	// same time, including the ones generating HLS segments. Requests above it
+	// are refused. By default it is the number of CPUs.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// TranscodingProfile is a format and a bit rate in kbit/s. Zero bit rate means the
+// default one for the format.
+type TranscodingProfile struct {
+	Format  string `json:"format"`
+	BitRate int    `json:"bitrate,omitempty"`
+}
+
+// ScrobblingConfig configures the scrobbling services. ListenBrainz is always
+// available while Last.fm requires an API account.
+type ScrobblingConfig struct {
+	// ListenBrainzURL is the base URL of the ListenBrainz API. By default it is
+	// "https://api.listenbrainz.org".
+	ListenBrainzURL string `json:"listenbrainz_url,omitempty"`
+
+	// LastFM is the Last.fm API account of the server. Last.fm is not available
+	// when it is missing.
+	LastFM *LastFMConfig `json:"lastfm,omitempty"`
+}
+
+// LastFMConfig is a Last.fm API account. One could be created on
+// https://www.last.fm/api/account/create
+type LastFMConfig struct {
+	APIKey string `json:"api_key"`
+	Secret string `json:"secret"`
+
+	// URL is the base URL of the Last.fm API. By default it is
+	// "https://ws.audioscrobbler.com".
+	URL string `json:"url,omitempty"`
 }
 
 // FindAndParse actually finds the configuration file, parsing it and merging it on
@@ -83,9 +236,93 @@ func FindAndParse(appfs afero.Fs) (Config, error) {
 		return Config{}, fmt.Errorf("decoding config: %s", err)
 	}
 
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %s", err)
+	}
+
 	return cfg, nil
 }
 
+// validate checks the values which could be only one of a predefined set and
+// the sections which have required values.
+func (cfg Config) validate() error {
+	switch cfg.Registration {
+	case RegistrationOpen, RegistrationInviteOnly, RegistrationDisabled:
+	default:
+		return fmt.Errorf("unknown registration mode `%s`", cfg.Registration)
+	}
+
+	if cfg.WebAuthn != nil {
+		if cfg.WebAuthn.RPID == "" {
+			return fmt.Errorf("webauthn.rp_id is required")
+		}
+		if len(cfg.WebAuthn.Origins) == 0 {
+			return fmt.Errorf("webauthn.origins must have at least one origin")
+		}
+	}
+
+	if cfg.OIDC != nil {
+		if cfg.OIDC.Issuer == "" {
+			return fmt.Errorf("oidc.issuer is required")
+		}
+		if cfg.OIDC.ClientID == "" {
+			return fmt.Errorf("oidc.client_id is required")
+		}
+		if cfg.OIDC.RedirectURL == "" {
+			return fmt.Errorf("oidc.redirect_url is required")
+		}
+		switch cfg.OIDC.DefaultRole {
+		case "", "guest", "listener", "admin":
+		default:
+			return fmt.Errorf("unknown oidc.default_role `%s`", cfg.OIDC.DefaultRole)
+		}
+	}
+
+	if cfg.Transcoding != nil {
+		for name, profile := range cfg.Transcoding.Profiles {
+			_, err := transcode.NewOptions(profile.Format, profile.BitRate)
+			if err != nil {
+				return fmt.Errorf("transcoding profile `%s`: %s", name, err)
+			}
+		}
+
+		if cfg.Transcoding.MaxConcurrent < 0 {
+			return fmt.Errorf("transcoding.max_concurrent must not be negative")
+		}
+
+		for _, bitRate := range cfg.Transcoding.HLSBitRates {
+			if bitRate < transcode.MinBitRate || bitRate > transcode.MaxBitRate {
+				return fmt.Errorf(
+					"transcoding.hls_bitrates must be between %d and %d",
+					transcode.MinBitRate,
+					transcode.MaxBitRate,
+				)
+			}
+		}
+	}
+
+	if cfg.Scrobbling != nil && cfg.Scrobbling.LastFM != nil {
+		if cfg.Scrobbling.LastFM.APIKey == "" {
+			return fmt.Errorf("scrobbling.lastfm.api_key is required")
+		}
+		if cfg.Scrobbling.LastFM.Secret == "" {
+			return fmt.Errorf("scrobbling.lastfm.secret is required")
+		}
+	}
+
+	if cfg.ListenThreshold.Percent < 0 || cfg.ListenThreshold.Percent > 100 {
+		return fmt.Errorf("listen_threshold.percent must be between 0 and 100")
+	}
+	if cfg.ListenThreshold.Seconds < 0 {
+		return fmt.Errorf("listen_threshold.seconds must not be negative")
+	}
+	if cfg.ListenThreshold.Percent == 0 && cfg.ListenThreshold.Seconds == 0 {
+		return fmt.Errorf("listen_threshold must have at least one non-zero limit")
+	}
+
+	return nil
+}
+
 // UserConfigPath returns the full path to the place where the user's configuration
 // file should be
 func UserConfigPath(appfs afero.Fs) string {
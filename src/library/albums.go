@@ -0,0 +1,76 @@
+package library
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VariousArtists is the artist of the compilations which have no album artist.
+const VariousArtists = "Various Artists"
+
+// discSuffix matches the names of directories and albums which are one disc of
+// a multi-disc album. For example "CD1", "Disc 2" or "Album (Disc 1)". The first
+// group is the name without the disc and the second one is the number of the disc.
+var discSuffix = regexp.MustCompile(
+	`(?i)^(.*?)[\s._-]*[(\[]?\b(?:cd|disc|disk)[\s._-]*(\d{1,3})[)\]]?$`,
+)
+
+// splitDisc returns the name without its disc suffix and the number of the disc.
+// The number is 0 when name is not the name of a disc.
+func splitDisc(name string) (string, int64) {
+	match := discSuffix.FindStringSubmatch(strings.TrimSpace(name))
+	if match == nil {
+		return name, 0
+	}
+
+	disc, _ := strconv.ParseInt(match[2], 10, 64)
+	return match[1], disc
+}
+
+// albumLocation returns the directory of the album of a track in the directory
+// dir together with the number of the disc which could be guessed from it. The
+// discs of multi-disc albums are often in sub-directories such as "CD1" and "CD2"
+// of the album's directory. For them the album is in the parent directory.
+func albumLocation(dir string) (string, int64) {
+	if _, disc := splitDisc(filepath.Base(dir)); disc > 0 {
+		return filepath.Dir(dir), disc
+	}
+	return dir, 0
+}
+
+// albumName returns the name of the album from the tags of a track without the
+// disc suffix which some albums have. It returns the number of the disc from the
+// suffix too. Names which are only a disc, such as "CD1", are kept as they are.
+func albumName(album string) (string, int64) {
+	name, disc := splitDisc(album)
+	if disc == 0 || name == "" {
+		return album, 0
+	}
+	return name, disc
+}
+
+// albumArtistColumn is the SQL expression for the artist of an album. It is the
+// album artist from the tags. When they have none it is the artist of the tracks
+// or VariousArtists when there are many. The query must name the albums `al`,
+// their tracks `tr` and the artists of the tracks `ar` and group by album.
+const albumArtistColumn = `
+	CASE
+		WHEN al.album_artist != '' THEN al.album_artist
+		WHEN COUNT(DISTINCT tr.artist_id) = 1 THEN MIN(ar.name)
+		ELSE '` + VariousArtists + `'
+	END
+`
+
+// albumCompilationColumn is the SQL expression for whether an album is a
+// compilation. Albums are compilations when one of their tracks is tagged as
+// such, when their album artist is VariousArtists or when they have tracks from
+// many artists and no album artist. The query must be as for albumArtistColumn.
+const albumCompilationColumn = `
+	(
+		MAX(tr.compilation) = 1 OR
+		LOWER(al.album_artist) = LOWER('` + VariousArtists + `') OR
+		(al.album_artist = '' AND COUNT(DISTINCT tr.artist_id) > 1)
+	)
+`
@@ -238,7 +238,8 @@ func (lib *LocalLibrary) albumArtworkFromInternet(
 	work := func(db *sql.DB) error {
 		row, err := db.QueryContext(ctx, `
 			SELECT
-				name
+				name,
+				album_artist
 			FROM
 				albums
 			WHERE
@@ -257,10 +258,16 @@ func (lib *LocalLibrary) albumArtworkFromInternet(
 			return ErrAlbumNotFound
 		}
 
-		if err := row.Scan(&albumName); err != nil {
+		if err := row.Scan(&albumName, &artistName); err != nil {
 			return fmt.Errorf("scanning db result: %s", err)
 		}
 
+		// Albums with an album artist are looked up by it. For the rest the
+		// artist of most of the tracks is used.
+		if artistName != "" {
+			return nil
+		}
+
 		row, err = db.QueryContext(ctx, `
 			SELECT
 				a.name,
@@ -0,0 +1,485 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// The codecs of the tracks as stored in the database and returned in
+// AudioProperties.
+const (
+	codecMP3    = "mp3"
+	codecAAC    = "aac"
+	codecVorbis = "vorbis"
+	codecOpus   = "opus"
+	codecFLAC   = "flac"
+	codecALAC   = "alac"
+	codecPCM    = "pcm"
+)
+
+// losslessCodecs is the SQL list of the lossless codecs.
+const losslessCodecs = `('flac', 'alac', 'pcm')`
+
+// AudioProperties are the technical properties of the audio of a track.
+type AudioProperties struct {
+	// Bitrate is the average bitrate in kbit/s.
+	Bitrate int64 `json:"bitrate"`
+
+	// SampleRate is in Hz.
+	SampleRate int64 `json:"sample_rate"`
+
+	// BitDepth is the number of bits per sample. Lossy codecs have no bit depth
+	// so it is 0 for them.
+	BitDepth int64 `json:"bit_depth"`
+
+	Channels int64 `json:"channels"`
+
+	// Codec is one of "mp3", "aac", "vorbis", "opus", "flac", "alac" and "pcm"
+	// or empty when it is not known.
+	Codec string `json:"codec"`
+
+	// Lossless is true for the FLAC, ALAC and PCM tracks.
+	Lossless bool `json:"lossless"`
+}
+
+// audioPropertiesColumns are the columns selected for AudioProperties in the order
+// of scanDest. The query must name the tracks table `t`.
+const audioPropertiesColumns = `
+	t.bitrate,
+	t.sample_rate,
+	t.bit_depth,
+	t.channels,
+	t.codec,
+	t.codec IN ` + losslessCodecs + `
+`
+
+// scanDest returns the destinations for scanning audioPropertiesColumns.
+func (p *AudioProperties) scanDest() []interface{} {
+	return []interface{}{
+		&p.Bitrate,
+		&p.SampleRate,
+		&p.BitDepth,
+		&p.Channels,
+		&p.Codec,
+		&p.Lossless,
+	}
+}
+
+// AudioFilter limits the tracks to the ones with certain audio properties. Its
+// zero value matches all tracks.
+type AudioFilter struct {
+	// Lossless limits the tracks to the ones with lossless codecs.
+	Lossless bool
+
+	// MinBitrate is the lowest bitrate of the tracks in kbit/s.
+	MinBitrate int64
+}
+
+// where returns the SQL condition and its parameters for the tracks table with
+// this name.
+func (f AudioFilter) where(table string) (string, []interface{}) {
+	where := "1 = 1"
+	var params []interface{}
+
+	if f.Lossless {
+		where += fmt.Sprintf(" AND %s.codec IN %s", table, losslessCodecs)
+	}
+	if f.MinBitrate > 0 {
+		where += fmt.Sprintf(" AND %s.bitrate >= ?", table)
+		params = append(params, f.MinBitrate)
+	}
+
+	return where, params
+}
+
+// audioMediaFile is a MediaFile which could read the audio properties too. The
+// taglib files are such.
+type audioMediaFile interface {
+	MediaFile
+
+	Bitrate() int
+	Samplerate() int
+	Channels() int
+}
+
+// readAudioProperties returns the AudioProperties of the media file at filePath.
+// The bitrate, the sample rate and the number of channels are taken from the file
+// when it could read them. The codec and the bit depth are found by reading the
+// headers of the file at filePath. The extension decides the codec when the
+// headers are not recognized.
+func (lib *LocalLibrary) readAudioProperties(file MediaFile, filePath string) AudioProperties {
+	var props AudioProperties
+
+	if audio, ok := file.(audioMediaFile); ok {
+		props.Bitrate = int64(audio.Bitrate())
+		props.SampleRate = int64(audio.Samplerate())
+		props.Channels = int64(audio.Channels())
+	}
+
+	if probe, err := lib.probeAudioFile(filePath); err == nil {
+		props.Codec = probe.codec
+		props.BitDepth = probe.bitDepth
+		if props.SampleRate == 0 {
+			props.SampleRate = probe.sampleRate
+		}
+		if props.Channels == 0 {
+			props.Channels = probe.channels
+		}
+	}
+
+	if props.Codec == "" {
+		props.Codec = codecFromExtension(filePath)
+	}
+
+	switch props.Codec {
+	case codecFLAC, codecALAC, codecPCM:
+		props.Lossless = true
+	default:
+		props.BitDepth = 0
+	}
+
+	return props
+}
+
+// errUnknownAudio is returned by the probe functions for files which are not in
+// the format they read.
+var errUnknownAudio = errors.New("unknown audio format")
+
+// audioProbe is what could be read from the headers of an audio file. The
+// values which could not be found are zero.
+type audioProbe struct {
+	codec      string
+	sampleRate int64
+	bitDepth   int64
+	channels   int64
+}
+
+func (lib *LocalLibrary) probeAudioFile(filePath string) (audioProbe, error) {
+	fh, err := lib.fs.Open(filePath)
+	if err != nil {
+		return audioProbe{}, err
+	}
+	defer fh.Close()
+
+	rs, ok := fh.(io.ReadSeeker)
+	if !ok {
+		return audioProbe{}, errUnknownAudio
+	}
+
+	return probeAudio(rs)
+}
+
+// probeAudio finds the codec of the audio in r by looking at its headers. It
+// supports FLAC, WAV, MP4, Ogg, WebM and MP3 files.
+func probeAudio(r io.ReadSeeker) (audioProbe, error) {
+	start, err := skipID3v2(r)
+	if err != nil {
+		return audioProbe{}, err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return audioProbe{}, err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return audioProbe{}, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return probeFLAC(r)
+	case bytes.HasPrefix(header, []byte("RIFF")) && string(header[8:12]) == "WAVE":
+		return probeWAV(r)
+	case string(header[4:8]) == "ftyp":
+		return probeMP4(r, 0)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return probeOgg(r)
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return probeWebM(r)
+	case header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 != 0:
+		// An MPEG audio frame. The layer bits are zero for AAC in ADTS.
+		return audioProbe{codec: codecMP3}, nil
+	}
+
+	return audioProbe{}, errUnknownAudio
+}
+
+// skipID3v2 moves r after the ID3v2 tag at its beginning, if there is one. It
+// returns the new position.
+func skipID3v2(r io.ReadSeeker) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[:3]) != "ID3" {
+		return r.Seek(0, io.SeekStart)
+	}
+
+	// The size is a "synchsafe" integer with 7 bits in every byte. It does not
+	// include the header and the footer.
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 |
+		int64(header[9])
+	size += 10
+	if header[5]&0x10 != 0 {
+		size += 10
+	}
+
+	return r.Seek(size, io.SeekStart)
+}
+
+// probeFLAC reads the STREAMINFO block of a FLAC file. It is always the first
+// metadata block.
+func probeFLAC(r io.Reader) (audioProbe, error) {
+	block := make([]byte, 4+4+34)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return audioProbe{}, err
+	}
+
+	if block[4]&0x7F != 0 {
+		return audioProbe{}, fmt.Errorf("FLAC: the first metadata block is not STREAMINFO")
+	}
+
+	return parseFLACStreamInfo(block[8:]), nil
+}
+
+// parseFLACStreamInfo reads the sample rate, the number of channels and the bits
+// per sample from the body of a STREAMINFO block. They are in 20, 3 and 5 bits
+// starting from the 11th byte.
+func parseFLACStreamInfo(info []byte) audioProbe {
+	return audioProbe{
+		codec:      codecFLAC,
+		sampleRate: int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4,
+		channels:   int64(info[12]>>1&0x07) + 1,
+		bitDepth:   (int64(info[12]&0x01)<<4 | int64(info[13])>>4) + 1,
+	}
+}
+
+// probeWAV reads the "fmt " chunk of a WAV file.
+func probeWAV(r io.ReadSeeker) (audioProbe, error) {
+	if _, err := r.Seek(12, io.SeekCurrent); err != nil {
+		return audioProbe{}, err
+	}
+
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return audioProbe{}, err
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		if string(chunk[:4]) != "fmt " {
+			// Chunks are padded to an even number of bytes.
+			if _, err := r.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return audioProbe{}, err
+			}
+			continue
+		}
+
+		if size < 16 {
+			return audioProbe{}, fmt.Errorf("WAV: fmt chunk too short")
+		}
+
+		fmtChunk := make([]byte, min(size, 40))
+		if _, err := io.ReadFull(r, fmtChunk); err != nil {
+			return audioProbe{}, err
+		}
+
+		probe := audioProbe{
+			channels:   int64(binary.LittleEndian.Uint16(fmtChunk[2:])),
+			sampleRate: int64(binary.LittleEndian.Uint32(fmtChunk[4:])),
+			bitDepth:   int64(binary.LittleEndian.Uint16(fmtChunk[14:])),
+		}
+
+		format := binary.LittleEndian.Uint16(fmtChunk)
+		if format == 0xFFFE && len(fmtChunk) >= 26 {
+			// WAVE_FORMAT_EXTENSIBLE has the actual format at the start of
+			// its sub-format GUID.
+			format = binary.LittleEndian.Uint16(fmtChunk[24:])
+		}
+
+		switch format {
+		case 0x0001, 0x0003:
+			probe.codec = codecPCM
+		case 0x0055:
+			probe.codec = codecMP3
+		}
+		return probe, nil
+	}
+}
+
+// mp4Containers are the MP4 boxes on the way to the sample descriptions of the
+// tracks.
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+}
+
+// mp4Codecs are the codecs by the type of the sample entries in MP4 files.
+var mp4Codecs = map[string]string{
+	"mp4a": codecAAC,
+	"alac": codecALAC,
+	"fLaC": codecFLAC,
+	"Opus": codecOpus,
+	".mp3": codecMP3,
+}
+
+// probeMP4 looks for the first audio sample entry in the boxes of an MP4 file
+// from the current position of r until end. The end of the file is used when end
+// is zero.
+func probeMP4(r io.ReadSeeker, end int64) (audioProbe, error) {
+	for {
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return audioProbe{}, err
+		}
+		if end > 0 && pos+8 > end {
+			return audioProbe{}, errUnknownAudio
+		}
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return audioProbe{}, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		name := string(header[4:])
+		headerSize := int64(8)
+
+		if size == 1 {
+			if _, err := io.ReadFull(r, header); err != nil {
+				return audioProbe{}, err
+			}
+			size = int64(binary.BigEndian.Uint64(header))
+			headerSize = 16
+		}
+
+		boxEnd := pos + size
+		if size == 0 {
+			// The box continues until the end of its parent.
+			boxEnd = end
+		} else if size < headerSize {
+			return audioProbe{}, fmt.Errorf("MP4: invalid size of box %q", name)
+		}
+
+		switch {
+		case mp4Containers[name]:
+			if probe, err := probeMP4(r, boxEnd); err == nil {
+				return probe, nil
+			}
+		case name == "stsd":
+			if probe, err := probeMP4SampleEntry(r); err == nil {
+				return probe, nil
+			}
+		}
+
+		// Not found in this box. This could be a video track for example.
+		if boxEnd == 0 {
+			return audioProbe{}, errUnknownAudio
+		}
+		if _, err := r.Seek(boxEnd, io.SeekStart); err != nil {
+			return audioProbe{}, err
+		}
+	}
+}
+
+// probeMP4SampleEntry reads the first sample entry of an "stsd" box. For audio
+// it has the number of channels, the sample size and the sample rate at fixed
+// positions.
+func probeMP4SampleEntry(r io.Reader) (audioProbe, error) {
+	// Version and flags, number of entries, size and type of the first entry
+	// and then the audio sample entry.
+	stsd := make([]byte, 8+8+28)
+	if _, err := io.ReadFull(r, stsd); err != nil {
+		return audioProbe{}, err
+	}
+
+	codec, ok := mp4Codecs[string(stsd[12:16])]
+	if !ok {
+		return audioProbe{}, errUnknownAudio
+	}
+
+	entry := stsd[16:]
+	return audioProbe{
+		codec:      codec,
+		channels:   int64(binary.BigEndian.Uint16(entry[16:])),
+		bitDepth:   int64(binary.BigEndian.Uint16(entry[18:])),
+		sampleRate: int64(binary.BigEndian.Uint32(entry[24:]) >> 16),
+	}, nil
+}
+
+// probeOgg reads the first packet of an Ogg file which identifies the codec.
+func probeOgg(r io.Reader) (audioProbe, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return audioProbe{}, err
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r, segments); err != nil {
+		return audioProbe{}, err
+	}
+
+	var size int
+	for _, segment := range segments {
+		size += int(segment)
+	}
+
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return audioProbe{}, err
+	}
+
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		return audioProbe{codec: codecVorbis}, nil
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		return audioProbe{codec: codecOpus}, nil
+	case bytes.HasPrefix(packet, []byte("\x7fFLAC")) && len(packet) >= 17+34:
+		// The mapping header is followed by "fLaC" and the STREAMINFO block.
+		return parseFLACStreamInfo(packet[17:]), nil
+	}
+
+	return audioProbe{}, errUnknownAudio
+}
+
+// probeWebM looks for the codec IDs of the audio codecs among the first bytes of
+// a WebM file. Its tracks are described before any of the media data.
+func probeWebM(r io.Reader) (audioProbe, error) {
+	head, err := io.ReadAll(io.LimitReader(r, 64*1024))
+	if err != nil {
+		return audioProbe{}, err
+	}
+
+	switch {
+	case bytes.Contains(head, []byte("A_OPUS")):
+		return audioProbe{codec: codecOpus}, nil
+	case bytes.Contains(head, []byte("A_VORBIS")):
+		return audioProbe{codec: codecVorbis}, nil
+	}
+
+	return audioProbe{}, errUnknownAudio
+}
+
+// codecFromExtension returns the codec for files with extensions used for a
+// single codec only.
+func codecFromExtension(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".mp3":
+		return codecMP3
+	case ".flac", ".fla":
+		return codecFLAC
+	case ".opus":
+		return codecOpus
+	default:
+		return ""
+	}
+}
@@ -38,6 +38,10 @@ type BrowseArgs struct {
 	PerPage uint
 	Order   BrowseOrder
 	OrderBy BrowseOrderBy
+
+	// Filter limits the artists and albums to the ones with at least one track
+	// which matches it.
+	Filter AudioFilter
 }
 
 //counterfeiter:generate . Browser
@@ -53,4 +57,6 @@ type Browser interface {
 	// Returns a list of albums for particular page and the number of all albums in the
 	// library.
 	BrowseAlbums(BrowseArgs) ([]Album, int)
+
+	Versioned
 }
@@ -0,0 +1,331 @@
+package library
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// PlayContinueWindow is the longest time between two requests which continue
+	// the same play, for example Range requests after seeking.
+	PlayContinueWindow = 30 * time.Minute
+
+	// PlayRestartWindow is the time after the start of a play during which new
+	// requests from the beginning of the track are still the same play. Players
+	// often request the start of a file more than once.
+	PlayRestartWindow = 30 * time.Second
+)
+
+// playedTrackColumns are the columns selected for every Play. The query must join
+// the tracks as `t`, the albums as `al` and the artists as `at`.
+const playedTrackColumns = `
+	p.id,
+	p.started_at,
+	p.played,
+	p.position,
+	IFNULL(p.client, ''),
+	t.id,
+	t.name,
+	al.name,
+	at.name,
+	at.id,
+	t.number,
+	t.album_id,
+	t.fs_path,
+	IFNULL(t.listens_count, 0),
+	IFNULL(t.duration, 0),
+` + trackDetailsColumns
+
+// Play is a single playing of a track by a user as stored in the listening
+// history.
+type Play struct {
+	ID int64 `json:"id"`
+
+	// PlayedAt is when the play started.
+	PlayedAt time.Time `json:"played_at"`
+
+	// Played is for how long the track has actually been played, in
+	// milliseconds. It is known only for clients which send play events. For
+	// imported plays it is the duration of the track.
+	Played int64 `json:"played"`
+
+	// Position is the last known position in the track, in milliseconds.
+	Position int64 `json:"position"`
+
+	// Client is the device or the program which played the track.
+	Client string `json:"client"`
+
+	Track SearchResult `json:"track"`
+}
+
+// HistoryArgs are the arguments for reading the listening history.
+type HistoryArgs struct {
+	Page    uint
+	PerPage uint
+
+	// Since and Until limit the plays to the ones which started in this period.
+	// Zero values mean no limit.
+	Since time.Time
+	Until time.Time
+}
+
+//counterfeiter:generate . History
+
+// History is the per-user listening history.
+type History interface {
+	// RecordPlay stores that the user is playing the track and returns the ID of
+	// the play. When continued is true the request is for the middle of the track
+	// and the last play of the track is returned if it is recent enough.
+	RecordPlay(userID, trackID int64, client string, continued bool) (int64, error)
+
+	// UpdatePlay sets for how long the track has been played and the position
+	// of the player. counted is true once the play has reached the listen
+	// threshold. Only such plays are counted in the charts.
+	UpdatePlay(playID int64, played, position time.Duration, counted bool) error
+
+	// GetHistory returns a page of the user's plays, newest first, and the
+	// number of all plays matching the arguments.
+	GetHistory(userID int64, args HistoryArgs) ([]Play, int, error)
+
+	// ContinueListening returns the tracks which the user has started but not
+	// finished, most recently played first. Only the last play of every track is
+	// considered.
+	ContinueListening(userID int64, limit int) ([]Play, error)
+
+	// DeleteHistory removes all plays of the user.
+	DeleteHistory(userID int64) error
+}
+
+// RecordPlay implements the History interface.
+func (lib *LocalLibrary) RecordPlay(
+	userID, trackID int64,
+	client string,
+	continued bool,
+) (int64, error) {
+	var playID int64
+
+	// Finding the last play and inserting a new one happen in the same job so
+	// that concurrent requests of the same play are never recorded twice.
+	work := func(db *sql.DB) error {
+		now := time.Now()
+
+		var startedAt, updatedAt int64
+		err := db.QueryRow(`
+			SELECT
+				id, started_at, updated_at
+			FROM
+				plays
+			WHERE
+				user_id = ? AND track_id = ?
+			ORDER BY
+				id DESC
+			LIMIT 1
+		`, userID, trackID).Scan(&playID, &startedAt, &updatedAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("finding last play: %w", err)
+		}
+
+		if err == nil &&
+			(continued && now.Sub(time.Unix(updatedAt, 0)) <= PlayContinueWindow ||
+				!continued && now.Sub(time.Unix(startedAt, 0)) <= PlayRestartWindow) {
+			_, err := db.Exec(`
+				UPDATE plays
+				SET updated_at = ?
+				WHERE id = ?
+			`, now.Unix(), playID)
+			return err
+		}
+
+		res, err := db.Exec(`
+			INSERT INTO
+				plays (user_id, track_id, started_at, updated_at, client)
+			VALUES
+				(?, ?, ?, ?, ?)
+		`, userID, trackID, now.Unix(), now.Unix(), client)
+		if err != nil {
+			return fmt.Errorf("inserting play: %w", err)
+		}
+
+		playID, err = res.LastInsertId()
+		return err
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return 0, err
+	}
+	return playID, nil
+}
+
+// UpdatePlay implements the History interface. The played time never decreases and
+// a counted play stays counted.
+func (lib *LocalLibrary) UpdatePlay(
+	playID int64,
+	played, position time.Duration,
+	counted bool,
+) error {
+	work := func(db *sql.DB) error {
+		_, err := db.Exec(`
+			UPDATE plays
+			SET
+				played = MAX(played, ?),
+				position = ?,
+				counted = MAX(counted, ?),
+				updated_at = ?
+			WHERE
+				id = ?
+		`, played.Milliseconds(), position.Milliseconds(), counted, time.Now().Unix(), playID)
+		return err
+	}
+
+	return lib.executeDBJobAndWait(work)
+}
+
+// GetHistory implements the History interface.
+func (lib *LocalLibrary) GetHistory(userID int64, args HistoryArgs) ([]Play, int, error) {
+	where := "p.user_id = ?"
+	params := []interface{}{userID}
+
+	if !args.Since.IsZero() {
+		where += " AND p.started_at >= ?"
+		params = append(params, args.Since.Unix())
+	}
+	if !args.Until.IsZero() {
+		where += " AND p.started_at < ?"
+		params = append(params, args.Until.Unix())
+	}
+
+	var (
+		output []Play
+		count  int
+	)
+	work := func(db *sql.DB) error {
+		err := db.QueryRow(`
+			SELECT
+				COUNT(*)
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+			WHERE
+				`+where, params...).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("counting plays: %w", err)
+		}
+
+		rows, err := db.Query(`
+			SELECT`+playedTrackColumns+`
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+					LEFT JOIN albums as al ON al.id = t.album_id
+					LEFT JOIN artists as at ON at.id = t.artist_id
+			WHERE
+				`+where+`
+			ORDER BY
+				p.started_at DESC, p.id DESC
+			LIMIT
+				?, ?
+		`, append(params, args.Page*args.PerPage, args.PerPage)...)
+		if err != nil {
+			return fmt.Errorf("querying plays: %w", err)
+		}
+
+		output, err = scanPlays(rows)
+		return err
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, 0, err
+	}
+	return output, count, nil
+}
+
+// ContinueListening implements the History interface. A play is not finished when
+// its position is before the last 5% of the track.
+func (lib *LocalLibrary) ContinueListening(userID int64, limit int) ([]Play, error) {
+	var output []Play
+	work := func(db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT`+playedTrackColumns+`
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+					LEFT JOIN albums as al ON al.id = t.album_id
+					LEFT JOIN artists as at ON at.id = t.artist_id
+			WHERE
+				p.id IN (
+					SELECT MAX(id) FROM plays WHERE user_id = ? GROUP BY track_id
+				) AND
+				p.position > 0 AND
+				(IFNULL(t.duration, 0) = 0 OR p.position < t.duration * 95 / 100)
+			ORDER BY
+				p.updated_at DESC
+			LIMIT
+				?
+		`, userID, limit)
+		if err != nil {
+			return fmt.Errorf("querying unfinished plays: %w", err)
+		}
+
+		output, err = scanPlays(rows)
+		return err
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// DeleteHistory implements the History interface.
+func (lib *LocalLibrary) DeleteHistory(userID int64) error {
+	work := func(db *sql.DB) error {
+		_, err := db.Exec(`
+			DELETE FROM plays
+			WHERE user_id = ?
+		`, userID)
+		return err
+	}
+
+	return lib.executeDBJobAndWait(work)
+}
+
+// scanPlays reads all rows selected with playedTrackColumns and closes them.
+func scanPlays(rows *sql.Rows) ([]Play, error) {
+	defer rows.Close()
+
+	output := []Play{}
+	for rows.Next() {
+		var (
+			play      Play
+			startedAt int64
+		)
+		err := rows.Scan(append([]interface{}{
+			&play.ID,
+			&startedAt,
+			&play.Played,
+			&play.Position,
+			&play.Client,
+			&play.Track.ID,
+			&play.Track.Title,
+			&play.Track.Album,
+			&play.Track.Artist,
+			&play.Track.ArtistID,
+			&play.Track.TrackNumber,
+			&play.Track.AlbumID,
+			&play.Track.Format,
+			&play.Track.View,
+			&play.Track.Duration,
+		}, play.Track.detailsScanDest()...)...)
+		if err != nil {
+			return nil, fmt.Errorf("scanning error: %w", err)
+		}
+
+		play.PlayedAt = time.Unix(startedAt, 0)
+		play.Track.Format = mediaFormatFromFileName(play.Track.Format)
+		output = append(output, play)
+	}
+
+	return output, rows.Err()
+}
@@ -0,0 +1,718 @@
+package library
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The formats of the listening history exports which could be imported.
+const (
+	// ImportFormatLastFM is a CSV file with one scrobble per row. Files with a
+	// header row are read by the names of their columns. Files without one must
+	// have the columns artist, album, title and date.
+	ImportFormatLastFM = "lastfm"
+
+	// ImportFormatListenBrainz is the JSON export of ListenBrainz. Both a JSON
+	// array of listens and one listen per line are accepted.
+	ImportFormatListenBrainz = "listenbrainz"
+)
+
+const (
+	// importMinSimilarity is how similar two names must be in order to be
+	// considered the same when they are not equal. It is between 0 and 1.
+	importMinSimilarity = 0.85
+
+	importReasonInvalid = "invalid row"
+	importReasonNoMatch = "no matching track"
+)
+
+// importClients are stored as the client of the imported plays.
+var importClients = map[string]string{
+	ImportFormatLastFM:       "Last.fm import",
+	ImportFormatListenBrainz: "ListenBrainz import",
+}
+
+var (
+	// ErrUnknownImportFormat is returned by ImportHistory for formats other
+	// than ImportFormatLastFM and ImportFormatListenBrainz.
+	ErrUnknownImportFormat = errors.New("unknown import format")
+
+	// ErrInvalidExport is returned by ImportHistory when the export could not
+	// be read in its format at all.
+	ErrInvalidExport = errors.New("invalid export")
+)
+
+// ImportedListen is a single row of a listening history export.
+type ImportedListen struct {
+	// Row is the number of the row in a CSV file, counting the header, or the
+	// position of the listen in a JSON file. It starts from 1.
+	Row int `json:"row"`
+
+	Artist     string    `json:"artist"`
+	Album      string    `json:"album,omitempty"`
+	Title      string    `json:"title"`
+	ListenedAt time.Time `json:"listened_at"`
+}
+
+// UnmatchedListen is a row of an export which has not been imported.
+type UnmatchedListen struct {
+	ImportedListen
+
+	// Reason is "invalid row" when the row could not be read or "no matching
+	// track" when no track in the library is similar enough.
+	Reason string `json:"reason"`
+}
+
+// ImportResult reports what has been imported from an export.
+type ImportResult struct {
+	Rows     int `json:"rows"`
+	Imported int `json:"imported"`
+
+	// Duplicates are the rows which are already in the history, for example
+	// from an earlier import of the same file.
+	Duplicates int `json:"duplicates"`
+
+	Unmatched []UnmatchedListen `json:"unmatched"`
+}
+
+//counterfeiter:generate . HistoryImporter
+
+// HistoryImporter imports listening history exported from other services.
+type HistoryImporter interface {
+	// ImportHistory reads the export in format and adds its rows which match
+	// tracks in the library to the user's history and to the listen counts of
+	// the tracks.
+	ImportHistory(userID int64, export io.Reader, format string) (ImportResult, error)
+}
+
+// ImportHistory implements the HistoryImporter interface. The artists, albums and
+// titles are compared after removing letter case, diacritics and punctuation.
+// Titles also match without the parts in brackets and after " - " which are
+// usually versions such as "(Remastered 2011)". Small differences in the names
+// are tolerated.
+func (lib *LocalLibrary) ImportHistory(
+	userID int64,
+	export io.Reader,
+	format string,
+) (ImportResult, error) {
+	client, ok := importClients[format]
+	if !ok {
+		return ImportResult{}, ErrUnknownImportFormat
+	}
+
+	var (
+		listens []ImportedListen
+		err     error
+	)
+	if format == ImportFormatLastFM {
+		listens, err = parseLastFMExport(export)
+	} else {
+		listens, err = parseListenBrainzExport(export)
+	}
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("%w: %s", ErrInvalidExport, err)
+	}
+
+	var index *importIndex
+	err = lib.executeDBJobAndWait(func(db *sql.DB) error {
+		index, err = loadImportIndex(db)
+		return err
+	})
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	result := ImportResult{
+		Rows:      len(listens),
+		Unmatched: []UnmatchedListen{},
+	}
+
+	type matchedListen struct {
+		listen  ImportedListen
+		trackID int64
+	}
+	var matched []matchedListen
+
+	for _, listen := range listens {
+		if listen.Title == "" || listen.Artist == "" || listen.ListenedAt.IsZero() {
+			result.Unmatched = append(result.Unmatched, UnmatchedListen{
+				ImportedListen: listen,
+				Reason:         importReasonInvalid,
+			})
+			continue
+		}
+
+		trackID, ok := index.match(listen)
+		if !ok {
+			result.Unmatched = append(result.Unmatched, UnmatchedListen{
+				ImportedListen: listen,
+				Reason:         importReasonNoMatch,
+			})
+			continue
+		}
+
+		matched = append(matched, matchedListen{listen: listen, trackID: trackID})
+	}
+
+	work := func(db *sql.DB) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		counts := make(map[int64]int64)
+		for _, m := range matched {
+			startedAt := m.listen.ListenedAt.Unix()
+
+			var existing int
+			err := tx.QueryRow(`
+				SELECT
+					COUNT(*)
+				FROM
+					plays
+				WHERE
+					user_id = ? AND track_id = ? AND started_at = ?
+			`, userID, m.trackID, startedAt).Scan(&existing)
+			if err != nil {
+				return fmt.Errorf("finding duplicate plays: %w", err)
+			}
+			if existing > 0 {
+				result.Duplicates++
+				continue
+			}
+
+			// The imported plays have been scrobbled so they are listens. How
+			// long they have been played is not known.
+			_, err = tx.Exec(`
+				INSERT INTO
+					plays (user_id, track_id, started_at, updated_at, client, counted, played)
+				VALUES
+					(?, ?, ?, ?, ?, 1, (
+						SELECT IFNULL(duration, 0) FROM tracks WHERE id = ?
+					))
+			`, userID, m.trackID, startedAt, startedAt, client, m.trackID)
+			if err != nil {
+				return fmt.Errorf("inserting play: %w", err)
+			}
+
+			counts[m.trackID]++
+			result.Imported++
+		}
+
+		for trackID, count := range counts {
+			_, err := tx.Exec(`
+				UPDATE tracks
+				SET listens_count = IFNULL(listens_count, 0) + ?
+				WHERE id = ?
+			`, count, trackID)
+			if err != nil {
+				return fmt.Errorf("updating listen count: %w", err)
+			}
+		}
+
+		return tx.Commit()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return ImportResult{}, err
+	}
+	if result.Imported > 0 {
+		lib.changed()
+	}
+	return result, nil
+}
+
+// parseLastFMExport reads a CSV export of Last.fm scrobbles. Rows which could not
+// be read are returned with zero ListenedAt.
+func parseLastFMExport(export io.Reader) ([]ImportedListen, error) {
+	reader := csv.NewReader(export)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	// Without a header the columns are artist, album, title and date.
+	columns := map[string]int{"artist": 0, "album": 1, "title": 2, "date": 3}
+
+	var listens []ImportedListen
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading CSV: %w", err)
+		}
+
+		if row == 1 {
+			if header, ok := lastFMHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+
+		field := func(name string) string {
+			col, ok := columns[name]
+			if !ok || col >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[col])
+		}
+
+		listens = append(listens, ImportedListen{
+			Row:        row,
+			Artist:     field("artist"),
+			Album:      field("album"),
+			Title:      field("title"),
+			ListenedAt: parseListenTime(field("date")),
+		})
+	}
+
+	return listens, nil
+}
+
+// lastFMHeader returns the columns of a Last.fm export by name when the record
+// is a header row.
+func lastFMHeader(record []string) (map[string]int, bool) {
+	names := map[string]string{
+		"artist":      "artist",
+		"artist_name": "artist",
+		"album":       "album",
+		"album_name":  "album",
+		"release":     "album",
+		"track":       "title",
+		"track_name":  "title",
+		"title":       "title",
+		"name":        "title",
+		"uts":         "date",
+		"date":        "date",
+		"date_uts":    "date",
+		"utc_time":    "date",
+		"time":        "date",
+		"timestamp":   "date",
+	}
+
+	columns := make(map[string]int)
+	for col, value := range record {
+		name, ok := names[strings.ToLower(strings.TrimSpace(value))]
+		if !ok {
+			continue
+		}
+
+		// Some exports have the time both as a Unix timestamp and as text.
+		// The timestamp comes first and is preferred.
+		if _, seen := columns[name]; !seen {
+			columns[name] = col
+		}
+	}
+
+	_, hasArtist := columns["artist"]
+	_, hasTitle := columns["title"]
+	return columns, hasArtist && hasTitle
+}
+
+// listenTimeLayouts are the formats of the times in Last.fm exports other than
+// Unix timestamps.
+var listenTimeLayouts = []string{
+	"02 Jan 2006 15:04",
+	"2 Jan 2006 15:04",
+	"02 Jan 2006, 15:04",
+	"2 Jan 2006, 15:04",
+	time.DateTime,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+// parseListenTime returns the time from an export. The times without a time zone
+// are in UTC. It returns a zero time when the value could not be parsed.
+func parseListenTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil && unix > 0 {
+		return time.Unix(unix, 0)
+	}
+
+	for _, layout := range listenTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// listenBrainzExportListen is a listen in the ListenBrainz export.
+type listenBrainzExportListen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName  string `json:"artist_name"`
+		TrackName   string `json:"track_name"`
+		ReleaseName string `json:"release_name"`
+	} `json:"track_metadata"`
+}
+
+func (l listenBrainzExportListen) imported(row int) ImportedListen {
+	listen := ImportedListen{
+		Row:    row,
+		Artist: strings.TrimSpace(l.TrackMetadata.ArtistName),
+		Album:  strings.TrimSpace(l.TrackMetadata.ReleaseName),
+		Title:  strings.TrimSpace(l.TrackMetadata.TrackName),
+	}
+	if l.ListenedAt > 0 {
+		listen.ListenedAt = time.Unix(l.ListenedAt, 0)
+	}
+	return listen
+}
+
+// parseListenBrainzExport reads a ListenBrainz export. It is either a JSON array
+// of listens or has a listen per line.
+func parseListenBrainzExport(export io.Reader) ([]ImportedListen, error) {
+	buffered := bufio.NewReader(export)
+	dec := json.NewDecoder(buffered)
+
+	var listens []ImportedListen
+
+	first, err := peekNonSpace(buffered)
+	if errors.Is(err, io.EOF) {
+		return listens, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if first != '[' {
+		for row := 1; ; row++ {
+			var listen listenBrainzExportListen
+			err := dec.Decode(&listen)
+			if errors.Is(err, io.EOF) {
+				return listens, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("decoding listen %d: %w", row, err)
+			}
+			listens = append(listens, listen.imported(row))
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+
+	for row := 1; dec.More(); row++ {
+		var listen listenBrainzExportListen
+		if err := dec.Decode(&listen); err != nil {
+			return nil, fmt.Errorf("decoding listen %d: %w", row, err)
+		}
+		listens = append(listens, listen.imported(row))
+	}
+
+	return listens, nil
+}
+
+// peekNonSpace returns the first byte which is not white space without consuming
+// it.
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !unicode.IsSpace(rune(b[0])) {
+			return b[0], nil
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// importCandidate is a track from the library with its names normalized for
+// comparing them with the rows of an export.
+type importCandidate struct {
+	id        int64
+	title     string
+	baseTitle string
+	artist    string
+	album     string
+}
+
+// importIndex is all tracks of the library indexed by their titles and artists.
+type importIndex struct {
+	byTitle  map[string][]*importCandidate
+	byArtist map[string][]*importCandidate
+
+	// artistScores caches the artists of the library which match an artist of
+	// the export, together with their scores. Exports repeat the same artists
+	// on many rows so each of them is compared with the library only once.
+	artistScores map[string]map[string]int
+}
+
+func loadImportIndex(db *sql.DB) (*importIndex, error) {
+	rows, err := db.Query(`
+		SELECT
+			t.id,
+			t.name,
+			IFNULL(at.name, ''),
+			IFNULL(al.name, '')
+		FROM
+			tracks as t
+				LEFT JOIN artists as at ON at.id = t.artist_id
+				LEFT JOIN albums as al ON al.id = t.album_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying tracks: %w", err)
+	}
+	defer rows.Close()
+
+	index := &importIndex{
+		byTitle:      make(map[string][]*importCandidate),
+		byArtist:     make(map[string][]*importCandidate),
+		artistScores: make(map[string]map[string]int),
+	}
+
+	for rows.Next() {
+		var title, artist, album string
+		c := &importCandidate{}
+		if err := rows.Scan(&c.id, &title, &artist, &album); err != nil {
+			return nil, fmt.Errorf("scanning error: %w", err)
+		}
+
+		c.title = normalizeName(title)
+		c.baseTitle = baseTitle(title)
+		c.artist = normalizeName(artist)
+		c.album = normalizeName(album)
+
+		index.byTitle[c.title] = append(index.byTitle[c.title], c)
+		if c.baseTitle != c.title {
+			index.byTitle[c.baseTitle] = append(index.byTitle[c.baseTitle], c)
+		}
+		index.byArtist[c.artist] = append(index.byArtist[c.artist], c)
+	}
+
+	return index, rows.Err()
+}
+
+// match returns the track which is the best match for the listen. The artist has
+// to match in any case. Tracks with the same title are preferred and the album
+// decides between otherwise equal matches.
+func (idx *importIndex) match(listen ImportedListen) (int64, bool) {
+	var (
+		title  = normalizeName(listen.Title)
+		base   = baseTitle(listen.Title)
+		artist = normalizeName(listen.Artist)
+		album  = normalizeName(listen.Album)
+
+		best      *importCandidate
+		bestScore int
+	)
+
+	artistScores := idx.matchingArtists(artist)
+	if len(artistScores) == 0 {
+		return 0, false
+	}
+
+	consider := func(c *importCandidate, titleScore int) {
+		artistScore := artistScores[c.artist]
+		if artistScore == 0 {
+			return
+		}
+
+		score := titleScore + artistScore
+		if album != "" && album == c.album {
+			score++
+		}
+
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+
+	for _, c := range idx.byTitle[title] {
+		if c.title == title {
+			consider(c, 3)
+		} else {
+			consider(c, 2)
+		}
+	}
+	if base != title {
+		for _, c := range idx.byTitle[base] {
+			consider(c, 2)
+		}
+	}
+
+	if best != nil {
+		return best.id, true
+	}
+
+	// There is no track with the same title. Look for similar titles among the
+	// tracks of the artist.
+	for name := range artistScores {
+		for _, c := range idx.byArtist[name] {
+			if similar(base, c.baseTitle) {
+				consider(c, 1)
+			}
+		}
+	}
+
+	if best == nil {
+		return 0, false
+	}
+	return best.id, true
+}
+
+// matchingArtists returns the artists of the library which match the normalized
+// artist with their scores from nameScore.
+func (idx *importIndex) matchingArtists(artist string) map[string]int {
+	if scores, ok := idx.artistScores[artist]; ok {
+		return scores
+	}
+
+	scores := make(map[string]int)
+	for name := range idx.byArtist {
+		if score := nameScore(artist, name); score > 0 {
+			scores[name] = score
+		}
+	}
+
+	idx.artistScores[artist] = scores
+	return scores
+}
+
+// nameScore returns how well two normalized names match. It is 3 for equal names,
+// 2 when one contains the other as whole words, for example "artist" and "artist
+// and someone", 1 for similar names and 0 otherwise.
+func nameScore(a, b string) int {
+	switch {
+	case a == "" || b == "":
+		return 0
+	case a == b:
+		return 3
+	case strings.Contains(" "+a+" ", " "+b+" ") || strings.Contains(" "+b+" ", " "+a+" "):
+		return 2
+	case similar(a, b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// normalizeName returns the name in lower case, without diacritics and with all
+// punctuation replaced by single spaces. "&" becomes "and" and a leading "the"
+// is removed.
+func normalizeName(name string) string {
+	var sb strings.Builder
+	space := true
+
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case r == 'đ':
+			r = 'd'
+		case r == '&':
+			if !space {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString("and ")
+			space = true
+			continue
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+			space = false
+		} else if !space {
+			sb.WriteByte(' ')
+			space = true
+		}
+	}
+
+	normalized := strings.TrimSpace(sb.String())
+	return strings.TrimPrefix(normalized, "the ")
+}
+
+// baseTitle returns the normalized title without the parts which usually describe
+// a version of the track: everything in brackets, after " - " and after "feat.".
+func baseTitle(title string) string {
+	var sb strings.Builder
+	depth := 0
+	for _, r := range title {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth > 0 {
+				depth--
+			}
+		default:
+			if depth == 0 {
+				sb.WriteRune(r)
+			}
+		}
+	}
+
+	base, _, _ := strings.Cut(sb.String(), " - ")
+	base = normalizeName(base)
+
+	for _, feat := range []string{" feat ", " ft ", " featuring "} {
+		if i := strings.Index(base+" ", feat); i > 0 {
+			base = base[:i]
+		}
+	}
+
+	if base == "" {
+		return normalizeName(title)
+	}
+	return base
+}
+
+// similar returns true when the strings are at least importMinSimilarity similar.
+// The distance between strings is at least the difference of their lengths so
+// most of the strings are told apart without computing it.
+func similar(a, b string) bool {
+	la, lb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if float64(max(la, lb)-min(la, lb)) > (1-importMinSimilarity)*float64(max(la, lb)) {
+		return false
+	}
+
+	return similarity(a, b) >= importMinSimilarity
+}
+
+// similarity returns how similar two strings are, from 0 for completely different
+// to 1 for equal ones. It is based on the Levenshtein distance between them.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
@@ -38,6 +38,19 @@ type SearchResult struct {
 
 	// Duration is the track length in milliseconds.
 	Duration int64 `json:"duration"`
+
+	TrackMetadata
+	AudioProperties
+}
+
+// trackDetailsColumns are the columns selected for the TrackMetadata and the
+// AudioProperties of a SearchResult in the order of detailsScanDest. The query
+// must name the tracks table `t`.
+const trackDetailsColumns = trackMetadataColumns + "," + audioPropertiesColumns
+
+// detailsScanDest returns the destinations for scanning trackDetailsColumns.
+func (res *SearchResult) detailsScanDest() []interface{} {
+	return append(res.TrackMetadata.scanDest(), res.AudioProperties.scanDest()...)
 }
 
 // Artist represents an artist from the database
@@ -51,6 +64,22 @@ type Album struct {
 	ID     int64  `json:"album_id"`
 	Name   string `json:"album"`
 	Artist string `json:"artist"`
+
+	// Compilation is true for albums with tracks by various artists. See
+	// albumCompilationColumn.
+	Compilation bool `json:"compilation"`
+
+	// Year, Genre and MusicBrainzAlbumID are taken from the tags of the album's
+	// tracks. They are empty when none of the tracks has them.
+	Year               int64  `json:"year"`
+	Genre              string `json:"genre"`
+	MusicBrainzAlbumID string `json:"musicbrainz_album_id"`
+}
+
+// SearchArgs are the arguments of the Library's Search method.
+type SearchArgs struct {
+	Query  string
+	Filter AudioFilter
 }
 
 // Library represents the media library which is played using the HTTPMS.
@@ -65,13 +94,18 @@ type Library interface {
 
 	// Search the library using a search string. It will match against Artist, Album
 	// and Title. Will OR the results. So it is "return anything which Artist matches or
-	// Album matches or Title matches"
-	Search(string) []SearchResult
+	// Album matches or Title matches". Only the tracks which match the filter of
+	// the SearchArgs are returned.
+	Search(SearchArgs) []SearchResult
 
 	// Returns the real filesystem path. Requires the media ID.
 	GetFilePath(int64) string
 
-	// Returns search result will all the files of this album
+	// Returns the meta data of a single track. Requires the media ID.
+	GetTrack(int64) (SearchResult, error)
+
+	// Returns search result will all the files of this album. They are ordered
+	// by disc and then by track number.
 	GetAlbumFiles(int64) []SearchResult
 
 	// Starts a full library scan. Will scan all paths if
@@ -97,4 +131,6 @@ type Library interface {
 	// Frees all resources this library object is using.
 	// Any operations (except Truncate) on closed library will result in panic.
 	Close()
+
+	Versioned
 }
@@ -24,8 +24,26 @@ func (lib *LocalLibrary) BrowseArtists(args BrowseArgs) ([]Artist, int) {
 		order = "DESC"
 	}
 
-	artistsCount := lib.getTableSize("artists")
-	var output []Artist
+	var (
+		artistsCount int
+		output       []Artist
+	)
+
+	// Without a filter the artists without tracks are listed too.
+	where := "1 = 1"
+	var params []interface{}
+
+	if args.Filter == (AudioFilter{}) {
+		artistsCount = lib.getTableSize("artists")
+	} else {
+		var filter string
+		filter, params = args.Filter.where("f")
+		where = fmt.Sprintf(
+			"ar.id IN (SELECT f.artist_id FROM tracks f WHERE %s)",
+			filter,
+		)
+		artistsCount = lib.countFilteredTracks("artist_id", args.Filter)
+	}
 
 	work := func(db *sql.DB) error {
 		rows, err := db.Query(fmt.Sprintf(`
@@ -34,11 +52,13 @@ func (lib *LocalLibrary) BrowseArtists(args BrowseArgs) ([]Artist, int) {
                 ar.name
             FROM
                 artists ar
+            WHERE
+                %s
             ORDER BY
                 %s %s
             LIMIT
                 ?, ?
-        `, orderBy, order), page*perPage, perPage)
+        `, where, orderBy, order), append(params, page*perPage, perPage)...)
 
 		if err != nil {
 			return err
@@ -75,18 +95,30 @@ func (lib *LocalLibrary) BrowseAlbums(args BrowseArgs) ([]Album, int) {
 		albumsCount int
 	)
 
+	filter, params := args.Filter.where("f")
+
+	where := "1 = 1"
+	if args.Filter != (AudioFilter{}) {
+		where = fmt.Sprintf(
+			"tr.album_id IN (SELECT f.album_id FROM tracks f WHERE %s)",
+			filter,
+		)
+	}
+
 	work := func(db *sql.DB) error {
 		smt, err := db.Prepare(`
             SELECT
-                COUNT(DISTINCT tr.album_id) as cnt
+                COUNT(DISTINCT f.album_id) as cnt
             FROM
-                tracks tr
+                tracks f
+            WHERE
+                ` + filter + `
         `)
 
 		if err != nil {
 			log.Printf("Query for getting albums count not prepared: %s\n", err)
 		} else {
-			err = smt.QueryRow().Scan(&albumsCount)
+			err = smt.QueryRow(params...).Scan(&albumsCount)
 
 			if err != nil {
 				log.Printf("Query for getting albums count not successful: %s\n", err)
@@ -108,23 +140,26 @@ func (lib *LocalLibrary) BrowseAlbums(args BrowseArgs) ([]Album, int) {
             SELECT
                 al.id,
                 al.name as album_name,
-                CASE WHEN COUNT(DISTINCT tr.artist_id) = 1
-                THEN ar.name
-                ELSE "Various Artists"
-                END AS arist_name
+                `+albumArtistColumn+` AS arist_name,
+                `+albumCompilationColumn+` AS compilation,
+                MAX(tr.year),
+                MAX(tr.genre),
+                MAX(tr.musicbrainz_album_id)
             FROM
                 tracks tr
                 LEFT JOIN
                     albums al ON al.id = tr.album_id
                 LEFT JOIN
                     artists ar ON ar.id = tr.artist_id
+            WHERE
+                %s
             GROUP BY
                 tr.album_id
             ORDER BY
                 %s %s
             LIMIT
                 ?, ?
-        `, orderBy, order), page*perPage, perPage)
+        `, where, orderBy, order), append(params, page*perPage, perPage)...)
 
 		if err != nil {
 			return err
@@ -133,7 +168,9 @@ func (lib *LocalLibrary) BrowseAlbums(args BrowseArgs) ([]Album, int) {
 		defer rows.Close()
 		for rows.Next() {
 			var res Album
-			if err := rows.Scan(&res.ID, &res.Name, &res.Artist); err != nil {
+			err := rows.Scan(&res.ID, &res.Name, &res.Artist, &res.Compilation,
+				&res.Year, &res.Genre, &res.MusicBrainzAlbumID)
+			if err != nil {
 				return fmt.Errorf("scanning db failed: %w", err)
 			}
 			output = append(output, res)
@@ -150,6 +187,36 @@ func (lib *LocalLibrary) BrowseAlbums(args BrowseArgs) ([]Album, int) {
 	return output, albumsCount
 }
 
+// countFilteredTracks returns the number of different values of the column of the
+// tracks which match the filter.
+func (lib *LocalLibrary) countFilteredTracks(column string, filter AudioFilter) int {
+	var count int
+
+	where, params := filter.where("f")
+	work := func(db *sql.DB) error {
+		err := db.QueryRow(fmt.Sprintf(`
+            SELECT
+                COUNT(DISTINCT f.%s) as cnt
+            FROM
+                tracks f
+            WHERE
+                %s
+        `, column, where), params...).Scan(&count)
+		if err != nil {
+			log.Printf("Query for getting filtered %s count not successful: %s\n",
+				column, err)
+		}
+
+		return nil
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		log.Printf("Error getting filtered count query: %s", err)
+	}
+
+	return count
+}
+
 func (lib *LocalLibrary) getTableSize(table string) int {
 	var count int
 
@@ -52,6 +52,9 @@ var (
 	// ErrArtistNotFound is returned when no artist could be found for particular operation.
 	ErrArtistNotFound = errors.New("Artist Not Found")
 
+	// ErrTrackNotFound is returned when no track could be found for particular operation.
+	ErrTrackNotFound = errors.New("Track Not Found")
+
 	// ErrArtworkNotFound is returned when no artwork can be found for particular album.
 	ErrArtworkNotFound = NewArtworkError("Artwork Not Found")
 
@@ -123,6 +126,18 @@ type LocalLibrary struct {
 
 	// runningRescan shows that at the moment a complete rescan is running.
 	runningRescan bool
+
+	// rescanLock guards rescanPending.
+	rescanLock sync.Mutex
+
+	// rescanPending shows that the tracks which are already in the database must
+	// have their meta data read again after the next scan. It is set when a
+	// migration adds information which is only read while adding files. It is
+	// stored in the database too so that an interrupted rescan is started again.
+	rescanPending bool
+
+	// version is changed whenever the tracks, albums or artists change.
+	version *libraryVersion
 }
 
 // Close closes the database connection. It is safe to call it as many times as you want.
@@ -143,8 +158,9 @@ func (lib *LocalLibrary) AddLibraryPath(path string) {
 }
 
 // Search searches in the library. Will match against the track's name, artist and album.
-func (lib *LocalLibrary) Search(searchTerm string) []SearchResult {
-	searchTerm = fmt.Sprintf("%%%s%%", searchTerm)
+func (lib *LocalLibrary) Search(args SearchArgs) []SearchResult {
+	searchTerm := fmt.Sprintf("%%%s%%", args.Query)
+	filter, params := args.Filter.where("t")
 
 	var output []SearchResult
 	work := func(db *sql.DB) error {
@@ -159,18 +175,21 @@ func (lib *LocalLibrary) Search(searchTerm string) []SearchResult {
 				t.album_id as album_id,
 				t.fs_path as fs_path,
 				t.listens_count as view,
-				t.duration as duration
+				t.duration as duration,
+				`+trackDetailsColumns+`
 			FROM
 				tracks as t
 					LEFT JOIN albums as al ON al.id = t.album_id
 					LEFT JOIN artists as at ON at.id = t.artist_id
 			WHERE
-				t.name LIKE ? OR
-				al.name LIKE ? OR
-				at.name LIKE ?
+				(
+					t.name LIKE ? OR
+					al.name LIKE ? OR
+					at.name LIKE ?
+				) AND `+filter+`
 			ORDER BY
-				al.name, t.number
-		`, searchTerm, searchTerm, searchTerm)
+				al.name, t.disc, t.number
+		`, append([]interface{}{searchTerm, searchTerm, searchTerm}, params...)...)
 		if err != nil {
 			log.Printf("Query not successful: %s\n", err.Error())
 			return nil
@@ -180,9 +199,9 @@ func (lib *LocalLibrary) Search(searchTerm string) []SearchResult {
 		for rows.Next() {
 			var res SearchResult
 
-			err := rows.Scan(&res.ID, &res.Title, &res.Album, &res.Artist,
-				&res.ArtistID, &res.TrackNumber, &res.AlbumID, &res.Format,
-				&res.View, &res.Duration)
+			err := rows.Scan(append([]interface{}{&res.ID, &res.Title, &res.Album,
+				&res.Artist, &res.ArtistID, &res.TrackNumber, &res.AlbumID,
+				&res.Format, &res.View, &res.Duration}, res.detailsScanDest()...)...)
 			if err != nil {
 				log.Printf("Error scanning search result: %s\n", err)
 				continue
@@ -236,6 +255,48 @@ func (lib *LocalLibrary) GetFilePath(ID int64) string {
 	return filePath
 }
 
+// GetTrack satisfies the Library interface. It returns ErrTrackNotFound when
+// there is no track with this ID.
+func (lib *LocalLibrary) GetTrack(trackID int64) (SearchResult, error) {
+	var res SearchResult
+	work := func(db *sql.DB) error {
+		err := db.QueryRow(`
+			SELECT
+				t.id as track_id,
+				t.name as track,
+				al.name as album,
+				at.name as artist,
+				at.id as artist_id,
+				t.number as track_number,
+				t.album_id as album_id,
+				t.fs_path as fs_path,
+				t.listens_count as view,
+				t.duration as duration,
+				`+trackDetailsColumns+`
+			FROM
+				tracks as t
+					LEFT JOIN albums as al ON al.id = t.album_id
+					LEFT JOIN artists as at ON at.id = t.artist_id
+			WHERE
+				t.id = ?
+		`, trackID).Scan(append([]interface{}{&res.ID, &res.Title, &res.Album,
+			&res.Artist, &res.ArtistID, &res.TrackNumber, &res.AlbumID,
+			&res.Format, &res.View, &res.Duration}, res.detailsScanDest()...)...)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTrackNotFound
+		} else if err != nil {
+			return fmt.Errorf("querying track: %w", err)
+		}
+
+		res.Format = mediaFormatFromFileName(res.Format)
+		return nil
+	}
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
 // GetAlbumFiles satisfies the Library interface
 func (lib *LocalLibrary) GetAlbumFiles(albumID int64) []SearchResult {
 	var output []SearchResult
@@ -249,7 +310,9 @@ func (lib *LocalLibrary) GetAlbumFiles(albumID int64) []SearchResult {
 				at.id as artist_id,
 				t.number as track_number,
 				t.album_id as album_id,
-				t.fs_path as fs_path
+				t.fs_path as fs_path,
+				t.duration as duration,
+				`+trackDetailsColumns+`
 			FROM
 				tracks as t
 					LEFT JOIN albums as al ON al.id = t.album_id
@@ -257,7 +320,7 @@ func (lib *LocalLibrary) GetAlbumFiles(albumID int64) []SearchResult {
 			WHERE
 				t.album_id = ?
 			ORDER BY
-				al.name, t.number
+				al.name, t.disc, t.number
 		`, albumID)
 		if err != nil {
 			log.Printf("Query not successful: %s\n", err.Error())
@@ -267,7 +330,7 @@ func (lib *LocalLibrary) GetAlbumFiles(albumID int64) []SearchResult {
 		defer rows.Close()
 		for rows.Next() {
 			var res SearchResult
-			err := rows.Scan(
+			err := rows.Scan(append([]interface{}{
 				&res.ID,
 				&res.Title,
 				&res.Album,
@@ -276,7 +339,8 @@ func (lib *LocalLibrary) GetAlbumFiles(albumID int64) []SearchResult {
 				&res.TrackNumber,
 				&res.AlbumID,
 				&res.Format,
-			)
+				&res.Duration,
+			}, res.detailsScanDest()...)...)
 			if err != nil {
 				return fmt.Errorf("scanning error: %w", err)
 			}
@@ -321,6 +385,7 @@ func (lib *LocalLibrary) removeFile(filePath string) {
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		log.Printf("Error executing remove file db work: %s", err)
 	}
+	lib.changed()
 }
 
 // Removes files which belong in this directory from the library.
@@ -344,6 +409,7 @@ func (lib *LocalLibrary) removeDirectory(dirPath string) {
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		log.Printf("Error executing remove dir db work: %s", err)
 	}
+	lib.changed()
 }
 
 // AddMedia adds a file specified by its file system name to the library. Will create the
@@ -418,11 +484,17 @@ func (lib *LocalLibrary) insertMediaIntoDatabase(file MediaFile, filePath string
 		return err
 	}
 
-	fileDir := filepath.Dir(filePath)
+	meta := lib.readTrackMetadata(file, filePath)
 
-	album := strings.TrimSpace(file.Album())
-	albumID, err := lib.setAlbumID(album, fileDir)
+	// The discs of a multi-disc album are one album even when they are in
+	// different directories or their names have a disc suffix.
+	albumDir, dirDisc := albumLocation(filepath.Dir(filePath))
+	album, nameDisc := albumName(strings.TrimSpace(file.Album()))
+	if meta.Disc == 0 {
+		meta.Disc = max(nameDisc, dirDisc)
+	}
 
+	albumID, err := lib.setAlbumID(album, meta.AlbumArtist, albumDir)
 	if err != nil {
 		return err
 	}
@@ -440,6 +512,8 @@ func (lib *LocalLibrary) insertMediaIntoDatabase(file MediaFile, filePath string
 		artistID,
 		albumID,
 		file.Length().Milliseconds(),
+		meta,
+		lib.readAudioProperties(file, filePath),
 	)
 	return err
 }
@@ -520,6 +594,7 @@ func (lib *LocalLibrary) setArtistID(artist string) (int64, error) {
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		return 0, err
 	}
+	lib.changed()
 
 	newID, err := lib.GetArtistID(artist)
 	if err != nil {
@@ -545,9 +620,14 @@ func (lib *LocalLibrary) setArtistID(artist string) (int64, error) {
 	return newID, nil
 }
 
-// GetAlbumID returns the id for this album. When missing or on error
-// returns that error.
-func (lib *LocalLibrary) GetAlbumID(album string, fsPath string) (int64, error) {
+// GetAlbumID returns the id for this album by this album artist. The album
+// artist is empty for albums without one. When missing or on error returns that
+// error.
+func (lib *LocalLibrary) GetAlbumID(
+	album string,
+	albumArtist string,
+	fsPath string,
+) (int64, error) {
 	var albumID int64
 
 	work := func(db *sql.DB) error {
@@ -558,7 +638,8 @@ func (lib *LocalLibrary) GetAlbumID(album string, fsPath string) (int64, error)
 				albums
 			WHERE
 				name = ? AND
-				fs_path = ?
+				fs_path = ? AND
+				album_artist = ?
 		`)
 		if err != nil {
 			return err
@@ -567,7 +648,7 @@ func (lib *LocalLibrary) GetAlbumID(album string, fsPath string) (int64, error)
 		defer smt.Close()
 
 		var id int64
-		err = smt.QueryRow(album, fsPath).Scan(&id)
+		err = smt.QueryRow(album, fsPath, albumArtist).Scan(&id)
 		if err != nil {
 			return err
 		}
@@ -584,13 +665,18 @@ func (lib *LocalLibrary) GetAlbumID(album string, fsPath string) (int64, error)
 
 // Sets a new ID for this album if it is new to the library. If not, returns
 // its current id. Albums with the same name but by different locations need to have
-// separate IDs hence the fsPath parameter.
-func (lib *LocalLibrary) setAlbumID(album string, fsPath string) (int64, error) {
+// separate IDs hence the fsPath parameter. The same goes for albums with the same
+// name by different album artists in the same directory.
+func (lib *LocalLibrary) setAlbumID(
+	album string,
+	albumArtist string,
+	fsPath string,
+) (int64, error) {
 	if len(album) < 1 {
 		album = UnknownLabel
 	}
 
-	id, err := lib.GetAlbumID(album, fsPath)
+	id, err := lib.GetAlbumID(album, albumArtist, fsPath)
 	if err == nil {
 		return id, nil
 	}
@@ -599,9 +685,9 @@ func (lib *LocalLibrary) setAlbumID(album string, fsPath string) (int64, error)
 	work := func(db *sql.DB) error {
 		stmt, err := db.Prepare(`
 				INSERT INTO
-					albums (name, fs_path)
+					albums (name, fs_path, album_artist)
 				VALUES
-					(?, ?)
+					(?, ?, ?)
 		`)
 		if err != nil {
 			return err
@@ -609,7 +695,7 @@ func (lib *LocalLibrary) setAlbumID(album string, fsPath string) (int64, error)
 
 		defer stmt.Close()
 
-		res, err := stmt.Exec(album, fsPath)
+		res, err := stmt.Exec(album, fsPath, albumArtist)
 		if err != nil {
 			return fmt.Errorf("executing album insert: %w", err)
 		}
@@ -620,11 +706,12 @@ func (lib *LocalLibrary) setAlbumID(album string, fsPath string) (int64, error)
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		return 0, err
 	}
+	lib.changed()
 
 	// For some reason the sql.Result.LastInsertId() function does not always
 	// return the correct ID. This might be a problem with the particular SQL
 	// driver used. In any case, explicitly selecting it is the safest option.
-	newID, err := lib.GetAlbumID(album, fsPath)
+	newID, err := lib.GetAlbumID(album, albumArtist, fsPath)
 	if err != nil {
 		return 0, fmt.Errorf("could not get ID of inserted album: %s", err)
 	}
@@ -775,9 +862,11 @@ func (lib *LocalLibrary) GetTrackID(
 // used when retrieving this particular song for playing.
 //
 // In case the track with this file system path already exists in the library it
-// is updated with new values for title, number, artist ID and album ID.
+// is updated with new values for title, number, artist ID, album ID, metadata and
+// audio properties.
 func (lib *LocalLibrary) setTrackID(title, fsPath string,
-	trackNumber, artistID, albumID, duration int64) (int64, error) {
+	trackNumber, artistID, albumID, duration int64,
+	meta TrackMetadata, props AudioProperties) (int64, error) {
 
 	if len(title) < 1 {
 		title = filepath.Base(fsPath)
@@ -787,16 +876,38 @@ func (lib *LocalLibrary) setTrackID(title, fsPath string,
 	work := func(db *sql.DB) error {
 		stmt, err := db.Prepare(`
 			INSERT INTO
-				tracks (name, album_id, artist_id, fs_path, number, duration)
+				tracks (name, album_id, artist_id, fs_path, number, duration,
+					genre, year, album_artist, disc, disc_total, composer, comment,
+					musicbrainz_track_id, musicbrainz_album_id,
+					musicbrainz_artist_id, musicbrainz_album_artist_id,
+					bitrate, sample_rate, bit_depth, channels, codec, compilation)
 			VALUES
-				($1, $2, $3, $4, $5, $6)
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+					$16, $17, $18, $19, $20, $21, $22, $23)
 			ON CONFLICT (fs_path) DO
 			UPDATE SET
 				name = $1,
 				album_id = $2,
 				artist_id = $3,
 				number = $5,
-				duration = $6
+				duration = $6,
+				genre = $7,
+				year = $8,
+				album_artist = $9,
+				disc = $10,
+				disc_total = $11,
+				composer = $12,
+				comment = $13,
+				musicbrainz_track_id = $14,
+				musicbrainz_album_id = $15,
+				musicbrainz_artist_id = $16,
+				musicbrainz_album_artist_id = $17,
+				bitrate = $18,
+				sample_rate = $19,
+				bit_depth = $20,
+				channels = $21,
+				codec = $22,
+				compilation = $23
 		`)
 		if err != nil {
 			return err
@@ -804,7 +915,12 @@ func (lib *LocalLibrary) setTrackID(title, fsPath string,
 
 		defer stmt.Close()
 
-		res, err := stmt.Exec(title, albumID, artistID, fsPath, trackNumber, duration)
+		res, err := stmt.Exec(title, albumID, artistID, fsPath, trackNumber, duration,
+			meta.Genre, meta.Year, meta.AlbumArtist, meta.Disc, meta.DiscTotal,
+			meta.Composer, meta.Comment, meta.MusicBrainzTrackID,
+			meta.MusicBrainzAlbumID, meta.MusicBrainzArtistID,
+			meta.MusicBrainzAlbumArtistID, props.Bitrate, props.SampleRate,
+			props.BitDepth, props.Channels, props.Codec, meta.Compilation)
 		if err != nil {
 			return err
 		}
@@ -816,6 +932,7 @@ func (lib *LocalLibrary) setTrackID(title, fsPath string,
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		return 0, err
 	}
+	lib.changed()
 
 	// Getting the track by its fs_path.
 	var trackID int64
@@ -930,6 +1047,7 @@ func (lib *LocalLibrary) IncrementListenCount(fileID int64) error {
 	if err := lib.executeDBJobAndWait(work); err != nil {
 		return err
 	}
+	lib.changed()
 
 	return nil
 }
@@ -1113,6 +1231,7 @@ func NewLocalLibrary(
 	lib.artworkSem = make(chan struct{}, 10)
 
 	lib.cleanupLock = &sync.RWMutex{}
+	lib.version = newLibraryVersion()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
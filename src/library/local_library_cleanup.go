@@ -275,6 +275,7 @@ func (lib *LocalLibrary) checkAndRemoveAlbums(albumIDs []int64) error {
 				return err
 			}
 
+			lib.changed()
 			return nil
 		}); err != nil {
 			log.Printf("Error deleting album %d: %s", albumID, err)
@@ -330,6 +331,7 @@ func (lib *LocalLibrary) checkAndRemoveArtists(artistIDs []int64) error {
 				return err
 			}
 
+			lib.changed()
 			return nil
 		}); err != nil {
 			log.Printf("Error deleting artist %d: %s", artistID, err)
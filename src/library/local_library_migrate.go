@@ -13,6 +13,15 @@ import (
 // the .sql files for sql-migrate.
 const sqlMigrateDirectory = "migrations"
 
+// rescanMigrations are the migrations after which the meta data of the files
+// already in the library has to be read again. They add columns which are only
+// filled while adding files, and AddMedia skips the files which are known.
+var rescanMigrations = map[string]bool{
+	"008_track_metadata.sql":   true,
+	"009_audio_properties.sql": true,
+	"010_compilations.sql":     true,
+}
+
 // applyMigrations reads the database migrations dir and applies them to the currently
 // open database if it is necessary.
 func (lib *LocalLibrary) applyMigrations() error {
@@ -25,8 +34,32 @@ func (lib *LocalLibrary) applyMigrations() error {
 		FileSystem: http.FS(migrationFiles),
 	}
 
+	var rescan bool
+	planned, _, err := migrate.PlanMigration(lib.db, "sqlite3", migrations, migrate.Up, 0)
+	if err == nil && lib.hasTracks() {
+		for _, migration := range planned {
+			if rescanMigrations[migration.Id] {
+				rescan = true
+				break
+			}
+		}
+	}
+
 	_, err = migrate.ExecMax(lib.db, "sqlite3", migrations, migrate.Up, 0)
 	if err == nil {
+		if rescan {
+			if err := lib.setRescanPending(true); err != nil {
+				return err
+			}
+		}
+		if err := lib.loadRescanPending(); err != nil {
+			return err
+		}
+
+		if lib.needsRescan() {
+			log.Println("The library will be rescanned after the next scan " +
+				"in order to read the meta data added by the database migrations.")
+		}
 		return nil
 	}
 
@@ -37,3 +70,74 @@ func (lib *LocalLibrary) applyMigrations() error {
 
 	return fmt.Errorf("executing db migration failed: %w", err)
 }
+
+// hasTracks returns true when there is at least one track in the database.
+func (lib *LocalLibrary) hasTracks() bool {
+	var count int
+	err := lib.db.QueryRow(`SELECT count(*) FROM (SELECT id FROM tracks LIMIT 1)`).
+		Scan(&count)
+	if err != nil {
+		log.Printf("Error checking for tracks in the library: %s\n", err)
+		return false
+	}
+	return count > 0
+}
+
+// rescanPendingSetting is the name of the setting which is stored while the
+// library has to be rescanned.
+const rescanPendingSetting = "rescan_pending"
+
+// needsRescan returns true when the meta data of the tracks in the library has
+// to be read again.
+func (lib *LocalLibrary) needsRescan() bool {
+	lib.rescanLock.Lock()
+	defer lib.rescanLock.Unlock()
+
+	return lib.rescanPending
+}
+
+// setRescanPending sets whether the library has to be rescanned and stores it in
+// the database.
+func (lib *LocalLibrary) setRescanPending(pending bool) error {
+	lib.rescanLock.Lock()
+	defer lib.rescanLock.Unlock()
+
+	if lib.rescanPending == pending {
+		return nil
+	}
+
+	var err error
+	if pending {
+		_, err = lib.db.Exec(
+			`INSERT OR REPLACE INTO settings (name, value) VALUES (?, '1')`,
+			rescanPendingSetting,
+		)
+	} else {
+		_, err = lib.db.Exec(`DELETE FROM settings WHERE name = ?`, rescanPendingSetting)
+	}
+	if err != nil {
+		return fmt.Errorf("storing the pending rescan: %w", err)
+	}
+
+	lib.rescanPending = pending
+	return nil
+}
+
+// loadRescanPending reads from the database whether a rescan is pending. This way
+// a rescan which has been interrupted by stopping the server is done again.
+func (lib *LocalLibrary) loadRescanPending() error {
+	lib.rescanLock.Lock()
+	defer lib.rescanLock.Unlock()
+
+	var count int
+	err := lib.db.QueryRow(
+		`SELECT count(*) FROM settings WHERE name = ?`,
+		rescanPendingSetting,
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("reading the pending rescan: %w", err)
+	}
+
+	lib.rescanPending = count > 0
+	return nil
+}
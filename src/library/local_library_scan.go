@@ -44,6 +44,22 @@ func (lib *LocalLibrary) Scan() {
 	start = time.Now()
 	lib.cleanUpDatabase()
 	log.Printf("Cleaning up took %s", time.Since(start))
+
+	if !lib.needsRescan() {
+		return
+	}
+
+	// Files which were already in the library are skipped by AddMedia so their
+	// meta data is read again. The clean up afterwards removes the albums which
+	// are left without tracks when they are grouped differently.
+	start = time.Now()
+	if err := lib.Rescan(lib.ctx); err != nil {
+		log.Printf("Rescanning the library failed: %s", err)
+		return
+	}
+	log.Printf("Rescanning took %s", time.Since(start))
+
+	lib.cleanUpDatabase()
 }
 
 // This is the goroutine which actually scans a library path.
@@ -141,7 +157,7 @@ func (lib *LocalLibrary) Rescan(ctx context.Context) error {
 		}
 	}
 
-	return nil
+	return lib.setRescanPending(false)
 }
 
 // getMediaFilenames returns batchSize media files after moving the db offset at
@@ -0,0 +1,214 @@
+package library
+
+import (
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// TrackMetadata is the information about a track which is read from its tags in
+// addition to its artist, album, title and track number.
+type TrackMetadata struct {
+	// Meta info: genre as written in the tags, for example "Rock"
+	Genre string `json:"genre"`
+
+	// Meta info: the year in which the track was released
+	Year int64 `json:"year"`
+
+	// Meta info: the artist of the whole album. It is different from the track's
+	// artist on compilations and for tracks featuring other artists.
+	AlbumArtist string `json:"album_artist"`
+
+	// Meta info: the number of the disc on which the track is and the number
+	// of the discs of the album. They are 0 when not known.
+	Disc      int64 `json:"disc"`
+	DiscTotal int64 `json:"disc_total"`
+
+	// Meta info: whether the track is tagged as part of a compilation of tracks
+	// by various artists
+	Compilation bool `json:"compilation"`
+
+	// Meta info: composer
+	Composer string `json:"composer"`
+
+	// Meta info: comment
+	Comment string `json:"comment"`
+
+	// The MusicBrainz IDs of the recording, the release, the track's artist
+	// and the album artist as written by MusicBrainz Picard.
+	MusicBrainzTrackID       string `json:"musicbrainz_track_id"`
+	MusicBrainzAlbumID       string `json:"musicbrainz_album_id"`
+	MusicBrainzArtistID      string `json:"musicbrainz_artist_id"`
+	MusicBrainzAlbumArtistID string `json:"musicbrainz_album_artist_id"`
+}
+
+// trackMetadataColumns are the columns selected for TrackMetadata in the order of
+// scanDest. The query must name the tracks table `t`.
+const trackMetadataColumns = `
+	t.genre,
+	t.year,
+	t.album_artist,
+	t.disc,
+	t.disc_total,
+	t.compilation,
+	t.composer,
+	t.comment,
+	t.musicbrainz_track_id,
+	t.musicbrainz_album_id,
+	t.musicbrainz_artist_id,
+	t.musicbrainz_album_artist_id
+`
+
+// scanDest returns the destinations for scanning trackMetadataColumns.
+func (m *TrackMetadata) scanDest() []interface{} {
+	return []interface{}{
+		&m.Genre,
+		&m.Year,
+		&m.AlbumArtist,
+		&m.Disc,
+		&m.DiscTotal,
+		&m.Compilation,
+		&m.Composer,
+		&m.Comment,
+		&m.MusicBrainzTrackID,
+		&m.MusicBrainzAlbumID,
+		&m.MusicBrainzArtistID,
+		&m.MusicBrainzAlbumArtistID,
+	}
+}
+
+// taggedMediaFile is a MediaFile which could read some of the tags in TrackMetadata
+// too. The taglib files are such.
+type taggedMediaFile interface {
+	MediaFile
+
+	Genre() string
+	Year() int
+	Comment() string
+}
+
+// The names of the tags in which MusicBrainz Picard stores the IDs, in lower case.
+// The first are the Vorbis comments and the second are the descriptions of the
+// ID3 TXXX frames and the names of the MP4 atoms. The recording ID is in an ID3
+// UFID frame instead.
+var (
+	musicBrainzTrackIDTags       = []string{"musicbrainz_trackid", "musicbrainz track id"}
+	musicBrainzAlbumIDTags       = []string{"musicbrainz_albumid", "musicbrainz album id"}
+	musicBrainzArtistIDTags      = []string{"musicbrainz_artistid", "musicbrainz artist id"}
+	musicBrainzAlbumArtistIDTags = []string{"musicbrainz_albumartistid", "musicbrainz album artist id"}
+)
+
+const musicBrainzUFIDProvider = "http://musicbrainz.org"
+
+// compilationTags are the names of the tags which mark compilations, in lower case.
+// They are the ID3 frames written by iTunes, the Vorbis comment and the MP4 atom.
+var compilationTags = []string{"tcmp", "tcp", "compilation", "cpil"}
+
+// readTrackMetadata returns the TrackMetadata of the media file at filePath. The
+// tags which taglib reads are taken from the file. The rest are read from the
+// file at filePath with a tag reader which knows about more of them. When the
+// format is not supported by it only the ones from taglib are returned.
+func (lib *LocalLibrary) readTrackMetadata(file MediaFile, filePath string) TrackMetadata {
+	var meta TrackMetadata
+
+	if tagged, ok := file.(taggedMediaFile); ok {
+		meta.Genre = strings.TrimSpace(tagged.Genre())
+		meta.Year = int64(tagged.Year())
+		meta.Comment = strings.TrimSpace(tagged.Comment())
+	}
+
+	fh, err := lib.fs.Open(filePath)
+	if err != nil {
+		return meta
+	}
+	defer fh.Close()
+
+	rs, ok := fh.(io.ReadSeeker)
+	if !ok {
+		return meta
+	}
+
+	tags, err := tag.ReadFrom(rs)
+	if err != nil {
+		return meta
+	}
+
+	if meta.Genre == "" {
+		meta.Genre = strings.TrimSpace(tags.Genre())
+	}
+	if meta.Year == 0 {
+		meta.Year = int64(tags.Year())
+	}
+	if meta.Comment == "" {
+		meta.Comment = strings.TrimSpace(tags.Comment())
+	}
+
+	disc, discTotal := tags.Disc()
+	meta.Disc, meta.DiscTotal = int64(disc), int64(discTotal)
+	meta.AlbumArtist = strings.TrimSpace(tags.AlbumArtist())
+	meta.Composer = strings.TrimSpace(tags.Composer())
+	meta.Compilation = isCompilation(tags)
+
+	raw := rawTags(tags)
+	meta.MusicBrainzTrackID = firstTag(raw, musicBrainzTrackIDTags)
+	meta.MusicBrainzAlbumID = firstTag(raw, musicBrainzAlbumIDTags)
+	meta.MusicBrainzArtistID = firstTag(raw, musicBrainzArtistIDTags)
+	meta.MusicBrainzAlbumArtistID = firstTag(raw, musicBrainzAlbumArtistIDTags)
+
+	return meta
+}
+
+// rawTags returns the text tags of the file by their names in lower case. The
+// ID3 TXXX frames are by their descriptions and the MusicBrainz UFID frame is
+// returned as "musicbrainz track id".
+func rawTags(tags tag.Metadata) map[string]string {
+	raw := make(map[string]string)
+
+	for name, value := range tags.Raw() {
+		switch v := value.(type) {
+		case string:
+			raw[strings.ToLower(name)] = v
+		case *tag.Comm:
+			if strings.HasPrefix(name, "TXX") {
+				raw[strings.ToLower(v.Description)] = v.Text
+			}
+		case *tag.UFID:
+			if v.Provider == musicBrainzUFIDProvider {
+				raw["musicbrainz track id"] = string(v.Identifier)
+			}
+		}
+	}
+
+	return raw
+}
+
+// firstTag returns the value of the first of names which is found in raw.
+func firstTag(raw map[string]string, names []string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(raw[name]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// isCompilation returns true when the file is tagged as part of a compilation.
+// The MP4 atom is a number while the rest of the tags are text.
+func isCompilation(tags tag.Metadata) bool {
+	for name, value := range tags.Raw() {
+		if !slices.Contains(compilationTags, strings.ToLower(name)) {
+			continue
+		}
+
+		switch v := value.(type) {
+		case int:
+			return v == 1
+		case string:
+			v = strings.TrimSpace(v)
+			return v == "1" || strings.EqualFold(v, "true")
+		}
+	}
+	return false
+}
@@ -0,0 +1,474 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// yearInReviewTopCount is the number of tracks, albums, artists and genres
+	// in the top lists of YearInReview.
+	yearInReviewTopCount = 5
+)
+
+// ChartArgs select the plays which are counted for a chart.
+type ChartArgs struct {
+	// UserID limits the chart to the plays of a single user. Zero means the
+	// plays of all users.
+	UserID int64
+
+	// Since and Until limit the plays to the ones which started in this period.
+	// Zero values mean no limit.
+	Since time.Time
+	Until time.Time
+
+	Limit int
+}
+
+// where returns the SQL condition and its parameters for the plays table `p`. Only
+// the plays which have reached the listen threshold are counted. The others may
+// be only prefetched files or tracks which have been skipped.
+func (args ChartArgs) where() (string, []interface{}) {
+	where := "p.counted = 1"
+	var params []interface{}
+
+	if args.UserID != 0 {
+		where += " AND p.user_id = ?"
+		params = append(params, args.UserID)
+	}
+	if !args.Since.IsZero() {
+		where += " AND p.started_at >= ?"
+		params = append(params, args.Since.Unix())
+	}
+	if !args.Until.IsZero() {
+		where += " AND p.started_at < ?"
+		params = append(params, args.Until.Unix())
+	}
+
+	return where, params
+}
+
+// TrackChartEntry is a track in a chart together with its number of plays.
+type TrackChartEntry struct {
+	Plays int64        `json:"plays"`
+	Track SearchResult `json:"track"`
+}
+
+// AlbumChartEntry is an album in a chart together with its number of plays.
+type AlbumChartEntry struct {
+	Plays int64 `json:"plays"`
+	Album Album `json:"album"`
+}
+
+// ArtistChartEntry is an artist in a chart together with its number of plays.
+type ArtistChartEntry struct {
+	Plays  int64  `json:"plays"`
+	Artist Artist `json:"artist"`
+}
+
+// GenreChartEntry is a genre in a chart together with its number of plays.
+type GenreChartEntry struct {
+	Plays int64  `json:"plays"`
+	Genre string `json:"genre"`
+}
+
+// ListeningStreak is a period of consecutive days with at least one play.
+type ListeningStreak struct {
+	Days  int    `json:"days"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// YearInReview summarises the plays of a user during a calendar year.
+type YearInReview struct {
+	Year    int   `json:"year"`
+	Plays   int64 `json:"plays"`
+	Minutes int64 `json:"minutes"`
+
+	// Tracks and Artists are the numbers of different tracks and artists
+	// which have been played.
+	Tracks  int64 `json:"tracks"`
+	Artists int64 `json:"artists"`
+
+	// ListeningDays is the number of days with at least one play.
+	ListeningDays int             `json:"listening_days"`
+	LongestStreak ListeningStreak `json:"longest_streak"`
+
+	TopTracks  []TrackChartEntry  `json:"top_tracks"`
+	TopAlbums  []AlbumChartEntry  `json:"top_albums"`
+	TopArtists []ArtistChartEntry `json:"top_artists"`
+	TopGenres  []GenreChartEntry  `json:"top_genres"`
+}
+
+//counterfeiter:generate . Stats
+
+// Stats computes charts and statistics from the listening history.
+type Stats interface {
+	// TopTracks returns the most played tracks, most played first.
+	TopTracks(ChartArgs) ([]TrackChartEntry, error)
+
+	// TopAlbums returns the most played albums, most played first.
+	TopAlbums(ChartArgs) ([]AlbumChartEntry, error)
+
+	// TopArtists returns the most played artists, most played first.
+	TopArtists(ChartArgs) ([]ArtistChartEntry, error)
+
+	// TopGenres returns the most played genres, most played first. Tracks
+	// without a genre are not counted.
+	TopGenres(ChartArgs) ([]GenreChartEntry, error)
+
+	// YearInReview returns the summary of the user's plays during the year. The
+	// days are in the local time zone of the server.
+	YearInReview(userID int64, year int) (YearInReview, error)
+}
+
+// TopTracks implements the Stats interface.
+func (lib *LocalLibrary) TopTracks(args ChartArgs) ([]TrackChartEntry, error) {
+	where, params := args.where()
+
+	output := []TrackChartEntry{}
+	work := func(db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT
+				COUNT(*) as plays,
+				t.id,
+				t.name,
+				al.name,
+				at.name,
+				at.id,
+				t.number,
+				t.album_id,
+				t.fs_path,
+				IFNULL(t.listens_count, 0),
+				IFNULL(t.duration, 0),
+				`+trackDetailsColumns+`
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+					LEFT JOIN albums as al ON al.id = t.album_id
+					LEFT JOIN artists as at ON at.id = t.artist_id
+			WHERE
+				`+where+`
+			GROUP BY
+				t.id
+			ORDER BY
+				plays DESC, t.name
+			LIMIT
+				?
+		`, append(params, args.Limit)...)
+		if err != nil {
+			return fmt.Errorf("querying top tracks: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry TrackChartEntry
+			err := rows.Scan(append([]interface{}{
+				&entry.Plays,
+				&entry.Track.ID,
+				&entry.Track.Title,
+				&entry.Track.Album,
+				&entry.Track.Artist,
+				&entry.Track.ArtistID,
+				&entry.Track.TrackNumber,
+				&entry.Track.AlbumID,
+				&entry.Track.Format,
+				&entry.Track.View,
+				&entry.Track.Duration,
+			}, entry.Track.detailsScanDest()...)...)
+			if err != nil {
+				return fmt.Errorf("scanning error: %w", err)
+			}
+
+			entry.Track.Format = mediaFormatFromFileName(entry.Track.Format)
+			output = append(output, entry)
+		}
+
+		return rows.Err()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// TopAlbums implements the Stats interface. The artists of the albums and whether
+// they are compilations are the same as when browsing.
+func (lib *LocalLibrary) TopAlbums(args ChartArgs) ([]AlbumChartEntry, error) {
+	where, params := args.where()
+
+	output := []AlbumChartEntry{}
+	work := func(db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT
+				COUNT(*) as plays,
+				al.id,
+				al.name,
+				(
+					SELECT
+						`+albumArtistColumn+`
+					FROM
+						tracks tr
+						LEFT JOIN
+							artists ar ON ar.id = tr.artist_id
+					WHERE
+						tr.album_id = al.id
+				) as artist_name,
+				(
+					SELECT
+						`+albumCompilationColumn+`
+					FROM
+						tracks tr
+					WHERE
+						tr.album_id = al.id
+				) as compilation
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+					JOIN albums as al ON al.id = t.album_id
+			WHERE
+				`+where+`
+			GROUP BY
+				al.id
+			ORDER BY
+				plays DESC, al.name
+			LIMIT
+				?
+		`, append(params, args.Limit)...)
+		if err != nil {
+			return fmt.Errorf("querying top albums: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry AlbumChartEntry
+			err := rows.Scan(
+				&entry.Plays,
+				&entry.Album.ID,
+				&entry.Album.Name,
+				&entry.Album.Artist,
+				&entry.Album.Compilation,
+			)
+			if err != nil {
+				return fmt.Errorf("scanning error: %w", err)
+			}
+			output = append(output, entry)
+		}
+
+		return rows.Err()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// TopArtists implements the Stats interface.
+func (lib *LocalLibrary) TopArtists(args ChartArgs) ([]ArtistChartEntry, error) {
+	where, params := args.where()
+
+	output := []ArtistChartEntry{}
+	work := func(db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT
+				COUNT(*) as plays,
+				at.id,
+				at.name
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+					JOIN artists as at ON at.id = t.artist_id
+			WHERE
+				`+where+`
+			GROUP BY
+				at.id
+			ORDER BY
+				plays DESC, at.name
+			LIMIT
+				?
+		`, append(params, args.Limit)...)
+		if err != nil {
+			return fmt.Errorf("querying top artists: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry ArtistChartEntry
+			err := rows.Scan(&entry.Plays, &entry.Artist.ID, &entry.Artist.Name)
+			if err != nil {
+				return fmt.Errorf("scanning error: %w", err)
+			}
+			output = append(output, entry)
+		}
+
+		return rows.Err()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// TopGenres implements the Stats interface. The genres are grouped as they are
+// written in the tags.
+func (lib *LocalLibrary) TopGenres(args ChartArgs) ([]GenreChartEntry, error) {
+	where, params := args.where()
+
+	output := []GenreChartEntry{}
+	work := func(db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT
+				COUNT(*) as plays,
+				t.genre
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+			WHERE
+				`+where+` AND t.genre != ''
+			GROUP BY
+				t.genre
+			ORDER BY
+				plays DESC, t.genre
+			LIMIT
+				?
+		`, append(params, args.Limit)...)
+		if err != nil {
+			return fmt.Errorf("querying top genres: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry GenreChartEntry
+			if err := rows.Scan(&entry.Plays, &entry.Genre); err != nil {
+				return fmt.Errorf("scanning error: %w", err)
+			}
+			output = append(output, entry)
+		}
+
+		return rows.Err()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// YearInReview implements the Stats interface.
+func (lib *LocalLibrary) YearInReview(userID int64, year int) (YearInReview, error) {
+	args := ChartArgs{
+		UserID: userID,
+		Since:  time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local),
+		Until:  time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.Local),
+		Limit:  yearInReviewTopCount,
+	}
+	where, params := args.where()
+
+	review := YearInReview{Year: year}
+	var days []string
+
+	work := func(db *sql.DB) error {
+		err := db.QueryRow(`
+			SELECT
+				COUNT(*),
+				IFNULL(SUM(p.played), 0) / 60000,
+				COUNT(DISTINCT t.id),
+				COUNT(DISTINCT t.artist_id)
+			FROM
+				plays as p
+					JOIN tracks as t ON t.id = p.track_id
+			WHERE
+				`+where, params...).Scan(
+			&review.Plays,
+			&review.Minutes,
+			&review.Tracks,
+			&review.Artists,
+		)
+		if err != nil {
+			return fmt.Errorf("querying totals: %w", err)
+		}
+
+		rows, err := db.Query(`
+			SELECT DISTINCT
+				date(p.started_at, 'unixepoch', 'localtime') as day
+			FROM
+				plays as p
+			WHERE
+				`+where+`
+			ORDER BY
+				day
+		`, params...)
+		if err != nil {
+			return fmt.Errorf("querying listening days: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var day string
+			if err := rows.Scan(&day); err != nil {
+				return fmt.Errorf("scanning error: %w", err)
+			}
+			days = append(days, day)
+		}
+
+		return rows.Err()
+	}
+
+	if err := lib.executeDBJobAndWait(work); err != nil {
+		return review, err
+	}
+
+	review.ListeningDays = len(days)
+	review.LongestStreak = longestStreak(days)
+
+	var err error
+	if review.TopTracks, err = lib.TopTracks(args); err != nil {
+		return review, err
+	}
+	if review.TopAlbums, err = lib.TopAlbums(args); err != nil {
+		return review, err
+	}
+	if review.TopArtists, err = lib.TopArtists(args); err != nil {
+		return review, err
+	}
+	if review.TopGenres, err = lib.TopGenres(args); err != nil {
+		return review, err
+	}
+
+	return review, nil
+}
+
+// longestStreak returns the longest run of consecutive days. The days must be
+// sorted "YYYY-MM-DD" dates.
+func longestStreak(days []string) ListeningStreak {
+	var (
+		longest ListeningStreak
+		current ListeningStreak
+		prev    time.Time
+	)
+
+	for _, day := range days {
+		date, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			continue
+		}
+
+		if current.Days > 0 && date.Sub(prev) == 24*time.Hour {
+			current.Days++
+			current.End = day
+		} else {
+			current = ListeningStreak{Days: 1, Start: day, End: day}
+		}
+		prev = date
+
+		if current.Days > longest.Days {
+			longest = current
+		}
+	}
+
+	return longest
+}
@@ -0,0 +1,55 @@
+package library
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//counterfeiter:generate . Versioned
+
+// Versioned is implemented by libraries which can tell whether their contents
+// have changed. It is used for answering conditional HTTP requests.
+type Versioned interface {
+	// Version returns a value which is different for every state of the library's
+	// tracks, albums and artists together with the time of the last change.
+	Version() (string, time.Time)
+}
+
+// libraryVersion counts the changes of a library. The counting starts over on
+// every start of the server so the time of the start is part of the version.
+// The database could have been changed while the server was not running.
+type libraryVersion struct {
+	sync.Mutex
+
+	started  int64
+	changes  uint64
+	modified time.Time
+}
+
+func newLibraryVersion() *libraryVersion {
+	now := time.Now()
+	return &libraryVersion{
+		started:  now.UnixNano(),
+		modified: now.Truncate(time.Second),
+	}
+}
+
+// Version implements the Versioned interface.
+func (lib *LocalLibrary) Version() (string, time.Time) {
+	lib.version.Lock()
+	defer lib.version.Unlock()
+
+	return fmt.Sprintf("%x-%x", lib.version.started, lib.version.changes),
+		lib.version.modified
+}
+
+// changed must be called after every change to the tracks, albums or artists of
+// the library which is visible in its search and browse results.
+func (lib *LocalLibrary) changed() {
+	lib.version.Lock()
+	defer lib.version.Unlock()
+
+	lib.version.changes++
+	lib.version.modified = time.Now().Truncate(time.Second)
+}
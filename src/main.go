@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"NT106/Group01/MusicStreamingAPI/src/art"
@@ -53,6 +54,17 @@ var (
 	// doNotWatchDirs is controlled by the -dont-watch flag and will cause
 	// the program to cease watching music library directories for changes.
 	doNotWatchDirs bool
+
+	// importHistory is populated by the -import-history flag. It is the path to
+	// a Last.fm or ListenBrainz export which is imported into the listening
+	// history of importUser without starting the server.
+	importHistory string
+
+	// importUser is the username from the -import-user flag.
+	importUser string
+
+	// importFormat is populated by the -import-format flag.
+	importFormat string
 )
 
 const userAgentFormat = "Music Streaming API"
@@ -78,6 +90,15 @@ func init() {
 			"Alternatively one could use the -rescan flag.\n\n"+
 			"This option is useful for systems with low open files limit such\n"+
 			"MacOS by default.")
+	flag.StringVar(&importHistory, "import-history", "",
+		"Imports the listening history from a Last.fm CSV or a ListenBrainz JSON\n"+
+			"export into the history of the user set with -import-user and then\n"+
+			"exits. The rows which do not match any track are printed.")
+	flag.StringVar(&importUser, "import-user", "",
+		"Username of the user whose history is imported with -import-history.")
+	flag.StringVar(&importFormat, "import-format", "",
+		"Format of the -import-history file: \"lastfm\" or \"listenbrainz\". By\n"+
+			"default it is \"lastfm\" for .csv files and \"listenbrainz\" otherwise.")
 }
 
 // Main is the only thing run in the project's root main.go file.
@@ -98,6 +119,14 @@ func Main(sqlFilesFS fs.FS) {
 		sqlFilesFS = os.DirFS("sqls")
 	}
 
+	if importHistory != "" {
+		if err := runHistoryImport(appfs, sqlFilesFS); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if generateConfig {
 		if _, err := config.FindAndParse(appfs); err != nil {
 			fmt.Fprintf(os.Stderr, "Could not create config file: %s", err)
@@ -254,3 +283,61 @@ func runLibraryRescan(appfs afero.Fs, sqlFilesFS fs.FS) error {
 
 	return lib.Rescan(ctx)
 }
+
+// runHistoryImport imports the -import-history file into the listening history
+// and prints the rows which have not been imported.
+func runHistoryImport(appfs afero.Fs, sqlFilesFS fs.FS) error {
+	if importUser == "" {
+		return fmt.Errorf("-import-user is required with -import-history")
+	}
+
+	format := importFormat
+	if format == "" {
+		format = library.ImportFormatListenBrainz
+		if strings.EqualFold(filepath.Ext(importHistory), ".csv") {
+			format = library.ImportFormatLastFM
+		}
+	}
+
+	cfg, err := config.FindAndParse(appfs)
+	if err != nil {
+		return fmt.Errorf("parsing configuration: %s", err)
+	}
+
+	userPath := filepath.Dir(config.UserConfigPath(appfs))
+	userID, err := webserver.FindUserID(
+		helpers.AbsolutePath(cfg.SqliteDatabaseAuth, userPath),
+		importUser,
+	)
+	if err != nil {
+		return fmt.Errorf("finding user: %w", err)
+	}
+
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	lib, err := getLibrary(ctx, userPath, cfg, sqlFilesFS)
+	if err != nil {
+		return fmt.Errorf("creating library object: %w", err)
+	}
+
+	export, err := os.Open(importHistory)
+	if err != nil {
+		return fmt.Errorf("opening export: %w", err)
+	}
+	defer export.Close()
+
+	result, err := lib.ImportHistory(int64(userID), export, format)
+	if err != nil {
+		return fmt.Errorf("importing history: %w", err)
+	}
+
+	for _, row := range result.Unmatched {
+		fmt.Printf("row %d: %s: %s - %s (%s)\n",
+			row.Row, row.Reason, row.Artist, row.Title, row.Album)
+	}
+	fmt.Printf("Rows: %d, imported: %d, duplicates: %d, unmatched: %d\n",
+		result.Rows, result.Imported, result.Duplicates, len(result.Unmatched))
+
+	return nil
+}
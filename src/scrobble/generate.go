@@ -0,0 +1,6 @@
+package scrobble
+
+// This file is here just to hold generate directives and to prevent them
+// being copied on more than one place throughout the package files.
+
+//go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 -generate
@@ -0,0 +1,223 @@
+package scrobble
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultLastFMAPIHost is the Last.fm API used when no other is configured.
+	DefaultLastFMAPIHost = "https://ws.audioscrobbler.com"
+
+	lastFMAPIEndpoint  = "%s/2.0/"
+	lastFMAuthEndpoint = "https://www.last.fm/api/auth/"
+)
+
+// The Last.fm error codes which are not permanent failures of a submission.
+// See https://www.last.fm/api/errorcodes
+const (
+	lastFMErrAuthFailed      = 4
+	lastFMErrInvalidSession  = 9
+	lastFMErrOffline         = 11
+	lastFMErrUnauthorized    = 14
+	lastFMErrTokenExpired    = 15
+	lastFMErrTemporary       = 16
+	lastFMErrSuspendedAPIKey = 26
+	lastFMErrRateLimit       = 29
+)
+
+// LastFM is a client for the Last.fm API. The credentials of the users are their
+// session keys. It implements Scrobbler and is safe for concurrent use.
+//
+// The users give access to their accounts by visiting AuthURL. Last.fm then
+// redirects them back with a token which is exchanged for a session key with
+// Session.
+type LastFM struct {
+	client  *http.Client
+	apiKey  string
+	secret  string
+	apiHost string
+}
+
+// NewLastFM returns a client for the Last.fm API at apiHost which uses the API
+// account apiKey and its shared secret. DefaultLastFMAPIHost is used when apiHost
+// is empty.
+func NewLastFM(apiKey, secret, apiHost string) *LastFM {
+	if apiHost == "" {
+		apiHost = DefaultLastFMAPIHost
+	}
+
+	return &LastFM{
+		client:  http.DefaultClient,
+		apiKey:  apiKey,
+		secret:  secret,
+		apiHost: strings.TrimSuffix(apiHost, "/"),
+	}
+}
+
+// AuthURL returns the Last.fm page on which the users allow this server to
+// scrobble for them. They are redirected to callback afterwards. The callback
+// set for the API account is used when it is empty.
+func (lf *LastFM) AuthURL(callback string) string {
+	query := url.Values{}
+	query.Set("api_key", lf.apiKey)
+	if callback != "" {
+		query.Set("cb", callback)
+	}
+	return lastFMAuthEndpoint + "?" + query.Encode()
+}
+
+// Session exchanges an authorized token for a session. It returns the name of
+// the user and the session key.
+func (lf *LastFM) Session(ctx context.Context, token string) (string, string, error) {
+	var respBody struct {
+		Session struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"session"`
+	}
+
+	err := lf.call(ctx, url.Values{
+		"method": {"auth.getSession"},
+		"token":  {token},
+	}, &respBody)
+	if err != nil {
+		return "", "", err
+	}
+
+	if respBody.Session.Key == "" {
+		return "", "", fmt.Errorf("Last.fm returned no session key")
+	}
+	return respBody.Session.Name, respBody.Session.Key, nil
+}
+
+// NowPlaying implements Scrobbler.
+func (lf *LastFM) NowPlaying(ctx context.Context, sessionKey string, track Track) error {
+	params := lastFMTrackParams(track)
+	params.Set("method", "track.updateNowPlaying")
+	params.Set("sk", sessionKey)
+
+	return lf.call(ctx, params, nil)
+}
+
+// Scrobble implements Scrobbler.
+func (lf *LastFM) Scrobble(ctx context.Context, sessionKey string, listen Listen) error {
+	params := lastFMTrackParams(listen.Track)
+	params.Set("method", "track.scrobble")
+	params.Set("sk", sessionKey)
+	params.Set("timestamp", strconv.FormatInt(listen.ListenedAt.Unix(), 10))
+
+	return lf.call(ctx, params, nil)
+}
+
+func lastFMTrackParams(track Track) url.Values {
+	params := url.Values{}
+	params.Set("artist", track.Artist)
+	params.Set("track", track.Title)
+	if track.Album != "" {
+		params.Set("album", track.Album)
+	}
+	if track.TrackNumber > 0 {
+		params.Set("trackNumber", strconv.FormatInt(track.TrackNumber, 10))
+	}
+	if track.Duration > 0 {
+		params.Set("duration", strconv.FormatInt(int64(track.Duration.Seconds()), 10))
+	}
+	return params
+}
+
+// call makes a signed POST request to the API method in params and decodes the
+// response into respBody when it is not nil.
+func (lf *LastFM) call(ctx context.Context, params url.Values, respBody interface{}) error {
+	params.Set("api_key", lf.apiKey)
+	params.Set("api_sig", lf.signature(params))
+	params.Set("format", "json")
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf(lastFMAPIEndpoint, lf.apiHost),
+		strings.NewReader(params.Encode()),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := lf.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Last.fm request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("Last.fm returned %s", resp.Status)
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding Last.fm response: %w", err)
+	}
+
+	var apiErr struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Error != 0 {
+		switch apiErr.Error {
+		case lastFMErrAuthFailed, lastFMErrInvalidSession, lastFMErrUnauthorized,
+			lastFMErrTokenExpired:
+			return ErrInvalidCredentials
+		case lastFMErrOffline, lastFMErrTemporary, lastFMErrSuspendedAPIKey,
+			lastFMErrRateLimit:
+			return fmt.Errorf("Last.fm error %d: %s", apiErr.Error, apiErr.Message)
+		default:
+			return fmt.Errorf("%w: Last.fm error %d: %s", ErrRejected, apiErr.Error,
+				apiErr.Message)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Last.fm returned %s", resp.Status)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, respBody); err != nil {
+		return fmt.Errorf("decoding Last.fm response: %w", err)
+	}
+	return nil
+}
+
+// signature returns the api_sig parameter for the request. It is the MD5 of all
+// parameters sorted by name, concatenated with their values and followed by the
+// shared secret.
+func (lf *LastFM) signature(params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name == "format" || name == "callback" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteString(params.Get(name))
+	}
+	sb.WriteString(lf.secret)
+
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,188 @@
+package scrobble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultListenBrainzAPIHost is the ListenBrainz API used when no other is
+	// configured.
+	DefaultListenBrainzAPIHost = "https://api.listenbrainz.org"
+
+	listenBrainzValidateEndpoint = "%s/1/validate-token"
+	listenBrainzSubmitEndpoint   = "%s/1/submit-listens"
+)
+
+// ListenBrainz is a client for the ListenBrainz API. The credentials of the users
+// are their user tokens. It implements Scrobbler and is safe for concurrent use.
+type ListenBrainz struct {
+	client  *http.Client
+	apiHost string
+}
+
+// NewListenBrainz returns a client for the ListenBrainz API at apiHost, for example
+// "https://api.listenbrainz.org". DefaultListenBrainzAPIHost is used when apiHost
+// is empty.
+func NewListenBrainz(apiHost string) *ListenBrainz {
+	if apiHost == "" {
+		apiHost = DefaultListenBrainzAPIHost
+	}
+
+	return &ListenBrainz{
+		client:  http.DefaultClient,
+		apiHost: strings.TrimSuffix(apiHost, "/"),
+	}
+}
+
+// ValidateToken checks the user token and returns the name of its user.
+func (lb *ListenBrainz) ValidateToken(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf(listenBrainzValidateEndpoint, lb.apiHost),
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var respBody struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+	}
+	if err := lb.do(req, token, &respBody); err != nil {
+		return "", err
+	}
+
+	if !respBody.Valid {
+		return "", ErrInvalidCredentials
+	}
+	return respBody.UserName, nil
+}
+
+// NowPlaying implements Scrobbler.
+func (lb *ListenBrainz) NowPlaying(ctx context.Context, token string, track Track) error {
+	return lb.submit(ctx, token, "playing_now", listenBrainzListen{
+		TrackMetadata: newListenBrainzMetadata(track),
+	})
+}
+
+// Scrobble implements Scrobbler.
+func (lb *ListenBrainz) Scrobble(ctx context.Context, token string, listen Listen) error {
+	return lb.submit(ctx, token, "single", listenBrainzListen{
+		ListenedAt:    listen.ListenedAt.Unix(),
+		TrackMetadata: newListenBrainzMetadata(listen.Track),
+	})
+}
+
+// listenBrainzListen is a listen in the format of the submit-listens endpoint.
+type listenBrainzListen struct {
+	ListenedAt    int64                `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzMetadata `json:"track_metadata"`
+}
+
+type listenBrainzMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+func newListenBrainzMetadata(track Track) listenBrainzMetadata {
+	info := map[string]interface{}{
+		"submission_client": submissionClient,
+	}
+	if track.Duration > 0 {
+		info["duration_ms"] = track.Duration.Milliseconds()
+	}
+	if track.TrackNumber > 0 {
+		info["tracknumber"] = track.TrackNumber
+	}
+
+	return listenBrainzMetadata{
+		ArtistName:     track.Artist,
+		TrackName:      track.Title,
+		ReleaseName:    track.Album,
+		AdditionalInfo: info,
+	}
+}
+
+func (lb *ListenBrainz) submit(
+	ctx context.Context,
+	token string,
+	listenType string,
+	listen listenBrainzListen,
+) error {
+	body, err := json.Marshal(struct {
+		ListenType string               `json:"listen_type"`
+		Payload    []listenBrainzListen `json:"payload"`
+	}{
+		ListenType: listenType,
+		Payload:    []listenBrainzListen{listen},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf(listenBrainzSubmitEndpoint, lb.apiHost),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return lb.do(req, token, nil)
+}
+
+// do sends the request authenticated with the token and decodes the response
+// into respBody when it is not nil. The error statuses are converted to the
+// errors of this package.
+func (lb *ListenBrainz) do(req *http.Request, token string, respBody interface{}) error {
+	req.Header.Set("Authorization", "Token "+token)
+
+	resp, err := lb.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ListenBrainz request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error != "" {
+			msg = []byte(apiErr.Error)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return ErrInvalidCredentials
+		case resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= http.StatusInternalServerError:
+			return fmt.Errorf("ListenBrainz returned %s: %s", resp.Status, msg)
+		default:
+			return fmt.Errorf("%w: ListenBrainz returned %s: %s", ErrRejected, resp.Status, msg)
+		}
+	}
+
+	if respBody == nil {
+		return nil
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(respBody); err != nil {
+		return fmt.Errorf("decoding ListenBrainz response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package scrobble submits what the users are listening to to the scrobbling
+// services ListenBrainz and Last.fm.
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// submissionClient is how this server introduces itself to the services.
+	submissionClient = "Music Streaming API"
+)
+
+var (
+	// ErrInvalidCredentials is returned when the service does not accept the
+	// token or the session of the user. Retrying will not help until the user
+	// connects their account again.
+	ErrInvalidCredentials = errors.New("invalid or expired credentials")
+
+	// ErrRejected is returned when the service refuses a submission for good,
+	// for example because of missing track metadata. It should not be retried.
+	ErrRejected = errors.New("rejected by the service")
+)
+
+// Track is the metadata of a track as sent to the services.
+type Track struct {
+	Artist      string
+	Title       string
+	Album       string
+	TrackNumber int64
+
+	// Duration is zero when not known.
+	Duration time.Duration
+}
+
+// Listen is a completed play of a track.
+type Listen struct {
+	Track Track
+
+	// ListenedAt is when the play started.
+	ListenedAt time.Time
+}
+
+//counterfeiter:generate . Scrobbler
+
+// Scrobbler is a client for a scrobbling service. Every call is made with the
+// credentials of a single user of the service. Errors which are neither
+// ErrInvalidCredentials nor ErrRejected are temporary and the call could be
+// retried later.
+type Scrobbler interface {
+	// NowPlaying tells the service that the user has started playing the track.
+	NowPlaying(ctx context.Context, credentials string, track Track) error
+
+	// Scrobble submits a completed play.
+	Scrobble(ctx context.Context, credentials string, listen Listen) error
+}
@@ -0,0 +1,92 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFFmpegBinary is the ffmpeg binary used when none is configured. It is
+// looked up in $PATH.
+const DefaultFFmpegBinary = "ffmpeg"
+
+// FFmpeg is a Transcoder which runs a locally installed ffmpeg binary for every
+// transcoding.
+type FFmpeg struct {
+	binary string
+}
+
+// NewFFmpeg returns a Transcoder which uses the ffmpeg binary. An empty binary
+// means DefaultFFmpegBinary.
+func NewFFmpeg(binary string) *FFmpeg {
+	if binary == "" {
+		binary = DefaultFFmpegBinary
+	}
+	return &FFmpeg{binary: binary}
+}
+
+// Transcode implements the Transcoder interface.
+func (f *FFmpeg) Transcode(
+	ctx context.Context,
+	w io.Writer,
+	path string,
+	opts Options,
+) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, f.binary, f.args(path, opts)...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("running ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// args returns the command line arguments for ffmpeg. Seeking is done before the
+// input so that it is fast. Only the first audio stream is used which drops any
+// embedded artwork.
+func (f *FFmpeg) args(path string, opts Options) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+
+	if opts.Offset > 0 {
+		args = append(args, "-ss", seconds(opts.Offset))
+	}
+	if opts.Duration > 0 {
+		args = append(args, "-t", seconds(opts.Duration))
+	}
+
+	args = append(args,
+		"-i", path,
+		"-map", "0:a:0",
+		"-map_metadata", "-1",
+		"-vn",
+		"-c:a", opts.Format.codec,
+	)
+
+	if !opts.Format.Lossless() && opts.BitRate > 0 {
+		args = append(args, "-b:a", strconv.Itoa(opts.BitRate)+"k")
+	}
+
+	// MPEG-TS segments of the same stream must have continuous time stamps.
+	if opts.Format.muxer == HLSSegment.muxer && opts.Offset > 0 {
+		args = append(args, "-output_ts_offset", seconds(opts.Offset))
+	}
+
+	return append(args, "-f", opts.Format.muxer, "pipe:1")
+}
+
+// seconds formats d the way ffmpeg expects durations.
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
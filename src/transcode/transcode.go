@@ -0,0 +1,166 @@
+// Package transcode converts media files to other formats while they are being
+// streamed to the clients.
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Format describes an output format which the transcoders could produce.
+type Format struct {
+	// Name is how the format is referred to in the API and in the configuration.
+	Name string
+
+	// Extension is the file extension of the result, without the leading dot.
+	Extension string
+
+	// ContentType is the MIME type of the result.
+	ContentType string
+
+	// DefaultBitRate is used when no bit rate is requested, in kbit/s. Zero
+	// means the format is lossless and does not have a bit rate.
+	DefaultBitRate int
+
+	// codec and muxer are the ffmpeg names of the encoder and the container.
+	codec string
+	muxer string
+}
+
+// Lossless returns true when the format does not accept a bit rate.
+func (f Format) Lossless() bool {
+	return f.DefaultBitRate == 0
+}
+
+// formats are all supported output formats.
+var formats = map[string]Format{
+	"mp3": {
+		Name:           "mp3",
+		Extension:      "mp3",
+		ContentType:    "audio/mpeg",
+		DefaultBitRate: 192,
+		codec:          "libmp3lame",
+		muxer:          "mp3",
+	},
+	"opus": {
+		Name:           "opus",
+		Extension:      "opus",
+		ContentType:    "audio/ogg; codecs=opus",
+		DefaultBitRate: 96,
+		codec:          "libopus",
+		muxer:          "ogg",
+	},
+	"vorbis": {
+		Name:           "vorbis",
+		Extension:      "ogg",
+		ContentType:    "audio/ogg; codecs=vorbis",
+		DefaultBitRate: 160,
+		codec:          "libvorbis",
+		muxer:          "ogg",
+	},
+	"aac": {
+		Name:           "aac",
+		Extension:      "aac",
+		ContentType:    "audio/aac",
+		DefaultBitRate: 160,
+		codec:          "aac",
+		muxer:          "adts",
+	},
+	"flac": {
+		Name:        "flac",
+		Extension:   "flac",
+		ContentType: "audio/flac",
+		codec:       "flac",
+		muxer:       "flac",
+	},
+}
+
+// HLSSegment is the format of the HTTP Live Streaming segments. It is not one of
+// the formats which could be requested by name.
+var HLSSegment = Format{
+	Name:           "hls",
+	Extension:      "ts",
+	ContentType:    "video/mp2t",
+	DefaultBitRate: 128,
+	codec:          "aac",
+	muxer:          "mpegts",
+}
+
+const (
+	// MinBitRate and MaxBitRate are the limits for the requested bit rates in
+	// kbit/s.
+	MinBitRate = 8
+	MaxBitRate = 512
+)
+
+// FormatByName returns the supported format with this name.
+func FormatByName(name string) (Format, bool) {
+	f, ok := formats[name]
+	return f, ok
+}
+
+// FormatNames returns the names of all supported formats, sorted.
+func FormatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Options describe a single transcoding.
+type Options struct {
+	Format Format
+
+	// BitRate is the target bit rate in kbit/s. It is ignored for lossless
+	// formats.
+	BitRate int
+
+	// Offset is the position in the source file from which the result starts.
+	// It is used for seeking in transcoded streams.
+	Offset time.Duration
+
+	// Duration limits the length of the result. Zero means until the end of
+	// the source file.
+	Duration time.Duration
+}
+
+// NewOptions returns options for the format with this name. A zero bitRate means
+// the default one of the format.
+func NewOptions(format string, bitRate int) (Options, error) {
+	f, ok := FormatByName(format)
+	if !ok {
+		return Options{}, fmt.Errorf("unknown format `%s`", format)
+	}
+
+	if f.Lossless() {
+		return Options{Format: f}, nil
+	}
+
+	if bitRate == 0 {
+		bitRate = f.DefaultBitRate
+	}
+	if bitRate < MinBitRate || bitRate > MaxBitRate {
+		return Options{}, fmt.Errorf(
+			"bit rate must be between %d and %d kbit/s",
+			MinBitRate,
+			MaxBitRate,
+		)
+	}
+
+	return Options{Format: f, BitRate: bitRate}, nil
+}
+
+//counterfeiter:generate . Transcoder
+
+// Transcoder converts media files to other formats.
+type Transcoder interface {
+	// Transcode converts the file at path and writes the result in w as it is
+	// being produced. It returns once the whole file has been written or ctx is
+	// cancelled.
+	Transcode(ctx context.Context, w io.Writer, path string, opts Options) error
+}
@@ -0,0 +1,517 @@
+package webserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	zipLocalHeaderLen     = 30
+	zipCentralHeaderLen   = 46
+	zipEndLen             = 22
+	zip64EndLen           = 56
+	zip64LocatorLen       = 20
+	zipTimestampExtraLen  = 9
+	zipMax32              = 0xffffffff
+	zipMax16              = 0xffff
+	zipVersion20          = 20
+	zipVersion45          = 45
+	zipFlagUTF8           = 0x800
+	zip64ExtraID          = 0x0001
+	zipTimestampExtraID   = 0x5455
+	zipLocalHeaderSig     = 0x04034b50
+	zipCentralHeaderSig   = 0x02014b50
+	zipEndSig             = 0x06054b50
+	zip64EndSig           = 0x06064b50
+	zip64LocatorSig       = 0x07064b50
+	zipLocalTimestampFlag = 1
+)
+
+// errZipFileChanged is returned when a file has been changed after its archive
+// was created. The archive could not be completed then.
+var errZipFileChanged = errors.New("file changed while archiving")
+
+// zipEntry is a single file in a zipArchive. Its contents are either the file at
+// path or data.
+type zipEntry struct {
+	name    string
+	modTime time.Time
+	size    int64
+
+	path string
+	data []byte
+
+	// offset is the position of the local header in the archive.
+	offset int64
+
+	crc      uint32
+	crcKnown bool
+}
+
+// zip64 returns true when the size of the entry does not fit in the ZIP headers.
+func (e *zipEntry) zip64() bool {
+	return e.size >= zipMax32
+}
+
+// zipArchive is a ZIP archive which is assembled while it is being read. All
+// entries are stored without compression. This way the size of the archive and
+// the position of every byte in it are known before anything has been read, which
+// makes it possible to serve it with Content-Length and Range requests.
+//
+// The checksums of the files are computed only when their headers are read. They
+// are kept in the sums cache so that resumed downloads do not read the files again.
+type zipArchive struct {
+	entries []*zipEntry
+	parts   []zipPart
+	size    int64
+	sums    *checksumCache
+
+	// centralDir is the central directory and the end records. It is built on
+	// its first read.
+	centralDir []byte
+}
+
+// zipPart is a continuous region of the archive. It is the local header or the
+// contents of an entry, or the central directory when entry is nil.
+type zipPart struct {
+	start  int64
+	size   int64
+	entry  *zipEntry
+	header bool
+}
+
+// newZipArchive lays out an archive with these entries in this order.
+func newZipArchive(entries []*zipEntry, sums *checksumCache) *zipArchive {
+	za := &zipArchive{
+		entries: entries,
+		sums:    sums,
+	}
+
+	var offset int64
+	for _, e := range entries {
+		e.offset = offset
+		headerLen := int64(zipLocalHeaderLen + len(e.name) + len(za.localExtra(e)))
+
+		za.parts = append(za.parts,
+			zipPart{start: offset, size: headerLen, entry: e, header: true},
+			zipPart{start: offset + headerLen, size: e.size, entry: e},
+		)
+		offset += headerLen + e.size
+	}
+
+	za.parts = append(za.parts, zipPart{
+		start: offset,
+		size:  za.centralDirLen(offset),
+	})
+	za.size = offset + za.parts[len(za.parts)-1].size
+
+	return za
+}
+
+// checksum makes sure the CRC-32 of the entry is known.
+func (za *zipArchive) checksum(e *zipEntry) error {
+	if e.crcKnown {
+		return nil
+	}
+
+	if e.data != nil {
+		e.crc = crc32.ChecksumIEEE(e.data)
+		e.crcKnown = true
+		return nil
+	}
+
+	crc, err := za.sums.checksum(e.path, e.size, e.modTime)
+	if err != nil {
+		return err
+	}
+
+	e.crc = crc
+	e.crcKnown = true
+	return nil
+}
+
+func (za *zipArchive) localExtra(e *zipEntry) []byte {
+	extra := timestampExtra(e.modTime)
+	if e.zip64() {
+		var b zipBuffer
+		b.uint16(zip64ExtraID)
+		b.uint16(16)
+		b.uint64(uint64(e.size))
+		b.uint64(uint64(e.size))
+		extra = append(extra, b...)
+	}
+	return extra
+}
+
+func (za *zipArchive) localHeader(e *zipEntry) ([]byte, error) {
+	if err := za.checksum(e); err != nil {
+		return nil, err
+	}
+
+	version := uint16(zipVersion20)
+	size := uint32(e.size)
+	if e.zip64() {
+		version = zipVersion45
+		size = zipMax32
+	}
+
+	date, tm := msDosTime(e.modTime)
+	extra := za.localExtra(e)
+
+	var b zipBuffer
+	b.uint32(zipLocalHeaderSig)
+	b.uint16(version)
+	b.uint16(zipFlagUTF8)
+	b.uint16(0) // stored
+	b.uint16(tm)
+	b.uint16(date)
+	b.uint32(e.crc)
+	b.uint32(size) // compressed
+	b.uint32(size) // uncompressed
+	b.uint16(uint16(len(e.name)))
+	b.uint16(uint16(len(extra)))
+	b = append(b, e.name...)
+	b = append(b, extra...)
+
+	return b, nil
+}
+
+// centralExtra returns the extra fields of the entry for the central directory.
+// The ZIP64 field contains only the values which do not fit in the header.
+func (za *zipArchive) centralExtra(e *zipEntry) []byte {
+	var zip64 zipBuffer
+	if e.zip64() {
+		zip64.uint64(uint64(e.size))
+		zip64.uint64(uint64(e.size))
+	}
+	if e.offset >= zipMax32 {
+		zip64.uint64(uint64(e.offset))
+	}
+
+	extra := timestampExtra(e.modTime)
+	if len(zip64) > 0 {
+		var b zipBuffer
+		b.uint16(zip64ExtraID)
+		b.uint16(uint16(len(zip64)))
+		extra = append(append(extra, b...), zip64...)
+	}
+	return extra
+}
+
+// needsZip64End returns true when the archive must have ZIP64 end records.
+func (za *zipArchive) needsZip64End(dirOffset, dirSize int64) bool {
+	return len(za.entries) >= zipMax16 ||
+		dirOffset >= zipMax32 ||
+		dirSize >= zipMax32
+}
+
+func (za *zipArchive) centralDirLen(dirOffset int64) int64 {
+	var dirSize int64
+	for _, e := range za.entries {
+		dirSize += int64(zipCentralHeaderLen + len(e.name) + len(za.centralExtra(e)))
+	}
+
+	size := dirSize + zipEndLen
+	if za.needsZip64End(dirOffset, dirSize) {
+		size += zip64EndLen + zip64LocatorLen
+	}
+	return size
+}
+
+func (za *zipArchive) buildCentralDir(dirOffset int64) ([]byte, error) {
+	var b zipBuffer
+
+	for _, e := range za.entries {
+		if err := za.checksum(e); err != nil {
+			return nil, err
+		}
+
+		version := uint16(zipVersion20)
+		size := uint32(e.size)
+		if e.zip64() {
+			size = zipMax32
+		}
+		offset := uint32(e.offset)
+		if e.offset >= zipMax32 {
+			offset = zipMax32
+		}
+		if e.zip64() || e.offset >= zipMax32 {
+			version = zipVersion45
+		}
+
+		date, tm := msDosTime(e.modTime)
+		extra := za.centralExtra(e)
+
+		b.uint32(zipCentralHeaderSig)
+		b.uint16(version) // made by
+		b.uint16(version) // needed to extract
+		b.uint16(zipFlagUTF8)
+		b.uint16(0) // stored
+		b.uint16(tm)
+		b.uint16(date)
+		b.uint32(e.crc)
+		b.uint32(size) // compressed
+		b.uint32(size) // uncompressed
+		b.uint16(uint16(len(e.name)))
+		b.uint16(uint16(len(extra)))
+		b.uint16(0) // comment length
+		b.uint16(0) // disk number
+		b.uint16(0) // internal attributes
+		b.uint32(0) // external attributes
+		b.uint32(offset)
+		b = append(b, e.name...)
+		b = append(b, extra...)
+	}
+
+	dirSize := int64(len(b))
+	count := uint16(len(za.entries))
+	size, offset := uint32(dirSize), uint32(dirOffset)
+
+	if za.needsZip64End(dirOffset, dirSize) {
+		end64Offset := dirOffset + dirSize
+		count, size, offset = zipMax16, zipMax32, zipMax32
+
+		b.uint32(zip64EndSig)
+		b.uint64(zip64EndLen - 12) // size of the rest of the record
+		b.uint16(zipVersion45)     // made by
+		b.uint16(zipVersion45)     // needed to extract
+		b.uint32(0)                // disk number
+		b.uint32(0)                // disk with the central directory
+		b.uint64(uint64(len(za.entries)))
+		b.uint64(uint64(len(za.entries)))
+		b.uint64(uint64(dirSize))
+		b.uint64(uint64(dirOffset))
+
+		b.uint32(zip64LocatorSig)
+		b.uint32(0) // disk with the ZIP64 end record
+		b.uint64(uint64(end64Offset))
+		b.uint32(1) // number of disks
+	}
+
+	b.uint32(zipEndSig)
+	b.uint16(0) // disk number
+	b.uint16(0) // disk with the central directory
+	b.uint16(count)
+	b.uint16(count)
+	b.uint32(size)
+	b.uint32(offset)
+	b.uint16(0) // comment length
+
+	return b, nil
+}
+
+// Open returns a reader for the whole archive. It must be closed once not needed.
+func (za *zipArchive) Open() *zipReader {
+	return &zipReader{archive: za}
+}
+
+// zipReader is an io.ReadSeeker for a zipArchive.
+type zipReader struct {
+	archive *zipArchive
+	offset  int64
+
+	// file is the last opened file. It is kept open since the contents of an
+	// entry are usually read with many consecutive calls.
+	file     *os.File
+	fileName string
+}
+
+// Read implements io.Reader.
+func (zr *zipReader) Read(p []byte) (int, error) {
+	za := zr.archive
+	if zr.offset >= za.size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(za.parts), func(i int) bool {
+		return za.parts[i].start+za.parts[i].size > zr.offset
+	})
+	part := za.parts[i]
+	pos := zr.offset - part.start
+
+	if rest := part.size - pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	var (
+		n   int
+		err error
+	)
+	switch {
+	case part.entry == nil:
+		if za.centralDir == nil {
+			za.centralDir, err = za.buildCentralDir(part.start)
+		}
+		if err == nil {
+			n = copy(p, za.centralDir[pos:])
+		}
+	case part.header:
+		var header []byte
+		header, err = za.localHeader(part.entry)
+		if err == nil {
+			n = copy(p, header[pos:])
+		}
+	case part.entry.data != nil:
+		n = copy(p, part.entry.data[pos:])
+	default:
+		n, err = zr.readFile(part.entry.path, p, pos)
+	}
+
+	zr.offset += int64(n)
+	return n, err
+}
+
+func (zr *zipReader) readFile(path string, p []byte, pos int64) (int, error) {
+	if zr.file == nil || zr.fileName != path {
+		if zr.file != nil {
+			_ = zr.file.Close()
+			zr.file = nil
+		}
+
+		fh, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		zr.file, zr.fileName = fh, path
+	}
+
+	n, err := zr.file.ReadAt(p, pos)
+	if err == io.EOF {
+		if n < len(p) {
+			return n, errZipFileChanged
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (zr *zipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += zr.offset
+	case io.SeekEnd:
+		offset += zr.archive.size
+	default:
+		return 0, fmt.Errorf("unknown whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+
+	zr.offset = offset
+	return offset, nil
+}
+
+// Close frees the resources used by the reader.
+func (zr *zipReader) Close() error {
+	if zr.file == nil {
+		return nil
+	}
+	err := zr.file.Close()
+	zr.file = nil
+	return err
+}
+
+// checksumCache keeps the CRC-32 checksums of files so that they are not computed
+// every time a file is archived. A checksum is used only while the size and the
+// modification time of the file are the same.
+type checksumCache struct {
+	mu   sync.Mutex
+	sums map[string]fileChecksum
+}
+
+type fileChecksum struct {
+	size    int64
+	modTime time.Time
+	crc     uint32
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{
+		sums: make(map[string]fileChecksum),
+	}
+}
+
+// checksum returns the CRC-32 of the file at path. size and modTime are the ones
+// from the moment it was added to the archive.
+func (cc *checksumCache) checksum(path string, size int64, modTime time.Time) (uint32, error) {
+	cc.mu.Lock()
+	sum, ok := cc.sums[path]
+	cc.mu.Unlock()
+
+	if ok && sum.size == size && sum.modTime.Equal(modTime) {
+		return sum.crc, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, fh)
+	if err != nil {
+		return 0, err
+	}
+	if n != size {
+		return 0, errZipFileChanged
+	}
+
+	cc.mu.Lock()
+	cc.sums[path] = fileChecksum{
+		size:    size,
+		modTime: modTime,
+		crc:     hash.Sum32(),
+	}
+	cc.mu.Unlock()
+
+	return hash.Sum32(), nil
+}
+
+// zipBuffer is a helper for writing little-endian ZIP records.
+type zipBuffer []byte
+
+func (b *zipBuffer) uint16(v uint16) {
+	*b = binary.LittleEndian.AppendUint16(*b, v)
+}
+
+func (b *zipBuffer) uint32(v uint32) {
+	*b = binary.LittleEndian.AppendUint32(*b, v)
+}
+
+func (b *zipBuffer) uint64(v uint64) {
+	*b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+// timestampExtra returns the "extended timestamp" extra field with the
+// modification time in UTC. The MS-DOS time in the headers has no time zone.
+func timestampExtra(t time.Time) []byte {
+	var b zipBuffer
+	b.uint16(zipTimestampExtraID)
+	b.uint16(zipTimestampExtraLen - 4)
+	b = append(b, zipLocalTimestampFlag)
+	b.uint32(uint32(t.Unix()))
+	return b
+}
+
+// msDosTime returns the date and the time of t in MS-DOS format.
+func msDosTime(t time.Time) (date uint16, tm uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
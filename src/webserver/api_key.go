@@ -0,0 +1,55 @@
+package webserver
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// apiKeyHeader is the HTTP header in which clients send their API keys.
+	apiKeyHeader = "X-API-Key"
+
+	// apiKeyPrefixLen is how many characters from the start of an API key are
+	// stored in plain text. They help users recognize their keys.
+	apiKeyPrefixLen = 8
+)
+
+// APIKey is a named long-lived credential for programs and devices which cannot
+// go through the login process. Only a hash of the key is stored.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"user_id"`
+	Name       string     `json:"name"`
+	Hash       string     `gorm:"uniqueIndex" json:"-"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// findAPIKey returns the stored key and its user for the plain text key.
+func findAPIKey(db *gorm.DB, key string) (*APIKey, *User, error) {
+	var apiKey APIKey
+	if err := db.Where("hash = ?", hashToken(key)).First(&apiKey).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var user User
+	if err := db.First(&user, apiKey.UserID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &apiKey, &user, nil
+}
+
+// touch updates the last used time of the key. In order not to write to the
+// database on every request it is done at most once per lastUsedPrecision.
+func (k *APIKey) touch(db *gorm.DB) {
+	now := time.Now()
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < lastUsedPrecision {
+		return
+	}
+
+	k.LastUsedAt = &now
+	db.Model(k).Update("last_used_at", now)
+}
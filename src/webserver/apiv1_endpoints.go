@@ -4,29 +4,224 @@ import "net/http"
 
 // The following are URL Path endpoints for certain API calls.
 const (
-	APIv1EndpointFile           = "/v1/file/{fileID}"
-	APIv1EndpointFileCount      = "/v1/file/{fileID}/count"
-	APIv1EndpointAlbumArtwork   = "/v1/album/{albumID}/artwork"
-	APIv1EndpointDownloadAlbum  = "/v1/album/{albumID}"
-	APIv1EndpointArtistImage    = "/v1/artist/{artistID}/image"
-	APIv1EndpointBrowse         = "/v1/browse"
-	APIv1EndpointSearchWithPath = "/v1/search/{searchQuery}"
-	APIv1EndpointSearch         = "/v1/search/"
-	APIv1EndpointLoginToken     = "/v1/login/token/"
-	APIv1EndpointRegisterToken  = "/v1/register/token/"
+	APIv1EndpointFile            = "/v1/file/{fileID}"
+	APIv1EndpointFileCount       = "/v1/file/{fileID}/count"
+	APIv1EndpointFilePlayEvents  = "/v1/file/{fileID}/play-events"
+	APIv1EndpointFileHLSMaster   = "/v1/file/{fileID}/hls/master.m3u8"
+	APIv1EndpointFileHLSVariant  = "/v1/file/{fileID}/hls/{bitrate:[0-9]+}/index.m3u8"
+	APIv1EndpointFileHLSSegment  = "/v1/file/{fileID}/hls/{bitrate:[0-9]+}/{segment:[0-9]+}.ts"
+	APIv1EndpointAlbumArtwork    = "/v1/album/{albumID}/artwork"
+	APIv1EndpointDownloadAlbum   = "/v1/album/{albumID}"
+	APIv1EndpointArtistImage     = "/v1/artist/{artistID}/image"
+	APIv1EndpointBrowse          = "/v1/browse"
+	APIv1EndpointSearchWithPath  = "/v1/search/{searchQuery}"
+	APIv1EndpointSearch          = "/v1/search/"
+	APIv1EndpointLoginToken      = "/v1/login/token/"
+	APIv1EndpointRegisterToken   = "/v1/register/token/"
+	APIv1EndpointRefreshToken    = "/v1/refresh/token/"
+	APIv1EndpointSessions        = "/v1/sessions"
+	APIv1EndpointSession         = "/v1/sessions/{sessionID}"
+	APIv1EndpointInvites         = "/v1/invites"
+	APIv1EndpointInvite          = "/v1/invites/{inviteID}"
+	APIv1EndpointAccount         = "/v1/account"
+	APIv1EndpointAccountPassword = "/v1/account/password"
+	APIv1EndpointUsers           = "/v1/users"
+	APIv1EndpointUser            = "/v1/users/{userID}"
+	APIv1EndpointUserPassword    = "/v1/users/{userID}/password"
+	APIv1EndpointUserHistory     = "/v1/users/{userID}/history"
+	APIv1EndpointAPIKeys         = "/v1/api-keys"
+	APIv1EndpointAPIKey          = "/v1/api-keys/{keyID}"
+	APIv1EndpointFileSignedURL   = "/v1/file/{fileID}/signed-url"
+	APIv1EndpointAlbumSignedURL  = "/v1/album/{albumID}/signed-url"
+	APIv1EndpointLockouts        = "/v1/lockouts"
+	APIv1EndpointAuditLog        = "/v1/audit"
+	APIv1EndpointHistory         = "/v1/history"
+	APIv1EndpointHistoryContinue = "/v1/history/continue"
+	APIv1EndpointCharts          = "/v1/charts/{kind}"
+	APIv1EndpointYearInReview    = "/v1/stats/year-in-review"
+	APIv1EndpointScrobblers      = "/v1/account/scrobblers"
+	APIv1EndpointScrobbler       = "/v1/account/scrobblers/{service}"
+
+	APIv1EndpointAccountTOTP          = "/v1/account/totp"
+	APIv1EndpointAccountTOTPQRCode    = "/v1/account/totp/qr"
+	APIv1EndpointAccountRecoveryCodes = "/v1/account/totp/recovery-codes"
+
+	APIv1EndpointPasskeys           = "/v1/account/passkeys"
+	APIv1EndpointPasskeysFinish     = "/v1/account/passkeys/finish"
+	APIv1EndpointPasskey            = "/v1/account/passkeys/{passkeyID:[0-9]+}"
+	APIv1EndpointPasskeyLoginBegin  = "/v1/login/passkey/begin"
+	APIv1EndpointPasskeyLoginFinish = "/v1/login/passkey/finish"
+	APIv1EndpointOIDCLogin          = "/v1/login/oidc"
+	APIv1EndpointOIDCCallback       = "/v1/login/oidc/callback"
+
+	APIv1EndpointPairings      = "/v1/pairings"
+	APIv1EndpointPairing       = "/v1/pairings/{pairingID}"
+	APIv1EndpointPairingQRCode = "/v1/pairings/{pairingID}/qr"
+	APIv1EndpointPairClaim     = "/v1/pair/claim"
+	APIv1EndpointPairToken     = "/v1/pair/token"
 )
 
 // APIv1Methods defines on which HTTP methods APIv1 endpoints will respond to.
 // It is an uri_path => list of HTTP methods map.
 var APIv1Methods map[string][]string = map[string][]string{
-	APIv1EndpointFile:           {http.MethodGet},
-	APIv1EndpointFileCount:      {http.MethodGet},
-	APIv1EndpointAlbumArtwork:   {http.MethodGet, http.MethodPut, http.MethodDelete},
-	APIv1EndpointDownloadAlbum:  {http.MethodGet},
-	APIv1EndpointArtistImage:    {http.MethodGet, http.MethodPut, http.MethodDelete},
-	APIv1EndpointBrowse:         {http.MethodGet},
-	APIv1EndpointSearchWithPath: {http.MethodGet},
-	APIv1EndpointSearch:         {http.MethodGet},
-	APIv1EndpointLoginToken:     {http.MethodPost},
-	APIv1EndpointRegisterToken:  {http.MethodPost},
+	APIv1EndpointFile:            {http.MethodGet},
+	APIv1EndpointFileCount:       {http.MethodGet},
+	APIv1EndpointFilePlayEvents:  {http.MethodPost},
+	APIv1EndpointFileHLSMaster:   {http.MethodGet},
+	APIv1EndpointFileHLSVariant:  {http.MethodGet},
+	APIv1EndpointFileHLSSegment:  {http.MethodGet},
+	APIv1EndpointAlbumArtwork:    {http.MethodGet, http.MethodPut, http.MethodDelete},
+	APIv1EndpointDownloadAlbum:   {http.MethodGet},
+	APIv1EndpointArtistImage:     {http.MethodGet, http.MethodPut, http.MethodDelete},
+	APIv1EndpointBrowse:          {http.MethodGet},
+	APIv1EndpointSearchWithPath:  {http.MethodGet},
+	APIv1EndpointSearch:          {http.MethodGet},
+	APIv1EndpointLoginToken:      {http.MethodPost},
+	APIv1EndpointRegisterToken:   {http.MethodPost},
+	APIv1EndpointRefreshToken:    {http.MethodPost},
+	APIv1EndpointSessions:        {http.MethodGet, http.MethodDelete},
+	APIv1EndpointSession:         {http.MethodDelete},
+	APIv1EndpointInvites:         {http.MethodGet, http.MethodPost},
+	APIv1EndpointInvite:          {http.MethodDelete},
+	APIv1EndpointAccount:         {http.MethodGet, http.MethodDelete},
+	APIv1EndpointAccountPassword: {http.MethodPut},
+	APIv1EndpointUsers:           {http.MethodGet},
+	APIv1EndpointUser:            {http.MethodGet, http.MethodPatch, http.MethodDelete},
+	APIv1EndpointUserPassword:    {http.MethodPut},
+	APIv1EndpointUserHistory:     {http.MethodPost},
+	APIv1EndpointAPIKeys:         {http.MethodGet, http.MethodPost},
+	APIv1EndpointAPIKey:          {http.MethodDelete},
+	APIv1EndpointFileSignedURL:   {http.MethodGet},
+	APIv1EndpointAlbumSignedURL:  {http.MethodGet},
+	APIv1EndpointLockouts:        {http.MethodGet, http.MethodDelete},
+	APIv1EndpointAuditLog:        {http.MethodGet},
+	APIv1EndpointHistory:         {http.MethodGet},
+	APIv1EndpointHistoryContinue: {http.MethodGet},
+	APIv1EndpointCharts:          {http.MethodGet},
+	APIv1EndpointYearInReview:    {http.MethodGet},
+	APIv1EndpointScrobblers:      {http.MethodGet},
+	APIv1EndpointScrobbler:       {http.MethodPut, http.MethodDelete},
+	APIv1EndpointAccountTOTP: {
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodDelete,
+	},
+	APIv1EndpointAccountTOTPQRCode:    {http.MethodGet},
+	APIv1EndpointAccountRecoveryCodes: {http.MethodPost},
+	APIv1EndpointPasskeys:             {http.MethodGet, http.MethodPost},
+	APIv1EndpointPasskeysFinish:       {http.MethodPost},
+	APIv1EndpointPasskey:              {http.MethodDelete},
+	APIv1EndpointPasskeyLoginBegin:    {http.MethodPost},
+	APIv1EndpointPasskeyLoginFinish:   {http.MethodPost},
+	APIv1EndpointOIDCLogin:            {http.MethodGet},
+	APIv1EndpointOIDCCallback:         {http.MethodGet},
+	APIv1EndpointPairings:             {http.MethodPost},
+	APIv1EndpointPairing: {
+		http.MethodGet,
+		http.MethodPut,
+		http.MethodDelete,
+	},
+	APIv1EndpointPairingQRCode: {http.MethodGet},
+	APIv1EndpointPairClaim:     {http.MethodPost},
+	APIv1EndpointPairToken:     {http.MethodPost},
+}
+
+// APIv1Permissions defines the minimal role a user needs for calling the APIv1
+// endpoints. It is an uri_path => HTTP method => role map. It is consulted only
+// when authentication is turned on. Routes and methods missing from it require
+// RoleGuest for GET and HEAD requests and RoleAdmin for everything else.
+var APIv1Permissions map[string]map[string]Role = map[string]map[string]Role{
+	APIv1EndpointFile:           {http.MethodGet: RoleGuest},
+	APIv1EndpointFileCount:      {http.MethodGet: RoleGuest},
+	APIv1EndpointFilePlayEvents: {http.MethodPost: RoleListener},
+	APIv1EndpointFileHLSMaster:  {http.MethodGet: RoleGuest},
+	APIv1EndpointFileHLSVariant: {http.MethodGet: RoleGuest},
+	APIv1EndpointFileHLSSegment: {http.MethodGet: RoleGuest},
+	APIv1EndpointAlbumArtwork: {
+		http.MethodGet:    RoleGuest,
+		http.MethodPut:    RoleAdmin,
+		http.MethodDelete: RoleAdmin,
+	},
+	APIv1EndpointDownloadAlbum: {http.MethodGet: RoleGuest},
+	APIv1EndpointArtistImage: {
+		http.MethodGet:    RoleGuest,
+		http.MethodPut:    RoleAdmin,
+		http.MethodDelete: RoleAdmin,
+	},
+	APIv1EndpointBrowse:         {http.MethodGet: RoleGuest},
+	APIv1EndpointSearchWithPath: {http.MethodGet: RoleGuest},
+	APIv1EndpointSearch:         {http.MethodGet: RoleGuest},
+	APIv1EndpointLoginToken:     {http.MethodPost: RoleNone},
+	APIv1EndpointRegisterToken:  {http.MethodPost: RoleNone},
+	APIv1EndpointRefreshToken:   {http.MethodPost: RoleNone},
+	APIv1EndpointSessions: {
+		http.MethodGet:    RoleGuest,
+		http.MethodDelete: RoleGuest,
+	},
+	APIv1EndpointSession: {http.MethodDelete: RoleGuest},
+	APIv1EndpointInvites: {
+		http.MethodGet:  RoleAdmin,
+		http.MethodPost: RoleAdmin,
+	},
+	APIv1EndpointInvite: {http.MethodDelete: RoleAdmin},
+	APIv1EndpointAccount: {
+		http.MethodGet:    RoleGuest,
+		http.MethodDelete: RoleListener,
+	},
+	APIv1EndpointAccountPassword: {http.MethodPut: RoleListener},
+	APIv1EndpointUsers:           {http.MethodGet: RoleAdmin},
+	APIv1EndpointUser: {
+		http.MethodGet:    RoleAdmin,
+		http.MethodPatch:  RoleAdmin,
+		http.MethodDelete: RoleAdmin,
+	},
+	APIv1EndpointUserPassword: {http.MethodPut: RoleAdmin},
+	APIv1EndpointUserHistory:  {http.MethodPost: RoleAdmin},
+	APIv1EndpointAPIKeys: {
+		http.MethodGet:  RoleGuest,
+		http.MethodPost: RoleGuest,
+	},
+	APIv1EndpointAPIKey:         {http.MethodDelete: RoleGuest},
+	APIv1EndpointFileSignedURL:  {http.MethodGet: RoleGuest},
+	APIv1EndpointAlbumSignedURL: {http.MethodGet: RoleGuest},
+	APIv1EndpointLockouts: {
+		http.MethodGet:    RoleAdmin,
+		http.MethodDelete: RoleAdmin,
+	},
+	APIv1EndpointAuditLog:        {http.MethodGet: RoleAdmin},
+	APIv1EndpointHistory:         {http.MethodGet: RoleListener},
+	APIv1EndpointHistoryContinue: {http.MethodGet: RoleListener},
+	APIv1EndpointCharts:          {http.MethodGet: RoleGuest},
+	APIv1EndpointYearInReview:    {http.MethodGet: RoleListener},
+	APIv1EndpointScrobblers:      {http.MethodGet: RoleListener},
+	APIv1EndpointScrobbler: {
+		http.MethodPut:    RoleListener,
+		http.MethodDelete: RoleListener,
+	},
+	APIv1EndpointAccountTOTP: {
+		http.MethodPost:   RoleListener,
+		http.MethodPut:    RoleListener,
+		http.MethodDelete: RoleListener,
+	},
+	APIv1EndpointAccountTOTPQRCode:    {http.MethodGet: RoleListener},
+	APIv1EndpointAccountRecoveryCodes: {http.MethodPost: RoleListener},
+	APIv1EndpointPasskeys: {
+		http.MethodGet:  RoleGuest,
+		http.MethodPost: RoleGuest,
+	},
+	APIv1EndpointPasskeysFinish:     {http.MethodPost: RoleGuest},
+	APIv1EndpointPasskey:            {http.MethodDelete: RoleGuest},
+	APIv1EndpointPasskeyLoginBegin:  {http.MethodPost: RoleNone},
+	APIv1EndpointPasskeyLoginFinish: {http.MethodPost: RoleNone},
+	APIv1EndpointOIDCLogin:          {http.MethodGet: RoleNone},
+	APIv1EndpointOIDCCallback:       {http.MethodGet: RoleNone},
+	APIv1EndpointPairings:           {http.MethodPost: RoleGuest},
+	APIv1EndpointPairing: {
+		http.MethodGet:    RoleGuest,
+		http.MethodPut:    RoleGuest,
+		http.MethodDelete: RoleGuest,
+	},
+	APIv1EndpointPairingQRCode: {http.MethodGet: RoleGuest},
+	APIv1EndpointPairClaim:     {http.MethodPost: RoleNone},
+	APIv1EndpointPairToken:     {http.MethodPost: RoleNone},
 }
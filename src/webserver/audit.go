@@ -0,0 +1,213 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// The possible values of AuditEntry.Result.
+const (
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+)
+
+// auditActionAuthenticate is the action of the entries written when the AuthHandler
+// rejects the credentials of a request.
+const auditActionAuthenticate = "authenticate"
+
+// auditedReadRoutes are the GET routes which are written in the audit log. All
+// requests with other methods are written since they change something.
+var auditedReadRoutes = map[string]bool{
+	APIv1EndpointOIDCCallback: true,
+}
+
+// auditSkippedRoutes are routes which are never written in the audit log. They
+// are called very often and do not change anything which should be audited.
+var auditSkippedRoutes = map[string]bool{
+	APIv1EndpointFilePlayEvents: true,
+}
+
+// AuditEntry is a record in the audit log. Entries are only ever appended, the
+// server never changes or removes them.
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	// UserID is the user which made the request. For logins it is the user who
+	// has logged in. It is nil when the user is not known.
+	UserID *uint `gorm:"index" json:"user_id"`
+
+	// Username is the name the user had at the time of the request. For failed
+	// logins it is the username which has been tried.
+	Username  string `gorm:"index" json:"username"`
+	IPAddress string `gorm:"index" json:"ip_address"`
+
+	// Action is the HTTP method and the route, for example
+	// "PUT /v1/album/{albumID}/artwork".
+	Action string `gorm:"index" json:"action"`
+
+	// Target has the IDs from the route as URL query, for example "albumID=42".
+	Target string `json:"target"`
+	Result string `json:"result"`
+	Status int    `json:"status"`
+}
+
+type auditContextKey struct{}
+
+// auditRecord is collected while a request is handled and written as AuditEntry
+// once it is done.
+type auditRecord struct {
+	user     *User
+	username string
+	action   string
+	target   string
+	always   bool
+}
+
+// auditFromContext returns the record of the request. It returns nil when there
+// is no AuditHandler in the handlers chain.
+func auditFromContext(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	return rec
+}
+
+// auditUser sets the user who made the request. Handlers for endpoints which are
+// not authenticated, such as the login, call it once they know the user.
+func auditUser(req *http.Request, user *User) {
+	if rec := auditFromContext(req.Context()); rec != nil && user != nil {
+		rec.user = user
+		rec.username = user.Username
+	}
+}
+
+// auditUsername sets the username for requests which failed before the user was
+// found.
+func auditUsername(req *http.Request, username string) {
+	if rec := auditFromContext(req.Context()); rec != nil {
+		rec.username = username
+	}
+}
+
+// AuditHandler is a handler wrapper which writes the audit log. It must be before
+// the AuthHandler in the handlers chain so that rejected credentials are written
+// too. The actions are set by the middleware returned by NewAuditMiddleware.
+type AuditHandler struct {
+	wrapped http.Handler
+	db      *gorm.DB
+}
+
+// NewAuditHandler returns a new AuditHandler which writes in db.
+func NewAuditHandler(wrapped http.Handler, db *gorm.DB) *AuditHandler {
+	return &AuditHandler{
+		wrapped: wrapped,
+		db:      db,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (ah *AuditHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	rec := &auditRecord{}
+	sw := &statusWriter{ResponseWriter: writer, status: http.StatusOK}
+	ctx := context.WithValue(req.Context(), auditContextKey{}, rec)
+
+	ah.wrapped.ServeHTTP(sw, req.WithContext(ctx))
+
+	if rec.action == "" || !rec.always && !isMutating(req.Method) {
+		return
+	}
+
+	entry := AuditEntry{
+		Username:  rec.username,
+		IPAddress: remoteIP(req),
+		Action:    rec.action,
+		Target:    rec.target,
+		Result:    auditResultSuccess,
+		Status:    sw.status,
+	}
+	if rec.user != nil {
+		entry.UserID = &rec.user.ID
+	}
+	if sw.status >= http.StatusBadRequest {
+		entry.Result = auditResultFailure
+	}
+
+	if err := ah.db.Create(&entry).Error; err != nil {
+		log.Printf("Error writing audit log: %s\n", err)
+	}
+}
+
+// NewAuditMiddleware returns a mux.MiddlewareFunc which sets the action and the
+// target of the audit record from the matched route. It should be installed before
+// the authorization middleware so that requests denied by it are written too.
+func NewAuditMiddleware() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			tpl := routeTemplate(req)
+			if rec := auditFromContext(req.Context()); rec != nil && !auditSkippedRoutes[tpl] {
+				rec.action = req.Method + " " + tpl
+				rec.always = auditedReadRoutes[tpl]
+
+				target := url.Values{}
+				for name, value := range mux.Vars(req) {
+					target.Set(name, value)
+				}
+				rec.target = target.Encode()
+
+				if user := UserFromContext(req.Context()); user != nil {
+					rec.user = user
+					rec.username = user.Username
+				}
+			}
+
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// isMutating returns true for the HTTP methods which are not supposed to be safe.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+}
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.status = code
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush makes streaming responses work through the wrapper.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,33 @@
+package webserver
+
+import "context"
+
+type userContextKey struct{}
+
+type sessionContextKey struct{}
+
+// UserFromContext returns the authenticated user which made the request. The
+// context must be the one of the request. It returns nil when the request has
+// not been authenticated, for example when authentication is turned off in the
+// configuration or the endpoint does not require it.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey{}).(*User)
+	return user
+}
+
+// contextWithUser returns a copy of ctx which carries the authenticated user.
+func contextWithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// contextWithSession returns a copy of ctx which carries sess.
+func contextWithSession(ctx context.Context, sess *Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sess)
+}
+
+// sessionFromContext returns the session which was used for authenticating the
+// request. It returns nil when the request was not authenticated with a token.
+func sessionFromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return sess
+}
@@ -4,10 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
 )
 
 const (
@@ -43,19 +51,46 @@ func WithInternalError(fnc HandlerFuncWithError) http.HandlerFunc {
 
 // The following check is carefully orchestrated so that it will take constant
 // time for wrong and correct pairs of username and password. This mitigates
-// simple timing attacks.
-func checkLoginCreds(user, pass string, db *gorm.DB) bool {
+// simple timing attacks. On success the matched user is returned. Disabled users
+// are never matched.
+func checkLoginCreds(user, pass string, db *gorm.DB) (*User, bool) {
 	var userModel User
 	if err := db.Where("username = ?", user).First(&userModel).Error; err != nil {
-		return false
+		return nil, false
 	}
 
 	err := bcrypt.CompareHashAndPassword([]byte(userModel.Password), []byte(pass))
+	if err != nil || userModel.Disabled {
+		return nil, false
+	}
+
+	return &userModel, true
+}
+
+// routeTemplate returns the path template of the route which matched the request,
+// for example "/v1/file/{fileID}". It returns an empty string when there is no
+// matched route.
+func routeTemplate(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return ""
+	}
+
+	tpl, err := route.GetPathTemplate()
 	if err != nil {
-		return false
+		return ""
 	}
 
-	return true
+	return tpl
+}
+
+// remoteIP returns the IP address of the client which made the request.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
 
 func respondWithJSONError(
@@ -75,3 +110,95 @@ func respondWithJSONError(
 	w.WriteHeader(code)
 	_ = enc.Encode(resp)
 }
+
+// respondWithUnavailable writes a 503 response which tells the client to try
+// again after retryAfter.
+func respondWithUnavailable(w http.ResponseWriter, retryAfter time.Duration, text string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithJSONError(w, http.StatusServiceUnavailable, text)
+}
+
+// parsePagination returns the page and the number of items per page from the
+// "page" and "per-page" query arguments. Pages start from 1. perPage is never
+// more than maxPerPage.
+func parsePagination(query url.Values, defaultPerPage, maxPerPage int) (int, int, error) {
+	page, perPage := 1, defaultPerPage
+	for arg, dest := range map[string]*int{"page": &page, "per-page": &perPage} {
+		value := query.Get(arg)
+		if value == "" {
+			continue
+		}
+
+		num, err := strconv.Atoi(value)
+		if err != nil || num < 1 {
+			return 0, 0, fmt.Errorf(`"%s" must be an integer greater than zero`, arg)
+		}
+		*dest = num
+	}
+
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	return page, perPage, nil
+}
+
+// parseLimit returns the number of results from the "limit" query argument. It is
+// never more than maxLimit.
+func parseLimit(query url.Values, defaultLimit, maxLimit int) (int, error) {
+	limit := defaultLimit
+	if value := query.Get("limit"); value != "" {
+		num, err := strconv.Atoi(value)
+		if err != nil || num < 1 {
+			return 0, fmt.Errorf(`"limit" must be an integer greater than zero`)
+		}
+		limit = num
+	}
+
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	return limit, nil
+}
+
+// parseAudioFilter returns the filter of the tracks from the "lossless" and
+// "min-bitrate" query arguments.
+func parseAudioFilter(query url.Values) (library.AudioFilter, error) {
+	var filter library.AudioFilter
+
+	if value := query.Get("lossless"); value != "" {
+		lossless, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf(`"lossless" must be "true" or "false"`)
+		}
+		filter.Lossless = lossless
+	}
+
+	if value := query.Get("min-bitrate"); value != "" {
+		bitrate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || bitrate < 1 {
+			return filter, fmt.Errorf(`"min-bitrate" must be an integer greater than zero`)
+		}
+		filter.MinBitrate = bitrate
+	}
+
+	return filter, nil
+}
+
+// pageURI returns the URI of another page of the same query to endpoint. It
+// returns an empty string when the page does not exist.
+func pageURI(endpoint string, query url.Values, page int, exists bool) string {
+	if !exists {
+		return ""
+	}
+
+	pageQuery := url.Values{}
+	for arg, values := range query {
+		pageQuery[arg] = values
+	}
+	pageQuery.Set("page", strconv.Itoa(page))
+
+	return fmt.Sprintf("%s?%s", endpoint, pageQuery.Encode())
+}
@@ -0,0 +1,156 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	wrongPasswordText = "wrong password"
+)
+
+// AccountHandler lets users manage their own account. They could see it, change
+// their password and delete it.
+type AccountHandler struct {
+	db       *gorm.DB
+	history  library.History
+	secret   string
+	throttle *loginThrottle
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ah AccountHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ah.handleRequest)
+}
+
+func (ah AccountHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	switch {
+	case req.Method == http.MethodGet:
+		enc := json.NewEncoder(writer)
+		return enc.Encode(newUserJSON(user))
+	case req.Method == http.MethodDelete:
+		return ah.remove(writer, req, user)
+	case req.Method == http.MethodPut:
+		return ah.changePassword(writer, req, user)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// changePassword sets a new password for the user. All of its sessions and API keys
+// are revoked and a new session is created for the device which made the request.
+func (ah AccountHandler) changePassword(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Current string `json:"current_password"`
+		New     string `json:"new_password"`
+		Device  string `json:"device"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if !checkUserPassword(writer, req, ah.throttle, user, reqBody.Current) {
+		return nil
+	}
+
+	if reqBody.New == "" {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"The new password must not be empty.",
+		)
+		return nil
+	}
+
+	if err := setUserPassword(ah.db, user, reqBody.New); err != nil {
+		return err
+	}
+
+	sess, refreshToken, err := newSession(ah.db, user, req, reqBody.Device)
+	if err != nil {
+		return err
+	}
+
+	respondWithTokens(writer, user, sess, refreshToken, ah.secret)
+	return nil
+}
+
+// remove deletes the account. The password is required once again so that a stolen
+// token is not enough for doing it.
+func (ah AccountHandler) remove(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Password string `json:"password"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if !checkUserPassword(writer, req, ah.throttle, user, reqBody.Password) {
+		return nil
+	}
+
+	err := deleteUser(ah.db, ah.history, user)
+	if errors.Is(err, errLastAdmin) {
+		respondWithJSONError(writer, http.StatusConflict, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewAccountHandler returns a new AccountHandler. The secret is used for signing the
+// tokens issued after a password change. Wrong passwords are counted by throttle.
+func NewAccountHandler(
+	db *gorm.DB,
+	history library.History,
+	secret string,
+	throttle *loginThrottle,
+) *AccountHandler {
+	return &AccountHandler{
+		db:       db,
+		history:  history,
+		secret:   secret,
+		throttle: throttle,
+	}
+}
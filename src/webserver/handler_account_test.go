@@ -0,0 +1,68 @@
+package webserver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestAccountFirstPassword checks that users without a password, such as the ones
+// created with OpenID Connect, could set one without knowing a current one only
+// right after logging in with the provider while the others could not.
+func TestAccountFirstPassword(t *testing.T) {
+	db := newTestDB(t)
+
+	passwordLess := &User{Username: "oidc-user", Role: RoleListener}
+	if err := db.Create(passwordLess).Error; err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	local := createTestUser(t, db, "alice", RoleListener)
+
+	account := func(user *User, sess *Session) http.Handler {
+		router := newTestRouter(
+			NewAccountHandler(db, nil, testSecret, newLoginThrottle()),
+			user,
+			APIv1EndpointAccountPassword,
+		)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sess != nil {
+				r = r.WithContext(contextWithSession(r.Context(), sess))
+			}
+			router.ServeHTTP(w, r)
+		})
+	}
+
+	resp := doJSON(t, account(local, nil), http.MethodPut, APIv1EndpointAccountPassword, map[string]string{
+		"new_password": "new-password",
+	})
+	decodeJSON(t, resp, http.StatusForbidden, nil)
+
+	// A stolen token is not enough for taking over the account.
+	for _, sess := range []*Session{
+		nil,
+		{UserID: passwordLess.ID},
+		{UserID: passwordLess.ID, OIDCAuthAt: time.Now().Add(-time.Hour)},
+	} {
+		resp = doJSON(t, account(passwordLess, sess), http.MethodPut, APIv1EndpointAccountPassword, map[string]string{
+			"new_password": "first-password",
+		})
+		decodeJSON(t, resp, http.StatusForbidden, nil)
+	}
+
+	fresh := &Session{UserID: passwordLess.ID, OIDCAuthAt: time.Now()}
+	resp = doJSON(t, account(passwordLess, fresh), http.MethodPut, APIv1EndpointAccountPassword, map[string]string{
+		"new_password": "first-password",
+	})
+	decodeJSON(t, resp, http.StatusOK, nil)
+
+	user := findTestUser(t, db, "oidc-user")
+	if !user.hasPassword() {
+		t.Fatalf("expected the user to have a password")
+	}
+
+	// Once set, the password is required like for everyone else.
+	resp = doJSON(t, account(user, fresh), http.MethodPut, APIv1EndpointAccountPassword, map[string]string{
+		"new_password": "second-password",
+	})
+	decodeJSON(t, resp, http.StatusForbidden, nil)
+}
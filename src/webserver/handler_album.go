@@ -1,13 +1,18 @@
 package webserver
 
 import (
-	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -17,7 +22,9 @@ import (
 // AlbumHandler is a http.Handler which will find and serve a zip of the
 // album by the album ID.
 type AlbumHandler struct {
-	library library.Library
+	library   library.Library
+	artwork   library.ArtworkManager
+	checksums *checksumCache
 }
 
 // ServeHTTP is required by the http.Handler's interface
@@ -27,7 +34,8 @@ func (fh AlbumHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request)
 
 // Actually searches through the library for this album
 // Will serve it as zip file with name "[AlbumName].zip". The zip will contain
-// all the files for this album.
+// all the files for this album, its artwork and a playlist. The files are stored
+// without compression so that the size of the archive is known in advance.
 func (fh AlbumHandler) find(writer http.ResponseWriter, req *http.Request) error {
 
 	vars := mux.Vars(req)
@@ -59,70 +67,221 @@ func (fh AlbumHandler) find(writer http.ResponseWriter, req *http.Request) error
 		return nil
 	}
 
+	entries, err := fh.trackEntries(albumFiles)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var modTime time.Time
+	for _, entry := range entries {
+		if entry.modTime.After(modTime) {
+			modTime = entry.modTime
+		}
+	}
+
+	if artwork := fh.artworkEntry(req.Context(), int64(id), modTime); artwork != nil {
+		entries = append(entries, artwork)
+	}
+	entries = append(entries, playlistEntry(albumFiles, entries, modTime))
+
+	archive := newZipArchive(entries, fh.checksums)
+	reader := archive.Open()
+	defer reader.Close()
+
 	writer.Header().Add("Content-Disposition",
 		fmt.Sprintf(`filename="%s.zip"`, albumFiles[0].Album))
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("ETag", archiveETag(entries))
 
-	var files []string
+	// ServeContent takes care of Range and If-Range requests. Since the size
+	// of the archive is known in advance the clients can show the progress
+	// of the download and resume it when it is interrupted.
+	http.ServeContent(writer, req, "", modTime, reader)
+	return nil
+}
 
-	for _, track := range albumFiles {
-		files = append(files, fh.library.GetFilePath(track.ID))
-	}
+// trackEntries returns the archive entries for the album's tracks. They are named
+// "NN - Title.ext" after the track number and the title. When the album has more
+// than one disc the names start with the disc number, "D-NN - Title.ext", since
+// every disc has its own track numbers.
+func (fh AlbumHandler) trackEntries(tracks []library.SearchResult) ([]*zipEntry, error) {
+	var (
+		entries   []*zipEntry
+		names     = make(map[string]struct{})
+		multiDisc = hasManyDiscs(tracks)
+	)
 
-	written, err := fh.writeZipContents(writer, files)
-	if err != nil && written == 0 {
-		// Return the error only in case there have been no bytes written in
-		// the response. Only then will the server be able to respond with
-		// any other status code. In case we're written some bytes and there
-		// are errors clients are left to fend on their own.
-		//
-		//!IDEA: maybe define a Trailer header which says "request went OK" for
-		// generated ZIP files. Since clients have no way of knowing the ZIP's
-		// Content-Length at the beginning of the download this might be a good
-		// way to signal to them the error.
-		return err
+	for _, track := range tracks {
+		filePath := fh.library.GetFilePath(track.ID)
+		st, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		title := sanitizeFileName(track.Title)
+		if title == "" {
+			title = sanitizeFileName(
+				strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath)),
+			)
+		}
+		switch {
+		case multiDisc && track.Disc > 0 && track.TrackNumber > 0:
+			title = fmt.Sprintf("%d-%02d - %s", track.Disc, track.TrackNumber, title)
+		case multiDisc && track.Disc > 0:
+			title = fmt.Sprintf("%d - %s", track.Disc, title)
+		case track.TrackNumber > 0:
+			title = fmt.Sprintf("%02d - %s", track.TrackNumber, title)
+		}
+
+		entries = append(entries, &zipEntry{
+			name:    uniqueFileName(names, title, filepath.Ext(filePath)),
+			modTime: st.ModTime(),
+			size:    st.Size(),
+			path:    filePath,
+		})
 	}
 
-	return nil
+	return entries, nil
 }
 
-// Zips all files in `files` and writes the output in the `writer`. The name of
-// every file is its filepath.Base.
-func (fh AlbumHandler) writeZipContents(writer io.Writer, files []string) (int64, error) {
+// artworkEntry returns an archive entry for the album artwork or nil when the
+// album has none.
+func (fh AlbumHandler) artworkEntry(
+	ctx context.Context,
+	albumID int64,
+	modTime time.Time,
+) *zipEntry {
+	if fh.artwork == nil {
+		return nil
+	}
+
+	r, err := fh.artwork.FindAndSaveAlbumArtwork(ctx, albumID, library.OriginalImage)
+	if errors.Is(err, library.ErrArtworkNotFound) || errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		log.Printf("Error finding artwork for album %d: %s\n", albumID, err)
+		return nil
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("Error reading artwork for album %d: %s\n", albumID, err)
+		return nil
+	}
+
+	ext := ".jpg"
+	if http.DetectContentType(data) == "image/png" {
+		ext = ".png"
+	}
 
-	var written int64
-	zipWriter := zip.NewWriter(writer)
+	return &zipEntry{
+		name:    "cover" + ext,
+		modTime: modTime,
+		size:    int64(len(data)),
+		data:    data,
+	}
+}
 
-	for _, file := range files {
-		fh, err := os.Open(file)
+// playlistEntry returns an archive entry with an extended M3U playlist of the
+// tracks. It refers to the entries in the same directory.
+func playlistEntry(
+	tracks []library.SearchResult,
+	entries []*zipEntry,
+	modTime time.Time,
+) *zipEntry {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
 
-		if err != nil {
-			_ = zipWriter.Close()
-			return written, err
+	for i, track := range tracks {
+		seconds := -1
+		if track.Duration > 0 {
+			seconds = int((time.Duration(track.Duration) * time.Millisecond).Seconds())
 		}
 
-		defer fh.Close()
+		fmt.Fprintf(
+			&playlist,
+			"#EXTINF:%d,%s - %s\n%s\n",
+			seconds,
+			track.Artist,
+			track.Title,
+			entries[i].name,
+		)
+	}
 
-		zfh, err := zipWriter.Create(filepath.Base(file))
-		if err != nil {
-			_ = zipWriter.Close()
-			return written, err
+	name := sanitizeFileName(tracks[0].Album)
+	if name == "" {
+		name = "playlist"
+	}
+
+	return &zipEntry{
+		name:    name + ".m3u8",
+		modTime: modTime,
+		size:    int64(playlist.Len()),
+		data:    []byte(playlist.String()),
+	}
+}
+
+// archiveETag returns a strong ETag for an archive with these entries. It changes
+// whenever any of the files in the archive changes.
+func archiveETag(entries []*zipEntry) string {
+	hash := fnv.New64a()
+	for _, entry := range entries {
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", entry.name, entry.size,
+			entry.modTime.UnixNano())
+		if entry.data != nil {
+			_, _ = hash.Write(entry.data)
 		}
+	}
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
 
-		n, err := io.Copy(zfh, fh)
-		if err != nil {
-			_ = zipWriter.Close()
-			return written, err
+// sanitizeFileName replaces the characters which are not allowed in file names on
+// the popular file systems.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
 		}
+		return r
+	}, name)
+	return strings.Trim(name, " .")
+}
 
-		written += n
+// uniqueFileName returns name+ext or, when it is already in names, a name with a
+// number in brackets appended. The result is added in names.
+func uniqueFileName(names map[string]struct{}, name, ext string) string {
+	candidate := name + ext
+	for i := 2; ; i++ {
+		if _, ok := names[strings.ToLower(candidate)]; !ok {
+			break
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", name, i, ext)
 	}
 
-	return written, zipWriter.Close()
+	names[strings.ToLower(candidate)] = struct{}{}
+	return candidate
+}
+
+// hasManyDiscs returns true when the tracks are on more than one disc.
+func hasManyDiscs(tracks []library.SearchResult) bool {
+	for _, track := range tracks {
+		if track.DiscTotal > 1 || track.Disc != tracks[0].Disc {
+			return true
+		}
+	}
+	return false
 }
 
 // NewAlbumHandler returns a new Album handler. It needs a library to search in
-func NewAlbumHandler(lib library.Library) *AlbumHandler {
+// and an artwork manager for the album artwork which is added to the archives.
+func NewAlbumHandler(lib library.Library, am library.ArtworkManager) *AlbumHandler {
 	fh := new(AlbumHandler)
 	fh.library = lib
+	fh.artwork = am
+	fh.checksums = newChecksumCache()
 	return fh
 }
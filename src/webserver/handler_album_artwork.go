@@ -87,10 +87,16 @@ func (aah AlbumArtworkHandler) find(
 
 	defer imgReader.Close()
 
-	writer.Header().Set("Cache-Control", "max-age=604800")
-	_, err = io.Copy(writer, imgReader)
-
+	img, err := io.ReadAll(imgReader)
 	if err != nil {
+		return fmt.Errorf("reading artwork: %w", err)
+	}
+
+	if checkNotModified(writer, req, cacheControlImages, contentETag(img), time.Time{}) {
+		return nil
+	}
+
+	if _, err := writer.Write(img); err != nil {
 		log.Printf("еrror sending HTTP data for artwork %d: %s", id, err)
 	}
 
@@ -0,0 +1,76 @@
+package webserver
+
+import (
+	"testing"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+// TestAlbumTrackEntryNames checks that the tracks of multi-disc albums do not get
+// the same names in the archive.
+func TestAlbumTrackEntryNames(t *testing.T) {
+	track := func(title string, disc, discTotal, number int64) library.SearchResult {
+		result := library.SearchResult{Title: title, TrackNumber: number}
+		result.Disc = disc
+		result.DiscTotal = discTotal
+		return result
+	}
+
+	tests := []struct {
+		desc     string
+		tracks   []library.SearchResult
+		expected []string
+	}{
+		{
+			desc: "single disc",
+			tracks: []library.SearchResult{
+				track("Intro", 1, 1, 1),
+				track("Outro", 1, 1, 2),
+			},
+			expected: []string{"01 - Intro.flac", "02 - Outro.flac"},
+		},
+		{
+			desc: "unknown disc",
+			tracks: []library.SearchResult{
+				track("Intro", 0, 0, 1),
+				track("Untitled", 0, 0, 0),
+			},
+			expected: []string{"01 - Intro.flac", "Untitled.flac"},
+		},
+		{
+			desc: "many discs",
+			tracks: []library.SearchResult{
+				track("Intro", 1, 0, 1),
+				track("Intro", 2, 0, 1),
+				track("Untitled", 2, 0, 0),
+			},
+			expected: []string{"1-01 - Intro.flac", "2-01 - Intro.flac", "2 - Untitled.flac"},
+		},
+		{
+			desc: "one disc of many",
+			tracks: []library.SearchResult{
+				track("Intro", 2, 2, 1),
+			},
+			expected: []string{"2-01 - Intro.flac"},
+		},
+	}
+
+	fh := NewAlbumHandler(&stubLibrary{filePath: createTestMediaFile(t)}, nil)
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			entries, err := fh.trackEntries(test.tracks)
+			if err != nil {
+				t.Fatalf("creating entries: %s", err)
+			}
+
+			if len(entries) != len(test.expected) {
+				t.Fatalf("expected %d entries but got %d", len(test.expected), len(entries))
+			}
+			for i, entry := range entries {
+				if entry.name != test.expected[i] {
+					t.Errorf("expected entry %q but got %q", test.expected[i], entry.name)
+				}
+			}
+		})
+	}
+}
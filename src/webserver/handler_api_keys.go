@@ -0,0 +1,164 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// APIKeysHandler lets users create, list and revoke their API keys.
+type APIKeysHandler struct {
+	db *gorm.DB
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (kh APIKeysHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, kh.handleRequest)
+}
+
+func (kh APIKeysHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	idString, ok := mux.Vars(req)["keyID"]
+
+	switch {
+	case req.Method == http.MethodGet && !ok:
+		return kh.list(writer, req, user)
+	case req.Method == http.MethodPost && !ok:
+		return kh.create(writer, req, user)
+	case req.Method == http.MethodDelete && ok:
+		return kh.revoke(writer, user, idString)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// list writes the keys of the user. Administrators may see the keys of all users
+// with the "all=true" query argument.
+func (kh APIKeysHandler) list(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	query := kh.db.Order("id")
+	if req.URL.Query().Get("all") != "true" || user.Role != RoleAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	keys := []APIKey{}
+	if err := query.Find(&keys).Error; err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(keys)
+}
+
+// create generates a new key. The key is present in the response only this once
+// since only its hash is stored.
+func (kh APIKeysHandler) create(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Name string `json:"name"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	reqBody.Name = strings.TrimSpace(reqBody.Name)
+	if reqBody.Name == "" {
+		respondWithJSONError(writer, http.StatusBadRequest, "The key name is required.")
+		return nil
+	}
+
+	key, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	apiKey := APIKey{
+		UserID: user.ID,
+		Name:   reqBody.Name,
+		Hash:   hashToken(key),
+		Prefix: key[:apiKeyPrefixLen],
+	}
+
+	if err := kh.db.Create(&apiKey).Error; err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+// revoke deletes a key. Administrators may revoke the keys of every user.
+func (kh APIKeysHandler) revoke(
+	writer http.ResponseWriter,
+	user *User,
+	idString string,
+) error {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing keyID: %s",
+			err,
+		)
+		return nil
+	}
+
+	query := kh.db.Where("id = ?", id)
+	if user.Role != RoleAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	res := query.Delete(&APIKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		respondWithJSONError(writer, http.StatusNotFound, "API key not found")
+		return nil
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewAPIKeysHandler returns a new APIKeysHandler which stores keys in db.
+func NewAPIKeysHandler(db *gorm.DB) *APIKeysHandler {
+	return &APIKeysHandler{
+		db: db,
+	}
+}
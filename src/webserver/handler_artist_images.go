@@ -85,10 +85,16 @@ func (aih ArtstImageHandler) find(
 
 	defer imgReader.Close()
 
-	writer.Header().Set("Cache-Control", "max-age=604800")
-	_, err = io.Copy(writer, imgReader)
-
+	img, err := io.ReadAll(imgReader)
 	if err != nil {
+		return fmt.Errorf("reading image: %w", err)
+	}
+
+	if checkNotModified(writer, req, cacheControlImages, contentETag(img), time.Time{}) {
+		return nil
+	}
+
+	if _, err := writer.Write(img); err != nil {
 		log.Printf("еrror sending HTTP data for artwork %d: %s", id, err)
 	}
 
@@ -0,0 +1,125 @@
+package webserver
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	auditDefaultPerPage = 50
+	auditMaxPerPage     = 500
+)
+
+// AuditLogHandler lets admins query the audit log.
+type AuditLogHandler struct {
+	db *gorm.DB
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ah AuditLogHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ah.handleRequest)
+}
+
+// handleRequest returns the entries matching the filters in the query, newest
+// first. All filters are optional:
+//
+//   - user-id and username
+//   - action, for example "DELETE /v1/users/{userID}"
+//   - ip
+//   - result, "success" or "failure"
+//   - since and until, RFC 3339 times
+//
+// The results are paginated with "page" and "per-page".
+func (ah AuditLogHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	query := req.URL.Query()
+	tx := ah.db.Model(&AuditEntry{})
+
+	if userID := query.Get("user-id"); userID != "" {
+		id, err := strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			respondWithJSONError(writer, http.StatusBadRequest, `Wrong "user-id": %s`, err)
+			return nil
+		}
+		tx = tx.Where("user_id = ?", id)
+	}
+
+	filters := []struct{ arg, column string }{
+		{"username", "username"},
+		{"action", "action"},
+		{"ip", "ip_address"},
+		{"result", "result"},
+	}
+	for _, filter := range filters {
+		if value := query.Get(filter.arg); value != "" {
+			tx = tx.Where(filter.column+" = ?", value)
+		}
+	}
+
+	for _, arg := range []string{"since", "until"} {
+		value := query.Get(arg)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondWithJSONError(writer, http.StatusBadRequest, `Wrong "%s": %s`, arg, err)
+			return nil
+		}
+
+		if arg == "since" {
+			tx = tx.Where("created_at >= ?", t)
+		} else {
+			tx = tx.Where("created_at < ?", t)
+		}
+	}
+
+	page, perPage, err := parsePagination(query, auditDefaultPerPage, auditMaxPerPage)
+	if err != nil {
+		respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	var count int64
+	if err := tx.Count(&count).Error; err != nil {
+		return err
+	}
+
+	entries := []AuditEntry{}
+	err = tx.Order("id DESC").
+		Offset((page - 1) * perPage).
+		Limit(perPage).
+		Find(&entries).Error
+	if err != nil {
+		return err
+	}
+
+	hasNext := page*perPage < int(count)
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		Data       []AuditEntry `json:"data"`
+		Next       string       `json:"next"`
+		Previous   string       `json:"previous"`
+		PagesCount int          `json:"pages_count"`
+	}{
+		Data:       entries,
+		Next:       pageURI(APIv1EndpointAuditLog, query, page+1, hasNext),
+		Previous:   pageURI(APIv1EndpointAuditLog, query, page-1, page > 1),
+		PagesCount: int(math.Ceil(float64(count) / float64(perPage))),
+	})
+}
+
+// NewAuditLogHandler returns a new AuditLogHandler which reads the log from db.
+func NewAuditLogHandler(db *gorm.DB) *AuditLogHandler {
+	return &AuditLogHandler{
+		db: db,
+	}
+}
@@ -2,7 +2,9 @@ package webserver
 
 import (
 	"encoding/base64"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,24 +14,41 @@ import (
 
 const (
 	authRequiredJSON = `{"error": "authentication required"}`
+	authRequiredText = "authentication required"
+
+	// lastUsedPrecision is how often the "last used" time of sessions is updated.
+	lastUsedPrecision = time.Minute
 )
 
+// errAuthRequired is returned when a request could not be authenticated.
+var errAuthRequired = errors.New(authRequiredText)
+
+// authError converts the result of an authentication method to an error.
+func authError(ok bool) error {
+	if !ok {
+		return errAuthRequired
+	}
+	return nil
+}
+
 // AuthHandler is a handler wrapper used for authentication. Its only job is
 // to do the authentication and then pass the work to the Handler it wraps around.
 // Possible methods for authentication:
 //
 //   - Basic Auth with the username and password
 //   - Authorization Bearer JWT token
-//   - JWT token in a session cookie
-//   - JWT token as a query string
+//   - API key in the X-API-Key header
+//   - JWT token in the session cookie set by the login endpoint
+//   - Signed URL, only for the endpoints in signedURLRoutes
 //
 // Basic auth is preserved for backward compatibility. Needless to say, it so not
 // a preferred method for authentication.
 type AuthHandler struct {
 	wrapped    http.Handler // The actual handler that does the APP Logic job
 	db         *gorm.DB
-	secret     string   // Secret used to craft and decode tokens
-	exceptions []string // Paths which will be exempt from authentication
+	secret     string         // Secret used to craft and decode tokens
+	exceptions []string       // Paths which will be exempt from authentication
+	throttle   *loginThrottle // Counts failed Basic auth attempts
 }
 
 // NewAuthHandler returns a new AuthHandler.
@@ -38,72 +57,213 @@ func NewAuthHandler(
 	secret string,
 	db *gorm.DB,
 	exceptions []string,
+	throttle *loginThrottle,
 ) *AuthHandler {
 	return &AuthHandler{
 		wrapped:    wrapped,
 		secret:     secret,
 		db:         db,
 		exceptions: exceptions,
+		throttle:   throttle,
 	}
 }
 
 // ServeHTTP implements the http.Handler interface and does the actual basic authenticate
-// check for every request
+// check for every request. The authenticated user is stored in the request context
+// and could be retrieved with UserFromContext.
 func (hl *AuthHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	if !hl.authenticated(req) {
+	user, sess, err := hl.authenticated(req)
+	if err != nil {
+		auditRejected(req)
+	}
+
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		respondWithTooManyAttempts(writer, throttled.retryAfter)
+		return
+	}
+	if err != nil {
 		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 		writer.WriteHeader(http.StatusUnauthorized)
 		_, _ = writer.Write([]byte(authRequiredJSON))
 		return
 	}
 
-	hl.wrapped.ServeHTTP(writer, req)
+	ctx := req.Context()
+	if user != nil {
+		ctx = contextWithUser(ctx, user)
+	}
+	if sess != nil {
+		ctx = contextWithSession(ctx, sess)
+	}
+
+	hl.wrapped.ServeHTTP(writer, req.WithContext(ctx))
+}
+
+// auditRejected writes the request in the audit log when it had credentials which
+// were not accepted. Requests without any credentials are not written.
+func auditRejected(req *http.Request) {
+	rec := auditFromContext(req.Context())
+	if rec == nil {
+		return
+	}
+
+	_, cookieErr := req.Cookie(sessionCookieName)
+	if req.Header.Get(apiKeyHeader) == "" &&
+		req.Header.Get("Authorization") == "" &&
+		cookieErr != nil &&
+		!req.URL.Query().Has(signedURLSignatureArg) {
+		return
+	}
+
+	rec.action = auditActionAuthenticate
+	rec.always = true
+	if username, _, ok := req.BasicAuth(); ok {
+		rec.username = username
+	}
 }
 
 // Compares the authentication header with the stored user and passwords
-// and returns true if they pass.
-func (hl *AuthHandler) authenticated(r *http.Request) bool {
+// and returns nil if they pass. The authenticated user is returned too. When a
+// token has been used for authentication its session is returned as well. When
+// Basic auth was refused because of too many failed attempts the error is a
+// *throttledError.
+//
+// Requests for exempt paths are not authenticated and no user is returned for
+// them.
+func (hl *AuthHandler) authenticated(r *http.Request) (*User, *Session, error) {
 	for _, path := range hl.exceptions {
 		if strings.HasPrefix(r.URL.Path, path) {
-			return true
+			return nil, nil, nil
 		}
 	}
 
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		user, ok := hl.withAPIKey(key)
+		return user, nil, authError(ok)
+	}
+
 	authHeader := r.Header.Get("Authorization")
 
 	if strings.HasPrefix(authHeader, "Bearer ") {
-		return hl.withJWT(strings.TrimPrefix(authHeader, "Bearer "))
+		user, sess, ok := hl.withJWT(strings.TrimPrefix(authHeader, "Bearer "))
+		return user, sess, authError(ok)
 	}
 
 	if strings.HasPrefix(authHeader, "Basic ") {
-		return hl.withBasicAuth(strings.TrimPrefix(authHeader, "Basic "))
+		user, err := hl.withBasicAuth(r, strings.TrimPrefix(authHeader, "Basic "))
+		return user, nil, err
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		user, sess, ok := hl.withJWT(cookie.Value)
+		return user, sess, authError(ok)
 	}
 
-	return false
+	if r.URL.Query().Has(signedURLSignatureArg) {
+		user, ok := hl.withSignedURL(r)
+		return user, nil, authError(ok)
+	}
+
+	return nil, nil, errAuthRequired
 }
 
-func (hl *AuthHandler) withBasicAuth(encoded string) bool {
+// withSignedURL accepts requests for signed URLs. The user for which the URL was
+// signed is returned when there is one. URLs signed for users who have since been
+// removed or disabled are rejected.
+func (hl *AuthHandler) withSignedURL(r *http.Request) (*User, bool) {
+	userID, ok := verifySignedURL(r, hl.secret)
+	if !ok {
+		return nil, false
+	}
+
+	if userID == 0 {
+		return nil, true
+	}
+
+	var user User
+	if err := hl.db.First(&user, userID).Error; err != nil || user.Disabled {
+		return nil, false
+	}
+
+	return &user, true
+}
+
+func (hl *AuthHandler) withBasicAuth(r *http.Request, encoded string) (*User, error) {
 	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
 	if err != nil {
-		return false
+		return nil, errAuthRequired
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 
 	if len(pair) != 2 {
-		return false
+		return nil, errAuthRequired
+	}
+
+	user, wait, ok := hl.throttle.checkLoginCreds(r, pair[0], pair[1], hl.db)
+	if wait > 0 {
+		return nil, &throttledError{retryAfter: wait}
 	}
 
-	return checkLoginCreds(pair[0], pair[1], hl.db)
+	// Basic auth has no way for sending a second factor. Users with two-factor
+	// authentication should use tokens or API keys instead.
+	if !ok || user.TOTPEnabled {
+		return nil, errAuthRequired
+	}
+
+	hl.throttle.succeeded(user.Username)
+	return user, nil
 }
 
-func (hl *AuthHandler) withJWT(token string) bool {
-	var jot jwt.Payload
+func (hl *AuthHandler) withAPIKey(key string) (*User, bool) {
+	apiKey, user, err := findAPIKey(hl.db, key)
+	if err != nil || user.Disabled {
+		return nil, false
+	}
+
+	apiKey.touch(hl.db)
+	return user, true
+}
+
+// withJWT checks the token signature and expiration and then makes sure the session
+// it was issued for has not been revoked or refreshed since.
+func (hl *AuthHandler) withJWT(token string) (*User, *Session, bool) {
+	var jot tokenPayload
 
 	alg := jwt.NewHS256([]byte(hl.secret))
-	exp := jwt.ExpirationTimeValidator(time.Now())
-	validatePayload := jwt.ValidatePayload(&jot, exp)
+	now := time.Now()
+	exp := jwt.ExpirationTimeValidator(now)
+	validatePayload := jwt.ValidatePayload(&jot.Payload, exp)
 
 	_, err := jwt.Verify([]byte(token), alg, &jot, validatePayload)
-	return err == nil
+	if err != nil || jot.JWTID == "" {
+		return nil, nil, false
+	}
+
+	var sess Session
+	err = hl.db.Where("token_id = ? AND expires_at > ?", jot.JWTID, now).
+		First(&sess).Error
+	if err != nil {
+		return nil, nil, false
+	}
+
+	if jot.Subject != strconv.FormatUint(uint64(sess.UserID), 10) {
+		return nil, nil, false
+	}
+
+	var user User
+	if err := hl.db.First(&user, sess.UserID).Error; err != nil || user.Disabled {
+		return nil, nil, false
+	}
+
+	// Do not write to the database on every request. Knowing when a device
+	// was last seen with a minute of precision is good enough.
+	if now.Sub(sess.LastUsedAt) > lastUsedPrecision {
+		sess.LastUsedAt = now
+		hl.db.Model(&sess).Update("last_used_at", now)
+	}
+
+	return &user, &sess, true
 }
@@ -0,0 +1,73 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	permissionDeniedJSON = `{"error": "permission denied"}`
+)
+
+// AuthorizationHandler is a handler wrapper which makes sure the authenticated user
+// has a role which allows calling the matched route. It must be installed as a
+// router middleware since it uses the matched route's path template for finding the
+// required role. The AuthHandler must be somewhere before it in the handlers chain
+// so that the user is present in the request context.
+type AuthorizationHandler struct {
+	wrapped     http.Handler
+	permissions map[string]map[string]Role
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (ah *AuthorizationHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	required := ah.requiredRole(req)
+	if required == RoleNone {
+		ah.wrapped.ServeHTTP(writer, req)
+		return
+	}
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusUnauthorized)
+		_, _ = writer.Write([]byte(authRequiredJSON))
+		return
+	}
+
+	if !user.Role.Allows(required) {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusForbidden)
+		_, _ = writer.Write([]byte(permissionDeniedJSON))
+		return
+	}
+
+	ah.wrapped.ServeHTTP(writer, req)
+}
+
+// requiredRole returns the minimal role needed for the request. Routes which are
+// not in the permissions table are readable by everyone and writable only by admins.
+func (ah *AuthorizationHandler) requiredRole(req *http.Request) Role {
+	if role, ok := ah.permissions[routeTemplate(req)][req.Method]; ok {
+		return role
+	}
+
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return RoleGuest
+	}
+
+	return RoleAdmin
+}
+
+// NewAuthorizationMiddleware returns a mux.MiddlewareFunc which wraps every route
+// handler in an AuthorizationHandler. permissions is a uri_path => HTTP method => role
+// map such as APIv1Permissions.
+func NewAuthorizationMiddleware(permissions map[string]map[string]Role) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return &AuthorizationHandler{
+			wrapped:     h,
+			permissions: permissions,
+		}
+	}
+}
@@ -79,20 +79,33 @@ func (bh BrowseHandler) browse(writer http.ResponseWriter, req *http.Request) er
 		return nil
 	}
 
+	filter, err := parseAudioFilter(req.Form)
+	if err != nil {
+		bh.badRequest(writer, err.Error())
+		return nil
+	}
+
+	version, modified := bh.browser.Version()
+	if checkNotModified(writer, req, cacheControlBrowse, libraryETag(version), modified) {
+		return nil
+	}
+
 	if browseBy == "artist" {
-		return bh.browseArtists(writer, page, perPage, orderBy, order)
+		return bh.browseArtists(writer, page, perPage, orderBy, order, filter)
 	}
 
-	return bh.browseAlbums(writer, page, perPage, orderBy, order)
+	return bh.browseAlbums(writer, page, perPage, orderBy, order, filter)
 }
 
 func (bh BrowseHandler) browseAlbums(
 	writer http.ResponseWriter,
 	page, perPage int,
 	orderBy, order string,
+	filter library.AudioFilter,
 ) error {
 
 	browseArgs := getBrowseArgs(page, perPage, orderBy, order)
+	browseArgs.Filter = filter
 	albums, count := bh.browser.BrowseAlbums(browseArgs)
 	prevPage, nextPage := getPrevNextPageURI(
 		"album",
@@ -101,6 +114,7 @@ func (bh BrowseHandler) browseAlbums(
 		count,
 		orderBy,
 		order,
+		filter,
 	)
 
 	retData := struct {
@@ -123,9 +137,11 @@ func (bh BrowseHandler) browseArtists(
 	writer http.ResponseWriter,
 	page, perPage int,
 	orderBy, order string,
+	filter library.AudioFilter,
 ) error {
 
 	browseArgs := getBrowseArgs(page, perPage, orderBy, order)
+	browseArgs.Filter = filter
 	artists, count := bh.browser.BrowseArtists(browseArgs)
 	prevPage, nextPage := getPrevNextPageURI(
 		"artist",
@@ -134,6 +150,7 @@ func (bh BrowseHandler) browseArtists(
 		count,
 		orderBy,
 		order,
+		filter,
 	)
 
 	retData := struct {
@@ -194,6 +211,7 @@ func getPrevNextPageURI(
 	page, perPage, count int,
 	orderBy,
 	order string,
+	filter library.AudioFilter,
 ) (string, string) {
 	orderArg := ""
 	orderByArg := ""
@@ -206,16 +224,27 @@ func getPrevNextPageURI(
 		orderByArg = fmt.Sprintf("&order-by=%s", orderBy)
 	}
 
+	filterArg := ""
+
+	if filter.Lossless {
+		filterArg += "&lossless=true"
+	}
+
+	if filter.MinBitrate > 0 {
+		filterArg += fmt.Sprintf("&min-bitrate=%d", filter.MinBitrate)
+	}
+
 	prevPage := ""
 
 	if page-1 > 0 {
 		prevPage = fmt.Sprintf(
-			"/v1/browse?by=%s&page=%d&per-page=%d%s%s",
+			"/v1/browse?by=%s&page=%d&per-page=%d%s%s%s",
 			by,
 			page-1,
 			perPage,
 			orderArg,
 			orderByArg,
+			filterArg,
 		)
 	}
 
@@ -223,12 +252,13 @@ func getPrevNextPageURI(
 
 	if page*perPage < count {
 		nextPage = fmt.Sprintf(
-			"/v1/browse?by=%s&page=%d&per-page=%d%s%s",
+			"/v1/browse?by=%s&page=%d&per-page=%d%s%s%s",
 			by,
 			page+1,
 			perPage,
 			orderArg,
 			orderByArg,
+			filterArg,
 		)
 	}
 
@@ -1,21 +1,29 @@
 package webserver
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"NT106/Group01/MusicStreamingAPI/src/library"
+	"NT106/Group01/MusicStreamingAPI/src/transcode"
 
 	"github.com/gorilla/mux"
 )
 
-// FileHandler will find and serve a media file by its ID
+// FileHandler will find and serve a media file by its ID. The file could be
+// transcoded on the fly when transcoding is configured. Files streamed by
+// authenticated users are recorded in their listening history and scrobbled.
 type FileHandler struct {
-	library library.Library
+	library     library.Library
+	history     library.History
+	transcoding *transcoding
+	scrobbling  *scrobbling
 }
 
 // ServeHTTP is required by the http.Handler's interface
@@ -25,7 +33,9 @@ func (fh FileHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
 
 // Actually searches through the library for this file and serves it
 // if it is found. Returns 404 if not (duh)
-// Uses http.FileServer for serving the found files
+// Uses http.FileServer for serving the found files unless transcoding has been
+// requested. Serving a file does not count as a listen since a single play could
+// be many requests. The listens are counted from the play events.
 func (fh FileHandler) find(writer http.ResponseWriter, req *http.Request) error {
 
 	vars := mux.Vars(req)
@@ -50,26 +60,146 @@ func (fh FileHandler) find(writer http.ResponseWriter, req *http.Request) error
 		return nil
 	}
 
-	baseName := filepath.Base(filePath)
+	// The transcoding arguments are checked first so that bad requests are not
+	// recorded as plays.
+	query := req.URL.Query()
+	transcoded := requestedTranscoding(query)
+
+	var opts transcode.Options
+	if transcoded {
+		if fh.transcoding == nil {
+			writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+			respondWithJSONError(writer, http.StatusBadRequest, transcodingDisabledText)
+			return nil
+		}
+
+		opts, err = fh.transcoding.options(query)
+		if err != nil {
+			writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+			respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+			return nil
+		}
+	}
 
-	writer.Header().Add("Content-Disposition",
-		fmt.Sprintf("filename=\"%s\"", baseName))
+	user := UserFromContext(req.Context())
+	client := playClient(req)
+	if user != nil && req.Method == http.MethodGet {
+		continued := continuesPlay(req)
+		_, err := fh.history.RecordPlay(
+			int64(user.ID),
+			int64(id),
+			client,
+			continued,
+		)
+		if err != nil {
+			log.Printf("Failed to record play in history: %s", err.Error())
+		}
+
+		if !continued {
+			fh.scrobbling.started(user.ID, client, int64(id))
+		}
+	}
 
-	req.URL.Path = "/" + baseName
-	http.FileServer(http.Dir(filepath.Dir(filePath))).ServeHTTP(writer, req)
+	// A play is scrobbled only when the file has been served to its end. So
+	// the responses for the track which is being followed are watched.
+	var served *servedEndWriter
+	if user != nil && req.Method == http.MethodGet &&
+		fh.scrobbling.following(user.ID, client, int64(id)) {
+		served = &servedEndWriter{ResponseWriter: writer}
+		writer = served
+	}
 
-	// Increment the listen count for the file
-	if err := fh.library.IncrementListenCount(int64(id)); err != nil {
-		log.Printf("Failed to increment listen count: %s", err.Error())
+	baseName := filepath.Base(filePath)
+
+	if transcoded {
+		completed := fh.transcode(writer, req, filePath, opts)
+		if completed && served != nil {
+			fh.scrobbling.servedEnd(user.ID, int64(id))
+		}
+	} else {
+		writer.Header().Add("Content-Disposition",
+			fmt.Sprintf("filename=\"%s\"", baseName))
+
+		req.URL.Path = "/" + baseName
+		http.FileServer(http.Dir(filepath.Dir(filePath))).ServeHTTP(writer, req)
+
+		if served != nil && served.reachedEnd() {
+			fh.scrobbling.servedEnd(user.ID, int64(id))
+		}
 	}
 
 	return nil
 }
 
+// transcode streams the file converted with opts. Transcoded streams do not support
+// range requests since their size is not known in advance. Clients seek with the
+// "offset" query argument instead. It returns true when the whole stream has been
+// sent.
+func (fh FileHandler) transcode(
+	writer http.ResponseWriter,
+	req *http.Request,
+	filePath string,
+	opts transcode.Options,
+) bool {
+	baseName := filepath.Base(filePath)
+	name := strings.TrimSuffix(baseName, filepath.Ext(baseName)) +
+		"." + opts.Format.Extension
+
+	header := writer.Header()
+	header.Set("Content-Type", opts.Format.ContentType)
+	header.Set("Content-Disposition", fmt.Sprintf("filename=\"%s\"", name))
+	header.Set("Accept-Ranges", "none")
+
+	if req.Method == http.MethodHead {
+		writer.WriteHeader(http.StatusOK)
+		return false
+	}
+
+	cw := &countingWriter{w: writer}
+	err := fh.transcoding.transcoder.Transcode(req.Context(), cw, filePath, opts)
+	if err == nil {
+		return true
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	// Nothing has been sent yet so the client could receive a proper error.
+	if cw.n == 0 {
+		header.Del("Content-Disposition")
+		header.Del("Accept-Ranges")
+		if errors.Is(err, errTranscodingBusy) {
+			respondWithTranscodingBusy(writer)
+			return false
+		}
+		header.Set("Content-Type", "application/json; charset=utf-8")
+		respondWithJSONError(
+			writer,
+			http.StatusInternalServerError,
+			"Error transcoding file: %s.",
+			err,
+		)
+		return false
+	}
+
+	log.Printf("Error transcoding %s: %s\n", filePath, err)
+	return false
+}
+
 // NewFileHandler returns a new File handler will will be resposible for serving a file
-// from the library identified from its ID.
-func NewFileHandler(lib library.Library) *FileHandler {
+// from the library identified from its ID. The transcoding may be nil in which
+// case the files are always served as they are. The scrobbling may be nil when
+// it is not configured.
+func NewFileHandler(
+	lib library.Library,
+	history library.History,
+	transcoding *transcoding,
+	scrobbling *scrobbling,
+) *FileHandler {
 	fh := new(FileHandler)
 	fh.library = lib
+	fh.history = history
+	fh.transcoding = transcoding
+	fh.scrobbling = scrobbling
 	return fh
 }
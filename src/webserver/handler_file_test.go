@@ -0,0 +1,341 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+	"NT106/Group01/MusicStreamingAPI/src/transcode"
+	"NT106/Group01/MusicStreamingAPI/src/transcode/transcodefakes"
+)
+
+// TestFileTranscodingOptions checks that the format and the bit rate given to the
+// transcoder are the ones requested by the client.
+func TestFileTranscodingOptions(t *testing.T) {
+	tests := []struct {
+		desc          string
+		query         string
+		expectedCode  int
+		expectedType  string
+		expectedOpts  transcode.Options
+		notTranscoded bool
+	}{
+		{
+			desc:         "format and bit rate",
+			query:        "format=opus&bitrate=64",
+			expectedCode: http.StatusOK,
+			expectedType: "audio/ogg; codecs=opus",
+			expectedOpts: transcode.Options{Format: mustFormat(t, "opus"), BitRate: 64},
+		},
+		{
+			desc:         "default bit rate",
+			query:        "format=mp3",
+			expectedCode: http.StatusOK,
+			expectedType: "audio/mpeg",
+			expectedOpts: transcode.Options{Format: mustFormat(t, "mp3"), BitRate: 192},
+		},
+		{
+			desc:         "lossless format ignores bit rate",
+			query:        "format=flac&bitrate=128",
+			expectedCode: http.StatusOK,
+			expectedType: "audio/flac",
+			expectedOpts: transcode.Options{Format: mustFormat(t, "flac")},
+		},
+		{
+			desc:         "profile",
+			query:        "profile=mobile",
+			expectedCode: http.StatusOK,
+			expectedType: "audio/ogg; codecs=vorbis",
+			expectedOpts: transcode.Options{Format: mustFormat(t, "vorbis"), BitRate: 96},
+		},
+		{
+			desc:         "offset",
+			query:        "format=aac&offset=93.5",
+			expectedCode: http.StatusOK,
+			expectedType: "audio/aac",
+			expectedOpts: transcode.Options{
+				Format:  mustFormat(t, "aac"),
+				BitRate: 160,
+				Offset:  93500 * time.Millisecond,
+			},
+		},
+		{
+			desc:          "unknown format",
+			query:         "format=wav",
+			expectedCode:  http.StatusBadRequest,
+			notTranscoded: true,
+		},
+		{
+			desc:          "bit rate out of range",
+			query:         "format=mp3&bitrate=1000",
+			expectedCode:  http.StatusBadRequest,
+			notTranscoded: true,
+		},
+		{
+			desc:          "unknown profile",
+			query:         "profile=nope",
+			expectedCode:  http.StatusBadRequest,
+			notTranscoded: true,
+		},
+		{
+			desc:          "negative offset",
+			query:         "format=mp3&offset=-1",
+			expectedCode:  http.StatusBadRequest,
+			notTranscoded: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			filePath := createTestMediaFile(t)
+			fake := &transcodefakes.FakeTranscoder{}
+			fake.TranscodeCalls(func(
+				_ context.Context,
+				w io.Writer,
+				_ string,
+				_ transcode.Options,
+			) error {
+				_, err := w.Write([]byte("transcoded"))
+				return err
+			})
+
+			h := newTestFileHandler(filePath, newTestTranscoding(t, fake, 1))
+			resp := getTestFile(h, "/v1/file/1?"+test.query)
+
+			if resp.Code != test.expectedCode {
+				t.Fatalf(
+					"expected status %d but got %d: %s",
+					test.expectedCode,
+					resp.Code,
+					resp.Body.String(),
+				)
+			}
+
+			if test.notTranscoded {
+				if fake.TranscodeCallCount() != 0 {
+					t.Errorf("expected the transcoder not to be called")
+				}
+				return
+			}
+
+			if fake.TranscodeCallCount() != 1 {
+				t.Fatalf("expected one transcoding but got %d", fake.TranscodeCallCount())
+			}
+
+			_, _, path, opts := fake.TranscodeArgsForCall(0)
+			if path != filePath {
+				t.Errorf("expected file %s to be transcoded but got %s", filePath, path)
+			}
+			if opts != test.expectedOpts {
+				t.Errorf("expected options %+v but got %+v", test.expectedOpts, opts)
+			}
+
+			if ct := resp.Header().Get("Content-Type"); ct != test.expectedType {
+				t.Errorf("expected Content-Type %s but got %s", test.expectedType, ct)
+			}
+			if resp.Body.String() != "transcoded" {
+				t.Errorf("unexpected body: %s", resp.Body.String())
+			}
+		})
+	}
+}
+
+// TestFileTranscodingErrors checks the responses when the transcoder fails.
+func TestFileTranscodingErrors(t *testing.T) {
+	filePath := createTestMediaFile(t)
+
+	t.Run("before writing", func(t *testing.T) {
+		fake := &transcodefakes.FakeTranscoder{}
+		fake.TranscodeReturns(errors.New("ffmpeg exploded"))
+
+		h := newTestFileHandler(filePath, newTestTranscoding(t, fake, 1))
+		resp := getTestFile(h, "/v1/file/1?format=mp3")
+
+		decodeJSON(t, resp, http.StatusInternalServerError, nil)
+		if ct := resp.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("expected a JSON error but got %s", ct)
+		}
+	})
+
+	t.Run("after writing", func(t *testing.T) {
+		fake := &transcodefakes.FakeTranscoder{}
+		fake.TranscodeCalls(func(
+			_ context.Context,
+			w io.Writer,
+			_ string,
+			_ transcode.Options,
+		) error {
+			_, _ = w.Write([]byte("partial"))
+			return errors.New("ffmpeg exploded")
+		})
+
+		h := newTestFileHandler(filePath, newTestTranscoding(t, fake, 1))
+		resp := getTestFile(h, "/v1/file/1?format=mp3")
+
+		// The status has already been sent so the stream is just cut short.
+		if resp.Code != http.StatusOK || resp.Body.String() != "partial" {
+			t.Errorf("expected partial stream but got %d: %s", resp.Code, resp.Body.String())
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		h := newTestFileHandler(filePath, nil)
+		resp := getTestFile(h, "/v1/file/1?format=mp3")
+		decodeJSON(t, resp, http.StatusBadRequest, nil)
+	})
+}
+
+// TestFileRecordedPlays checks that only the files which are served are recorded
+// as plays.
+func TestFileRecordedPlays(t *testing.T) {
+	filePath := createTestMediaFile(t)
+	fake := &transcodefakes.FakeTranscoder{}
+
+	tests := []struct {
+		desc     string
+		tr       *transcoding
+		target   string
+		expected int64
+	}{
+		{"original", nil, "/v1/file/1", 1},
+		{"transcoded", newTestTranscoding(t, fake, 1), "/v1/file/1?format=mp3", 1},
+		{"unknown format", newTestTranscoding(t, fake, 1), "/v1/file/1?format=wav", 0},
+		{"bad bitrate", newTestTranscoding(t, fake, 1), "/v1/file/1?format=mp3&bitrate=x", 0},
+		{"not configured", nil, "/v1/file/1?format=mp3", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			history := &stubHistory{}
+			h := newTestRouter(
+				NewFileHandler(&stubLibrary{filePath: filePath}, history, test.tr, nil),
+				&User{ID: 1},
+				APIv1EndpointFile,
+			)
+			getTestFile(h, test.target)
+
+			if history.lastID != test.expected {
+				t.Errorf("expected %d recorded plays but got %d", test.expected, history.lastID)
+			}
+		})
+	}
+}
+
+// TestFileTranscodingLimit checks that transcodings above the limit are refused
+// with 503 while the running ones are not affected.
+func TestFileTranscodingLimit(t *testing.T) {
+	filePath := createTestMediaFile(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fake := &transcodefakes.FakeTranscoder{}
+	fake.TranscodeCalls(func(
+		_ context.Context,
+		w io.Writer,
+		_ string,
+		_ transcode.Options,
+	) error {
+		started <- struct{}{}
+		<-release
+		_, err := w.Write([]byte("transcoded"))
+		return err
+	})
+
+	h := newTestFileHandler(filePath, newTestTranscoding(t, fake, 1))
+
+	running := make(chan *httptest.ResponseRecorder)
+	go func() {
+		running <- getTestFile(h, "/v1/file/1?format=mp3")
+	}()
+	<-started
+
+	resp := getTestFile(h, "/v1/file/1?format=opus")
+	decodeJSON(t, resp, http.StatusServiceUnavailable, nil)
+	if resp.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header")
+	}
+
+	close(release)
+	if resp := <-running; resp.Code != http.StatusOK {
+		t.Errorf("expected the running transcoding to finish but got %d", resp.Code)
+	}
+
+	// The slot is free again.
+	go func() { <-started }()
+	resp = getTestFile(h, "/v1/file/1?format=opus")
+	if resp.Code != http.StatusOK {
+		t.Errorf("expected transcoding after the slot is free but got %d", resp.Code)
+	}
+}
+
+// stubLibrary is a library with a single file.
+type stubLibrary struct {
+	library.Library
+	filePath string
+}
+
+func (l *stubLibrary) GetFilePath(int64) string {
+	return l.filePath
+}
+
+func newTestFileHandler(filePath string, tr *transcoding) http.Handler {
+	return newTestRouter(
+		NewFileHandler(&stubLibrary{filePath: filePath}, nil, tr, nil),
+		nil,
+		APIv1EndpointFile,
+	)
+}
+
+func newTestTranscoding(
+	t *testing.T,
+	transcoder transcode.Transcoder,
+	maxConcurrent int,
+) *transcoding {
+	t.Helper()
+
+	mobile, err := transcode.NewOptions("vorbis", 96)
+	if err != nil {
+		t.Fatalf("creating profile: %s", err)
+	}
+
+	return &transcoding{
+		transcoder: newLimitedTranscoder(transcoder, maxConcurrent),
+		profiles: map[string]transcode.Options{
+			"mobile": mobile,
+		},
+	}
+}
+
+func createTestMediaFile(t *testing.T) string {
+	t.Helper()
+
+	filePath := filepath.Join(t.TempDir(), "track.flac")
+	if err := os.WriteFile(filePath, []byte("not really flac"), 0o644); err != nil {
+		t.Fatalf("creating media file: %s", err)
+	}
+	return filePath
+}
+
+func getTestFile(h http.Handler, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func mustFormat(t *testing.T, name string) transcode.Format {
+	t.Helper()
+
+	format, ok := transcode.FormatByName(name)
+	if !ok {
+		t.Fatalf("unknown format %s", name)
+	}
+	return format
+}
@@ -0,0 +1,138 @@
+package webserver
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	historyDefaultPerPage = 50
+	historyMaxPerPage     = 500
+
+	continueListeningDefaultLimit = 20
+	continueListeningMaxLimit     = 100
+)
+
+// HistoryHandler returns the listening history of the logged in user.
+type HistoryHandler struct {
+	history library.History
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (hh HistoryHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, hh.handleRequest)
+}
+
+func (hh HistoryHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	if routeTemplate(req) == APIv1EndpointHistoryContinue {
+		return hh.continueListening(writer, req, user)
+	}
+	return hh.plays(writer, req, user)
+}
+
+// plays returns the user's plays, newest first. They could be limited with the
+// "since" and "until" RFC 3339 times and are paginated with "page" and "per-page".
+func (hh HistoryHandler) plays(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	query := req.URL.Query()
+
+	page, perPage, err := parsePagination(
+		query,
+		historyDefaultPerPage,
+		historyMaxPerPage,
+	)
+	if err != nil {
+		respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	args := library.HistoryArgs{
+		Page:    uint(page - 1),
+		PerPage: uint(perPage),
+	}
+
+	for arg, dest := range map[string]*time.Time{
+		"since": &args.Since,
+		"until": &args.Until,
+	} {
+		value := query.Get(arg)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondWithJSONError(writer, http.StatusBadRequest, `Wrong "%s": %s`, arg, err)
+			return nil
+		}
+		*dest = t
+	}
+
+	plays, count, err := hh.history.GetHistory(int64(user.ID), args)
+	if err != nil {
+		return err
+	}
+
+	hasNext := page*perPage < count
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		Data       []library.Play `json:"data"`
+		Next       string         `json:"next"`
+		Previous   string         `json:"previous"`
+		PagesCount int            `json:"pages_count"`
+	}{
+		Data:       plays,
+		Next:       pageURI(APIv1EndpointHistory, query, page+1, hasNext),
+		Previous:   pageURI(APIv1EndpointHistory, query, page-1, page > 1),
+		PagesCount: int(math.Ceil(float64(count) / float64(perPage))),
+	})
+}
+
+// continueListening returns the tracks which the user could continue listening
+// to. Their number could be set with the "limit" query argument.
+func (hh HistoryHandler) continueListening(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	limit, err := parseLimit(
+		req.URL.Query(),
+		continueListeningDefaultLimit,
+		continueListeningMaxLimit,
+	)
+	if err != nil {
+		respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	plays, err := hh.history.ContinueListening(int64(user.ID), limit)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(plays)
+}
+
+// NewHistoryHandler returns a new HistoryHandler which reads from history.
+func NewHistoryHandler(history library.History) *HistoryHandler {
+	return &HistoryHandler{
+		history: history,
+	}
+}
@@ -0,0 +1,192 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+// HLSHandler serves media files as HTTP Live Streaming. There is a master playlist
+// for every file which lists one variant for every configured bit rate. The
+// variants are split in segments which are transcoded when first requested.
+type HLSHandler struct {
+	library     library.Library
+	transcoding *transcoding
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (hh HLSHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, hh.handleRequest)
+}
+
+func (hh HLSHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	if hh.transcoding == nil {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		respondWithJSONError(writer, http.StatusBadRequest, transcodingDisabledText)
+		return nil
+	}
+
+	vars := mux.Vars(req)
+	id, err := strconv.ParseInt(vars["fileID"], 10, 64)
+	if err != nil {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+
+	track, err := hh.library.GetTrack(id)
+	if errors.Is(err, library.ErrTrackNotFound) {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	duration := time.Duration(track.Duration) * time.Millisecond
+	if duration <= 0 {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		respondWithJSONError(
+			writer,
+			http.StatusUnprocessableEntity,
+			"the duration of the track is not known",
+		)
+		return nil
+	}
+
+	if routeTemplate(req) == APIv1EndpointFileHLSMaster {
+		return hh.master(writer)
+	}
+
+	bitRate, _ := strconv.Atoi(vars["bitrate"])
+	if !hh.hasVariant(bitRate) {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+
+	if routeTemplate(req) == APIv1EndpointFileHLSVariant {
+		return hh.variant(writer, duration)
+	}
+
+	index, err := strconv.Atoi(vars["segment"])
+	if err != nil || index >= hlsSegmentsCount(duration) {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+
+	return hh.segment(writer, req, id, bitRate, index, duration)
+}
+
+// master writes the master playlist. The URIs in the playlists are relative so
+// that they work behind reverse proxies too.
+func (hh HLSHandler) master(writer http.ResponseWriter) error {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	for _, bitRate := range hh.transcoding.hlsBitRates {
+		// The bandwidth includes about 10% for the MPEG-TS overhead.
+		fmt.Fprintf(
+			&playlist,
+			"#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%d/index.m3u8\n",
+			bitRate*1100,
+			bitRate,
+		)
+	}
+
+	writer.Header().Set("Content-Type", hlsPlaylistContentType)
+	_, err := writer.Write([]byte(playlist.String()))
+	return err
+}
+
+// variant writes the playlist with all segments of a variant.
+func (hh HLSHandler) variant(writer http.ResponseWriter, duration time.Duration) error {
+	var playlist strings.Builder
+	fmt.Fprintf(
+		&playlist,
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n"+
+			"#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n",
+		int(hlsSegmentDuration.Seconds()),
+	)
+
+	for i := 0; i < hlsSegmentsCount(duration); i++ {
+		fmt.Fprintf(
+			&playlist,
+			"#EXTINF:%.3f,\n%d.ts\n",
+			hlsSegmentLength(duration, i).Seconds(),
+			i,
+		)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	writer.Header().Set("Content-Type", hlsPlaylistContentType)
+	_, err := writer.Write([]byte(playlist.String()))
+	return err
+}
+
+// segment serves a single segment from the cache.
+func (hh HLSHandler) segment(
+	writer http.ResponseWriter,
+	req *http.Request,
+	id int64,
+	bitRate int,
+	index int,
+	duration time.Duration,
+) error {
+	filePath := hh.library.GetFilePath(id)
+
+	segmentPath, err := hh.transcoding.hlsSegments.segment(
+		filePath,
+		id,
+		bitRate,
+		index,
+		duration,
+	)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	} else if errors.Is(err, errTranscodingBusy) {
+		respondWithTranscodingBusy(writer)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("generating HLS segment: %w", err)
+	}
+
+	fh, err := os.Open(segmentPath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	st, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(writer, req, "", st.ModTime(), fh)
+	return nil
+}
+
+func (hh HLSHandler) hasVariant(bitRate int) bool {
+	for _, br := range hh.transcoding.hlsBitRates {
+		if br == bitRate {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHLSHandler returns a new HLSHandler for the files in lib. The transcoding
+// may be nil in which case all requests are refused.
+func NewHLSHandler(lib library.Library, transcoding *transcoding) *HLSHandler {
+	return &HLSHandler{
+		library:     lib,
+		transcoding: transcoding,
+	}
+}
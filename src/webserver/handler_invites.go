@@ -0,0 +1,170 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	// inviteCodeBytes is the number of random bytes in an invite code. They are
+	// base32 encoded so that the code is easy to type and read out loud.
+	inviteCodeBytes = 10
+)
+
+// InvitesHandler is used by administrators for creating, listing and deleting
+// invite codes.
+type InvitesHandler struct {
+	db *gorm.DB
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ih InvitesHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ih.handleRequest)
+}
+
+func (ih InvitesHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	idString, ok := mux.Vars(req)["inviteID"]
+
+	switch {
+	case req.Method == http.MethodGet && !ok:
+		return ih.list(writer)
+	case req.Method == http.MethodPost && !ok:
+		return ih.create(writer, req)
+	case req.Method == http.MethodDelete && ok:
+		return ih.remove(writer, idString)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+func (ih InvitesHandler) list(writer http.ResponseWriter) error {
+	invites := []Invite{}
+	if err := ih.db.Order("created_at DESC").Find(&invites).Error; err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(invites)
+}
+
+func (ih InvitesHandler) create(writer http.ResponseWriter, req *http.Request) error {
+	reqBody := struct {
+		MaxUses   int  `json:"max_uses"`
+		ExpiresIn int  `json:"expires_in"`
+		Role      Role `json:"role"`
+	}{
+		MaxUses: 1,
+		Role:    RoleListener,
+	}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if reqBody.MaxUses < 0 || reqBody.ExpiresIn < 0 {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`"max_uses" and "expires_in" must not be negative`,
+		)
+		return nil
+	}
+
+	if !reqBody.Role.Valid() {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Unknown role `%s`.",
+			reqBody.Role,
+		)
+		return nil
+	}
+
+	code, err := randomReadableCode()
+	if err != nil {
+		return err
+	}
+
+	invite := Invite{
+		Code:    code,
+		Role:    reqBody.Role,
+		MaxUses: reqBody.MaxUses,
+	}
+
+	if user := UserFromContext(req.Context()); user != nil {
+		invite.CreatedBy = user.ID
+	}
+
+	if reqBody.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(reqBody.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	if err := ih.db.Create(&invite).Error; err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	return enc.Encode(invite)
+}
+
+func (ih InvitesHandler) remove(writer http.ResponseWriter, idString string) error {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing inviteID: %s",
+			err,
+		)
+		return nil
+	}
+
+	res := ih.db.Delete(&Invite{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		respondWithJSONError(writer, http.StatusNotFound, "invite not found")
+		return nil
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// randomReadableCode returns a short random code which is easy to type.
+func randomReadableCode() (string, error) {
+	buff := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(buff); err != nil {
+		return "", fmt.Errorf("generating random code: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buff), nil
+}
+
+// NewInvitesHandler returns a new InvitesHandler which stores invites in db.
+func NewInvitesHandler(db *gorm.DB) *InvitesHandler {
+	return &InvitesHandler{
+		db: db,
+	}
+}
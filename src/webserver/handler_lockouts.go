@@ -0,0 +1,75 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// LockoutsHandler lets administrators see which usernames and IP addresses are
+// locked because of too many failed logins and lift the locks.
+type LockoutsHandler struct {
+	throttle *loginThrottle
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (lh LockoutsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, lh.handleRequest)
+}
+
+func (lh LockoutsHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	switch req.Method {
+	case http.MethodGet:
+		users, ips := lh.throttle.locked()
+		enc := json.NewEncoder(writer)
+		return enc.Encode(struct {
+			Users []loginLock `json:"users"`
+			IPs   []loginLock `json:"ips"`
+		}{
+			Users: users,
+			IPs:   ips,
+		})
+	case http.MethodDelete:
+		return lh.unlock(writer, req)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// unlock removes the lock of the username or IP address from the query.
+func (lh LockoutsHandler) unlock(writer http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+	username, ip := query.Get("username"), query.Get("ip")
+
+	var found bool
+	switch {
+	case username != "" && ip == "":
+		found = lh.throttle.unlockUser(username)
+	case ip != "" && username == "":
+		found = lh.throttle.unlockIP(ip)
+	default:
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`exactly one of "username" or "ip" is required`,
+		)
+		return nil
+	}
+
+	if !found {
+		respondWithJSONError(writer, http.StatusNotFound, "lockout not found")
+		return nil
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewLockoutsHandler returns a new LockoutsHandler for the locks in throttle.
+func NewLockoutsHandler(throttle *loginThrottle) *LockoutsHandler {
+	return &LockoutsHandler{
+		throttle: throttle,
+	}
+}
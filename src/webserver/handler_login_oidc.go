@@ -0,0 +1,167 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+const (
+	oidcDisabledText = "OpenID Connect is not configured on this server"
+)
+
+// oidcLoginHandler logs users in with the external OpenID Connect provider. After
+// that the users use the same tokens as with the local accounts.
+type oidcLoginHandler struct {
+	db     *gorm.DB
+	secret string
+	oidc   *oidcLogin
+}
+
+// NewOIDCLoginHandler returns a handler for both the redirect to the provider and
+// the callback from it.
+func NewOIDCLoginHandler(db *gorm.DB, secret string, oidc *oidcLogin) http.Handler {
+	return &oidcLoginHandler{
+		db:     db,
+		secret: secret,
+		oidc:   oidc,
+	}
+}
+
+func (h *oidcLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if h.oidc == nil {
+		respondWithJSONError(w, http.StatusNotFound, oidcDisabledText)
+		return
+	}
+
+	if routeTemplate(r) == APIv1EndpointOIDCCallback {
+		h.callback(w, r)
+		return
+	}
+
+	h.begin(w, r)
+}
+
+// begin redirects the user to the provider. The optional "device" and "set-cookie"
+// query arguments have the same meaning as the fields of the login request. The
+// "invite" argument is the invite code used when an account is created for the
+// user in invite-only registration mode. With "reauth=true" the provider asks for
+// the credentials even when the user is already logged in with it. This is how
+// users without a password confirm sensitive operations. The
+// state of the login is stored in a cookie so that only this browser could finish
+// it.
+func (h *oidcLoginHandler) begin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	authURL, state, err := h.oidc.start(
+		query.Get("device"),
+		query.Get("set-cookie") == "true",
+		query.Get("invite"),
+		query.Get("reauth") == "true",
+	)
+	if errors.Is(err, errTooManyOIDCLogins) {
+		respondWithUnavailable(w, oidcRetryAfter, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadGateway,
+			"Error starting OpenID Connect login: %s.",
+			err,
+		)
+		return
+	}
+
+	setOIDCStateCookie(w, r, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// callback is where the provider redirects the user after logging in. The response
+// is the same as the one of the login endpoint. The login must be finished by the
+// same browser which started it or otherwise anyone could make a victim log into
+// their account.
+func (h *oidcLoginHandler) callback(w http.ResponseWriter, r *http.Request) {
+	clearOIDCStateCookie(w)
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithJSONError(
+			w,
+			http.StatusUnauthorized,
+			"OpenID Connect login failed: %s %s",
+			providerErr,
+			query.Get("error_description"),
+		)
+		return
+	}
+
+	if err := checkOIDCState(r, query.Get("state")); err != nil {
+		respondWithJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	identity, pending, err := h.oidc.finish(r.Context(), query.Get("state"), query.Get("code"))
+	if errors.Is(err, errInvalidOIDCState) {
+		respondWithJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusUnauthorized,
+			"OpenID Connect login failed: %s.",
+			err,
+		)
+		return
+	}
+
+	auditUsername(r, identity.username())
+
+	user, err := h.oidc.user(h.db, identity, pending.invite)
+	if errors.Is(err, errOIDCUserDisabled) ||
+		errors.Is(err, errOIDCUnknownUser) ||
+		errors.Is(err, errInvalidInvite) {
+		respondWithJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error finding user: %s.",
+			err,
+		)
+		return
+	}
+
+	auditUser(r, user)
+
+	sess, refreshToken, err := newSession(h.db, user, r, pending.device)
+	if err == nil {
+		sess.OIDCAuthAt = identity.authenticatedAt()
+		err = h.db.Model(sess).Update("oidc_auth_at", sess.OIDCAuthAt).Error
+	}
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error creating session: %s.",
+			err,
+		)
+		return
+	}
+
+	if pending.cookie {
+		if err := setSessionCookie(w, r, user, sess, h.secret); err != nil {
+			respondWithJSONError(
+				w,
+				http.StatusInternalServerError,
+				"Error generating session cookie: %s.",
+				err,
+			)
+			return
+		}
+	}
+
+	respondWithTokens(w, user, sess, refreshToken, h.secret)
+}
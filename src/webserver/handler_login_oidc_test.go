@@ -0,0 +1,604 @@
+package webserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+)
+
+// TestOIDCLoginProvisionsUser logs in with an identity which is not known yet and
+// checks that a user is created for it.
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	db := newTestDB(t)
+	provider := newStubOIDCProvider(t)
+	h := newTestOIDCHandler(t, db, provider, true, config.RegistrationOpen)
+
+	resp := provider.login(t, h, "device=Phone", "subject-1", "alice")
+
+	var tokens tokenResponse
+	decodeJSON(t, resp, http.StatusOK, &tokens)
+	if tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Errorf("expected tokens in the response but got %+v", tokens)
+	}
+
+	user := findTestUser(t, db, "alice")
+	if user.Role != RoleAdmin {
+		t.Errorf("expected the first user to be an admin but it is %s", user.Role)
+	}
+	if user.OIDCSubject == nil || *user.OIDCSubject != "subject-1" {
+		t.Errorf("expected the user to be linked with the identity")
+	}
+	if user.hasPassword() {
+		t.Errorf("expected the provisioned user not to have a password")
+	}
+
+	if !clearsStateCookie(resp) {
+		t.Errorf("expected the callback to clear the state cookie")
+	}
+
+	var sess Session
+	if err := db.Where("user_id = ?", user.ID).First(&sess).Error; err != nil {
+		t.Fatalf("finding session: %s", err)
+	}
+	if time.Since(sess.OIDCAuthAt) > time.Minute {
+		t.Errorf("expected the session to record the login with the provider")
+	}
+
+	// The second login finds the same user.
+	resp = provider.login(t, h, "", "subject-1", "alice")
+	decodeJSON(t, resp, http.StatusOK, nil)
+
+	var count int64
+	db.Model(&User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected one user but there are %d", count)
+	}
+}
+
+// TestOIDCLoginReauth checks that the provider is asked to authenticate the user
+// again when this is requested.
+func TestOIDCLoginReauth(t *testing.T) {
+	db := newTestDB(t)
+	provider := newStubOIDCProvider(t)
+	h := newTestOIDCHandler(t, db, provider, true, config.RegistrationOpen)
+
+	for query, prompt := range map[string]string{"": "", "reauth=true": "login"} {
+		req := httptest.NewRequest(http.MethodGet, APIv1EndpointOIDCLogin+"?"+query, nil)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		location, err := url.Parse(resp.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("parsing redirect location: %s", err)
+		}
+		if location.Query().Get("prompt") != prompt {
+			t.Errorf("expected prompt %q for %q but got %s", prompt, query, location)
+		}
+	}
+}
+
+// TestOIDCLoginLimit checks that new logins are refused while too many are in
+// progress and that the expired ones make room for new ones.
+func TestOIDCLoginLimit(t *testing.T) {
+	db := newTestDB(t)
+	provider := newStubOIDCProvider(t)
+	login := newTestOIDCLogin(provider, true, config.RegistrationOpen)
+	login.maxPending = 2
+
+	h := newTestRouter(
+		NewOIDCLoginHandler(db, testSecret, login),
+		nil,
+		APIv1EndpointOIDCLogin,
+		APIv1EndpointOIDCCallback,
+	)
+
+	for i := 0; i < login.maxPending; i++ {
+		provider.begin(t, h, "", "subject-1", "alice")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, APIv1EndpointOIDCLogin, nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	decodeJSON(t, resp, http.StatusServiceUnavailable, nil)
+	if resp.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header")
+	}
+
+	login.mu.Lock()
+	for state, pending := range login.pending {
+		pending.expiresAt = time.Now().Add(-time.Second)
+		login.pending[state] = pending
+	}
+	login.pruned = time.Time{}
+	login.mu.Unlock()
+
+	provider.begin(t, h, "", "subject-1", "alice")
+	if len(login.pending) != 1 {
+		t.Errorf("expected the expired logins to be removed")
+	}
+}
+
+// TestOIDCLoginStateMismatch makes sure a login could be finished only by the
+// browser which started it.
+func TestOIDCLoginStateMismatch(t *testing.T) {
+	db := newTestDB(t)
+	provider := newStubOIDCProvider(t)
+	h := newTestOIDCHandler(t, db, provider, true, config.RegistrationOpen)
+
+	tests := []struct {
+		desc   string
+		cookie *http.Cookie
+	}{
+		{
+			desc: "no cookie",
+		},
+		{
+			desc: "cookie for another login",
+			cookie: &http.Cookie{
+				Name:  oidcStateCookieName,
+				Value: "other-state",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			// The attacker starts the login and captures their own code and state.
+			login := provider.begin(t, h, "", "attacker", "mallory")
+			code := provider.authorize(t, login)
+
+			// Then a victim's browser is made to finish it.
+			req := httptest.NewRequest(
+				http.MethodGet,
+				APIv1EndpointOIDCCallback+"?"+url.Values{
+					"code":  {code},
+					"state": {login.state},
+				}.Encode(),
+				nil,
+			)
+			if test.cookie != nil {
+				req.AddCookie(test.cookie)
+			}
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, req)
+
+			decodeJSON(t, resp, http.StatusBadRequest, nil)
+			if _, ok := cookieByName(resp, sessionCookieName); ok {
+				t.Errorf("expected no session cookie to be set")
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&User{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no users to be created but there are %d", count)
+	}
+}
+
+// TestOIDCLoginRegistrationMode checks that the users are created only when the
+// registration mode allows it.
+func TestOIDCLoginRegistrationMode(t *testing.T) {
+	tests := []struct {
+		desc          string
+		autoProvision bool
+		mode          string
+		invite        string
+		expectedCode  int
+		expectedRole  Role
+	}{
+		{
+			desc:         "auto-provisioning is off",
+			mode:         config.RegistrationOpen,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			desc:          "registration is disabled",
+			autoProvision: true,
+			mode:          config.RegistrationDisabled,
+			expectedCode:  http.StatusForbidden,
+		},
+		{
+			desc:          "invite-only without an invite",
+			autoProvision: true,
+			mode:          config.RegistrationInviteOnly,
+			expectedCode:  http.StatusForbidden,
+		},
+		{
+			desc:          "invite-only with a wrong invite",
+			autoProvision: true,
+			mode:          config.RegistrationInviteOnly,
+			invite:        "wrong",
+			expectedCode:  http.StatusForbidden,
+		},
+		{
+			desc:          "invite-only with an invite",
+			autoProvision: true,
+			mode:          config.RegistrationInviteOnly,
+			invite:        "invite-code",
+			expectedCode:  http.StatusOK,
+			expectedRole:  RoleGuest,
+		},
+		{
+			desc:          "open registration",
+			autoProvision: true,
+			mode:          config.RegistrationOpen,
+			expectedCode:  http.StatusOK,
+			expectedRole:  RoleListener,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			db := newTestDB(t)
+			createTestUser(t, db, "admin", RoleAdmin)
+			err := db.Create(&Invite{
+				Code:    "invite-code",
+				Role:    RoleGuest,
+				MaxUses: 1,
+			}).Error
+			if err != nil {
+				t.Fatalf("creating invite: %s", err)
+			}
+
+			provider := newStubOIDCProvider(t)
+			h := newTestOIDCHandler(t, db, provider, test.autoProvision, test.mode)
+
+			query := url.Values{"invite": {test.invite}}.Encode()
+			resp := provider.login(t, h, query, "subject-1", "alice")
+			decodeJSON(t, resp, test.expectedCode, nil)
+
+			var users []User
+			db.Where("username = ?", "alice").Find(&users)
+
+			if test.expectedCode != http.StatusOK {
+				if len(users) != 0 {
+					t.Errorf("expected no user to be created")
+				}
+				return
+			}
+
+			if len(users) != 1 {
+				t.Fatalf("expected the user to be created")
+			}
+			if users[0].Role != test.expectedRole {
+				t.Errorf("expected role %s but got %s", test.expectedRole, users[0].Role)
+			}
+		})
+	}
+}
+
+// TestOIDCLoginLinkedUserWithoutProvisioning makes sure already linked users could
+// log in when auto-provisioning is off.
+func TestOIDCLoginLinkedUserWithoutProvisioning(t *testing.T) {
+	db := newTestDB(t)
+	provider := newStubOIDCProvider(t)
+	h := newTestOIDCHandler(t, db, provider, false, config.RegistrationDisabled)
+
+	issuer, subject := provider.URL, "subject-1"
+	user := createTestUser(t, db, "alice", RoleListener)
+	err := db.Model(user).Updates(User{
+		OIDCIssuer:  &issuer,
+		OIDCSubject: &subject,
+	}).Error
+	if err != nil {
+		t.Fatalf("linking user: %s", err)
+	}
+
+	resp := provider.login(t, h, "", subject, "someone-else")
+	decodeJSON(t, resp, http.StatusOK, nil)
+
+	if err := db.Model(user).Update("disabled", true).Error; err != nil {
+		t.Fatalf("disabling user: %s", err)
+	}
+
+	resp = provider.login(t, h, "", subject, "someone-else")
+	decodeJSON(t, resp, http.StatusForbidden, nil)
+}
+
+func newTestOIDCHandler(
+	t *testing.T,
+	db *gorm.DB,
+	provider *stubOIDCProvider,
+	autoProvision bool,
+	registration string,
+) http.Handler {
+	t.Helper()
+
+	return newTestRouter(
+		NewOIDCLoginHandler(db, testSecret, newTestOIDCLogin(provider, autoProvision, registration)),
+		nil,
+		APIv1EndpointOIDCLogin,
+		APIv1EndpointOIDCCallback,
+	)
+}
+
+func newTestOIDCLogin(
+	provider *stubOIDCProvider,
+	autoProvision bool,
+	registration string,
+) *oidcLogin {
+	return newOIDCLogin(context.Background(), &config.OIDCConfig{
+		Issuer:        provider.URL,
+		ClientID:      stubOIDCClientID,
+		ClientSecret:  "client-secret",
+		RedirectURL:   "https://music.example.com" + APIv1EndpointOIDCCallback,
+		AutoProvision: autoProvision,
+	}, registration)
+}
+
+func findTestUser(t *testing.T, db *gorm.DB, username string) *User {
+	t.Helper()
+
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("finding user %s: %s", username, err)
+	}
+	return &user
+}
+
+func cookieByName(resp *httptest.ResponseRecorder, name string) (*http.Cookie, bool) {
+	for _, cookie := range resp.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie, true
+		}
+	}
+	return nil, false
+}
+
+func clearsStateCookie(resp *httptest.ResponseRecorder) bool {
+	cookie, ok := cookieByName(resp, oidcStateCookieName)
+	return ok && cookie.MaxAge < 0
+}
+
+const stubOIDCClientID = "httpms"
+
+// stubOIDCProvider is an OpenID Connect provider which issues ID tokens for any
+// subject without asking anyone. The authorization endpoint is never visited,
+// authorize is called instead.
+type stubOIDCProvider struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]map[string]interface{}
+}
+
+// stubOIDCLogin is a login started with the handler as seen by the provider.
+type stubOIDCLogin struct {
+	state   string
+	nonce   string
+	cookie  *http.Cookie
+	subject string
+	name    string
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	p := &stubOIDCProvider{
+		key:   key,
+		codes: make(map[string]map[string]interface{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// begin starts a login with the handler and returns it as the provider would see
+// it after the redirect.
+func (p *stubOIDCProvider) begin(
+	t *testing.T,
+	h http.Handler,
+	query string,
+	subject string,
+	name string,
+) stubOIDCLogin {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, APIv1EndpointOIDCLogin+"?"+query, nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusFound {
+		t.Fatalf("expected a redirect but got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	location, err := url.Parse(resp.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect location: %s", err)
+	}
+
+	cookie, ok := cookieByName(resp, oidcStateCookieName)
+	if !ok {
+		t.Fatalf("expected the state cookie to be set")
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("expected HttpOnly and SameSite=Lax state cookie: %s", cookie)
+	}
+
+	login := stubOIDCLogin{
+		state:   location.Query().Get("state"),
+		nonce:   location.Query().Get("nonce"),
+		cookie:  cookie,
+		subject: subject,
+		name:    name,
+	}
+	if login.state == "" || login.state != cookie.Value {
+		t.Fatalf("expected the state cookie to hold the state")
+	}
+
+	return login
+}
+
+// authorize is what the provider does once the user logs in with it. It returns
+// the authorization code which is exchanged for an ID token.
+func (p *stubOIDCProvider) authorize(t *testing.T, login stubOIDCLogin) string {
+	t.Helper()
+
+	code, err := randomToken()
+	if err != nil {
+		t.Fatalf("generating code: %s", err)
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	p.codes[code] = map[string]interface{}{
+		"iss":                p.URL,
+		"aud":                stubOIDCClientID,
+		"sub":                login.subject,
+		"nonce":              login.nonce,
+		"preferred_username": login.name,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"auth_time":          now.Unix(),
+	}
+	p.mu.Unlock()
+
+	return code
+}
+
+// login goes through the whole login with the handler in the same browser and
+// returns the response of the callback.
+func (p *stubOIDCProvider) login(
+	t *testing.T,
+	h http.Handler,
+	query string,
+	subject string,
+	name string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+
+	login := p.begin(t, h, query, subject, name)
+	code := p.authorize(t, login)
+
+	req := httptest.NewRequest(
+		http.MethodGet,
+		APIv1EndpointOIDCCallback+"?"+url.Values{
+			"code":  {code},
+			"state": {login.state},
+		}.Encode(),
+		nil,
+	)
+	req.AddCookie(&http.Cookie{Name: login.cookie.Name, Value: login.cookie.Value})
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func (p *stubOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *stubOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(
+					big.NewInt(int64(pub.E)).Bytes(),
+				),
+			},
+		},
+	})
+}
+
+func (p *stubOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+
+	p.mu.Lock()
+	claims, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns a compact RS256 JWS of the claims.
+func (p *stubOIDCProvider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"kid": "test",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,236 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+const (
+	wrongPasskeyText = "passkey could not be verified"
+)
+
+// passkeyLoginHandler logs users in with passkeys. It is the passwordless
+// alternative of loginTokenHandler and issues the same tokens.
+type passkeyLoginHandler struct {
+	db         *gorm.DB
+	secret     string
+	webAuthn   *webauthn.WebAuthn
+	ceremonies *ceremonyStore
+	throttle   *loginThrottle
+}
+
+// NewPasskeyLoginHandler returns a handler for both the start and the end of the
+// passkey login ceremony.
+func NewPasskeyLoginHandler(
+	db *gorm.DB,
+	secret string,
+	webAuthn *webauthn.WebAuthn,
+	ceremonies *ceremonyStore,
+	throttle *loginThrottle,
+) http.Handler {
+	return &passkeyLoginHandler{
+		db:         db,
+		secret:     secret,
+		webAuthn:   webAuthn,
+		ceremonies: ceremonies,
+		throttle:   throttle,
+	}
+}
+
+func (h *passkeyLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if h.webAuthn == nil {
+		respondWithJSONError(w, http.StatusNotFound, passkeysDisabledText)
+		return
+	}
+
+	if routeTemplate(r) == APIv1EndpointPasskeyLoginFinish {
+		h.finish(w, r)
+		return
+	}
+
+	h.begin(w)
+}
+
+// begin starts a login ceremony. The options in the response are meant to be
+// passed to navigator.credentials.get() in the browser. No username is needed
+// since the passkeys are discoverable.
+func (h *passkeyLoginHandler) begin(w http.ResponseWriter) {
+	assertion, session, err := h.webAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error starting passkey login: %s.",
+			err,
+		)
+		return
+	}
+
+	ceremonyID, err := h.ceremonies.start(0, session)
+	if errors.Is(err, errTooManyCeremonies) {
+		respondWithUnavailable(w, ceremonyRetryAfter, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error starting passkey login: %s.",
+			err,
+		)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	_ = enc.Encode(struct {
+		CeremonyID string                        `json:"ceremony_id"`
+		Options    *protocol.CredentialAssertion `json:"options"`
+	}{
+		CeremonyID: ceremonyID,
+		Options:    assertion,
+	})
+}
+
+// finish verifies the assertion from the authenticator and creates a new session.
+// User verification is required by the ceremony so the passkey is enough even for
+// users with two-factor authentication.
+func (h *passkeyLoginHandler) finish(w http.ResponseWriter, r *http.Request) {
+	reqBody := struct {
+		CeremonyID string          `json:"ceremony_id"`
+		Credential json.RawMessage `json:"credential"`
+		Device     string          `json:"device"`
+		Cookie     bool            `json:"set_cookie"`
+	}{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return
+	}
+
+	ip := remoteIP(r)
+	if wait := h.throttle.retryAfter(ip, ""); wait > 0 {
+		respondWithTooManyAttempts(w, wait)
+		return
+	}
+
+	cer, ok := h.ceremonies.finish(reqBody.CeremonyID)
+	if !ok {
+		respondWithJSONError(w, http.StatusBadRequest, invalidCeremonyText)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(
+		bytes.NewReader(reqBody.Credential),
+	)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadRequest,
+			"Error parsing credential: %s.",
+			err,
+		)
+		return
+	}
+
+	var waUser *webAuthnUser
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := strconv.ParseUint(string(userHandle), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		var user User
+		if err := h.db.First(&user, userID).Error; err != nil {
+			return nil, err
+		}
+		if user.Disabled {
+			return nil, errors.New("user is disabled")
+		}
+
+		waUser, err = loadWebAuthnUser(h.db, &user)
+		return waUser, err
+	}
+
+	cred, err := h.webAuthn.ValidateDiscoverableLogin(findUser, cer.session, parsed)
+	if err != nil || cred.Authenticator.CloneWarning {
+		h.throttle.failed(ip, "")
+		respondWithJSONError(w, http.StatusUnauthorized, wrongPasskeyText)
+		return
+	}
+
+	if err := h.touchPasskey(waUser.passkey(cred.ID), cred); err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error updating passkey: %s.",
+			err,
+		)
+		return
+	}
+
+	user := waUser.user
+	auditUser(r, user)
+
+	sess, refreshToken, err := newSession(h.db, user, r, reqBody.Device)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error creating session: %s.",
+			err,
+		)
+		return
+	}
+
+	if reqBody.Cookie {
+		if err := setSessionCookie(w, r, user, sess, h.secret); err != nil {
+			respondWithJSONError(
+				w,
+				http.StatusInternalServerError,
+				"Error generating session cookie: %s.",
+				err,
+			)
+			return
+		}
+	}
+
+	respondWithTokens(w, user, sess, refreshToken, h.secret)
+}
+
+// touchPasskey stores the new signature counter of the credential and the time
+// the passkey was used.
+func (h *passkeyLoginHandler) touchPasskey(
+	passkey *Passkey,
+	cred *webauthn.Credential,
+) error {
+	if passkey == nil {
+		return errors.New("passkey not found")
+	}
+
+	if err := passkey.setCredential(cred); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	passkey.LastUsedAt = &now
+	return h.db.Model(passkey).
+		Select("credential", "last_used_at").
+		Updates(passkey).Error
+}
@@ -5,26 +5,43 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/gbrlsnchs/jwt/v3"
 	"gorm.io/gorm"
 )
 
+const (
+	twoFactorRequiredText     = "two-factor authentication code required"
+	wrongTwoFactorCodeText    = "wrong two-factor authentication code"
+	invalidTwoFactorTokenText = "invalid or expired two-factor token"
+)
+
 type loginTokenHandler struct {
-	db     *gorm.DB
-	secect string
+	db       *gorm.DB
+	secect   string
+	throttle *loginThrottle
 }
 
 var (
+	// rememberMeDuration is for how long a session stays valid without being
+	// refreshed.
 	rememberMeDuration = 62 * 24 * time.Hour
+
+	// accessTokenDuration is the lifetime of the JWT access tokens. Clients are
+	// expected to use their refresh token for getting a new one once it expires.
+	accessTokenDuration = 15 * time.Minute
 )
 
 // NewLoginTokenHandler returns a new login handler which will use the information in
 // auth for deciding when device or program was logged in correctly by entering
-// username and password.
-func NewLoginTokenHandler(db *gorm.DB, secect string) http.Handler {
+// username and password. Failed attempts are counted by throttle.
+func NewLoginTokenHandler(
+	db *gorm.DB,
+	secect string,
+	throttle *loginThrottle,
+) http.Handler {
 	return &loginTokenHandler{
-		db:     db,
-		secect: secect,
+		db:       db,
+		secect:   secect,
+		throttle: throttle,
 	}
 }
 
@@ -32,8 +49,15 @@ func (h *loginTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	reqBody := struct {
-		User string `json:"username"`
-		Pass string `json:"password"`
+		User   string `json:"username"`
+		Pass   string `json:"password"`
+		Device string `json:"device"`
+		Cookie bool   `json:"set_cookie"`
+
+		// Used for the second step of the login when the user has two-factor
+		// authentication.
+		TwoFactorToken string `json:"two_factor_token"`
+		Code           string `json:"code"`
 	}{}
 
 	dec := json.NewDecoder(r.Body)
@@ -47,51 +71,136 @@ func (h *loginTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkLoginCreds(reqBody.User, reqBody.Pass, h.db) {
-		respondWithJSONError(w, http.StatusUnauthorized, wrongLoginText)
-		return
-	}
+	auditUsername(r, reqBody.User)
 
-	now := time.Now()
-	pl := jwt.Payload{
-		IssuedAt:       jwt.NumericDate(now),
-		ExpirationTime: jwt.NumericDate(time.Now().Add(rememberMeDuration)),
+	var user *User
+	if reqBody.TwoFactorToken != "" {
+		user = h.userFromTwoFactorToken(reqBody.TwoFactorToken)
+		if user == nil {
+			respondWithJSONError(w, http.StatusUnauthorized, invalidTwoFactorTokenText)
+			return
+		}
+	} else {
+		var (
+			wait time.Duration
+			ok   bool
+		)
+		user, wait, ok = h.throttle.checkLoginCreds(r, reqBody.User, reqBody.Pass, h.db)
+		if wait > 0 {
+			respondWithTooManyAttempts(w, wait)
+			return
+		}
+		if !ok {
+			respondWithJSONError(w, http.StatusUnauthorized, wrongLoginText)
+			return
+		}
 	}
 
-	if len(h.secect) == 0 {
-		respondWithJSONError(
-			w,
-			http.StatusInternalServerError,
-			"Error generating JWT: secret is empty.",
-		)
+	auditUser(r, user)
+
+	if user.TOTPEnabled && !h.checkSecondFactor(w, r, user, reqBody.Code) {
 		return
 	}
+	h.throttle.succeeded(user.Username)
 
-	token, err := jwt.Sign(pl, jwt.NewHS256([]byte(h.secect)))
+	sess, refreshToken, err := newSession(h.db, user, r, reqBody.Device)
 	if err != nil {
 		respondWithJSONError(
 			w,
 			http.StatusInternalServerError,
-			"Error generating JWT: %s.",
+			"Error creating session: %s.",
 			err,
 		)
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	err = enc.Encode(&struct {
-		Token string `json:"token"`
-	}{
-		Token: string(token),
-	})
+	if reqBody.Cookie {
+		if err := setSessionCookie(w, r, user, sess, h.secect); err != nil {
+			respondWithJSONError(
+				w,
+				http.StatusInternalServerError,
+				"Error generating session cookie: %s.",
+				err,
+			)
+			return
+		}
+	}
+
+	respondWithTokens(w, user, sess, refreshToken, h.secect)
+}
+
+// userFromTwoFactorToken returns the user for which the token was issued after the
+// first step of the login. It returns nil when the token is not valid.
+func (h *loginTokenHandler) userFromTwoFactorToken(token string) *User {
+	userID, ok := verifyTwoFactorToken(token, h.secect)
+	if !ok {
+		return nil
+	}
+
+	var user User
+	if err := h.db.First(&user, userID).Error; err != nil || user.Disabled {
+		return nil
+	}
+
+	return &user
+}
+
+// checkSecondFactor is the second step of the login for users with two-factor
+// authentication. Without a code it responds with a token which could be sent
+// together with the code instead of the username and password. Wrong codes are
+// counted as failed logins. The response is written when false is returned.
+func (h *loginTokenHandler) checkSecondFactor(
+	w http.ResponseWriter,
+	r *http.Request,
+	user *User,
+	code string,
+) bool {
+	if code == "" {
+		token, err := signTwoFactorToken(user, h.secect)
+		if err != nil {
+			respondWithJSONError(
+				w,
+				http.StatusInternalServerError,
+				"Error generating token: %s.",
+				err,
+			)
+			return false
+		}
 
+		w.WriteHeader(http.StatusUnauthorized)
+		enc := json.NewEncoder(w)
+		_ = enc.Encode(struct {
+			Error          string `json:"error"`
+			TwoFactorToken string `json:"two_factor_token"`
+		}{
+			Error:          twoFactorRequiredText,
+			TwoFactorToken: token,
+		})
+		return false
+	}
+
+	ip := remoteIP(r)
+	if wait := h.throttle.retryAfter(ip, user.Username); wait > 0 {
+		respondWithTooManyAttempts(w, wait)
+		return false
+	}
+
+	ok, err := checkSecondFactor(h.db, user, code)
 	if err != nil {
 		respondWithJSONError(
 			w,
 			http.StatusInternalServerError,
-			"Error writing token response: %s.",
+			"Error checking two-factor code: %s.",
 			err,
 		)
-		return
+		return false
 	}
+
+	if !ok {
+		h.throttle.failed(ip, user.Username)
+		respondWithJSONError(w, http.StatusUnauthorized, wrongTwoFactorCodeText)
+		return false
+	}
+
+	return true
 }
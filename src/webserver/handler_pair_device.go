@@ -0,0 +1,213 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pairDeviceHandler is used by new devices which are being paired with an account.
+// They do not have any credentials yet so its endpoints are not authenticated.
+type pairDeviceHandler struct {
+	db       *gorm.DB
+	secret   string
+	throttle *loginThrottle
+}
+
+// NewPairDeviceHandler returns a handler for claiming pairing codes and polling
+// for the tokens afterwards.
+func NewPairDeviceHandler(
+	db *gorm.DB,
+	secret string,
+	throttle *loginThrottle,
+) http.Handler {
+	return &pairDeviceHandler{
+		db:       db,
+		secret:   secret,
+		throttle: throttle,
+	}
+}
+
+func (h *pairDeviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if routeTemplate(r) == APIv1EndpointPairClaim {
+		h.claim(w, r)
+		return
+	}
+
+	h.token(w, r)
+}
+
+// claim binds the pairing code to the device. The response contains a device code
+// which only this device knows and which it uses for polling.
+func (h *pairDeviceHandler) claim(w http.ResponseWriter, r *http.Request) {
+	reqBody := struct {
+		Code   string `json:"code"`
+		Device string `json:"device"`
+	}{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return
+	}
+
+	ip := remoteIP(r)
+	if wait := h.throttle.retryAfter(ip, ""); wait > 0 {
+		respondWithTooManyAttempts(w, wait)
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(reqBody.Code))
+	pairing, err := findPairing(h.db, "code = ? AND claimed = ?", code, false)
+	if errors.Is(err, errInvalidPairing) {
+		h.throttle.failed(ip, "")
+		respondWithJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error finding pairing: %s.",
+			err,
+		)
+		return
+	}
+
+	deviceCode, err := randomToken()
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error generating device code: %s.",
+			err,
+		)
+		return
+	}
+
+	hashed := hashToken(deviceCode)
+	res := h.db.Model(&Pairing{}).
+		Where("id = ? AND claimed = ?", pairing.ID, false).
+		Updates(map[string]interface{}{
+			"claimed":     true,
+			"device_code": hashed,
+			"device":      reqBody.Device,
+			"ip_address":  ip,
+		})
+	if res.Error != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error claiming pairing: %s.",
+			res.Error,
+		)
+		return
+	}
+
+	// Another device has claimed the code in the meantime.
+	if res.RowsAffected == 0 {
+		respondWithJSONError(w, http.StatusBadRequest, errInvalidPairing.Error())
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	_ = enc.Encode(struct {
+		DeviceCode string    `json:"device_code"`
+		Interval   int       `json:"interval"`
+		ExpiresAt  time.Time `json:"expires_at"`
+	}{
+		DeviceCode: deviceCode,
+		Interval:   pairingPollInterval,
+		ExpiresAt:  pairing.ExpiresAt,
+	})
+}
+
+// token responds with "202 Accepted" until the user confirms the pairing. Then
+// the device receives its tokens once and the pairing is removed.
+func (h *pairDeviceHandler) token(w http.ResponseWriter, r *http.Request) {
+	reqBody := struct {
+		DeviceCode string `json:"device_code"`
+	}{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return
+	}
+
+	if reqBody.DeviceCode == "" {
+		respondWithJSONError(w, http.StatusBadRequest, errInvalidPairing.Error())
+		return
+	}
+
+	pairing, err := findPairing(h.db, "device_code = ?", hashToken(reqBody.DeviceCode))
+	if errors.Is(err, errInvalidPairing) {
+		respondWithJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error finding pairing: %s.",
+			err,
+		)
+		return
+	}
+
+	if !pairing.Confirmed {
+		w.WriteHeader(http.StatusAccepted)
+		enc := json.NewEncoder(w)
+		_ = enc.Encode(struct {
+			Status   string `json:"status"`
+			Interval int    `json:"interval"`
+		}{
+			Status:   "pending",
+			Interval: pairingPollInterval,
+		})
+		return
+	}
+
+	// Deleting first makes sure the tokens are issued only once even when the
+	// device polls concurrently.
+	res := h.db.Where("id = ? AND confirmed = ?", pairing.ID, true).Delete(&Pairing{})
+	if res.Error != nil || res.RowsAffected == 0 {
+		respondWithJSONError(w, http.StatusBadRequest, errInvalidPairing.Error())
+		return
+	}
+
+	var user User
+	if err := h.db.First(&user, pairing.UserID).Error; err != nil || user.Disabled {
+		respondWithJSONError(w, http.StatusBadRequest, errInvalidPairing.Error())
+		return
+	}
+
+	auditUser(r, &user)
+
+	sess, refreshToken, err := newSession(h.db, &user, r, pairing.Device)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error creating session: %s.",
+			err,
+		)
+		return
+	}
+
+	respondWithTokens(w, &user, sess, refreshToken, h.secret)
+}
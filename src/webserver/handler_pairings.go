@@ -0,0 +1,169 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+const (
+	// pairingQRCodeSize is the width and height of the pairing QR code in pixels.
+	pairingQRCodeSize = 256
+)
+
+// PairingsHandler is used by logged in users for pairing new devices with their
+// account. See Pairing for the whole process.
+type PairingsHandler struct {
+	db *gorm.DB
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ph PairingsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ph.handleRequest)
+}
+
+func (ph PairingsHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	idString, ok := mux.Vars(req)["pairingID"]
+	if !ok {
+		if req.Method != http.MethodPost {
+			http.NotFoundHandler().ServeHTTP(writer, req)
+			return nil
+		}
+		return ph.create(writer, user)
+	}
+
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing pairingID: %s",
+			err,
+		)
+		return nil
+	}
+
+	pairing, err := findPairing(ph.db, "id = ? AND user_id = ?", id, user.ID)
+	if errors.Is(err, errInvalidPairing) {
+		respondWithJSONError(writer, http.StatusNotFound, "pairing not found")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case req.Method == http.MethodGet && routeTemplate(req) == APIv1EndpointPairingQRCode:
+		return ph.qrCode(writer, pairing)
+	case req.Method == http.MethodGet:
+		enc := json.NewEncoder(writer)
+		return enc.Encode(pairing)
+	case req.Method == http.MethodPut:
+		return ph.confirm(writer, pairing)
+	case req.Method == http.MethodDelete:
+		if err := ph.db.Delete(pairing).Error; err != nil {
+			return err
+		}
+		writer.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// create starts a new pairing for the user. The code is present only in this
+// response and in the QR code.
+func (ph PairingsHandler) create(writer http.ResponseWriter, user *User) error {
+	if err := removeExpiredPairings(ph.db); err != nil {
+		return err
+	}
+
+	code, err := randomReadableCode()
+	if err != nil {
+		return err
+	}
+
+	pairing := Pairing{
+		UserID:    user.ID,
+		Code:      code,
+		ExpiresAt: time.Now().Add(pairingDuration),
+	}
+
+	if err := ph.db.Create(&pairing).Error; err != nil {
+		return err
+	}
+
+	qrURL := strings.Replace(
+		APIv1EndpointPairingQRCode,
+		"{pairingID}",
+		strconv.FormatUint(uint64(pairing.ID), 10),
+		1,
+	)
+
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		Pairing
+		Code      string `json:"code"`
+		QRCodeURL string `json:"qr_code_url"`
+	}{
+		Pairing:   pairing,
+		Code:      code,
+		QRCodeURL: qrURL,
+	})
+}
+
+// qrCode writes a PNG image with the pairing code for scanning by the new device.
+func (ph PairingsHandler) qrCode(writer http.ResponseWriter, pairing *Pairing) error {
+	png, err := qrcode.Encode(pairing.Code, qrcode.Medium, pairingQRCodeSize)
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "image/png")
+	writer.Header().Set("Cache-Control", "no-store")
+	_, err = writer.Write(png)
+	return err
+}
+
+// confirm allows the device which claimed the code to receive its tokens.
+func (ph PairingsHandler) confirm(writer http.ResponseWriter, pairing *Pairing) error {
+	if !pairing.Claimed {
+		respondWithJSONError(
+			writer,
+			http.StatusConflict,
+			"no device has claimed the pairing code yet",
+		)
+		return nil
+	}
+
+	pairing.Confirmed = true
+	if err := ph.db.Model(pairing).Update("confirmed", true).Error; err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(pairing)
+}
+
+// NewPairingsHandler returns a new PairingsHandler which stores pairings in db.
+func NewPairingsHandler(db *gorm.DB) *PairingsHandler {
+	return &PairingsHandler{
+		db: db,
+	}
+}
@@ -0,0 +1,272 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	passkeysDisabledText = "passkeys are not configured on this server"
+	invalidCeremonyText  = "invalid or expired ceremony"
+)
+
+// PasskeysHandler lets users register, list and remove the passkeys for their
+// own account.
+type PasskeysHandler struct {
+	db         *gorm.DB
+	webAuthn   *webauthn.WebAuthn
+	ceremonies *ceremonyStore
+	throttle   *loginThrottle
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ph PasskeysHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ph.handleRequest)
+}
+
+func (ph PasskeysHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	idString, ok := mux.Vars(req)["passkeyID"]
+
+	switch {
+	case req.Method == http.MethodDelete && ok:
+		return ph.remove(writer, user, idString)
+	case req.Method == http.MethodGet && !ok:
+		return ph.list(writer, user)
+	}
+
+	if ph.webAuthn == nil {
+		respondWithJSONError(writer, http.StatusNotFound, passkeysDisabledText)
+		return nil
+	}
+
+	switch {
+	case req.Method == http.MethodPost && routeTemplate(req) == APIv1EndpointPasskeysFinish:
+		return ph.finishRegistration(writer, req, user)
+	case req.Method == http.MethodPost && !ok:
+		return ph.beginRegistration(writer, req, user)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+func (ph PasskeysHandler) list(writer http.ResponseWriter, user *User) error {
+	passkeys := []Passkey{}
+	if err := ph.db.Where("user_id = ?", user.ID).Order("id").Find(&passkeys).Error; err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(passkeys)
+}
+
+// beginRegistration starts the registration ceremony. The options in the response
+// are meant to be passed to navigator.credentials.create() in the browser. The
+// password is required so that a stolen token could not be used for adding a
+// passkey which outlives it.
+func (ph PasskeysHandler) beginRegistration(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Password string `json:"password"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil && !errors.Is(err, io.EOF) {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if !checkUserPassword(writer, req, ph.throttle, user, reqBody.Password) {
+		return nil
+	}
+
+	waUser, err := loadWebAuthnUser(ph.db, user)
+	if err != nil {
+		return err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(waUser.passkeys))
+	for _, cred := range waUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+
+	// The credentials must be discoverable so that the login does not require
+	// entering the username first.
+	creation, session, err := ph.webAuthn.BeginRegistration(
+		waUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return err
+	}
+
+	ceremonyID, err := ph.ceremonies.start(user.ID, session)
+	if errors.Is(err, errTooManyCeremonies) {
+		respondWithUnavailable(writer, ceremonyRetryAfter, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		CeremonyID string                       `json:"ceremony_id"`
+		Options    *protocol.CredentialCreation `json:"options"`
+	}{
+		CeremonyID: ceremonyID,
+		Options:    creation,
+	})
+}
+
+// finishRegistration verifies the new credential created by the authenticator and
+// stores it as a passkey.
+func (ph PasskeysHandler) finishRegistration(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		CeremonyID string          `json:"ceremony_id"`
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	cer, ok := ph.ceremonies.finish(reqBody.CeremonyID)
+	if !ok || cer.userID != user.ID {
+		respondWithJSONError(writer, http.StatusBadRequest, invalidCeremonyText)
+		return nil
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(
+		bytes.NewReader(reqBody.Credential),
+	)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing credential: %s.",
+			err,
+		)
+		return nil
+	}
+
+	waUser, err := loadWebAuthnUser(ph.db, user)
+	if err != nil {
+		return err
+	}
+
+	cred, err := ph.webAuthn.CreateCredential(waUser, cer.session, parsed)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error verifying credential: %s.",
+			err,
+		)
+		return nil
+	}
+
+	passkey := Passkey{
+		UserID: user.ID,
+		Name:   strings.TrimSpace(reqBody.Name),
+	}
+	if passkey.Name == "" {
+		passkey.Name = "Passkey"
+	}
+	if err := passkey.setCredential(cred); err != nil {
+		return err
+	}
+
+	if err := ph.db.Create(&passkey).Error; err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	return enc.Encode(passkey)
+}
+
+func (ph PasskeysHandler) remove(
+	writer http.ResponseWriter,
+	user *User,
+	idString string,
+) error {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing passkeyID: %s",
+			err,
+		)
+		return nil
+	}
+
+	res := ph.db.Where("id = ? AND user_id = ?", id, user.ID).Delete(&Passkey{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		respondWithJSONError(writer, http.StatusNotFound, "passkey not found")
+		return nil
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewPasskeysHandler returns a new PasskeysHandler. The webAuthn relying party may
+// be nil in which case passkeys could only be listed and removed. Wrong passwords
+// are counted by throttle.
+func NewPasskeysHandler(
+	db *gorm.DB,
+	webAuthn *webauthn.WebAuthn,
+	ceremonies *ceremonyStore,
+	throttle *loginThrottle,
+) *PasskeysHandler {
+	return &PasskeysHandler{
+		db:         db,
+		webAuthn:   webAuthn,
+		ceremonies: ceremonies,
+		throttle:   throttle,
+	}
+}
@@ -0,0 +1,433 @@
+package webserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+)
+
+const (
+	testRPID   = "music.example.com"
+	testOrigin = "https://music.example.com"
+)
+
+// TestPasskeyRoundTrip registers a passkey for a user with a software
+// authenticator and then logs in with it.
+func TestPasskeyRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", RoleListener)
+	webAuthn := newTestWebAuthn(t)
+	ceremonies := newCeremonyStore()
+	throttle := newLoginThrottle()
+
+	passkeys := newTestRouter(
+		NewPasskeysHandler(db, webAuthn, ceremonies, throttle),
+		user,
+		APIv1EndpointPasskeys,
+		APIv1EndpointPasskeysFinish,
+	)
+	login := newTestRouter(
+		NewPasskeyLoginHandler(db, testSecret, webAuthn, ceremonies, throttle),
+		nil,
+		APIv1EndpointPasskeyLoginBegin,
+		APIv1EndpointPasskeyLoginFinish,
+	)
+
+	auth := newSoftAuthenticator(t, testRPID, testOrigin)
+
+	var creation struct {
+		CeremonyID string                      `json:"ceremony_id"`
+		Options    protocol.CredentialCreation `json:"options"`
+	}
+	// A token is not enough for adding a passkey to the account.
+	resp := doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeys, nil)
+	decodeJSON(t, resp, http.StatusForbidden, nil)
+
+	resp = doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeys, map[string]string{
+		"password": "password",
+	})
+	decodeJSON(t, resp, http.StatusOK, &creation)
+
+	var passkey Passkey
+	resp = doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeysFinish, map[string]interface{}{
+		"ceremony_id": creation.CeremonyID,
+		"name":        "Laptop",
+		"credential":  auth.create(t, creation.Options.Response),
+	})
+	decodeJSON(t, resp, http.StatusCreated, &passkey)
+
+	if passkey.UserID != user.ID || passkey.Name != "Laptop" {
+		t.Errorf("unexpected passkey stored: %+v", passkey)
+	}
+
+	var assertion struct {
+		CeremonyID string                       `json:"ceremony_id"`
+		Options    protocol.CredentialAssertion `json:"options"`
+	}
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginBegin, nil)
+	decodeJSON(t, resp, http.StatusOK, &assertion)
+
+	var tokens tokenResponse
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginFinish, map[string]interface{}{
+		"ceremony_id": assertion.CeremonyID,
+		"device":      "Laptop",
+		"credential":  auth.get(t, assertion.Options.Response),
+	})
+	decodeJSON(t, resp, http.StatusOK, &tokens)
+
+	if tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Errorf("expected tokens in the response but got %+v", tokens)
+	}
+
+	var sessions []Session
+	if err := db.Where("user_id = ?", user.ID).Find(&sessions).Error; err != nil {
+		t.Fatalf("listing sessions: %s", err)
+	}
+	if len(sessions) != 1 || sessions[0].Device != "Laptop" {
+		t.Errorf("expected one session for the device but got %+v", sessions)
+	}
+
+	if err := db.First(&passkey, passkey.ID).Error; err != nil {
+		t.Fatalf("finding passkey: %s", err)
+	}
+	if passkey.LastUsedAt == nil {
+		t.Errorf("expected the passkey last used time to be set")
+	}
+
+	// Every ceremony could be finished only once.
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginFinish, map[string]interface{}{
+		"ceremony_id": assertion.CeremonyID,
+		"credential":  auth.get(t, assertion.Options.Response),
+	})
+	decodeJSON(t, resp, http.StatusBadRequest, nil)
+
+	// Changing the password removes the passkeys.
+	if err := setUserPassword(db, user, "new-password"); err != nil {
+		t.Fatalf("setting password: %s", err)
+	}
+	var count int64
+	db.Model(&Passkey{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("expected the passkeys to be removed but there are %d", count)
+	}
+}
+
+// TestPasskeyLoginWrongKey makes sure an assertion signed by a key other than the
+// registered one is rejected.
+func TestPasskeyLoginWrongKey(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", RoleListener)
+	webAuthn := newTestWebAuthn(t)
+	ceremonies := newCeremonyStore()
+
+	passkeys := newTestRouter(
+		NewPasskeysHandler(db, webAuthn, ceremonies, newLoginThrottle()),
+		user,
+		APIv1EndpointPasskeys,
+		APIv1EndpointPasskeysFinish,
+	)
+	login := newTestRouter(
+		NewPasskeyLoginHandler(db, testSecret, webAuthn, ceremonies, newLoginThrottle()),
+		nil,
+		APIv1EndpointPasskeyLoginBegin,
+		APIv1EndpointPasskeyLoginFinish,
+	)
+
+	auth := newSoftAuthenticator(t, testRPID, testOrigin)
+
+	var creation struct {
+		CeremonyID string                      `json:"ceremony_id"`
+		Options    protocol.CredentialCreation `json:"options"`
+	}
+	resp := doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeys, map[string]string{
+		"password": "password",
+	})
+	decodeJSON(t, resp, http.StatusOK, &creation)
+
+	resp = doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeysFinish, map[string]interface{}{
+		"ceremony_id": creation.CeremonyID,
+		"credential":  auth.create(t, creation.Options.Response),
+	})
+	decodeJSON(t, resp, http.StatusCreated, nil)
+
+	// The same credential ID but signed with another key.
+	forged := newSoftAuthenticator(t, testRPID, testOrigin)
+	forged.credentialID = auth.credentialID
+	forged.userHandle = auth.userHandle
+
+	var assertion struct {
+		CeremonyID string                       `json:"ceremony_id"`
+		Options    protocol.CredentialAssertion `json:"options"`
+	}
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginBegin, nil)
+	decodeJSON(t, resp, http.StatusOK, &assertion)
+
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginFinish, map[string]interface{}{
+		"ceremony_id": assertion.CeremonyID,
+		"credential":  forged.get(t, assertion.Options.Response),
+	})
+	decodeJSON(t, resp, http.StatusUnauthorized, nil)
+}
+
+// TestPasskeyLoginLimit checks that logins are refused while the ceremony store
+// is full and that expired ceremonies make room for new ones.
+func TestPasskeyLoginLimit(t *testing.T) {
+	db := newTestDB(t)
+	ceremonies := newCeremonyStore()
+	ceremonies.max = 2
+
+	login := newTestRouter(
+		NewPasskeyLoginHandler(db, testSecret, newTestWebAuthn(t), ceremonies, newLoginThrottle()),
+		nil,
+		APIv1EndpointPasskeyLoginBegin,
+	)
+
+	for i := 0; i < ceremonies.max; i++ {
+		resp := doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginBegin, nil)
+		decodeJSON(t, resp, http.StatusOK, nil)
+	}
+
+	resp := doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginBegin, nil)
+	decodeJSON(t, resp, http.StatusServiceUnavailable, nil)
+	if resp.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header")
+	}
+
+	ceremonies.mu.Lock()
+	for id, c := range ceremonies.ceremonies {
+		c.expires = time.Now().Add(-time.Second)
+		ceremonies.ceremonies[id] = c
+	}
+	ceremonies.pruned = time.Time{}
+	ceremonies.mu.Unlock()
+
+	resp = doJSON(t, login, http.MethodPost, APIv1EndpointPasskeyLoginBegin, nil)
+	decodeJSON(t, resp, http.StatusOK, nil)
+	if len(ceremonies.ceremonies) != 1 {
+		t.Errorf("expected the expired ceremonies to be removed")
+	}
+}
+
+// TestPasskeysDisabled checks that registration is not possible when passkeys are
+// not configured.
+func TestPasskeysDisabled(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", RoleListener)
+
+	passkeys := newTestRouter(
+		NewPasskeysHandler(db, nil, newCeremonyStore(), newLoginThrottle()),
+		user,
+		APIv1EndpointPasskeys,
+	)
+
+	resp := doJSON(t, passkeys, http.MethodPost, APIv1EndpointPasskeys, nil)
+	decodeJSON(t, resp, http.StatusNotFound, nil)
+
+	resp = doJSON(t, passkeys, http.MethodGet, APIv1EndpointPasskeys, nil)
+	decodeJSON(t, resp, http.StatusOK, nil)
+}
+
+func newTestWebAuthn(t *testing.T) *webauthn.WebAuthn {
+	t.Helper()
+
+	webAuthn, err := newWebAuthn(&config.WebAuthnConfig{
+		RPID:    testRPID,
+		Origins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("creating WebAuthn relying party: %s", err)
+	}
+	return webAuthn
+}
+
+// softAuthenticator is a WebAuthn authenticator implemented in software. It holds
+// a single discoverable ES256 credential and always verifies the user.
+type softAuthenticator struct {
+	rpID   string
+	origin string
+
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatalf("generating credential ID: %s", err)
+	}
+
+	return &softAuthenticator{
+		rpID:         rpID,
+		origin:       origin,
+		key:          key,
+		credentialID: credentialID,
+	}
+}
+
+// create answers navigator.credentials.create() with a "none" attestation. It
+// returns the JSON which the browser would send to the server.
+func (a *softAuthenticator) create(
+	t *testing.T,
+	opts protocol.PublicKeyCredentialCreationOptions,
+) json.RawMessage {
+	t.Helper()
+
+	if userID, ok := opts.User.ID.(string); ok {
+		handle, err := base64.RawURLEncoding.DecodeString(userID)
+		if err != nil {
+			t.Fatalf("decoding user handle: %s", err)
+		}
+		a.userHandle = handle
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: padTo32(a.key.PublicKey.X.Bytes()),
+		YCoord: padTo32(a.key.PublicKey.Y.Bytes()),
+	})
+	if err != nil {
+		t.Fatalf("encoding public key: %s", err)
+	}
+
+	// The attested credential data is the AAGUID, the length of the credential
+	// ID, the credential ID and the public key.
+	attested := make([]byte, 16, 16+2+len(a.credentialID)+len(publicKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	authData := a.authenticatorData(protocol.FlagAttestedCredentialData)
+	authData = append(authData, attested...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Format       string                 `cbor:"fmt"`
+		AttStatement map[string]interface{} `cbor:"attStmt"`
+		AuthData     []byte                 `cbor:"authData"`
+	}{
+		Format:       "none",
+		AttStatement: map[string]interface{}{},
+		AuthData:     authData,
+	})
+	if err != nil {
+		t.Fatalf("encoding attestation object: %s", err)
+	}
+
+	return a.credentialJSON(t, map[string]string{
+		"clientDataJSON":    a.clientData(t, protocol.CreateCeremony, opts.Challenge),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers navigator.credentials.get() with an assertion for the credential.
+func (a *softAuthenticator) get(
+	t *testing.T,
+	opts protocol.PublicKeyCredentialRequestOptions,
+) json.RawMessage {
+	t.Helper()
+
+	clientData := a.clientData(t, protocol.AssertCeremony, opts.Challenge)
+	clientDataJSON, _ := base64.RawURLEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	a.signCount++
+	authData := a.authenticatorData(0)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("signing assertion: %s", err)
+	}
+
+	return a.credentialJSON(t, map[string]string{
+		"clientDataJSON":    clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+// authenticatorData returns the hash of the relying party ID, the flags and the
+// signature counter. The user is always present and verified.
+func (a *softAuthenticator) authenticatorData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	flags |= protocol.FlagUserPresent | protocol.FlagUserVerified
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, byte(flags))
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+// clientData returns the base64url encoded client data JSON as the browser
+// would have collected it.
+func (a *softAuthenticator) clientData(
+	t *testing.T,
+	ceremony protocol.CeremonyType,
+	challenge protocol.URLEncodedBase64,
+) string {
+	t.Helper()
+
+	data, err := json.Marshal(protocol.CollectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	if err != nil {
+		t.Fatalf("encoding client data: %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *softAuthenticator) credentialJSON(
+	t *testing.T,
+	response map[string]string,
+) json.RawMessage {
+	t.Helper()
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	data, err := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatalf("encoding credential: %s", err)
+	}
+	return data
+}
+
+// padTo32 left pads an elliptic curve coordinate to the size of P-256 ones.
+func padTo32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte, 32-len(b)), b...)
+}
@@ -0,0 +1,121 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+// PlayEventsHandler receives the play events which the clients send while they
+// are playing a track. The listens of the tracks are counted from them.
+type PlayEventsHandler struct {
+	library library.Library
+	plays   *playTracker
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (ph PlayEventsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, ph.handleRequest)
+}
+
+func (ph PlayEventsHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	trackID, err := strconv.ParseInt(mux.Vars(req)["fileID"], 10, 64)
+	if err != nil {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+
+	reqBody := struct {
+		Event    string  `json:"event"`
+		PlayID   string  `json:"play_id"`
+		Position float64 `json:"position"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if reqBody.Position < 0 {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`"position" must be a non-negative number of seconds`,
+		)
+		return nil
+	}
+	position := time.Duration(reqBody.Position * float64(time.Second))
+
+	var userID uint
+	if user := UserFromContext(req.Context()); user != nil {
+		userID = user.ID
+	}
+
+	var status playStatus
+	switch reqBody.Event {
+	case playEventStarted:
+		track, err := ph.library.GetTrack(trackID)
+		if errors.Is(err, library.ErrTrackNotFound) {
+			respondWithJSONError(writer, http.StatusNotFound, "track not found")
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		status, err = ph.plays.start(userID, playClient(req), track, position)
+		if err != nil {
+			return err
+		}
+		writer.WriteHeader(http.StatusCreated)
+	case playEventProgress, playEventFinished:
+		status, err = ph.plays.update(
+			reqBody.PlayID,
+			userID,
+			trackID,
+			position,
+			reqBody.Event == playEventFinished,
+		)
+		if errors.Is(err, errPlayNotFound) {
+			respondWithJSONError(writer, http.StatusNotFound, err.Error())
+			return nil
+		} else if err != nil {
+			return err
+		}
+	default:
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`"event" must be one of "%s", "%s" or "%s"`,
+			playEventStarted,
+			playEventProgress,
+			playEventFinished,
+		)
+		return nil
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(status)
+}
+
+// NewPlayEventsHandler returns a new PlayEventsHandler which counts the listens
+// of the tracks in lib.
+func NewPlayEventsHandler(lib library.Library, plays *playTracker) *PlayEventsHandler {
+	return &PlayEventsHandler{
+		library: lib,
+		plays:   plays,
+	}
+}
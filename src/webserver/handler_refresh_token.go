@@ -0,0 +1,100 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	invalidRefreshTokenText = "invalid or expired refresh token"
+)
+
+type refreshTokenHandler struct {
+	db     *gorm.DB
+	secret string
+}
+
+// NewRefreshTokenHandler returns a handler which exchanges a refresh token for a new
+// access token. The refresh token is rotated on every use so a token which has been
+// used once will not be accepted again.
+func NewRefreshTokenHandler(db *gorm.DB, secret string) http.Handler {
+	return &refreshTokenHandler{
+		db:     db,
+		secret: secret,
+	}
+}
+
+func (h *refreshTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	reqBody := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return
+	}
+
+	if reqBody.RefreshToken == "" {
+		respondWithJSONError(w, http.StatusUnauthorized, invalidRefreshTokenText)
+		return
+	}
+
+	var sess Session
+	err := h.db.Where("refresh_token = ?", hashToken(reqBody.RefreshToken)).
+		First(&sess).Error
+	if err != nil {
+		respondWithJSONError(w, http.StatusUnauthorized, invalidRefreshTokenText)
+		return
+	}
+
+	if time.Now().After(sess.ExpiresAt) {
+		h.db.Delete(&sess)
+		respondWithJSONError(w, http.StatusUnauthorized, invalidRefreshTokenText)
+		return
+	}
+
+	var user User
+	if err := h.db.First(&user, sess.UserID).Error; err != nil || user.Disabled {
+		respondWithJSONError(w, http.StatusUnauthorized, invalidRefreshTokenText)
+		return
+	}
+	auditUser(r, &user)
+
+	refreshToken, err := sess.rotate(h.db, r)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error refreshing session: %s.",
+			err,
+		)
+		return
+	}
+
+	// Browsers which authenticate with the session cookie get a new one since
+	// refreshing invalidates the old.
+	if _, err := r.Cookie(sessionCookieName); err == nil {
+		if err := setSessionCookie(w, r, &user, &sess, h.secret); err != nil {
+			respondWithJSONError(
+				w,
+				http.StatusInternalServerError,
+				"Error generating session cookie: %s.",
+				err,
+			)
+			return
+		}
+	}
+
+	respondWithTokens(w, &user, &sess, refreshToken, h.secret)
+}
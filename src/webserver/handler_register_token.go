@@ -2,32 +2,45 @@ package webserver
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"time"
 
-	"github.com/gbrlsnchs/jwt/v3"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
 )
 
 type registerTokenHandler struct {
 	db     *gorm.DB
 	secect string
+	mode   string
 }
 
-func NewRigisterTokenHandler(db *gorm.DB, secect string) http.Handler {
+// NewRigisterTokenHandler returns a handler which creates new accounts and logs them
+// in. The registration mode is one of the config.Registration* values and controls
+// whether an invite code is required.
+func NewRigisterTokenHandler(db *gorm.DB, secect string, mode string) http.Handler {
 	return &registerTokenHandler{
 		db:     db,
 		secect: secect,
+		mode:   mode,
 	}
 }
 
 func (register *registerTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
+	if register.mode == config.RegistrationDisabled {
+		respondWithJSONError(w, http.StatusForbidden, "registration is disabled")
+		return
+	}
+
 	reqBody := struct {
-		User string `json:"username"`
-		Pass string `json:"password"`
+		User       string `json:"username"`
+		Pass       string `json:"password"`
+		Device     string `json:"device"`
+		InviteCode string `json:"invite_code"`
 	}{}
 
 	dec := json.NewDecoder(r.Body)
@@ -41,78 +54,84 @@ func (register *registerTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	bytes, err := bcrypt.GenerateFromPassword([]byte(reqBody.Pass), 14)
-	if err != nil {
+	auditUsername(r, reqBody.User)
+
+	if reqBody.User == "" || reqBody.Pass == "" {
 		respondWithJSONError(
 			w,
-			http.StatusInternalServerError,
-			"Error hash Password: %s.",
-			err,
+			http.StatusBadRequest,
+			"Username and password must not be empty.",
 		)
 		return
 	}
 
-	// Perform the registration logic here
-	// You can use the reqBody.User and reqBody.Password to create a new user record in the database
-	// and generate a registration token if needed
-
-	// Example registration logic
-	// create a new user in the database
-	user := User{
-		Username: reqBody.User,
-		Password: string(bytes),
-	}
-
-	if err := register.db.Create(&user).Error; err != nil {
+	passwordHash, err := hashPassword(reqBody.Pass)
+	if err != nil {
 		respondWithJSONError(
 			w,
 			http.StatusInternalServerError,
-			"Error saving user to database: %s.",
+			"Error hash Password: %s.",
 			err,
 		)
 		return
 	}
 
-	now := time.Now()
-	pl := jwt.Payload{
-		IssuedAt:       jwt.NumericDate(now),
-		ExpirationTime: jwt.NumericDate(time.Now().Add(rememberMeDuration)),
+	user := User{
+		Username: reqBody.User,
+		Password: passwordHash,
+		Role:     RoleListener,
 	}
 
-	if len(register.secect) == 0 {
-		respondWithJSONError(
-			w,
-			http.StatusInternalServerError,
-			"Error generating JWT: secret is empty.",
-		)
-		return
-	}
+	err = register.db.Transaction(func(tx *gorm.DB) error {
+		var usersCount int64
+		if err := tx.Model(&User{}).Count(&usersCount).Error; err != nil {
+			return fmt.Errorf("counting users: %w", err)
+		}
+
+		// The very first user of the server becomes its administrator. It does
+		// not need an invite since there is nobody who could have created it.
+		if usersCount == 0 {
+			user.Role = RoleAdmin
+		} else if register.mode == config.RegistrationInviteOnly {
+			invite, err := consumeInvite(tx, reqBody.InviteCode)
+			if err != nil {
+				return err
+			}
+			user.Role = invite.Role
+		}
+
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("saving user to database: %w", err)
+		}
+
+		return nil
+	})
 
-	token, err := jwt.Sign(pl, jwt.NewHS256([]byte(register.secect)))
-	if err != nil {
+	if errors.Is(err, errInvalidInvite) {
+		respondWithJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
 		respondWithJSONError(
 			w,
 			http.StatusInternalServerError,
-			"Error generating JWT: %s.",
+			"Error registering user: %s.",
 			err,
 		)
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	err = enc.Encode(&struct {
-		Token string `json:"token"`
-	}{
-		Token: string(token),
-	})
+	auditUser(r, &user)
 
+	sess, refreshToken, err := newSession(register.db, &user, r, reqBody.Device)
 	if err != nil {
 		respondWithJSONError(
 			w,
 			http.StatusInternalServerError,
-			"Error writing token response: %s.",
+			"Error creating session: %s.",
 			err,
 		)
 		return
 	}
+
+	respondWithTokens(w, &user, sess, refreshToken, register.secect)
 }
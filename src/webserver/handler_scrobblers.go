@@ -0,0 +1,183 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"NT106/Group01/MusicStreamingAPI/src/scrobble"
+)
+
+// ScrobblersHandler lets users connect their accounts with the scrobbling
+// services and disconnect them.
+type ScrobblersHandler struct {
+	scrobbling *scrobbling
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (sh ScrobblersHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, sh.handleRequest)
+}
+
+func (sh ScrobblersHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	if sh.scrobbling == nil {
+		respondWithJSONError(writer, http.StatusBadRequest, scrobblingDisabledText)
+		return nil
+	}
+
+	service, ok := mux.Vars(req)["service"]
+
+	switch {
+	case req.Method == http.MethodGet && !ok:
+		return sh.list(writer, req, user)
+	case req.Method == http.MethodPut && ok:
+		return sh.connect(writer, req, user, service)
+	case req.Method == http.MethodDelete && ok:
+		return sh.disconnect(writer, user, service)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// list writes the configured services and the accounts of the user together with
+// the number of their scrobbles which are waiting to be submitted. The Last.fm
+// authorization page redirects back to the "callback" query argument.
+func (sh ScrobblersHandler) list(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	accounts, err := sh.scrobbling.accounts(user.ID)
+	if err != nil {
+		return err
+	}
+
+	queued, err := sh.scrobbling.queued(user.ID)
+	if err != nil {
+		return err
+	}
+
+	type accountWithQueue struct {
+		ScrobblerAccount
+		Queued int64 `json:"queued"`
+	}
+
+	resp := struct {
+		Services      []string           `json:"services"`
+		LastFMAuthURL string             `json:"lastfm_auth_url,omitempty"`
+		Accounts      []accountWithQueue `json:"accounts"`
+	}{
+		Services: sh.scrobbling.serviceNames(),
+		Accounts: make([]accountWithQueue, 0, len(accounts)),
+	}
+
+	if sh.scrobbling.lastFM != nil {
+		resp.LastFMAuthURL = sh.scrobbling.lastFM.AuthURL(req.URL.Query().Get("callback"))
+	}
+
+	for _, account := range accounts {
+		resp.Accounts = append(resp.Accounts, accountWithQueue{
+			ScrobblerAccount: account,
+			Queued:           queued[account.Service],
+		})
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(resp)
+}
+
+// connect stores the account of the user with the service. The request body has
+// the ListenBrainz user token or the token which Last.fm has given after the user
+// has allowed access.
+func (sh ScrobblersHandler) connect(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+	service string,
+) error {
+	reqBody := struct {
+		Token string `json:"token"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	reqBody.Token = strings.TrimSpace(reqBody.Token)
+	if reqBody.Token == "" {
+		respondWithJSONError(writer, http.StatusBadRequest, "The token is required.")
+		return nil
+	}
+
+	account, err := sh.scrobbling.connect(req.Context(), user.ID, service, reqBody.Token)
+	switch {
+	case errors.Is(err, errUnknownScrobbler):
+		respondWithJSONError(writer, http.StatusNotFound, err.Error())
+		return nil
+	case errors.Is(err, scrobble.ErrInvalidCredentials),
+		errors.Is(err, scrobble.ErrRejected):
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"The token was not accepted by %s.",
+			service,
+		)
+		return nil
+	case errors.Is(err, errScrobblerUnavailable):
+		respondWithJSONError(writer, http.StatusBadGateway, err.Error())
+		return nil
+	case err != nil:
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(account)
+}
+
+// disconnect removes the account of the user with the service. Its scrobbles
+// which have not been submitted yet are discarded.
+func (sh ScrobblersHandler) disconnect(
+	writer http.ResponseWriter,
+	user *User,
+	service string,
+) error {
+	found, err := sh.scrobbling.disconnect(user.ID, service)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		respondWithJSONError(writer, http.StatusNotFound, "scrobbler account not found")
+		return nil
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewScrobblersHandler returns a new ScrobblersHandler. The scrobbling is nil when
+// it is not configured.
+func NewScrobblersHandler(scrobbling *scrobbling) *ScrobblersHandler {
+	return &ScrobblersHandler{
+		scrobbling: scrobbling,
+	}
+}
@@ -47,7 +47,21 @@ func (sh SearchHandler) search(writer http.ResponseWriter, req *http.Request) er
 		}
 	}
 
-	results := sh.library.Search(query)
+	filter, err := parseAudioFilter(req.Form)
+	if err != nil {
+		respondWithJSONError(writer, http.StatusBadRequest, "%s", err)
+		return nil
+	}
+
+	version, modified := sh.library.Version()
+	if checkNotModified(writer, req, cacheControlSearch, libraryETag(version), modified) {
+		return nil
+	}
+
+	results := sh.library.Search(library.SearchArgs{
+		Query:  query,
+		Filter: filter,
+	})
 
 	if len(results) == 0 {
 		_, err := writer.Write([]byte("[]"))
@@ -0,0 +1,164 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	// currentSessionID may be used in place of a session ID for referring to the
+	// session with which the request was made.
+	currentSessionID = "current"
+
+	tokenRequiredText = "authentication with a token is required"
+)
+
+// SessionsHandler lists and revokes the sessions (logged in devices) of the user
+// which makes the request.
+type SessionsHandler struct {
+	db *gorm.DB
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (sh SessionsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, sh.handleRequest)
+}
+
+func (sh SessionsHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	current := sessionFromContext(req.Context())
+	idString, ok := mux.Vars(req)["sessionID"]
+
+	switch {
+	case req.Method == http.MethodGet && !ok:
+		return sh.list(writer, user, current)
+	case req.Method == http.MethodDelete && !ok:
+		return sh.revokeAll(writer, user)
+	case req.Method == http.MethodDelete:
+		return sh.revoke(writer, user, current, idString)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// list writes the active sessions of the user. The current session is nil when the
+// request was not authenticated with a token.
+func (sh SessionsHandler) list(
+	writer http.ResponseWriter,
+	user *User,
+	current *Session,
+) error {
+	var sessions []Session
+	err := sh.db.
+		Where("user_id = ? AND expires_at > ?", user.ID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return err
+	}
+
+	type sessionJSON struct {
+		ID         uint      `json:"id"`
+		Device     string    `json:"device"`
+		UserAgent  string    `json:"user_agent"`
+		IPAddress  string    `json:"ip_address"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		ExpiresAt  time.Time `json:"expires_at"`
+		Current    bool      `json:"current"`
+	}
+
+	retData := make([]sessionJSON, 0, len(sessions))
+	for _, sess := range sessions {
+		retData = append(retData, sessionJSON{
+			ID:         sess.ID,
+			Device:     sess.Device,
+			UserAgent:  sess.UserAgent,
+			IPAddress:  sess.IPAddress,
+			CreatedAt:  sess.CreatedAt,
+			LastUsedAt: sess.LastUsedAt,
+			ExpiresAt:  sess.ExpiresAt,
+			Current:    current != nil && sess.ID == current.ID,
+		})
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(retData)
+}
+
+func (sh SessionsHandler) revoke(
+	writer http.ResponseWriter,
+	user *User,
+	current *Session,
+	idString string,
+) error {
+	var id uint
+	if idString == currentSessionID {
+		if current == nil {
+			respondWithJSONError(writer, http.StatusBadRequest, tokenRequiredText)
+			return nil
+		}
+		id = current.ID
+	} else {
+		parsed, err := strconv.ParseUint(idString, 10, 64)
+		if err != nil {
+			respondWithJSONError(
+				writer,
+				http.StatusBadRequest,
+				"Parsing sessionID: %s",
+				err,
+			)
+			return nil
+		}
+		id = uint(parsed)
+	}
+
+	res := sh.db.Where("id = ? AND user_id = ?", id, user.ID).
+		Delete(&Session{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		respondWithJSONError(writer, http.StatusNotFound, "session not found")
+		return nil
+	}
+
+	if current != nil && id == current.ID {
+		clearSessionCookie(writer)
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (sh SessionsHandler) revokeAll(writer http.ResponseWriter, user *User) error {
+	err := sh.db.Where("user_id = ?", user.ID).Delete(&Session{}).Error
+	if err != nil {
+		return err
+	}
+
+	clearSessionCookie(writer)
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewSessionsHandler returns a new SessionsHandler which stores sessions in db.
+func NewSessionsHandler(db *gorm.DB) *SessionsHandler {
+	return &SessionsHandler{
+		db: db,
+	}
+}
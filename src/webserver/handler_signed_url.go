@@ -0,0 +1,99 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// signedURLTargets maps the endpoints which issue signed URLs to the endpoints
+// for which the URLs are issued.
+var signedURLTargets = map[string]string{
+	APIv1EndpointFileSignedURL:  APIv1EndpointFile,
+	APIv1EndpointAlbumSignedURL: APIv1EndpointDownloadAlbum,
+}
+
+// SignedURLHandler issues short-lived signed URLs for files and albums. They are
+// useful for clients such as HTML audio elements which cannot send authentication
+// headers.
+type SignedURLHandler struct {
+	secret string
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (sh SignedURLHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	target, ok := signedURLTargets[routeTemplate(req)]
+	if !ok {
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return
+	}
+
+	varName, _ := routeVariable(target)
+	resourceID := mux.Vars(req)[varName]
+	if _, err := strconv.ParseInt(resourceID, 10, 64); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing %s: %s",
+			varName,
+			err,
+		)
+		return
+	}
+
+	duration := signedURLDuration
+	if expiresIn := req.URL.Query().Get("expires-in"); expiresIn != "" {
+		seconds, err := strconv.Atoi(expiresIn)
+		if err != nil || seconds < 1 {
+			respondWithJSONError(
+				writer,
+				http.StatusBadRequest,
+				`"expires-in" must be a positive number of seconds`,
+			)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	if duration > signedURLMaxDuration {
+		duration = signedURLMaxDuration
+	}
+
+	var userID uint
+	if user := UserFromContext(req.Context()); user != nil {
+		userID = user.ID
+	}
+
+	expiresAt := time.Now().Add(duration)
+	signed, err := signURL(target, resourceID, userID, expiresAt, sh.secret)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusInternalServerError,
+			"Error signing URL: %s.",
+			err,
+		)
+		return
+	}
+
+	enc := json.NewEncoder(writer)
+	_ = enc.Encode(struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		URL:       signed,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// NewSignedURLHandler returns a new SignedURLHandler which signs URLs with secret.
+func NewSignedURLHandler(secret string) *SignedURLHandler {
+	return &SignedURLHandler{
+		secret: secret,
+	}
+}
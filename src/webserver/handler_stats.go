@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	chartDefaultLimit = 20
+	chartMaxLimit     = 100
+)
+
+// chartPeriods are the possible values of the "period" query argument of the
+// charts. Zero means all time.
+var chartPeriods = map[string]time.Duration{
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+	"all":   0,
+}
+
+// StatsHandler serves the charts of the most played tracks, albums, artists and
+// genres and the yearly summaries of the users' listening.
+type StatsHandler struct {
+	stats library.Stats
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (sh StatsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, sh.handleRequest)
+}
+
+func (sh StatsHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if routeTemplate(req) == APIv1EndpointYearInReview {
+		return sh.yearInReview(writer, req)
+	}
+	return sh.chart(writer, req)
+}
+
+// chart returns the most played tracks, albums, artists or genres. The query arguments are:
+//
+//   - period, one of "week", "month" (the default), "year" and "all"
+//   - scope, "global" (the default) for the plays of everyone or "me" for the
+//     plays of the logged in user
+//   - limit, the number of results
+func (sh StatsHandler) chart(writer http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+
+	limit, err := parseLimit(query, chartDefaultLimit, chartMaxLimit)
+	if err != nil {
+		respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	args := library.ChartArgs{Limit: limit}
+
+	periodName := query.Get("period")
+	if periodName == "" {
+		periodName = "month"
+	}
+	period, ok := chartPeriods[periodName]
+	if !ok {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`"period" must be one of "week", "month", "year" or "all"`,
+		)
+		return nil
+	}
+	if period > 0 {
+		args.Since = time.Now().Add(-period)
+	}
+
+	switch query.Get("scope") {
+	case "", "global":
+	case "me":
+		user, ok := sh.listener(writer, req)
+		if !ok {
+			return nil
+		}
+		args.UserID = int64(user.ID)
+	default:
+		respondWithJSONError(writer, http.StatusBadRequest, `"scope" must be "global" or "me"`)
+		return nil
+	}
+
+	var chart interface{}
+	switch mux.Vars(req)["kind"] {
+	case "tracks":
+		chart, err = sh.stats.TopTracks(args)
+	case "albums":
+		chart, err = sh.stats.TopAlbums(args)
+	case "artists":
+		chart, err = sh.stats.TopArtists(args)
+	case "genres":
+		chart, err = sh.stats.TopGenres(args)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(chart)
+}
+
+// yearInReview returns the summary of the logged in user's year. The year could be
+// set with the "year" query argument and is the current one by default.
+func (sh StatsHandler) yearInReview(writer http.ResponseWriter, req *http.Request) error {
+	user, ok := sh.listener(writer, req)
+	if !ok {
+		return nil
+	}
+
+	year := time.Now().Year()
+	if value := req.URL.Query().Get("year"); value != "" {
+		num, err := strconv.Atoi(value)
+		if err != nil || num < 1 || num > 9999 {
+			respondWithJSONError(writer, http.StatusBadRequest, `"year" must be a year`)
+			return nil
+		}
+		year = num
+	}
+
+	review, err := sh.stats.YearInReview(int64(user.ID), year)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(review)
+}
+
+// listener returns the logged in user when it has access to the per-user features.
+// Otherwise it writes an error response and returns false.
+func (sh StatsHandler) listener(writer http.ResponseWriter, req *http.Request) (*User, bool) {
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil, false
+	}
+
+	if !user.Role.Allows(RoleListener) {
+		writer.WriteHeader(http.StatusForbidden)
+		_, _ = writer.Write([]byte(permissionDeniedJSON))
+		return nil, false
+	}
+
+	return user, true
+}
+
+// NewStatsHandler returns a new StatsHandler which reads from stats.
+func NewStatsHandler(stats library.Stats) *StatsHandler {
+	return &StatsHandler{
+		stats: stats,
+	}
+}
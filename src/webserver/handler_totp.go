@@ -0,0 +1,286 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+const (
+	// totpQRCodeSize is the width and height of the enrollment QR code in pixels.
+	totpQRCodeSize = 256
+
+	totpEnabledText    = "two-factor authentication is already enabled"
+	totpNotEnabledText = "two-factor authentication is not enabled"
+	totpNotStartedText = "two-factor enrollment has not been started"
+)
+
+// TOTPHandler lets users enable and disable two-factor authentication with time
+// based one-time passwords for their own account.
+type TOTPHandler struct {
+	db       *gorm.DB
+	throttle *loginThrottle
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (th TOTPHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, th.handleRequest)
+}
+
+func (th TOTPHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	user := UserFromContext(req.Context())
+	if user == nil {
+		respondWithJSONError(writer, http.StatusUnauthorized, authRequiredText)
+		return nil
+	}
+
+	switch route := routeTemplate(req); {
+	case route == APIv1EndpointAccountTOTPQRCode && req.Method == http.MethodGet:
+		return th.qrCode(writer, user)
+	case route == APIv1EndpointAccountRecoveryCodes && req.Method == http.MethodPost:
+		return th.regenerateRecoveryCodes(writer, req, user)
+	case route == APIv1EndpointAccountTOTP && req.Method == http.MethodPost:
+		return th.enroll(writer, user)
+	case route == APIv1EndpointAccountTOTP && req.Method == http.MethodPut:
+		return th.confirm(writer, req, user)
+	case route == APIv1EndpointAccountTOTP && req.Method == http.MethodDelete:
+		return th.disable(writer, req, user)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+// enroll generates a new secret for the user. Two-factor authentication is not
+// enabled until the user confirms it with a code from its authenticator.
+func (th TOTPHandler) enroll(writer http.ResponseWriter, user *User) error {
+	if user.TOTPEnabled {
+		respondWithJSONError(writer, http.StatusConflict, totpEnabledText)
+		return nil
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	err = th.db.Model(user).Select("totp_secret", "totp_counter").Updates(&User{
+		TOTPSecret:  secret,
+		TOTPCounter: 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{
+		Secret: secret,
+		URI:    totpURI(user.Username, secret),
+	})
+}
+
+// qrCode writes a PNG image with the otpauth URI for the enrollment which is in
+// progress. It is not available once the enrollment is finished so that the secret
+// could not be read by whoever gets hold of a token later.
+func (th TOTPHandler) qrCode(writer http.ResponseWriter, user *User) error {
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		respondWithJSONError(writer, http.StatusNotFound, totpNotStartedText)
+		return nil
+	}
+
+	png, err := qrcode.Encode(
+		totpURI(user.Username, user.TOTPSecret),
+		qrcode.Medium,
+		totpQRCodeSize,
+	)
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "image/png")
+	writer.Header().Set("Cache-Control", "no-store")
+	_, err = writer.Write(png)
+	return err
+}
+
+// confirm enables two-factor authentication after checking a code from the
+// authenticator. The response contains the recovery codes.
+func (th TOTPHandler) confirm(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	if user.TOTPEnabled {
+		respondWithJSONError(writer, http.StatusConflict, totpEnabledText)
+		return nil
+	}
+
+	if user.TOTPSecret == "" {
+		respondWithJSONError(writer, http.StatusConflict, totpNotStartedText)
+		return nil
+	}
+
+	code, ok := th.decodeCode(writer, req)
+	if !ok {
+		return nil
+	}
+
+	ip := remoteIP(req)
+	if wait := th.throttle.retryAfter(ip, user.Username); wait > 0 {
+		respondWithTooManyAttempts(writer, wait)
+		return nil
+	}
+
+	counter, ok := validateTOTP(user.TOTPSecret, code, user.TOTPCounter)
+	if !ok {
+		th.throttle.failed(ip, user.Username)
+		respondWithJSONError(writer, http.StatusForbidden, wrongTwoFactorCodeText)
+		return nil
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPCounter = counter
+	err := th.db.Model(user).Select("totp_enabled", "totp_counter").Updates(user).Error
+	if err != nil {
+		return err
+	}
+
+	return th.respondWithRecoveryCodes(writer, user)
+}
+
+// disable turns off two-factor authentication. It requires the password of the
+// user.
+func (th TOTPHandler) disable(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Password string `json:"password"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if !checkUserPassword(writer, req, th.throttle, user, reqBody.Password) {
+		return nil
+	}
+
+	err := th.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).
+			Select("totp_secret", "totp_enabled", "totp_counter").
+			Updates(&User{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// regenerateRecoveryCodes replaces all recovery codes of the user. A valid TOTP
+// or recovery code is required.
+func (th TOTPHandler) regenerateRecoveryCodes(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	if !user.TOTPEnabled {
+		respondWithJSONError(writer, http.StatusConflict, totpNotEnabledText)
+		return nil
+	}
+
+	code, ok := th.decodeCode(writer, req)
+	if !ok {
+		return nil
+	}
+
+	ip := remoteIP(req)
+	if wait := th.throttle.retryAfter(ip, user.Username); wait > 0 {
+		respondWithTooManyAttempts(writer, wait)
+		return nil
+	}
+
+	ok, err := checkSecondFactor(th.db, user, code)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		th.throttle.failed(ip, user.Username)
+		respondWithJSONError(writer, http.StatusForbidden, wrongTwoFactorCodeText)
+		return nil
+	}
+
+	return th.respondWithRecoveryCodes(writer, user)
+}
+
+func (th TOTPHandler) respondWithRecoveryCodes(
+	writer http.ResponseWriter,
+	user *User,
+) error {
+	codes, err := newRecoveryCodes(th.db, user.ID)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+// decodeCode reads the TOTP code from the request body. The error response is
+// written when false is returned.
+func (th TOTPHandler) decodeCode(
+	writer http.ResponseWriter,
+	req *http.Request,
+) (string, bool) {
+	reqBody := struct {
+		Code string `json:"code"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return "", false
+	}
+
+	return reqBody.Code, true
+}
+
+// NewTOTPHandler returns a new TOTPHandler. Wrong passwords are counted by
+// throttle.
+func NewTOTPHandler(db *gorm.DB, throttle *loginThrottle) *TOTPHandler {
+	return &TOTPHandler{
+		db:       db,
+		throttle: throttle,
+	}
+}
@@ -0,0 +1,290 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	// historyImportMaxSize is the largest listening history export which could
+	// be imported, in bytes.
+	historyImportMaxSize = 256 * 1024 * 1024
+)
+
+// UsersHandler is used by administrators for managing all users of the server.
+type UsersHandler struct {
+	db       *gorm.DB
+	history  library.History
+	importer library.HistoryImporter
+}
+
+// ServeHTTP is required by the http.Handler's interface
+func (uh UsersHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	InternalErrorOnErrorHandler(writer, req, uh.handleRequest)
+}
+
+func (uh UsersHandler) handleRequest(writer http.ResponseWriter, req *http.Request) error {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	idString, ok := mux.Vars(req)["userID"]
+	if !ok {
+		if req.Method != http.MethodGet {
+			http.NotFoundHandler().ServeHTTP(writer, req)
+			return nil
+		}
+		return uh.list(writer)
+	}
+
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Parsing userID: %s",
+			err,
+		)
+		return nil
+	}
+
+	var user User
+	err = uh.db.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		respondWithJSONError(writer, http.StatusNotFound, "user not found")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case req.Method == http.MethodGet:
+		enc := json.NewEncoder(writer)
+		return enc.Encode(newUserJSON(&user))
+	case req.Method == http.MethodPatch:
+		return uh.update(writer, req, &user)
+	case req.Method == http.MethodPut && routeTemplate(req) == APIv1EndpointUserPassword:
+		return uh.resetPassword(writer, req, &user)
+	case req.Method == http.MethodPost && routeTemplate(req) == APIv1EndpointUserHistory:
+		return uh.importHistory(writer, req, &user)
+	case req.Method == http.MethodDelete:
+		return uh.remove(writer, &user)
+	default:
+		http.NotFoundHandler().ServeHTTP(writer, req)
+		return nil
+	}
+}
+
+func (uh UsersHandler) list(writer http.ResponseWriter) error {
+	var users []User
+	if err := uh.db.Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+
+	retData := make([]userJSON, 0, len(users))
+	for i := range users {
+		retData = append(retData, newUserJSON(&users[i]))
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(retData)
+}
+
+// update changes the role of the user or enables and disables it. Disabling a user
+// revokes all of its sessions.
+func (uh UsersHandler) update(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Role     *Role `json:"role"`
+		Disabled *bool `json:"disabled"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if reqBody.Role != nil && !reqBody.Role.Valid() {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Unknown role `%s`.",
+			*reqBody.Role,
+		)
+		return nil
+	}
+
+	err := uh.db.Transaction(func(tx *gorm.DB) error {
+		demoted := reqBody.Role != nil && *reqBody.Role != RoleAdmin
+		disabled := reqBody.Disabled != nil && *reqBody.Disabled
+		if demoted || disabled {
+			if err := checkNotLastAdmin(tx, user); err != nil {
+				return err
+			}
+		}
+
+		if reqBody.Role != nil {
+			user.Role = *reqBody.Role
+		}
+		if reqBody.Disabled != nil {
+			user.Disabled = *reqBody.Disabled
+		}
+
+		err := tx.Model(user).Select("role", "disabled").Updates(user).Error
+		if err != nil {
+			return err
+		}
+
+		if disabled {
+			return revokeUserSessions(tx, user.ID)
+		}
+		return nil
+	})
+
+	if errors.Is(err, errLastAdmin) {
+		respondWithJSONError(writer, http.StatusConflict, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(newUserJSON(user))
+}
+
+// resetPassword sets a new password for the user. When no password is given a
+// random one is generated and returned in the response.
+func (uh UsersHandler) resetPassword(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	reqBody := struct {
+		Password string `json:"password"`
+	}{}
+
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&reqBody); err != nil {
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			"Error parsing JSON request: %s.",
+			err,
+		)
+		return nil
+	}
+
+	if reqBody.Password == "" {
+		pass, err := randomReadableCode()
+		if err != nil {
+			return err
+		}
+		reqBody.Password = pass
+	}
+
+	if err := setUserPassword(uh.db, user, reqBody.Password); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(struct {
+		Password string `json:"password"`
+	}{
+		Password: reqBody.Password,
+	})
+}
+
+// importHistory adds the plays from a Last.fm or ListenBrainz export in the request
+// body to the user's history. The format is the "format" query argument or comes
+// from the Content-Type: "text/csv" for Last.fm and "application/json" for
+// ListenBrainz.
+func (uh UsersHandler) importHistory(
+	writer http.ResponseWriter,
+	req *http.Request,
+	user *User,
+) error {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = library.ImportFormatLastFM
+		case "application/json", "application/x-ndjson", "application/jsonl":
+			format = library.ImportFormatListenBrainz
+		}
+	}
+
+	body := http.MaxBytesReader(writer, req.Body, historyImportMaxSize)
+	result, err := uh.importer.ImportHistory(int64(user.ID), body, format)
+
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.Is(err, library.ErrUnknownImportFormat):
+		respondWithJSONError(
+			writer,
+			http.StatusBadRequest,
+			`"format" must be "%s" or "%s"`,
+			library.ImportFormatLastFM,
+			library.ImportFormatListenBrainz,
+		)
+		return nil
+	case errors.As(err, &tooBig):
+		respondWithJSONError(
+			writer,
+			http.StatusRequestEntityTooLarge,
+			"The export must not be larger than %d bytes.",
+			tooBig.Limit,
+		)
+		return nil
+	case errors.Is(err, library.ErrInvalidExport):
+		respondWithJSONError(writer, http.StatusBadRequest, err.Error())
+		return nil
+	case err != nil:
+		return err
+	}
+
+	enc := json.NewEncoder(writer)
+	return enc.Encode(result)
+}
+
+func (uh UsersHandler) remove(writer http.ResponseWriter, user *User) error {
+	err := deleteUser(uh.db, uh.history, user)
+	if errors.Is(err, errLastAdmin) {
+		respondWithJSONError(writer, http.StatusConflict, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewUsersHandler returns a new UsersHandler for the users stored in db. Their
+// listening history is imported with importer.
+func NewUsersHandler(
+	db *gorm.DB,
+	history library.History,
+	importer library.HistoryImporter,
+) *UsersHandler {
+	return &UsersHandler{
+		db:       db,
+		history:  history,
+		importer: importer,
+	}
+}
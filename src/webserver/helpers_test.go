@@ -0,0 +1,138 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testSecret = "test-secret"
+)
+
+// newTestDB returns a migrated users database which is removed at the end of the
+// test.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "auth.db")
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+
+	if sqlDB, err := db.DB(); err == nil {
+		t.Cleanup(func() { _ = sqlDB.Close() })
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatalf("migrating database: %s", err)
+	}
+
+	return db
+}
+
+// createTestUser stores a user with this username and role. Its password is
+// "password".
+func createTestUser(t *testing.T, db *gorm.DB, username string, role Role) *User {
+	t.Helper()
+
+	user := &User{
+		Username: username,
+		Role:     role,
+	}
+
+	// The lowest cost keeps the tests fast. Passwords are compared the same way
+	// regardless of it.
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %s", err)
+	}
+	user.Password = string(hash)
+
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	return user
+}
+
+// newTestRouter returns a router which serves h on all of the route templates.
+// The handlers use the templates for telling the endpoints apart. When user is
+// not nil all requests are made on its behalf.
+func newTestRouter(h http.Handler, user *User, templates ...string) http.Handler {
+	router := mux.NewRouter()
+	for _, tpl := range templates {
+		router.Handle(tpl, h)
+	}
+
+	if user == nil {
+		return router
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r.WithContext(contextWithUser(r.Context(), user)))
+	})
+}
+
+// doJSON makes a request to h with body encoded as JSON. A nil body means a
+// request without a body.
+func doJSON(
+	t *testing.T,
+	h http.Handler,
+	method string,
+	target string,
+	body interface{},
+) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatalf("encoding request body: %s", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, target, &reqBody)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+// decodeJSON decodes the body of the response into v and fails the test when
+// the status code is not the expected one.
+func decodeJSON(
+	t *testing.T,
+	resp *httptest.ResponseRecorder,
+	expectedCode int,
+	v interface{},
+) {
+	t.Helper()
+
+	if resp.Code != expectedCode {
+		t.Fatalf(
+			"expected status %d but got %d: %s",
+			expectedCode,
+			resp.Code,
+			resp.Body.String(),
+		)
+	}
+
+	if v == nil {
+		return
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+}
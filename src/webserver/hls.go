@@ -0,0 +1,230 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"NT106/Group01/MusicStreamingAPI/src/transcode"
+)
+
+const (
+	// hlsSegmentDuration is the length of every HLS segment but the last one
+	// of a track.
+	hlsSegmentDuration = 6 * time.Second
+
+	// hlsDefaultCacheSize is the size of the segments cache in megabytes when
+	// the configuration does not set one.
+	hlsDefaultCacheSize = 1024
+
+	// hlsSegmentTimeout is the longest time generating a single segment may take.
+	hlsSegmentTimeout = 2 * time.Minute
+
+	hlsPlaylistContentType = "application/vnd.apple.mpegurl"
+)
+
+// hlsDefaultBitRates are the bit rates of the HLS variants in kbit/s when the
+// configuration does not set them.
+var hlsDefaultBitRates = []int{64, 128, 256}
+
+// hlsSegmentsCount returns the number of segments for a track with this duration.
+func hlsSegmentsCount(duration time.Duration) int {
+	return int((duration + hlsSegmentDuration - 1) / hlsSegmentDuration)
+}
+
+// hlsSegmentLength returns the duration of the segment with this index.
+func hlsSegmentLength(duration time.Duration, index int) time.Duration {
+	rest := duration - time.Duration(index)*hlsSegmentDuration
+	if rest < hlsSegmentDuration {
+		return rest
+	}
+	return hlsSegmentDuration
+}
+
+// hlsCache generates HLS segments when they are requested for the first time and
+// keeps them on disk. The least recently used segments are removed once the cache
+// grows over its maximal size.
+type hlsCache struct {
+	dir        string
+	maxSize    int64
+	transcoder transcode.Transcoder
+
+	// generating makes sure a segment is generated only once when it is
+	// requested by many clients at the same time.
+	generating singleflight.Group
+
+	mu   sync.Mutex
+	size int64 // -1 until the cache directory is measured for the first time
+}
+
+// newHLSCache returns a cache which stores the segments in dir. maxSize is in
+// bytes.
+func newHLSCache(dir string, maxSize int64, transcoder transcode.Transcoder) *hlsCache {
+	return &hlsCache{
+		dir:        dir,
+		maxSize:    maxSize,
+		transcoder: transcoder,
+		size:       -1,
+	}
+}
+
+// segment returns the path to the segment of the source file, generating it first
+// when it is not cached. duration is the length of the whole source file.
+func (c *hlsCache) segment(
+	srcPath string,
+	fileID int64,
+	bitRate int,
+	index int,
+	duration time.Duration,
+) (string, error) {
+	st, err := os.Stat(srcPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The modification time in the name makes sure that segments of files which
+	// have been changed are never served.
+	name := filepath.Join(
+		c.dir,
+		strconv.FormatInt(fileID, 10),
+		fmt.Sprintf("%d-%dk-%d.ts", st.ModTime().Unix(), bitRate, index),
+	)
+
+	if _, err := os.Stat(name); err == nil {
+		now := time.Now()
+		_ = os.Chtimes(name, now, now)
+		return name, nil
+	}
+
+	opts := transcode.Options{
+		Format:   transcode.HLSSegment,
+		BitRate:  bitRate,
+		Offset:   time.Duration(index) * hlsSegmentDuration,
+		Duration: hlsSegmentLength(duration, index),
+	}
+
+	_, err, _ = c.generating.Do(name, func() (interface{}, error) {
+		return nil, c.generate(srcPath, name, opts)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// generate transcodes a segment into a temporary file and moves it at dst once
+// it is complete so that partial segments are never served.
+func (c *hlsCache) generate(srcPath, dst string, opts transcode.Options) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".segment-*")
+	if err != nil {
+		return fmt.Errorf("creating segment file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), hlsSegmentTimeout)
+	defer cancel()
+
+	err = c.transcoder.Transcode(ctx, tmp, srcPath, opts)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	st, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("storing segment: %w", err)
+	}
+
+	c.added(st.Size())
+	return nil
+}
+
+// added accounts for a new segment and evicts old segments when needed.
+func (c *hlsCache) added(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size < 0 {
+		c.size = 0
+		c.evict(false)
+	} else {
+		c.size += size
+	}
+
+	if c.size > c.maxSize {
+		c.evict(true)
+	}
+}
+
+// evict measures the cache directory. When remove is true the least recently used
+// segments are removed until the cache is at three quarters of its maximal size.
+// It must be called with c.mu held.
+func (c *hlsCache) evict(remove bool) {
+	type segmentFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var (
+		files []segmentFile
+		total int64
+	)
+	_ = filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".ts" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		files = append(files, segmentFile{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	if remove {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+
+		for _, file := range files {
+			if total <= c.maxSize/4*3 {
+				break
+			}
+			if err := os.Remove(file.path); err != nil {
+				log.Printf("Error removing cached HLS segment: %s\n", err)
+				continue
+			}
+			total -= file.size
+		}
+	}
+
+	c.size = total
+}
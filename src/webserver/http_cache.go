@@ -0,0 +1,100 @@
+package webserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The Cache-Control policies of the responses which the clients are allowed to
+// cache. All of them are private since the API requires authentication.
+const (
+	// Images rarely change. Even so they are revalidated once a day since they
+	// could be replaced by uploading a new one.
+	cacheControlImages = "private, max-age=86400"
+
+	// Browse pages change only when the library does. Clients use them for a
+	// minute before revalidating them.
+	cacheControlBrowse = "private, max-age=60"
+
+	// Search results include the listen counts of the tracks so clients must
+	// revalidate them every time.
+	cacheControlSearch = "private, no-cache"
+)
+
+// contentETag returns a strong ETag for a response with this body.
+func contentETag(body []byte) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write(body)
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// libraryETag returns a strong ETag for a JSON response generated from the
+// library in this version. The responses of the same URL are equal for as long
+// as the library does not change.
+func libraryETag(version string) string {
+	return fmt.Sprintf(`"%s"`, version)
+}
+
+// checkNotModified sets the validators and the Cache-Control header of the
+// response. Then it answers conditional requests for which the client's copy is
+// still valid with 304 Not Modified. It returns true when it has done so and the
+// body must not be written. The modified time is not sent when it is zero.
+//
+// If-None-Match takes precedence over If-Modified-Since as in RFC 9110.
+func checkNotModified(
+	writer http.ResponseWriter,
+	req *http.Request,
+	cacheControl string,
+	etag string,
+	modified time.Time,
+) bool {
+	header := writer.Header()
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", etag)
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if !etagListMatches(inm, etag) {
+			return false
+		}
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	// The headers which describe the body are not sent with 304 responses.
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	writer.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListMatches returns true when the value of an If-None-Match header contains
+// etag or is "*". The comparison is weak as required for If-None-Match.
+func etagListMatches(list string, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
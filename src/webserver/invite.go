@@ -0,0 +1,56 @@
+package webserver
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// errInvalidInvite is returned when an invite code does not exist, has expired or
+// has been used up.
+var errInvalidInvite = errors.New("invalid or expired invite code")
+
+// Invite is a code which allows creating an account when the registration is
+// invite-only. It may be used MaxUses times or unlimited amount of times when
+// MaxUses is zero.
+type Invite struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Code      string     `gorm:"uniqueIndex" json:"code"`
+	Role      Role       `gorm:"default:listener" json:"role"`
+	CreatedBy uint       `json:"created_by"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// consumeInvite marks one use of the invite with this code. It returns the invite
+// or errInvalidInvite when the code cannot be used. It is safe to call it
+// concurrently for the same code since the check and the update are done in a
+// single statement.
+func consumeInvite(db *gorm.DB, code string) (*Invite, error) {
+	if code == "" {
+		return nil, errInvalidInvite
+	}
+
+	res := db.Model(&Invite{}).
+		Where("code = ?", code).
+		Where("max_uses = 0 OR uses < max_uses").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, errInvalidInvite
+	}
+
+	var invite Invite
+	if err := db.Where("code = ?", code).First(&invite).Error; err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
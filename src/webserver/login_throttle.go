@@ -0,0 +1,316 @@
+package webserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// loginFreeAttemptsPerUser is how many wrong passwords in a row a username
+	// may receive before it gets locked.
+	loginFreeAttemptsPerUser = 5
+
+	// loginFreeAttemptsPerIP is how many failed logins an IP address may make
+	// before it gets locked. It is higher than the per user limit since many
+	// users may be behind the same NAT.
+	loginFreeAttemptsPerIP = 20
+
+	// loginBaseLockout is the duration of the first lockout. Every failure
+	// after it doubles the duration up to loginMaxLockout.
+	loginBaseLockout = 30 * time.Second
+	loginMaxLockout  = time.Hour
+
+	// loginFailuresTTL is for how long failures are remembered after the last
+	// one. It is longer than loginMaxLockout so that locks do not reset in the
+	// middle of an attack.
+	loginFailuresTTL = 24 * time.Hour
+
+	// maxLoginFailures is the maximal number of IP addresses and of usernames
+	// whose failures are remembered. When there are more of them, the ones
+	// with the oldest failures are forgotten.
+	maxLoginFailures = 10000
+
+	// loginPruneInterval is how often at most the old failures are removed
+	// when there are too many of them.
+	loginPruneInterval = time.Second
+
+	tooManyAttemptsText = "too many failed login attempts, try again later"
+)
+
+// throttledError is returned when a login attempt was refused without checking
+// the credentials because of too many failures.
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("login locked for %s", e.retryAfter)
+}
+
+// loginFailures are the recent failed logins for a username or an IP address.
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLock describes a username or IP address which is currently locked.
+type loginLock struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// loginThrottle keeps counters of failed logins per IP address and per username
+// and locks them out for exponentially growing periods. The counters are kept in
+// memory and are reset when the server restarts. Their number is limited so that
+// failing logins from many addresses or for many usernames could not grow the
+// memory without bound.
+type loginThrottle struct {
+	mu     sync.Mutex
+	ips    map[string]*loginFailures
+	users  map[string]*loginFailures
+	max    int
+	pruned time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		ips:   make(map[string]*loginFailures),
+		users: make(map[string]*loginFailures),
+		max:   maxLoginFailures,
+	}
+}
+
+// checkLoginCreds is like the function with the same name but refuses to check
+// the password when the IP address of the request or the username are locked. In
+// that case it returns for how long the lock will last. Wrong passwords are counted
+// as failures. Callers must call succeeded once the whole login process finishes.
+func (t *loginThrottle) checkLoginCreds(
+	req *http.Request,
+	user string,
+	pass string,
+	db *gorm.DB,
+) (*User, time.Duration, bool) {
+	ip := remoteIP(req)
+	if wait := t.retryAfter(ip, user); wait > 0 {
+		return nil, wait, false
+	}
+
+	userModel, ok := checkLoginCreds(user, pass, db)
+	if !ok {
+		t.failed(ip, user)
+		return nil, 0, false
+	}
+
+	return userModel, 0, true
+}
+
+// retryAfter returns for how long logins from this IP address or for this username
+// are refused. Zero means they are not.
+func (t *loginThrottle) retryAfter(ip, user string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var until time.Time
+	for _, f := range []*loginFailures{t.ips[ip], t.users[user]} {
+		if f != nil && f.lockedUntil.After(until) {
+			until = f.lockedUntil
+		}
+	}
+
+	if !until.After(now) {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// failed records a failed login. The username is empty for login methods which
+// do not use one.
+func (t *loginThrottle) failed(ip, user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if (len(t.ips) >= t.max || len(t.users) >= t.max) &&
+		now.Sub(t.pruned) >= loginPruneInterval {
+		t.prune(now)
+	}
+
+	t.record(t.ips, ip, loginFreeAttemptsPerIP, now)
+	if user != "" {
+		t.record(t.users, user, loginFreeAttemptsPerUser, now)
+	}
+}
+
+// succeeded forgets the failures for the username. Failures of the IP address are
+// kept so that an attacker who owns one account cannot reset them.
+func (t *loginThrottle) succeeded(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.users, user)
+}
+
+// unlockUser removes the lock and failures of the username. It returns false when
+// there were none.
+func (t *loginThrottle) unlockUser(user string) bool {
+	return t.unlock(t.users, user)
+}
+
+// unlockIP removes the lock and failures of the IP address. It returns false when
+// there were none.
+func (t *loginThrottle) unlockIP(ip string) bool {
+	return t.unlock(t.ips, ip)
+}
+
+func (t *loginThrottle) unlock(failures map[string]*loginFailures, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := failures[key]
+	delete(failures, key)
+	return ok
+}
+
+// locked returns the usernames and IP addresses which are locked at the moment.
+func (t *loginThrottle) locked() (users []loginLock, ips []loginLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	return lockedKeys(t.users, now), lockedKeys(t.ips, now)
+}
+
+// prune forgets failures which are old enough. Must be called with t.mu held.
+func (t *loginThrottle) prune(now time.Time) {
+	t.pruned = now
+	for _, failures := range []map[string]*loginFailures{t.ips, t.users} {
+		for key, f := range failures {
+			if now.Sub(f.last) > loginFailuresTTL {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// record adds a failure for the key. When there are too many keys already, the
+// one with the oldest failure is forgotten. Must be called with t.mu held.
+func (t *loginThrottle) record(
+	failures map[string]*loginFailures,
+	key string,
+	freeAttempts int,
+	now time.Time,
+) {
+	f, ok := failures[key]
+	if !ok {
+		if len(failures) >= t.max {
+			forgetOldestFailures(failures)
+		}
+		f = &loginFailures{}
+		failures[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if f.count < freeAttempts {
+		return
+	}
+
+	lockout := loginBaseLockout
+	for i := freeAttempts; i < f.count && lockout < loginMaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > loginMaxLockout {
+		lockout = loginMaxLockout
+	}
+	f.lockedUntil = now.Add(lockout)
+}
+
+// forgetOldestFailures removes the key whose last failure is the oldest.
+func forgetOldestFailures(failures map[string]*loginFailures) {
+	var (
+		oldestKey string
+		oldest    *loginFailures
+	)
+	for key, f := range failures {
+		if oldest == nil || f.last.Before(oldest.last) {
+			oldestKey, oldest = key, f
+		}
+	}
+	delete(failures, oldestKey)
+}
+
+func lockedKeys(failures map[string]*loginFailures, now time.Time) []loginLock {
+	locks := []loginLock{}
+	for key, f := range failures {
+		if !f.lockedUntil.After(now) {
+			continue
+		}
+		locks = append(locks, loginLock{
+			Key:         key,
+			Failures:    f.count,
+			LockedUntil: f.lockedUntil,
+		})
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Key < locks[j].Key
+	})
+	return locks
+}
+
+// checkUserPassword verifies the password of an already authenticated user before
+// sensitive operations. Wrong passwords count as failed logins so that a stolen
+// token could not be used for guessing it. On failure the error response is
+// written and false is returned. Users without a password, such as the ones
+// created on their first OpenID Connect login, confirm the operation by logging
+// in with the provider again shortly before it. This is required for setting
+// their first password too.
+func checkUserPassword(
+	writer http.ResponseWriter,
+	req *http.Request,
+	throttle *loginThrottle,
+	user *User,
+	pass string,
+) bool {
+	if !user.hasPassword() {
+		if !recentOIDCLogin(req) {
+			respondWithJSONError(writer, http.StatusForbidden, oidcReauthRequiredText)
+			return false
+		}
+		return true
+	}
+
+	ip := remoteIP(req)
+	if wait := throttle.retryAfter(ip, user.Username); wait > 0 {
+		respondWithTooManyAttempts(writer, wait)
+		return false
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(pass))
+	if err != nil {
+		throttle.failed(ip, user.Username)
+		respondWithJSONError(writer, http.StatusForbidden, wrongPasswordText)
+		return false
+	}
+
+	return true
+}
+
+// respondWithTooManyAttempts writes the response for a throttled login attempt.
+func respondWithTooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithJSONError(w, http.StatusTooManyRequests, tooManyAttemptsText)
+}
@@ -0,0 +1,39 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestLoginThrottleLimit makes sure failing logins from many addresses for many
+// usernames does not grow the failures without a bound and that the oldest
+// failures are the ones which are forgotten.
+func TestLoginThrottleLimit(t *testing.T) {
+	throttle := newLoginThrottle()
+	throttle.max = 10
+
+	for i := 0; i < loginFreeAttemptsPerUser; i++ {
+		throttle.failed("10.0.0.1", "victim")
+	}
+	if throttle.retryAfter("10.0.0.2", "victim") == 0 {
+		t.Fatalf("expected the username to be locked")
+	}
+	throttle.users["victim"].last = time.Now().Add(-time.Minute)
+	throttle.ips["10.0.0.1"].last = time.Now().Add(-time.Minute)
+
+	for i := 0; i < throttle.max*3; i++ {
+		throttle.failed(fmt.Sprintf("10.0.1.%d", i), fmt.Sprintf("user%d", i))
+	}
+
+	if len(throttle.ips) != throttle.max || len(throttle.users) != throttle.max {
+		t.Errorf("expected %d IP addresses and usernames but got %d and %d",
+			throttle.max, len(throttle.ips), len(throttle.users))
+	}
+	if _, ok := throttle.users["victim"]; ok {
+		t.Errorf("expected the oldest username to be forgotten")
+	}
+	if _, ok := throttle.users[fmt.Sprintf("user%d", throttle.max*3-1)]; !ok {
+		t.Errorf("expected the newest username to be kept")
+	}
+}
@@ -0,0 +1,455 @@
+package webserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+)
+
+const (
+	// oidcLoginDuration is for how long the user has to log in with the provider
+	// after being redirected to it.
+	oidcLoginDuration = 10 * time.Minute
+
+	// oidcStateCookieName is the cookie which ties a started login to the browser
+	// which started it. It holds the OAuth2 state parameter.
+	oidcStateCookieName = "oidc_state"
+
+	// oidcReauthDuration is for how long after logging in with the provider users
+	// without a password could do the operations which otherwise require one.
+	oidcReauthDuration = 5 * time.Minute
+
+	oidcReauthRequiredText = "log in again with OpenID Connect to confirm this action"
+
+	// maxOIDCLogins is the maximal number of started logins which the provider
+	// has not redirected back yet. Anyone could start a login so they must be
+	// bounded.
+	maxOIDCLogins = 10000
+
+	// oidcPruneInterval is how often at most the expired logins are removed when
+	// there are maxOIDCLogins of them.
+	oidcPruneInterval = time.Second
+
+	// oidcRetryAfter is the time after which clients are told to try again when
+	// too many logins have been started.
+	oidcRetryAfter = 5 * time.Second
+)
+
+var (
+	// errInvalidOIDCState is returned when the provider redirects back with a state
+	// which was not issued by this server or has already been used.
+	errInvalidOIDCState = errors.New("invalid or expired login state")
+
+	// errOIDCStateMismatch is returned when the login was not started by the
+	// browser which finishes it.
+	errOIDCStateMismatch = errors.New("login was not started by this browser")
+
+	// errOIDCUserDisabled is returned when the local user of the identity is
+	// disabled.
+	errOIDCUserDisabled = errors.New("user is disabled")
+
+	// errOIDCUnknownUser is returned when the identity is not linked with a local
+	// user and one could not be created for it.
+	errOIDCUnknownUser = errors.New("there is no account for this identity")
+
+	// errTooManyOIDCLogins is returned when maxOIDCLogins logins have been started
+	// and have not finished or expired yet.
+	errTooManyOIDCLogins = errors.New(
+		"too many OpenID Connect logins are in progress, try again later",
+	)
+)
+
+// oidcLogin is the relying party of the OpenID Connect authorization code flow.
+// The provider is discovered on first use so that the server starts even when it
+// is not reachable.
+type oidcLogin struct {
+	ctx  context.Context
+	cfg  config.OIDCConfig
+	role Role
+
+	// registration is the registration mode of the server. It is one of the
+	// config.Registration* values.
+	registration string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+
+	// pending are the started logins. The expired ones are removed only when
+	// there are maxPending of them.
+	pending    map[string]oidcPending
+	maxPending int
+	pruned     time.Time
+}
+
+// oidcPending is a login which has been started but the provider has not redirected
+// back yet. It is keyed by the OAuth2 state parameter.
+type oidcPending struct {
+	nonce     string
+	verifier  string
+	device    string
+	cookie    bool
+	invite    string
+	expiresAt time.Time
+}
+
+// oidcIdentity is what the server uses from the ID token.
+type oidcIdentity struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+
+	// AuthTime is when the user authenticated with the provider as a Unix time.
+	// Providers do not have to send it.
+	AuthTime int64 `json:"auth_time"`
+}
+
+// newOIDCLogin returns the relying party for the configuration. It returns nil
+// when OIDC is not configured. ctx bounds the life time of the discovered provider.
+// The registration mode controls whether users could be created on their first
+// login.
+func newOIDCLogin(
+	ctx context.Context,
+	cfg *config.OIDCConfig,
+	registration string,
+) *oidcLogin {
+	if cfg == nil {
+		return nil
+	}
+
+	role := Role(cfg.DefaultRole)
+	if role == RoleNone {
+		role = RoleListener
+	}
+
+	return &oidcLogin{
+		ctx:          ctx,
+		cfg:          *cfg,
+		role:         role,
+		registration: registration,
+		pending:      make(map[string]oidcPending),
+		maxPending:   maxOIDCLogins,
+	}
+}
+
+// discover returns the provider, fetching its configuration when this has not
+// been done yet. Failures are not cached so that they are retried on next login.
+func (l *oidcLogin) discover() (*oidc.Provider, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.provider != nil {
+		return l.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(l.ctx, l.cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC provider: %w", err)
+	}
+
+	l.provider = provider
+	return provider, nil
+}
+
+func (l *oidcLogin) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := l.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     l.cfg.ClientID,
+		ClientSecret: l.cfg.ClientSecret,
+		RedirectURL:  l.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+}
+
+// start begins a new login and returns the URL of the provider to which the user
+// has to be redirected together with the state of the login. The device, cookie
+// and invite are used once the login finishes. With reauth the provider is asked
+// to authenticate the user again even when they are logged in with it. It returns
+// errTooManyOIDCLogins when too many logins have been started.
+func (l *oidcLogin) start(
+	device string,
+	cookie bool,
+	invite string,
+	reauth bool,
+) (string, string, error) {
+	provider, err := l.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	pending := oidcPending{
+		nonce:     nonce,
+		verifier:  oauth2.GenerateVerifier(),
+		device:    device,
+		cookie:    cookie,
+		invite:    invite,
+		expiresAt: time.Now().Add(oidcLoginDuration),
+	}
+
+	l.mu.Lock()
+	if len(l.pending) >= l.maxPending && time.Since(l.pruned) >= oidcPruneInterval {
+		l.removeExpired()
+	}
+	if len(l.pending) >= l.maxPending {
+		l.mu.Unlock()
+		return "", "", errTooManyOIDCLogins
+	}
+	l.pending[state] = pending
+	l.mu.Unlock()
+
+	opts := []oauth2.AuthCodeOption{
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(pending.verifier),
+	}
+	if reauth {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"))
+	}
+
+	authURL := l.oauth2Config(provider).AuthCodeURL(state, opts...)
+	return authURL, state, nil
+}
+
+// finish exchanges the authorization code for an ID token and returns the identity
+// in it together with the login which was started for state. Every state could be
+// finished only once.
+func (l *oidcLogin) finish(
+	ctx context.Context,
+	state string,
+	code string,
+) (*oidcIdentity, oidcPending, error) {
+	l.mu.Lock()
+	pending, ok := l.pending[state]
+	delete(l.pending, state)
+	provider := l.provider
+	l.mu.Unlock()
+
+	if !ok || provider == nil || time.Now().After(pending.expiresAt) {
+		return nil, pending, errInvalidOIDCState
+	}
+
+	token, err := l.oauth2Config(provider).Exchange(
+		ctx,
+		code,
+		oauth2.VerifierOption(pending.verifier),
+	)
+	if err != nil {
+		return nil, pending, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, pending, errors.New("token response has no id_token")
+	}
+
+	verifier := provider.Verifier(&oidc.Config{ClientID: l.cfg.ClientID})
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, pending, fmt.Errorf("verifying ID token: %w", err)
+	}
+
+	if idToken.Nonce != pending.nonce {
+		return nil, pending, errors.New("ID token nonce does not match")
+	}
+
+	var identity oidcIdentity
+	if err := idToken.Claims(&identity); err != nil {
+		return nil, pending, fmt.Errorf("parsing ID token claims: %w", err)
+	}
+
+	return &identity, pending, nil
+}
+
+// setOIDCStateCookie binds the login with this state to the browser. Lax is needed
+// since the provider redirects back with a cross-site navigation.
+func setOIDCStateCookie(w http.ResponseWriter, req *http.Request, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     APIv1EndpointOIDCLogin,
+		MaxAge:   int(oidcLoginDuration.Seconds()),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearOIDCStateCookie instructs the browser to forget the state cookie.
+func clearOIDCStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     APIv1EndpointOIDCLogin,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkOIDCState returns errOIDCStateMismatch unless the request carries the state
+// cookie which was set when the login with this state started.
+func checkOIDCState(req *http.Request, state string) error {
+	cookie, err := req.Cookie(oidcStateCookieName)
+	if err != nil || state == "" {
+		return errOIDCStateMismatch
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return errOIDCStateMismatch
+	}
+
+	return nil
+}
+
+// removeExpired must be called with l.mu held.
+func (l *oidcLogin) removeExpired() {
+	now := time.Now()
+	l.pruned = now
+	for state, pending := range l.pending {
+		if now.After(pending.expiresAt) {
+			delete(l.pending, state)
+		}
+	}
+}
+
+// user returns the local user linked with the identity. When auto-provisioning is
+// enabled a new user is created on the first login of every identity, subject to
+// the registration mode. In invite-only mode the invite code is consumed for it.
+// Existing users with the same username are never linked automatically since
+// anyone could choose any username with the provider.
+func (l *oidcLogin) user(db *gorm.DB, identity *oidcIdentity, invite string) (*User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(
+			"oidc_issuer = ? AND oidc_subject = ?",
+			l.cfg.Issuer,
+			identity.Subject,
+		).First(&user).Error
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if !l.cfg.AutoProvision || l.registration == config.RegistrationDisabled {
+			return errOIDCUnknownUser
+		}
+
+		username, err := freeUsername(tx, identity.username())
+		if err != nil {
+			return err
+		}
+
+		var usersCount int64
+		if err := tx.Model(&User{}).Count(&usersCount).Error; err != nil {
+			return fmt.Errorf("counting users: %w", err)
+		}
+
+		issuer, subject := l.cfg.Issuer, identity.Subject
+		user = User{
+			Username:    username,
+			Role:        l.role,
+			OIDCIssuer:  &issuer,
+			OIDCSubject: &subject,
+		}
+
+		// Same as with the registration the first user becomes the administrator
+		// and does not need an invite.
+		if usersCount == 0 {
+			user.Role = RoleAdmin
+		} else if l.registration == config.RegistrationInviteOnly {
+			inv, err := consumeInvite(tx, invite)
+			if err != nil {
+				return err
+			}
+			user.Role = inv.Role
+		}
+
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("saving user to database: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, errOIDCUserDisabled
+	}
+
+	return &user, nil
+}
+
+// authenticatedAt returns when the user authenticated with the provider. It is now
+// when the provider has not told.
+func (i *oidcIdentity) authenticatedAt() time.Time {
+	now := time.Now()
+	if i.AuthTime <= 0 || i.AuthTime > now.Unix() {
+		return now
+	}
+	return time.Unix(i.AuthTime, 0)
+}
+
+// recentOIDCLogin returns true when the request has been authenticated with a
+// session which was created by logging in with the OpenID Connect provider in
+// the last oidcReauthDuration.
+func recentOIDCLogin(req *http.Request) bool {
+	sess := sessionFromContext(req.Context())
+	if sess == nil || sess.OIDCAuthAt.IsZero() {
+		return false
+	}
+	return time.Since(sess.OIDCAuthAt) < oidcReauthDuration
+}
+
+// username returns the preferred username for the local account of the identity.
+func (i *oidcIdentity) username() string {
+	if name := strings.TrimSpace(i.PreferredUsername); name != "" {
+		return name
+	}
+	if name, _, _ := strings.Cut(i.Email, "@"); name != "" {
+		return name
+	}
+	return "oidc-" + i.Subject
+}
+
+// freeUsername returns username if it is not taken. Otherwise a number is appended
+// to it until a free one is found.
+func freeUsername(db *gorm.DB, username string) (string, error) {
+	candidate := username
+	for i := 2; ; i++ {
+		var count int64
+		err := db.Model(&User{}).Where("username = ?", candidate).Count(&count).Error
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", username, i)
+	}
+}
@@ -0,0 +1,63 @@
+package webserver
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// pairingDuration is for how long a pairing code could be used.
+	pairingDuration = 10 * time.Minute
+
+	// pairingPollInterval is the minimal time in seconds devices should wait
+	// between polls.
+	pairingPollInterval = 5
+)
+
+// errInvalidPairing is returned when a pairing code or device code does not exist
+// or has expired.
+var errInvalidPairing = errors.New("invalid or expired pairing code")
+
+// Pairing is a request for logging in a new device without typing a password on
+// it. A logged in user creates it and shows its code to the new device, usually as
+// a QR code. The device claims the code and polls until the user confirms it.
+type Pairing struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"index" json:"user_id"`
+	Code   string `gorm:"uniqueIndex" json:"-"`
+
+	// DeviceCode is the hash of the secret which the device receives when it
+	// claims the code. Only this device could receive the tokens afterwards.
+	DeviceCode *string `gorm:"uniqueIndex" json:"-"`
+
+	// Device is the name the device has sent when claiming the code. It is shown
+	// to the user so that it confirms the right device.
+	Device    string    `json:"device"`
+	IPAddress string    `json:"ip_address"`
+	Claimed   bool      `json:"claimed"`
+	Confirmed bool      `json:"confirmed"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// findPairing returns a not expired pairing which matches the condition.
+func findPairing(db *gorm.DB, query string, args ...interface{}) (*Pairing, error) {
+	var pairing Pairing
+	err := db.Where(query, args...).
+		Where("expires_at > ?", time.Now()).
+		First(&pairing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidPairing
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &pairing, nil
+}
+
+// removeExpiredPairings deletes the pairings which could not be used any more.
+func removeExpiredPairings(db *gorm.DB) error {
+	return db.Where("expires_at <= ?", time.Now()).Delete(&Pairing{}).Error
+}
@@ -0,0 +1,231 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+)
+
+const (
+	// webAuthnDisplayName is used when the configuration does not set one.
+	webAuthnDisplayName = "HTTPMS"
+
+	// ceremonyDuration is for how long a started passkey registration or login
+	// could be finished.
+	ceremonyDuration = 5 * time.Minute
+
+	// maxCeremonies is the maximal number of started passkey registrations and
+	// logins together. Anyone could start a login so they must be bounded.
+	maxCeremonies = 10000
+
+	// ceremonyPruneInterval is how often at most the expired ceremonies are
+	// removed from a full store.
+	ceremonyPruneInterval = time.Second
+
+	// ceremonyRetryAfter is the time after which clients are told to try again
+	// when the ceremony store is full.
+	ceremonyRetryAfter = 5 * time.Second
+)
+
+// errTooManyCeremonies is returned when the maximal number of ceremonies have
+// been started and have not finished or expired yet.
+var errTooManyCeremonies = errors.New(
+	"too many passkey ceremonies are in progress, try again later",
+)
+
+// Passkey is a WebAuthn credential registered by a user. It could be used for
+// logging in instead of the username and password.
+type Passkey struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index" json:"user_id"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `gorm:"uniqueIndex" json:"-"`
+	Credential   []byte     `json:"-"` // JSON encoded webauthn.Credential
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+// credential decodes the stored WebAuthn credential.
+func (p *Passkey) credential() (webauthn.Credential, error) {
+	var cred webauthn.Credential
+	err := json.Unmarshal(p.Credential, &cred)
+	return cred, err
+}
+
+// setCredential encodes the WebAuthn credential for storing.
+func (p *Passkey) setCredential(cred *webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+
+	p.CredentialID = cred.ID
+	p.Credential = data
+	return nil
+}
+
+// newWebAuthn returns the relying party for the configuration. It returns nil
+// when passkeys are not configured.
+func newWebAuthn(cfg *config.WebAuthnConfig) (*webauthn.WebAuthn, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	displayName := cfg.RPDisplayName
+	if displayName == "" {
+		displayName = webAuthnDisplayName
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     cfg.Origins,
+	})
+}
+
+// webAuthnUser adapts User and its passkeys to the webauthn.User interface.
+type webAuthnUser struct {
+	user     *User
+	passkeys []Passkey
+}
+
+// loadWebAuthnUser returns the user together with all of its passkeys.
+func loadWebAuthnUser(db *gorm.DB, user *User) (*webAuthnUser, error) {
+	var passkeys []Passkey
+	if err := db.Where("user_id = ?", user.ID).Find(&passkeys).Error; err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{
+		user:     user,
+		passkeys: passkeys,
+	}, nil
+}
+
+// WebAuthnID is the user handle. It is the ID of the user since it does not
+// reveal anything about it.
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.ID)
+}
+
+// WebAuthnName returns the username.
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+// WebAuthnDisplayName returns the username too as users have no other names.
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+// WebAuthnCredentials returns the credentials of all passkeys of the user. Ones
+// which could not be decoded are skipped.
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.passkeys))
+	for i := range u.passkeys {
+		cred, err := u.passkeys[i].credential()
+		if err != nil {
+			continue
+		}
+		creds = append(creds, cred)
+	}
+	return creds
+}
+
+// WebAuthnIcon is deprecated by the specification and is always empty.
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// passkey returns the passkey of the user with this credential ID.
+func (u *webAuthnUser) passkey(credentialID []byte) *Passkey {
+	for i := range u.passkeys {
+		if string(u.passkeys[i].CredentialID) == string(credentialID) {
+			return &u.passkeys[i]
+		}
+	}
+	return nil
+}
+
+func webAuthnUserHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
+
+// ceremony is a started passkey registration or login.
+type ceremony struct {
+	userID  uint
+	session webauthn.SessionData
+	expires time.Time
+}
+
+// ceremonyStore keeps the started ceremonies in memory until they are finished.
+// Every ceremony could be finished only once. The expired ones are removed only
+// when the store is full so that starting a ceremony does not have to go through
+// all of them.
+type ceremonyStore struct {
+	mu         sync.Mutex
+	ceremonies map[string]ceremony
+	max        int
+	pruned     time.Time
+}
+
+func newCeremonyStore() *ceremonyStore {
+	return &ceremonyStore{
+		ceremonies: make(map[string]ceremony),
+		max:        maxCeremonies,
+	}
+}
+
+// start stores the session data and returns the ID with which it could be taken.
+// It returns errTooManyCeremonies when the store is full.
+func (s *ceremonyStore) start(userID uint, session *webauthn.SessionData) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.ceremonies) >= s.max && now.Sub(s.pruned) >= ceremonyPruneInterval {
+		s.pruned = now
+		for key, c := range s.ceremonies {
+			if now.After(c.expires) {
+				delete(s.ceremonies, key)
+			}
+		}
+	}
+
+	if len(s.ceremonies) >= s.max {
+		return "", errTooManyCeremonies
+	}
+
+	s.ceremonies[id] = ceremony{
+		userID:  userID,
+		session: *session,
+		expires: now.Add(ceremonyDuration),
+	}
+	return id, nil
+}
+
+// finish removes the ceremony and returns it if it has not expired.
+func (s *ceremonyStore) finish(id string) (ceremony, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.ceremonies[id]
+	delete(s.ceremonies, id)
+	if !ok || time.Now().After(c.expires) {
+		return ceremony{}, false
+	}
+
+	return c, true
+}
@@ -0,0 +1,317 @@
+package webserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	// playIdleTimeout is the time after the last event of a play after which
+	// it is forgotten. Clients which pause for longer start a new play.
+	playIdleTimeout = 30 * time.Minute
+
+	// playPositionSlack is how much the reported position may advance over the
+	// wall clock time since the play started. It covers network delays.
+	playPositionSlack = 5 * time.Second
+
+	// maxUserPlays is the maximal number of plays in progress of a single user.
+	// It is more than enough for a few clients playing at the same time.
+	maxUserPlays = 16
+
+	// maxPlays is the maximal number of plays in progress of all users together,
+	// including the anonymous ones.
+	maxPlays = 10000
+)
+
+// The possible play events.
+const (
+	playEventStarted  = "started"
+	playEventProgress = "progress"
+	playEventFinished = "finished"
+)
+
+// errPlayNotFound is returned for events of plays which do not exist, have
+// expired or belong to another user or track.
+var errPlayNotFound = errors.New("play not found")
+
+// play is a single playing of a track by a client. It is followed through the
+// play events which the client sends.
+type play struct {
+	id       string
+	userID   uint
+	client   string
+	trackID  int64
+	duration time.Duration
+
+	// historyID is the ID of the play in the user's listening history. It is
+	// zero for plays of anonymous users.
+	historyID int64
+
+	startedAt time.Time
+	lastEvent time.Time
+	position  time.Duration
+
+	// listened is the time the track has actually been played. Seeking forward
+	// does not add to it.
+	listened time.Duration
+	counted  bool
+}
+
+// playStatus is the state of a play as returned to the clients.
+type playStatus struct {
+	ID       string  `json:"play_id"`
+	Listened float64 `json:"listened"`
+	Counted  bool    `json:"counted"`
+}
+
+func (p *play) status() playStatus {
+	return playStatus{
+		ID:       p.id,
+		Listened: p.listened.Seconds(),
+		Counted:  p.counted,
+	}
+}
+
+// playTracker keeps the plays which are in progress and counts a listen of the
+// track once a play reaches the listen threshold. Plays are kept in memory and
+// are lost when the server restarts. Their number is limited per user and in
+// total so that clients could not grow the memory without bound by starting
+// plays. The listening history of the users is
+// updated with the progress of their plays and the counted plays are scrobbled.
+type playTracker struct {
+	library    library.Library
+	history    library.History
+	scrobbling *scrobbling
+	threshold  config.ListenThreshold
+
+	mu    sync.Mutex
+	plays map[string]*play
+}
+
+func newPlayTracker(
+	lib library.Library,
+	history library.History,
+	scrobbling *scrobbling,
+	threshold config.ListenThreshold,
+) *playTracker {
+	return &playTracker{
+		library:    lib,
+		history:    history,
+		scrobbling: scrobbling,
+		threshold:  threshold,
+		plays:      make(map[string]*play),
+	}
+}
+
+// start begins a new play of the track. userID is zero when the request was not
+// authenticated. The play is the same one in the history as the one recorded
+// while the client was requesting the file.
+func (pt *playTracker) start(
+	userID uint,
+	client string,
+	track library.SearchResult,
+	position time.Duration,
+) (playStatus, error) {
+	id, err := randomToken()
+	if err != nil {
+		return playStatus{}, err
+	}
+
+	var historyID int64
+	if userID != 0 {
+		historyID, err = pt.history.RecordPlay(
+			int64(userID),
+			track.ID,
+			client,
+			position > 0,
+		)
+		if err != nil {
+			return playStatus{}, err
+		}
+	}
+
+	now := time.Now()
+	p := &play{
+		id:        id,
+		userID:    userID,
+		client:    client,
+		trackID:   track.ID,
+		duration:  time.Duration(track.Duration) * time.Millisecond,
+		historyID: historyID,
+		startedAt: now,
+		lastEvent: now,
+		position:  position,
+	}
+
+	pt.mu.Lock()
+	pt.prune(now)
+	if userID != 0 {
+		pt.limit(maxUserPlays-1, func(p *play) bool { return p.userID == userID })
+	}
+	pt.limit(maxPlays-1, func(*play) bool { return true })
+	pt.plays[id] = p
+	status := p.status()
+	pt.mu.Unlock()
+
+	if userID != 0 {
+		pt.scrobbling.playing(userID, client, track)
+	}
+
+	return status, nil
+}
+
+// update records that the play with this id has reached position. The play is
+// forgotten when finished is true.
+func (pt *playTracker) update(
+	id string,
+	userID uint,
+	trackID int64,
+	position time.Duration,
+	finished bool,
+) (playStatus, error) {
+	pt.mu.Lock()
+
+	now := time.Now()
+	p, ok := pt.plays[id]
+	if !ok || p.userID != userID || p.trackID != trackID ||
+		now.Sub(p.lastEvent) > playIdleTimeout {
+		pt.mu.Unlock()
+		return playStatus{}, errPlayNotFound
+	}
+
+	// Only the time which could have actually passed since the previous event
+	// is added. This way seeking forward is not counted as listening. The slack
+	// is granted only once for the whole play or otherwise seeking back and
+	// forth would add it on every event.
+	if advanced := position - p.position; advanced > 0 {
+		if elapsed := now.Sub(p.lastEvent) + playPositionSlack; advanced > elapsed {
+			advanced = elapsed
+		}
+		p.listened = min(p.listened+advanced, now.Sub(p.startedAt)+playPositionSlack)
+	}
+	p.position = position
+	p.lastEvent = now
+
+	count := !p.counted && thresholdReached(pt.threshold, p.listened, p.duration)
+	if count {
+		p.counted = true
+	}
+	if finished {
+		delete(pt.plays, id)
+	}
+
+	status := p.status()
+	historyID, listened, startedAt := p.historyID, p.listened, p.startedAt
+	client := p.client
+	pt.mu.Unlock()
+
+	if userID != 0 {
+		pt.scrobbling.progressed(userID, client)
+	}
+
+	if historyID != 0 {
+		err := pt.history.UpdatePlay(historyID, listened, position, status.Counted)
+		if err != nil {
+			log.Printf("Failed to update play in history: %s", err.Error())
+		}
+	}
+
+	if count {
+		if err := pt.library.IncrementListenCount(trackID); err != nil {
+			log.Printf("Failed to increment listen count: %s", err.Error())
+		}
+
+		if userID != 0 {
+			pt.scrobbling.counted(userID, trackID, startedAt)
+		}
+	}
+
+	return status, nil
+}
+
+// thresholdReached returns true when playing a track of this duration for the
+// listened time reaches the listen threshold. The duration is zero when unknown.
+func thresholdReached(
+	threshold config.ListenThreshold,
+	listened time.Duration,
+	duration time.Duration,
+) bool {
+	if threshold.Seconds > 0 &&
+		listened >= time.Duration(threshold.Seconds)*time.Second {
+		return true
+	}
+
+	return threshold.Percent > 0 && duration > 0 &&
+		listened >= duration*time.Duration(threshold.Percent)/100
+}
+
+// prune removes the plays which have been idle for too long. It must be called
+// with pt.mu held.
+func (pt *playTracker) prune(now time.Time) {
+	for id, p := range pt.plays {
+		if now.Sub(p.lastEvent) > playIdleTimeout {
+			delete(pt.plays, id)
+		}
+	}
+}
+
+// limit removes the least recently active plays for which match returns true until
+// at most max of them are left. It must be called with pt.mu held.
+func (pt *playTracker) limit(max int, match func(*play) bool) {
+	for {
+		var (
+			count  int
+			oldest *play
+		)
+		for _, p := range pt.plays {
+			if !match(p) {
+				continue
+			}
+			count++
+			if oldest == nil || p.lastEvent.Before(oldest.lastEvent) {
+				oldest = p
+			}
+		}
+
+		if count <= max {
+			return
+		}
+		delete(pt.plays, oldest.id)
+	}
+}
+
+// playClient returns the name of the client which made the request. It is the
+// device of the session or the user agent otherwise.
+func playClient(req *http.Request) string {
+	if sess := sessionFromContext(req.Context()); sess != nil && sess.Device != "" {
+		return sess.Device
+	}
+	return req.UserAgent()
+}
+
+// continuesPlay returns true when the request is for the middle of a file. Such
+// requests continue a play instead of starting a new one.
+func continuesPlay(req *http.Request) bool {
+	if offset, err := strconv.ParseFloat(req.URL.Query().Get("offset"), 64); err == nil {
+		return offset > 0
+	}
+
+	spec, ok := strings.CutPrefix(req.Header.Get("Range"), "bytes=")
+	if !ok {
+		return false
+	}
+
+	start, _, _ := strings.Cut(strings.TrimSpace(spec), "-")
+	first, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+
+	// Suffix ranges such as "bytes=-1024" read the end of the file.
+	return err != nil || first > 0
+}
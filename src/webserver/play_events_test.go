@@ -0,0 +1,94 @@
+package webserver
+
+import (
+	"testing"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+// TestPlayTrackerLimits makes sure starting plays over and over does not grow the
+// plays in progress without a bound and that the oldest plays are the ones which
+// are forgotten.
+func TestPlayTrackerLimits(t *testing.T) {
+	pt := newPlayTracker(nil, &stubHistory{}, nil, config.ListenThreshold{Percent: 50})
+	track := library.SearchResult{ID: 1, Duration: 60000}
+
+	first, err := pt.start(1, "client", track, 0)
+	if err != nil {
+		t.Fatalf("starting play: %s", err)
+	}
+	pt.plays[first.ID].lastEvent = time.Now().Add(-time.Minute)
+
+	for i := 0; i < maxUserPlays*3; i++ {
+		if _, err := pt.start(1, "client", track, 0); err != nil {
+			t.Fatalf("starting play: %s", err)
+		}
+	}
+	other, err := pt.start(2, "client", track, 0)
+	if err != nil {
+		t.Fatalf("starting play: %s", err)
+	}
+
+	userPlays := 0
+	for _, p := range pt.plays {
+		if p.userID == 1 {
+			userPlays++
+		}
+	}
+	if userPlays != maxUserPlays {
+		t.Errorf("expected %d plays of the user but there are %d", maxUserPlays, userPlays)
+	}
+
+	if _, err := pt.update(first.ID, 1, track.ID, 0, false); err != errPlayNotFound {
+		t.Errorf("expected the oldest play to be forgotten but got %v", err)
+	}
+	if _, err := pt.update(other.ID, 2, track.ID, 0, false); err != nil {
+		t.Errorf("expected the play of another user to be kept but got %s", err)
+	}
+}
+
+// TestPlayTrackerSeekingBack makes sure seeking back and forth does not count as
+// listening for longer than the time which has passed.
+func TestPlayTrackerSeekingBack(t *testing.T) {
+	pt := newPlayTracker(nil, &stubHistory{}, nil, config.ListenThreshold{Percent: 50})
+	track := library.SearchResult{ID: 1, Duration: 60000}
+
+	started, err := pt.start(0, "client", track, 0)
+	if err != nil {
+		t.Fatalf("starting play: %s", err)
+	}
+
+	var status playStatus
+	for i := 0; i < 20; i++ {
+		for _, position := range []time.Duration{playPositionSlack, 0} {
+			status, err = pt.update(started.ID, 0, track.ID, position, false)
+			if err != nil {
+				t.Fatalf("updating play: %s", err)
+			}
+		}
+	}
+
+	if status.Counted {
+		t.Errorf("expected the play not to be counted")
+	}
+	if limit := (playPositionSlack + time.Second).Seconds(); status.Listened > limit {
+		t.Errorf("expected at most %.0fs listened but got %.1fs", limit, status.Listened)
+	}
+}
+
+// stubHistory is a listening history which only hands out play IDs.
+type stubHistory struct {
+	library.History
+	lastID int64
+}
+
+func (h *stubHistory) RecordPlay(int64, int64, string, bool) (int64, error) {
+	h.lastID++
+	return h.lastID, nil
+}
+
+func (h *stubHistory) UpdatePlay(int64, time.Duration, time.Duration, bool) error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package webserver
+
+// Role defines what a user is allowed to do with the server.
+type Role string
+
+const (
+	// RoleNone is used in the permissions table for endpoints which do not require
+	// any authentication. No user ever has this role.
+	RoleNone Role = ""
+
+	// RoleGuest is a read-only user. It may browse, search and stream the
+	// library but cannot change anything.
+	RoleGuest Role = "guest"
+
+	// RoleListener is the role of the regular users. On top of what the guests
+	// can do they have access to the per-user features.
+	RoleListener Role = "listener"
+
+	// RoleAdmin is allowed to do everything, including changing the library
+	// meta data and managing the other users.
+	RoleAdmin Role = "admin"
+)
+
+// Valid returns true when r is a role which could be given to a user.
+func (r Role) Valid() bool {
+	return r == RoleGuest || r == RoleListener || r == RoleAdmin
+}
+
+// Allows returns true when a user with role r has at least the permissions of
+// a user with the required role.
+func (r Role) Allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleGuest:
+		return 1
+	case RoleListener:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,785 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+	"NT106/Group01/MusicStreamingAPI/src/library"
+	"NT106/Group01/MusicStreamingAPI/src/scrobble"
+)
+
+// The names of the scrobbling services as used in the API.
+const (
+	scrobblerListenBrainz = "listenbrainz"
+	scrobblerLastFM       = "lastfm"
+)
+
+const (
+	scrobblingDisabledText = "scrobbling is not configured on this server"
+
+	// scrobbleRequestTimeout is the longest time a single request to a
+	// scrobbling service may take.
+	scrobbleRequestTimeout = 30 * time.Second
+
+	// scrobbleQueuePoll is how often the queue is checked for scrobbles which
+	// are due for another attempt.
+	scrobbleQueuePoll = time.Minute
+
+	// scrobbleQueueBatch is how many queued scrobbles are read at once.
+	scrobbleQueueBatch = 50
+
+	// scrobbleRetryMin and scrobbleRetryMax limit the time between two attempts
+	// to submit a scrobble. It doubles after every failed attempt.
+	scrobbleRetryMin = time.Minute
+	scrobbleRetryMax = 6 * time.Hour
+
+	// streamedPlaySlack is added to the duration of a track before a play which
+	// is followed only through the file requests is considered finished.
+	streamedPlaySlack = 30 * time.Second
+)
+
+var (
+	// errUnknownScrobbler is returned for services which do not exist or are not
+	// configured on this server.
+	errUnknownScrobbler = errors.New("unknown scrobbling service")
+
+	// errScrobblerUnavailable is returned when the service could not be reached
+	// or has failed to answer.
+	errScrobblerUnavailable = errors.New("scrobbling service unavailable")
+)
+
+// ScrobblerAccount is the account of a user with a scrobbling service.
+type ScrobblerAccount struct {
+	ID      uint   `gorm:"primaryKey" json:"-"`
+	UserID  uint   `gorm:"uniqueIndex:idx_scrobbler_accounts_user" json:"-"`
+	Service string `gorm:"uniqueIndex:idx_scrobbler_accounts_user" json:"service"`
+
+	// Name is the name of the user with the service.
+	Name string `json:"name"`
+
+	// Credentials are the ListenBrainz user token or the Last.fm session key.
+	Credentials string `json:"-"`
+
+	// Error is set when the service has stopped accepting the credentials. The
+	// scrobbles stay queued until the account is connected again.
+	Error string `json:"error,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// QueuedScrobble is a completed play which has not been submitted to a scrobbling
+// service yet. The track is copied so that it could be submitted even after it
+// has been removed from the library.
+type QueuedScrobble struct {
+	ID          uint `gorm:"primaryKey"`
+	UserID      uint `gorm:"index"`
+	Service     string
+	Artist      string
+	Title       string
+	Album       string
+	TrackNumber int64
+
+	// Duration of the track in milliseconds.
+	Duration   int64
+	ListenedAt time.Time
+
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+}
+
+func (qs QueuedScrobble) listen() scrobble.Listen {
+	return scrobble.Listen{
+		Track: scrobble.Track{
+			Artist:      qs.Artist,
+			Title:       qs.Title,
+			Album:       qs.Album,
+			TrackNumber: qs.TrackNumber,
+			Duration:    time.Duration(qs.Duration) * time.Millisecond,
+		},
+		ListenedAt: qs.ListenedAt,
+	}
+}
+
+// streamedPlay is the last play of a user as seen from the requests for the file.
+// It is how completed plays are detected for clients which do not send play
+// events.
+type streamedPlay struct {
+	track     library.SearchResult
+	startedAt time.Time
+	timer     *time.Timer
+
+	// reachedEnd is set once the last byte of the file has been served late
+	// enough after the start for the play to reach the listen threshold.
+	reachedEnd bool
+
+	// scrobbled is set once the play has been queued for scrobbling.
+	scrobbled bool
+}
+
+// scrobbling submits the plays of the users to their scrobbling services. The
+// completed plays are first stored in a queue in the database and are submitted
+// from there. This way they survive restarts of the server and outages of the
+// services. A nil *scrobbling does nothing so that callers do not have to check
+// whether scrobbling is configured.
+type scrobbling struct {
+	db        *gorm.DB
+	library   library.Library
+	threshold config.ListenThreshold
+
+	listenBrainz *scrobble.ListenBrainz
+
+	// lastFM is nil when Last.fm is not configured.
+	lastFM *scrobble.LastFM
+
+	// services are the configured services by name.
+	services map[string]scrobble.Scrobbler
+
+	// wake makes the queue be checked immediately.
+	wake chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint]*streamedPlay
+
+	// eventClients are the last clients of the users which sent play events.
+	// The plays of these clients are followed through the events and not
+	// through their requests for the files.
+	eventClients map[uint]eventClient
+}
+
+// eventClient is a client which sends play events.
+type eventClient struct {
+	name     string
+	lastSeen time.Time
+}
+
+// newScrobbling returns the scrobbling for the configuration and starts submitting
+// the queued scrobbles until ctx is done. It returns nil when scrobbling is not
+// configured.
+func newScrobbling(
+	ctx context.Context,
+	cfg *config.ScrobblingConfig,
+	db *gorm.DB,
+	lib library.Library,
+	threshold config.ListenThreshold,
+) *scrobbling {
+	if cfg == nil {
+		return nil
+	}
+
+	s := &scrobbling{
+		db:           db,
+		library:      lib,
+		threshold:    threshold,
+		listenBrainz: scrobble.NewListenBrainz(cfg.ListenBrainzURL),
+		services:     make(map[string]scrobble.Scrobbler),
+		wake:         make(chan struct{}, 1),
+		streams:      make(map[uint]*streamedPlay),
+		eventClients: make(map[uint]eventClient),
+	}
+	s.services[scrobblerListenBrainz] = s.listenBrainz
+
+	if cfg.LastFM != nil {
+		s.lastFM = scrobble.NewLastFM(cfg.LastFM.APIKey, cfg.LastFM.Secret, cfg.LastFM.URL)
+		s.services[scrobblerLastFM] = s.lastFM
+	}
+
+	go s.run(ctx)
+	return s
+}
+
+// serviceNames returns the names of the configured services, sorted.
+func (s *scrobbling) serviceNames() []string {
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// connect checks the token with the service and stores the account of the user.
+// The token is a ListenBrainz user token or an authorized Last.fm token. Scrobbles
+// which have been waiting for the account are retried.
+func (s *scrobbling) connect(
+	ctx context.Context,
+	userID uint,
+	service string,
+	token string,
+) (ScrobblerAccount, error) {
+	account := ScrobblerAccount{
+		UserID:  userID,
+		Service: service,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scrobbleRequestTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case service == scrobblerListenBrainz:
+		account.Name, err = s.listenBrainz.ValidateToken(ctx, token)
+		account.Credentials = token
+	case service == scrobblerLastFM && s.lastFM != nil:
+		account.Name, account.Credentials, err = s.lastFM.Session(ctx, token)
+	default:
+		return account, errUnknownScrobbler
+	}
+	if errors.Is(err, scrobble.ErrInvalidCredentials) || errors.Is(err, scrobble.ErrRejected) {
+		return account, err
+	} else if err != nil {
+		return account, fmt.Errorf("%w: %s", errScrobblerUnavailable, err)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var existing ScrobblerAccount
+		err := tx.Where("user_id = ? AND service = ?", userID, service).
+			First(&existing).Error
+		if err == nil {
+			account.ID = existing.ID
+			account.CreatedAt = existing.CreatedAt
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&QueuedScrobble{}).
+			Where("user_id = ? AND service = ?", userID, service).
+			Update("next_attempt_at", time.Now()).Error
+	})
+	if err != nil {
+		return account, err
+	}
+
+	s.wakeUp()
+	return account, nil
+}
+
+// disconnect removes the account of the user together with its queued scrobbles.
+// It returns false when there was no such account.
+func (s *scrobbling) disconnect(userID uint, service string) (bool, error) {
+	var found bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("user_id = ? AND service = ?", userID, service).
+			Delete(&ScrobblerAccount{})
+		if res.Error != nil {
+			return res.Error
+		}
+		found = res.RowsAffected > 0
+
+		return tx.Where("user_id = ? AND service = ?", userID, service).
+			Delete(&QueuedScrobble{}).Error
+	})
+	return found, err
+}
+
+// accounts returns the accounts of the user with the configured services.
+func (s *scrobbling) accounts(userID uint) ([]ScrobblerAccount, error) {
+	var accounts []ScrobblerAccount
+	err := s.db.Where("user_id = ? AND service IN ?", userID, s.serviceNames()).
+		Order("service").
+		Find(&accounts).Error
+	return accounts, err
+}
+
+// started is called when the user starts streaming the track from its beginning
+// with the client. The services are told that the user is playing it. The previous
+// play of the user is queued for scrobbling when it has been completed. Clients
+// which send play events are ignored since they request files for prefetching
+// too.
+func (s *scrobbling) started(userID uint, client string, trackID int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	events := s.sendsPlayEvents(userID, client, time.Now())
+	s.mu.Unlock()
+	if events {
+		return
+	}
+
+	accounts, err := s.accounts(userID)
+	if err != nil {
+		log.Printf("Failed to get scrobbler accounts: %s", err.Error())
+		return
+	}
+	if len(accounts) == 0 {
+		return
+	}
+
+	track, err := s.library.GetTrack(trackID)
+	if err != nil {
+		log.Printf("Failed to get track %d for scrobbling: %s", trackID, err.Error())
+		return
+	}
+
+	now := time.Now()
+	p := &streamedPlay{
+		track:     track,
+		startedAt: now,
+	}
+
+	s.mu.Lock()
+	prev := s.streams[userID]
+	if prev != nil && prev.track.ID == trackID &&
+		now.Sub(prev.startedAt) <= library.PlayRestartWindow {
+		s.mu.Unlock()
+		return
+	}
+
+	var completed bool
+	if prev != nil {
+		if prev.timer != nil {
+			prev.timer.Stop()
+		}
+		completed = s.completed(prev, now)
+	}
+
+	if track.Duration > 0 {
+		p.timer = time.AfterFunc(
+			time.Duration(track.Duration)*time.Millisecond+streamedPlaySlack,
+			func() { s.expire(userID, p) },
+		)
+	}
+	s.streams[userID] = p
+	s.mu.Unlock()
+
+	if completed {
+		s.enqueue(userID, prev.track, prev.startedAt)
+	}
+	go s.nowPlaying(accounts, track)
+}
+
+// following returns true when the track is the one the user is streaming with
+// the client and it could still be scrobbled. Only then it matters whether its
+// end is served.
+func (s *scrobbling) following(userID uint, client string, trackID int64) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sendsPlayEvents(userID, client, time.Now()) {
+		return false
+	}
+
+	p := s.streams[userID]
+	return p != nil && p.track.ID == trackID && !p.scrobbled
+}
+
+// servedEnd is called when the end of the track's file has been served to the
+// user. Files are often downloaded much faster than they are played. So the end
+// counts only when it is served after the time the track must be played for
+// reaching the listen threshold.
+func (s *scrobbling) servedEnd(userID uint, trackID int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.streams[userID]
+	if p == nil || p.track.ID != trackID {
+		return
+	}
+
+	duration := time.Duration(p.track.Duration) * time.Millisecond
+	if thresholdReached(s.threshold, time.Since(p.startedAt), duration) {
+		p.reachedEnd = true
+	}
+}
+
+// playing is called when the client of the user starts a play of the track with
+// play events. The services are told that the user is playing it. From now on
+// the plays of the client are followed only through the events.
+func (s *scrobbling) playing(userID uint, client string, track library.SearchResult) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.playEvent(userID, client)
+	if p := s.streams[userID]; p != nil && p.track.ID == track.ID {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(s.streams, userID)
+	}
+	s.mu.Unlock()
+
+	accounts, err := s.accounts(userID)
+	if err != nil {
+		log.Printf("Failed to get scrobbler accounts: %s", err.Error())
+		return
+	}
+	if len(accounts) > 0 {
+		go s.nowPlaying(accounts, track)
+	}
+}
+
+// progressed is called when the client of the user sends an event for a play
+// other than its start.
+func (s *scrobbling) progressed(userID uint, client string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.playEvent(userID, client)
+	s.mu.Unlock()
+}
+
+// playEvent records that the client of the user has sent a play event. It must
+// be called with s.mu held.
+func (s *scrobbling) playEvent(userID uint, client string) {
+	s.eventClients[userID] = eventClient{
+		name:     client,
+		lastSeen: time.Now(),
+	}
+}
+
+// sendsPlayEvents returns true when the client of the user has recently sent
+// play events. It must be called with s.mu held.
+func (s *scrobbling) sendsPlayEvents(userID uint, client string, now time.Time) bool {
+	c, ok := s.eventClients[userID]
+	return ok && c.name == client && now.Sub(c.lastSeen) <= playIdleTimeout
+}
+
+// counted is called when a play reported with play events reaches the listen
+// threshold. Such plays are scrobbled right away.
+func (s *scrobbling) counted(userID uint, trackID int64, startedAt time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if p := s.streams[userID]; p != nil && p.track.ID == trackID {
+		if p.scrobbled {
+			s.mu.Unlock()
+			return
+		}
+		p.scrobbled = true
+	}
+	s.mu.Unlock()
+
+	track, err := s.library.GetTrack(trackID)
+	if err != nil {
+		log.Printf("Failed to get track %d for scrobbling: %s", trackID, err.Error())
+		return
+	}
+
+	s.enqueue(userID, track, startedAt)
+}
+
+// expire is called when the streamed play p has lasted for the whole duration of
+// its track.
+func (s *scrobbling) expire(userID uint, p *streamedPlay) {
+	s.mu.Lock()
+	if s.streams[userID] == p {
+		delete(s.streams, userID)
+	}
+	completed := s.completed(p, time.Now())
+	s.mu.Unlock()
+
+	if completed {
+		s.enqueue(userID, p.track, p.startedAt)
+	}
+}
+
+// completed returns true when the streamed play should be scrobbled at the time
+// it ended. The whole file must have been served and the time since the start
+// of the play must reach the listen threshold. It must be called with s.mu held.
+func (s *scrobbling) completed(p *streamedPlay, ended time.Time) bool {
+	if p.scrobbled || !p.reachedEnd {
+		return false
+	}
+
+	duration := time.Duration(p.track.Duration) * time.Millisecond
+	listened := ended.Sub(p.startedAt)
+	if duration > 0 && listened > duration {
+		listened = duration
+	}
+
+	if !thresholdReached(s.threshold, listened, duration) {
+		return false
+	}
+
+	p.scrobbled = true
+	return true
+}
+
+// nowPlaying tells the services of the accounts that the track is being played.
+// It is not retried since it is useful only while the track is playing.
+func (s *scrobbling) nowPlaying(accounts []ScrobblerAccount, track library.SearchResult) {
+	if track.Artist == "" || track.Title == "" {
+		return
+	}
+
+	for _, account := range accounts {
+		scrobbler, ok := s.services[account.Service]
+		if !ok || account.Error != "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), scrobbleRequestTimeout)
+		err := scrobbler.NowPlaying(ctx, account.Credentials, scrobbleTrack(track))
+		cancel()
+
+		if errors.Is(err, scrobble.ErrInvalidCredentials) {
+			s.invalidate(account, err)
+		} else if err != nil {
+			log.Printf("Failed to send now playing to %s: %s", account.Service, err.Error())
+		}
+	}
+}
+
+// enqueue stores the play of the track in the queue of every account of the user.
+// Tracks without an artist or a title could not be scrobbled.
+func (s *scrobbling) enqueue(userID uint, track library.SearchResult, listenedAt time.Time) {
+	if track.Artist == "" || track.Title == "" {
+		return
+	}
+
+	accounts, err := s.accounts(userID)
+	if err != nil {
+		log.Printf("Failed to get scrobbler accounts: %s", err.Error())
+		return
+	}
+	if len(accounts) == 0 {
+		return
+	}
+
+	now := time.Now()
+	entries := make([]QueuedScrobble, 0, len(accounts))
+	for _, account := range accounts {
+		entries = append(entries, QueuedScrobble{
+			UserID:        userID,
+			Service:       account.Service,
+			Artist:        track.Artist,
+			Title:         track.Title,
+			Album:         track.Album,
+			TrackNumber:   track.TrackNumber,
+			Duration:      track.Duration,
+			ListenedAt:    listenedAt,
+			NextAttemptAt: now,
+		})
+	}
+
+	if err := s.db.Create(&entries).Error; err != nil {
+		log.Printf("Failed to queue scrobbles: %s", err.Error())
+		return
+	}
+
+	s.wakeUp()
+}
+
+func (s *scrobbling) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run submits the queued scrobbles until ctx is done.
+func (s *scrobbling) run(ctx context.Context) {
+	ticker := time.NewTicker(scrobbleQueuePoll)
+	defer ticker.Stop()
+
+	for {
+		s.flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// flush submits all queued scrobbles which are due, oldest first.
+func (s *scrobbling) flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		var entries []QueuedScrobble
+		err := s.db.Where("next_attempt_at <= ?", time.Now()).
+			Order("id").
+			Limit(scrobbleQueueBatch).
+			Find(&entries).Error
+		if err != nil {
+			log.Printf("Failed to read the scrobble queue: %s", err.Error())
+			return
+		}
+
+		for i := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			s.submit(ctx, &entries[i])
+		}
+
+		if len(entries) < scrobbleQueueBatch {
+			return
+		}
+	}
+}
+
+// submit makes an attempt to submit the queued scrobble. It is removed from the
+// queue when accepted or rejected for good. Otherwise it is retried later.
+func (s *scrobbling) submit(ctx context.Context, entry *QueuedScrobble) {
+	var account ScrobblerAccount
+	err := s.db.Where("user_id = ? AND service = ?", entry.UserID, entry.Service).
+		First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		s.db.Delete(entry)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get scrobbler account: %s", err.Error())
+		return
+	}
+
+	scrobbler, ok := s.services[entry.Service]
+	if !ok || account.Error != "" {
+		// The service has been removed from the configuration or the account
+		// has to be connected again. The scrobble waits for that.
+		s.postpone(entry, account.Error, scrobbleRetryMax)
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, scrobbleRequestTimeout)
+	err = scrobbler.Scrobble(reqCtx, account.Credentials, entry.listen())
+	cancel()
+
+	switch {
+	case err == nil:
+		s.db.Delete(entry)
+	case errors.Is(err, scrobble.ErrRejected):
+		log.Printf("Scrobble of `%s` by `%s` to %s rejected: %s",
+			entry.Title, entry.Artist, entry.Service, err.Error())
+		s.db.Delete(entry)
+	case errors.Is(err, scrobble.ErrInvalidCredentials):
+		s.invalidate(account, err)
+		s.postpone(entry, err.Error(), scrobbleRetryMax)
+	default:
+		retry := scrobbleRetryMax
+		if entry.Attempts < 16 {
+			retry = min(scrobbleRetryMin<<entry.Attempts, scrobbleRetryMax)
+		}
+		s.postpone(entry, err.Error(), retry)
+	}
+}
+
+// postpone schedules another attempt to submit the scrobble after the delay.
+func (s *scrobbling) postpone(entry *QueuedScrobble, reason string, delay time.Duration) {
+	err := s.db.Model(entry).Updates(map[string]interface{}{
+		"attempts":        entry.Attempts + 1,
+		"next_attempt_at": time.Now().Add(delay),
+		"last_error":      reason,
+	}).Error
+	if err != nil {
+		log.Printf("Failed to postpone scrobble: %s", err.Error())
+	}
+}
+
+// invalidate records that the service does not accept the credentials of the
+// account any more.
+func (s *scrobbling) invalidate(account ScrobblerAccount, reason error) {
+	err := s.db.Model(&account).Update("error", reason.Error()).Error
+	if err != nil {
+		log.Printf("Failed to update scrobbler account: %s", err.Error())
+	}
+}
+
+// queued returns the number of queued scrobbles of the user by service.
+func (s *scrobbling) queued(userID uint) (map[string]int64, error) {
+	var rows []struct {
+		Service string
+		Count   int64
+	}
+	err := s.db.Model(&QueuedScrobble{}).
+		Select("service, COUNT(*) as count").
+		Where("user_id = ?", userID).
+		Group("service").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Service] = row.Count
+	}
+	return counts, nil
+}
+
+func scrobbleTrack(track library.SearchResult) scrobble.Track {
+	return scrobble.Track{
+		Artist:      track.Artist,
+		Title:       track.Title,
+		Album:       track.Album,
+		TrackNumber: track.TrackNumber,
+		Duration:    time.Duration(track.Duration) * time.Millisecond,
+	}
+}
+
+// servedEndWriter records whether a response from http.FileServer has reached
+// the last byte of the file.
+type servedEndWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *servedEndWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *servedEndWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// reachedEnd returns true when the whole response has been written and it ends
+// with the last byte of the file.
+func (w *servedEndWriter) reachedEnd() bool {
+	header := w.Header()
+
+	switch w.status {
+	case http.StatusOK:
+		length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		return err == nil && w.written == length
+	case http.StatusPartialContent:
+		var first, last, size int64
+		_, err := fmt.Sscanf(
+			header.Get("Content-Range"),
+			"bytes %d-%d/%d",
+			&first, &last, &size,
+		)
+		return err == nil && last == size-1 && w.written == last-first+1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+	"NT106/Group01/MusicStreamingAPI/src/library"
+	"NT106/Group01/MusicStreamingAPI/src/scrobble"
+)
+
+// TestScrobblingStreamedPlays checks which plays of the clients without play
+// events are scrobbled.
+func TestScrobblingStreamedPlays(t *testing.T) {
+	tests := []struct {
+		desc string
+
+		// servedAfter is the time after the start of the play at which the
+		// end of the file is served.
+		servedAfter time.Duration
+		expected    int64
+	}{
+		{"downloaded", 0, 0},
+		{"below threshold", 20 * time.Second, 0},
+		{"listened", 40 * time.Second, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			s, _ := newTestScrobbling(t)
+
+			s.started(1, "client", 1)
+			if !s.following(1, "client", 1) {
+				t.Fatalf("expected the play to be followed")
+			}
+			s.streams[1].startedAt = time.Now().Add(-test.servedAfter)
+			s.servedEnd(1, 1)
+
+			// The next track is started once the whole track could have been
+			// played.
+			s.streams[1].startedAt = time.Now().Add(-time.Minute)
+
+			s.started(1, "client", 2)
+			if queued := countQueuedScrobbles(t, s); queued != test.expected {
+				t.Errorf("expected %d queued scrobbles but got %d", test.expected, queued)
+			}
+		})
+	}
+}
+
+// TestScrobblingPlayEvents checks that the file requests of clients which send
+// play events do not start plays.
+func TestScrobblingPlayEvents(t *testing.T) {
+	s, nowPlaying := newTestScrobbling(t)
+
+	s.playing(1, "events", testScrobblingTrack(1))
+	if track := <-nowPlaying; track.Title != "Track 1" {
+		t.Errorf("expected now playing for the started play but got %q", track.Title)
+	}
+
+	// A prefetch of the next track.
+	s.started(1, "events", 2)
+	if s.following(1, "events", 2) {
+		t.Errorf("expected the prefetched track not to be followed")
+	}
+	select {
+	case track := <-nowPlaying:
+		t.Errorf("expected no now playing for the prefetch but got %q", track.Title)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other clients of the user are still followed through their requests.
+	s.started(1, "other", 2)
+	if !s.following(1, "other", 2) {
+		t.Errorf("expected the track of another client to be followed")
+	}
+}
+
+// stubScrobbler sends the tracks played now to a channel.
+type stubScrobbler struct {
+	nowPlaying chan scrobble.Track
+}
+
+func (s *stubScrobbler) NowPlaying(_ context.Context, _ string, track scrobble.Track) error {
+	s.nowPlaying <- track
+	return nil
+}
+
+func (s *stubScrobbler) Scrobble(context.Context, string, scrobble.Listen) error {
+	return nil
+}
+
+// trackLibrary is a library in which every track exists.
+type trackLibrary struct {
+	library.Library
+}
+
+func (l *trackLibrary) GetTrack(id int64) (library.SearchResult, error) {
+	return testScrobblingTrack(id), nil
+}
+
+func testScrobblingTrack(id int64) library.SearchResult {
+	return library.SearchResult{
+		ID:       id,
+		Artist:   "Artist",
+		Title:    fmt.Sprintf("Track %d", id),
+		Duration: 60000,
+	}
+}
+
+// newTestScrobbling returns scrobbling with a ListenBrainz account for the user
+// with ID 1. Nothing is submitted from the queue. The tracks sent as played now
+// are sent to the returned channel.
+func newTestScrobbling(t *testing.T) (*scrobbling, chan scrobble.Track) {
+	t.Helper()
+
+	db := newTestDB(t)
+	account := ScrobblerAccount{UserID: 1, Service: scrobblerListenBrainz}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatalf("creating account: %s", err)
+	}
+
+	nowPlaying := make(chan scrobble.Track, 10)
+	s := &scrobbling{
+		db:        db,
+		library:   &trackLibrary{},
+		threshold: config.ListenThreshold{Percent: 50},
+		services: map[string]scrobble.Scrobbler{
+			scrobblerListenBrainz: &stubScrobbler{nowPlaying: nowPlaying},
+		},
+		wake:         make(chan struct{}, 1),
+		streams:      make(map[uint]*streamedPlay),
+		eventClients: make(map[uint]eventClient),
+	}
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, p := range s.streams {
+			p.timer.Stop()
+		}
+	})
+
+	return s, nowPlaying
+}
+
+func countQueuedScrobbles(t *testing.T, s *scrobbling) int64 {
+	t.Helper()
+
+	var count int64
+	if err := s.db.Model(&QueuedScrobble{}).Count(&count).Error; err != nil {
+		t.Fatalf("counting queued scrobbles: %s", err)
+	}
+	return count
+}
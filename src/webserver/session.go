@@ -0,0 +1,270 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	// sessionTokenBytes is the number of random bytes used for generating
+	// refresh tokens and access token IDs.
+	sessionTokenBytes = 32
+
+	// sessionCookieName is the name of the cookie used by browsers for
+	// authentication.
+	sessionCookieName = "session"
+)
+
+// Session represents a single logged in device or program. Every session has a
+// long-lived refresh token which is used for obtaining short-lived access tokens.
+// Access tokens are bound to the session by their JWT ID. Removing the session
+// revokes all of its tokens at once.
+type Session struct {
+	ID     uint `gorm:"primaryKey"`
+	UserID uint `gorm:"index"`
+
+	// TokenID is the JWT ID of the currently valid access tokens for this
+	// session. It changes on every refresh so that older access tokens are
+	// rejected.
+	TokenID string `gorm:"uniqueIndex"`
+
+	// RefreshToken is the SHA256 hash of the refresh token. The token itself
+	// is known only to the client.
+	RefreshToken string `gorm:"uniqueIndex"`
+
+	Device     string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+
+	// OIDCAuthAt is when the user authenticated with the OpenID Connect provider
+	// for creating this session. It is zero for sessions created otherwise.
+	OIDCAuthAt time.Time `gorm:"column:oidc_auth_at"`
+}
+
+// tokenResponse is the JSON response for every endpoint which issues tokens.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// tokenPayload is the JWT payload of the access tokens. The subject claim is the
+// ID of the user for which the token has been issued.
+type tokenPayload struct {
+	jwt.Payload
+	Username string `json:"username,omitempty"`
+}
+
+// newSession creates and stores a new session for the user. It returns the
+// session and its refresh token in plain text.
+func newSession(
+	db *gorm.DB,
+	user *User,
+	req *http.Request,
+	device string,
+) (*Session, string, error) {
+	now := time.Now()
+
+	// Take the chance to forget about sessions which cannot be used anymore.
+	err := db.Where("user_id = ? AND expires_at < ?", user.ID, now).
+		Delete(&Session{}).Error
+	if err != nil {
+		return nil, "", fmt.Errorf("removing expired sessions: %w", err)
+	}
+
+	sess := &Session{
+		UserID:     user.ID,
+		Device:     device,
+		UserAgent:  req.UserAgent(),
+		IPAddress:  remoteIP(req),
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	refreshToken, err := sess.regenerateTokens()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := db.Create(sess).Error; err != nil {
+		return nil, "", fmt.Errorf("saving session: %w", err)
+	}
+
+	return sess, refreshToken, nil
+}
+
+// rotate issues a new refresh token and access token ID for the session. All
+// tokens issued before it will not be accepted anymore.
+func (sess *Session) rotate(db *gorm.DB, req *http.Request) (string, error) {
+	refreshToken, err := sess.regenerateTokens()
+	if err != nil {
+		return "", err
+	}
+
+	sess.LastUsedAt = time.Now()
+	sess.UserAgent = req.UserAgent()
+	sess.IPAddress = remoteIP(req)
+
+	if err := db.Save(sess).Error; err != nil {
+		return "", fmt.Errorf("saving session: %w", err)
+	}
+
+	return refreshToken, nil
+}
+
+func (sess *Session) regenerateTokens() (string, error) {
+	tokenID, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	sess.TokenID = tokenID
+	sess.RefreshToken = hashToken(refreshToken)
+	sess.ExpiresAt = time.Now().Add(rememberMeDuration)
+
+	return refreshToken, nil
+}
+
+// signAccessToken returns a short-lived JWT for the user bound to the session.
+func signAccessToken(user *User, sess *Session, secret string) (string, error) {
+	return signSessionToken(user, sess, secret, time.Now().Add(accessTokenDuration))
+}
+
+// signSessionToken returns a JWT for the user bound to the session which expires
+// at expiresAt.
+func signSessionToken(
+	user *User,
+	sess *Session,
+	secret string,
+	expiresAt time.Time,
+) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("secret is empty")
+	}
+
+	pl := tokenPayload{
+		Payload: jwt.Payload{
+			Subject:        strconv.FormatUint(uint64(user.ID), 10),
+			JWTID:          sess.TokenID,
+			IssuedAt:       jwt.NumericDate(time.Now()),
+			ExpirationTime: jwt.NumericDate(expiresAt),
+		},
+		Username: user.Username,
+	}
+
+	token, err := jwt.Sign(pl, jwt.NewHS256([]byte(secret)))
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+// respondWithTokens writes the access and refresh tokens for a session as a
+// JSON response.
+func respondWithTokens(
+	w http.ResponseWriter,
+	user *User,
+	sess *Session,
+	refreshToken string,
+	secret string,
+) {
+	token, err := signAccessToken(user, sess, secret)
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error generating JWT: %s.",
+			err,
+		)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&tokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenDuration.Seconds()),
+	})
+
+	if err != nil {
+		respondWithJSONError(
+			w,
+			http.StatusInternalServerError,
+			"Error writing token response: %s.",
+			err,
+		)
+		return
+	}
+}
+
+// setSessionCookie sets a cookie which authenticates the browser for the whole
+// life time of the session. The cookie stops working once the session is revoked
+// or refreshed.
+func setSessionCookie(
+	w http.ResponseWriter,
+	req *http.Request,
+	user *User,
+	sess *Session,
+	secret string,
+) error {
+	token, err := signSessionToken(user, sess, secret, sess.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// clearSessionCookie instructs the browser to forget the session cookie.
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// randomToken returns a hex encoded cryptographically secure random string.
+func randomToken() (string, error) {
+	buff := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(buff); err != nil {
+		return "", fmt.Errorf("generating random token: %w", err)
+	}
+	return hex.EncodeToString(buff), nil
+}
+
+// hashToken returns the form in which tokens are stored in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
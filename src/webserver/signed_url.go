@@ -0,0 +1,149 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The following are the query arguments which make up a signed URL.
+	signedURLExpiresArg   = "expires"
+	signedURLUserArg      = "user"
+	signedURLSignatureArg = "signature"
+
+	// signedURLDuration is the default life time of signed URLs.
+	signedURLDuration = time.Hour
+
+	// signedURLMaxDuration is the longest life time a client may request for
+	// a signed URL.
+	signedURLMaxDuration = 24 * time.Hour
+)
+
+// signedURLRoutes are the endpoints which accept signed URLs instead of the usual
+// authentication. Every one of them is a route template with exactly one variable
+// which is the ID of the resource.
+var signedURLRoutes = []string{
+	APIv1EndpointFile,
+	APIv1EndpointDownloadAlbum,
+}
+
+// signedURLRouter is used for finding out to which resource a signed URL points.
+var signedURLRouter = func() *mux.Router {
+	router := mux.NewRouter()
+	for _, tpl := range signedURLRoutes {
+		router.NewRoute().Path(tpl).Methods(http.MethodGet, http.MethodHead)
+	}
+	return router
+}()
+
+// signURL returns a URL for the resource with this ID which is accessible without
+// any other means of authentication until expiresAt. The route template must be one
+// of signedURLRoutes.
+func signURL(
+	route string,
+	resourceID string,
+	userID uint,
+	expiresAt time.Time,
+	secret string,
+) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("secret is empty")
+	}
+
+	varName, ok := routeVariable(route)
+	if !ok {
+		return "", fmt.Errorf("route %s does not support signed URLs", route)
+	}
+
+	path := strings.Replace(route, "{"+varName+"}", url.PathEscape(resourceID), 1)
+	expires := expiresAt.Unix()
+
+	args := url.Values{}
+	args.Set(signedURLExpiresArg, strconv.FormatInt(expires, 10))
+	args.Set(signedURLUserArg, strconv.FormatUint(uint64(userID), 10))
+	args.Set(
+		signedURLSignatureArg,
+		urlSignature(route, resourceID, userID, expires, secret),
+	)
+
+	return path + "?" + args.Encode(), nil
+}
+
+// verifySignedURL checks whether the request is for a valid and not expired signed
+// URL. On success it returns the ID of the user for which the URL was signed.
+func verifySignedURL(req *http.Request, secret string) (uint, bool) {
+	if len(secret) == 0 {
+		return 0, false
+	}
+
+	var match mux.RouteMatch
+	if !signedURLRouter.Match(req, &match) {
+		return 0, false
+	}
+
+	route, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return 0, false
+	}
+
+	varName, _ := routeVariable(route)
+	resourceID := match.Vars[varName]
+
+	query := req.URL.Query()
+	expires, err := strconv.ParseInt(query.Get(signedURLExpiresArg), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+
+	userID, err := strconv.ParseUint(query.Get(signedURLUserArg), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	expected := urlSignature(route, resourceID, uint(userID), expires, secret)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signedURLSignatureArg))) {
+		return 0, false
+	}
+
+	return uint(userID), true
+}
+
+// urlSignature returns the HMAC of everything which a signed URL is scoped to.
+func urlSignature(
+	route string,
+	resourceID string,
+	userID uint,
+	expires int64,
+	secret string,
+) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d", route, resourceID, userID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// routeVariable returns the name of the only variable in a signedURLRoutes route.
+func routeVariable(route string) (string, bool) {
+	for _, tpl := range signedURLRoutes {
+		if tpl != route {
+			continue
+		}
+
+		start := strings.Index(route, "{")
+		end := strings.Index(route, "}")
+		if start < 0 || end < start {
+			return "", false
+		}
+		return route[start+1 : end], true
+	}
+
+	return "", false
+}
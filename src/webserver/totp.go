@@ -0,0 +1,249 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	// totpIssuer is shown by authenticator apps next to the username.
+	totpIssuer = "HTTPMS"
+
+	// totpPeriod and totpDigits are the RFC 6238 defaults which every
+	// authenticator app supports.
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+
+	// totpSkew is how many periods before and after the current one are
+	// accepted in order to tolerate clock drift.
+	totpSkew = 1
+
+	// totpSecretBytes is the size of the shared secret, 160 bits as recommended
+	// by RFC 4226.
+	totpSecretBytes = 20
+
+	// recoveryCodesCount is how many single-use recovery codes users receive
+	// when they enable two-factor authentication.
+	recoveryCodesCount = 10
+
+	// twoFactorTokenDuration is for how long the token returned after the first
+	// login step could be exchanged for a session.
+	twoFactorTokenDuration = 5 * time.Minute
+
+	// twoFactorAudience marks the tokens which are only good for finishing a
+	// login. They could not be used as access tokens.
+	twoFactorAudience = "two-factor"
+)
+
+// totpEncoding is the base32 encoding which authenticator apps expect.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode is a single-use code which could be used instead of a TOTP code
+// when the user has lost its authenticator. Only a hash of the code is stored.
+type RecoveryCode struct {
+	ID     uint   `gorm:"primaryKey"`
+	UserID uint   `gorm:"index"`
+	Hash   string `gorm:"uniqueIndex"`
+}
+
+// newTOTPSecret returns a random base32 encoded secret.
+func newTOTPSecret() (string, error) {
+	buff := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buff), nil
+}
+
+// totpURI returns the otpauth URI which authenticator apps use for enrollment.
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+
+	args := url.Values{}
+	args.Set("secret", secret)
+	args.Set("issuer", totpIssuer)
+	args.Set("algorithm", "SHA1")
+	args.Set("digits", fmt.Sprint(totpDigits))
+	args.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + args.Encode()
+}
+
+// totpCode returns the code for the secret at the given counter as described in
+// RFC 4226.
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// validateTOTP checks the code against the secret at the current time. On success
+// it returns the counter which matched so that the code could not be used twice.
+// Counters not bigger than lastCounter are never accepted.
+func validateTOTP(secret, code string, lastCounter int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / int64(totpPeriod.Seconds())
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// checkSecondFactor verifies either a TOTP code or a recovery code for the user.
+// Used recovery codes are removed and used TOTP counters are remembered.
+func checkSecondFactor(db *gorm.DB, user *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	if counter, ok := validateTOTP(user.TOTPSecret, code, user.TOTPCounter); ok {
+		// The condition makes sure two concurrent requests could not both use
+		// the same code.
+		res := db.Model(&User{}).
+			Where("id = ? AND totp_counter < ?", user.ID, counter).
+			Update("totp_counter", counter)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		user.TOTPCounter = counter
+		return res.RowsAffected == 1, nil
+	}
+
+	res := db.Where("user_id = ? AND hash = ?", user.ID, hashToken(normalizeRecoveryCode(code))).
+		Delete(&RecoveryCode{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+// newRecoveryCodes replaces the recovery codes of the user with new ones and
+// returns them in plain text.
+func newRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	records := make([]RecoveryCode, 0, recoveryCodesCount)
+
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := randomReadableCode()
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+		records = append(records, RecoveryCode{
+			UserID: userID,
+			Hash:   hashToken(normalizeRecoveryCode(code)),
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes the recovery codes case insensitive.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// signTwoFactorToken returns a short-lived token which proves that the user has
+// entered its username and password correctly.
+func signTwoFactorToken(user *User, secret string) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("secret is empty")
+	}
+
+	now := time.Now()
+	pl := jwt.Payload{
+		Subject:        strconv.FormatUint(uint64(user.ID), 10),
+		Audience:       jwt.Audience{twoFactorAudience},
+		IssuedAt:       jwt.NumericDate(now),
+		ExpirationTime: jwt.NumericDate(now.Add(twoFactorTokenDuration)),
+	}
+
+	token, err := jwt.Sign(pl, jwt.NewHS256([]byte(secret)))
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+// verifyTwoFactorToken checks a token returned by signTwoFactorToken and returns
+// the ID of the user for which it was issued.
+func verifyTwoFactorToken(token, secret string) (uint, bool) {
+	var pl jwt.Payload
+
+	validatePayload := jwt.ValidatePayload(
+		&pl,
+		jwt.ExpirationTimeValidator(time.Now()),
+		jwt.AudienceValidator(jwt.Audience{twoFactorAudience}),
+	)
+
+	_, err := jwt.Verify([]byte(token), jwt.NewHS256([]byte(secret)), &pl, validatePayload)
+	if err != nil {
+		return 0, false
+	}
+
+	userID, err := strconv.ParseUint(pl.Subject, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint(userID), true
+}
@@ -0,0 +1,183 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"NT106/Group01/MusicStreamingAPI/src/config"
+	"NT106/Group01/MusicStreamingAPI/src/transcode"
+)
+
+const (
+	transcodingDisabledText = "transcoding is not configured on this server"
+
+	// transcodingRetryAfter is the time after which clients are told to try again
+	// when all transcoding slots are taken.
+	transcodingRetryAfter = 5 * time.Second
+)
+
+// errTranscodingBusy is returned when the maximal number of transcodings are
+// already running.
+var errTranscodingBusy = errors.New("too many transcodings are running, try again later")
+
+// transcoding holds the transcoder and the profiles from the configuration.
+type transcoding struct {
+	transcoder transcode.Transcoder
+	profiles   map[string]transcode.Options
+
+	// hlsBitRates are the bit rates of the HLS variants, sorted.
+	hlsBitRates []int
+	hlsSegments *hlsCache
+}
+
+// newTranscoding returns the transcoding for the configuration. It returns nil
+// when transcoding is not configured. The HLS segments are cached in cacheDir.
+func newTranscoding(cfg *config.TranscodingConfig, cacheDir string) (*transcoding, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	profiles := make(map[string]transcode.Options, len(cfg.Profiles))
+	for name, profile := range cfg.Profiles {
+		opts, err := transcode.NewOptions(profile.Format, profile.BitRate)
+		if err != nil {
+			return nil, fmt.Errorf("profile `%s`: %w", name, err)
+		}
+		profiles[name] = opts
+	}
+
+	hlsBitRates := append([]int(nil), cfg.HLSBitRates...)
+	if len(hlsBitRates) == 0 {
+		hlsBitRates = append(hlsBitRates, hlsDefaultBitRates...)
+	}
+	sort.Ints(hlsBitRates)
+
+	cacheSize := cfg.HLSCacheSize
+	if cacheSize <= 0 {
+		cacheSize = hlsDefaultCacheSize
+	}
+
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = runtime.NumCPU()
+	}
+
+	transcoder := newLimitedTranscoder(transcode.NewFFmpeg(cfg.FFmpeg), maxConcurrent)
+	return &transcoding{
+		transcoder:  transcoder,
+		profiles:    profiles,
+		hlsBitRates: hlsBitRates,
+		hlsSegments: newHLSCache(cacheDir, cacheSize*1024*1024, transcoder),
+	}, nil
+}
+
+// requestedTranscoding returns true when the query asks for a transcoded file.
+func requestedTranscoding(query url.Values) bool {
+	return query.Has("profile") || query.Has("format") || query.Has("offset")
+}
+
+// options returns the transcoding options from the query. The format comes either
+// from a profile ("profile") or from the "format" and the optional "bitrate"
+// arguments. The "offset" argument is the position in seconds from which the
+// result starts.
+func (t *transcoding) options(query url.Values) (transcode.Options, error) {
+	var (
+		opts transcode.Options
+		err  error
+	)
+
+	if name := query.Get("profile"); name != "" {
+		var ok bool
+		opts, ok = t.profiles[name]
+		if !ok {
+			return opts, fmt.Errorf("unknown transcoding profile `%s`", name)
+		}
+	} else {
+		if query.Get("format") == "" {
+			return opts, fmt.Errorf(`"format" or "profile" is required for transcoding`)
+		}
+
+		bitRate := 0
+		if arg := query.Get("bitrate"); arg != "" {
+			bitRate, err = strconv.Atoi(arg)
+			if err != nil {
+				return opts, fmt.Errorf(`wrong "bitrate": %w`, err)
+			}
+		}
+
+		opts, err = transcode.NewOptions(query.Get("format"), bitRate)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if arg := query.Get("offset"); arg != "" {
+		seconds, err := strconv.ParseFloat(arg, 64)
+		if err != nil || seconds < 0 {
+			return opts, fmt.Errorf(`"offset" must be a non-negative number of seconds`)
+		}
+		opts.Offset = time.Duration(seconds * float64(time.Second))
+	}
+
+	return opts, nil
+}
+
+// limitedTranscoder is a transcode.Transcoder which runs at most a fixed number of
+// transcodings at the same time. Every one of them is a CPU-bound process so
+// without a limit a few clients could exhaust the host. Transcodings above the
+// limit fail with errTranscodingBusy right away instead of waiting.
+type limitedTranscoder struct {
+	transcoder transcode.Transcoder
+	slots      chan struct{}
+}
+
+func newLimitedTranscoder(transcoder transcode.Transcoder, max int) *limitedTranscoder {
+	return &limitedTranscoder{
+		transcoder: transcoder,
+		slots:      make(chan struct{}, max),
+	}
+}
+
+// Transcode implements the transcode.Transcoder interface.
+func (lt *limitedTranscoder) Transcode(
+	ctx context.Context,
+	w io.Writer,
+	path string,
+	opts transcode.Options,
+) error {
+	select {
+	case lt.slots <- struct{}{}:
+	default:
+		return errTranscodingBusy
+	}
+	defer func() { <-lt.slots }()
+
+	return lt.transcoder.Transcode(ctx, w, path, opts)
+}
+
+// respondWithTranscodingBusy writes the response for a transcoding which was
+// refused because of the limit.
+func respondWithTranscodingBusy(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	respondWithUnavailable(w, transcodingRetryAfter, errTranscodingBusy.Error())
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
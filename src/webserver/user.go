@@ -0,0 +1,172 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"NT106/Group01/MusicStreamingAPI/src/library"
+)
+
+const (
+	// passwordHashCost is the bcrypt cost used for hashing user passwords.
+	passwordHashCost = 14
+)
+
+// errLastAdmin is returned when an operation would leave the server without an
+// active administrator.
+var errLastAdmin = errors.New("the server must have at least one active administrator")
+
+// userJSON is the representation of a user in API responses. It never includes
+// the password hash, only whether the user has a password at all.
+type userJSON struct {
+	ID          uint      `json:"id"`
+	Username    string    `json:"username"`
+	Role        Role      `json:"role"`
+	Disabled    bool      `json:"disabled"`
+	TwoFactor   bool      `json:"two_factor"`
+	HasPassword bool      `json:"has_password"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newUserJSON(user *User) userJSON {
+	return userJSON{
+		ID:          user.ID,
+		Username:    user.Username,
+		Role:        user.Role,
+		Disabled:    user.Disabled,
+		TwoFactor:   user.TOTPEnabled,
+		HasPassword: user.hasPassword(),
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// hasPassword returns false for users which have never set a password.
+func (user *User) hasPassword() bool {
+	return user.Password != ""
+}
+
+// hashPassword returns the form in which passwords are stored in the database.
+func hashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// setUserPassword changes the password of the user and revokes all of its sessions,
+// API keys and passkeys. Neither a leaked key nor a passkey added with a stolen
+// token must survive a password reset.
+func setUserPassword(db *gorm.DB, user *User, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password", hash).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&APIKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&Passkey{}).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID)
+	})
+}
+
+// FindUserID returns the ID of the user with this username from the users database
+// at databasePath. It is used by the command line tools which run without the
+// server.
+func FindUserID(databasePath, username string) (uint, error) {
+	db, err := gorm.Open(sqlite.Open(databasePath), &gorm.Config{})
+	if err != nil {
+		return 0, fmt.Errorf("opening database: %w", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	var user User
+	err = db.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, fmt.Errorf("user `%s` not found", username)
+	} else if err != nil {
+		return 0, err
+	}
+
+	return user.ID, nil
+}
+
+// revokeUserSessions makes all tokens issued for the user invalid.
+func revokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+// deleteUser removes the user together with everything which belongs to it,
+// including the listening history.
+func deleteUser(db *gorm.DB, history library.History, user *User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkNotLastAdmin(tx, user); err != nil {
+			return err
+		}
+		if err := revokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&APIKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&Passkey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&Pairing{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&ScrobblerAccount{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&QueuedScrobble{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// The history is in the library database so it could not be removed in the
+	// same transaction. User IDs could be reused, so it must not be left behind.
+	return history.DeleteHistory(int64(user.ID))
+}
+
+// checkNotLastAdmin returns errLastAdmin when the user is the only one active
+// administrator. It should be called before demoting, disabling or removing a user.
+func checkNotLastAdmin(db *gorm.DB, user *User) error {
+	if user.Role != RoleAdmin || user.Disabled {
+		return nil
+	}
+
+	var admins int64
+	err := db.Model(&User{}).
+		Where("role = ? AND disabled = ? AND id <> ?", RoleAdmin, false, user.ID).
+		Count(&admins).Error
+	if err != nil {
+		return err
+	}
+
+	if admins == 0 {
+		return errLastAdmin
+	}
+
+	return nil
+}
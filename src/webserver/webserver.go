@@ -4,12 +4,15 @@ package webserver
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/mux"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -26,9 +29,68 @@ const (
 
 // User model
 type User struct {
-	ID       uint   `gorm:"primaryKey"`
-	Username string `gorm:"unique"`
-	Password string
+	ID        uint   `gorm:"primaryKey"`
+	Username  string `gorm:"unique"`
+	Password  string
+	Role      Role `gorm:"default:listener"`
+	Disabled  bool
+	CreatedAt time.Time
+
+	// TOTPSecret is set once the user starts enrolling in two-factor
+	// authentication. It is in use only after TOTPEnabled is set.
+	TOTPSecret  string
+	TOTPEnabled bool
+
+	// TOTPCounter is the time step of the last accepted TOTP code. It makes
+	// sure every code is accepted only once.
+	TOTPCounter int64
+
+	// OIDCIssuer and OIDCSubject identify the user with the OpenID Connect
+	// provider. They are nil for local accounts.
+	OIDCIssuer  *string `gorm:"column:oidc_issuer;uniqueIndex:idx_users_oidc"`
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex:idx_users_oidc"`
+}
+
+// ensureAdmin makes sure there is at least one administrator when there are users
+// at all. Databases created before roles existed have only listeners so the oldest
+// user is promoted.
+func ensureAdmin(db *gorm.DB) error {
+	var admins int64
+	if err := db.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+
+	if admins > 0 {
+		return nil
+	}
+
+	var first User
+	err := db.Order("id").First(&first).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("There are no administrators. Promoting user `%s`.\n", first.Username)
+	return db.Model(&first).Update("role", RoleAdmin).Error
+}
+
+// migrateDatabase creates or updates the tables of all models in the users
+// database.
+func migrateDatabase(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&User{},
+		&Session{},
+		&Invite{},
+		&APIKey{},
+		&RecoveryCode{},
+		&Passkey{},
+		&Pairing{},
+		&AuditEntry{},
+		&ScrobblerAccount{},
+		&QueuedScrobble{},
+	)
 }
 
 // Server represents our web server. It will be controlled from here
@@ -56,6 +118,31 @@ type Server struct {
 
 	db *gorm.DB
 
+	// Counts failed logins and locks out usernames and IP addresses
+	loginThrottle *loginThrottle
+
+	// The WebAuthn relying party used for passkeys. It is nil when passkeys
+	// are not configured.
+	webAuthn *webauthn.WebAuthn
+
+	// Passkey registrations and logins which have been started but not
+	// finished yet
+	ceremonies *ceremonyStore
+
+	// The OpenID Connect relying party. It is nil when OIDC is not configured.
+	oidc *oidcLogin
+
+	// Converts files to other formats while streaming. It is nil when
+	// transcoding is not configured.
+	transcoding *transcoding
+
+	// plays are the plays which the clients are reporting with play events.
+	plays *playTracker
+
+	// Submits the users' plays to ListenBrainz and Last.fm. It is nil when
+	// scrobbling is not configured.
+	scrobbling *scrobbling
+
 	// Makes the server lockable. This lock should be used for accessing the
 	// listener
 	sync.Mutex
@@ -77,17 +164,70 @@ func (srv *Server) Serve() {
 
 func (srv *Server) serveGoroutine() {
 	searchHandler := NewSearchHandler(srv.library)
-	albumHandler := NewAlbumHandler(srv.library)
+	albumHandler := NewAlbumHandler(srv.library, srv.library)
 	artworkHandler := NewAlbumArtworkHandler(
 		srv.library,
 		notFoundAlbumImage,
 	)
 	artistImageHandler := NewArtistImagesHandler(srv.library)
 	browseHandler := NewBrowseHandler(srv.library)
-	mediaFileHandler := NewFileHandler(srv.library)
+	mediaFileHandler := NewFileHandler(
+		srv.library,
+		srv.library,
+		srv.transcoding,
+		srv.scrobbling,
+	)
 	mediaFileHandlerCount := NewFileHandlerCount(srv.library)
-	loginTokenHandler := NewLoginTokenHandler(srv.db, srv.cfg.Secret)
-	registerTokenHandler := NewRigisterTokenHandler(srv.db, srv.cfg.Secret)
+	hlsHandler := NewHLSHandler(srv.library, srv.transcoding)
+	playEventsHandler := NewPlayEventsHandler(srv.library, srv.plays)
+	historyHandler := NewHistoryHandler(srv.library)
+	statsHandler := NewStatsHandler(srv.library)
+	scrobblersHandler := NewScrobblersHandler(srv.scrobbling)
+	loginTokenHandler := NewLoginTokenHandler(
+		srv.db,
+		srv.cfg.Secret,
+		srv.loginThrottle,
+	)
+	registerTokenHandler := NewRigisterTokenHandler(
+		srv.db,
+		srv.cfg.Secret,
+		srv.cfg.Registration,
+	)
+	refreshTokenHandler := NewRefreshTokenHandler(srv.db, srv.cfg.Secret)
+	sessionsHandler := NewSessionsHandler(srv.db)
+	invitesHandler := NewInvitesHandler(srv.db)
+	accountHandler := NewAccountHandler(
+		srv.db,
+		srv.library,
+		srv.cfg.Secret,
+		srv.loginThrottle,
+	)
+	usersHandler := NewUsersHandler(srv.db, srv.library, srv.library)
+	apiKeysHandler := NewAPIKeysHandler(srv.db)
+	signedURLHandler := NewSignedURLHandler(srv.cfg.Secret)
+	lockoutsHandler := NewLockoutsHandler(srv.loginThrottle)
+	auditLogHandler := NewAuditLogHandler(srv.db)
+	totpHandler := NewTOTPHandler(srv.db, srv.loginThrottle)
+	passkeysHandler := NewPasskeysHandler(
+		srv.db,
+		srv.webAuthn,
+		srv.ceremonies,
+		srv.loginThrottle,
+	)
+	passkeyLoginHandler := NewPasskeyLoginHandler(
+		srv.db,
+		srv.cfg.Secret,
+		srv.webAuthn,
+		srv.ceremonies,
+		srv.loginThrottle,
+	)
+	oidcLoginHandler := NewOIDCLoginHandler(srv.db, srv.cfg.Secret, srv.oidc)
+	pairingsHandler := NewPairingsHandler(srv.db)
+	pairDeviceHandler := NewPairDeviceHandler(
+		srv.db,
+		srv.cfg.Secret,
+		srv.loginThrottle,
+	)
 
 	router := mux.NewRouter()
 	router.StrictSlash(true)
@@ -115,15 +255,141 @@ func (srv *Server) serveGoroutine() {
 	router.Handle(APIv1EndpointFile, mediaFileHandler).Methods(
 		APIv1Methods[APIv1EndpointFile]...,
 	)
+	router.Handle(APIv1EndpointFileHLSMaster, hlsHandler).Methods(
+		APIv1Methods[APIv1EndpointFileHLSMaster]...,
+	)
+	router.Handle(APIv1EndpointFileHLSVariant, hlsHandler).Methods(
+		APIv1Methods[APIv1EndpointFileHLSVariant]...,
+	)
+	router.Handle(APIv1EndpointFileHLSSegment, hlsHandler).Methods(
+		APIv1Methods[APIv1EndpointFileHLSSegment]...,
+	)
 	router.Handle(APIv1EndpointFileCount, mediaFileHandlerCount).Methods(
 		APIv1Methods[APIv1EndpointFileCount]...,
 	)
+	router.Handle(APIv1EndpointFilePlayEvents, playEventsHandler).Methods(
+		APIv1Methods[APIv1EndpointFilePlayEvents]...,
+	)
 	router.Handle(APIv1EndpointLoginToken, loginTokenHandler).Methods(
 		APIv1Methods[APIv1EndpointLoginToken]...,
 	)
 	router.Handle(APIv1EndpointRegisterToken, registerTokenHandler).Methods(
 		APIv1Methods[APIv1EndpointRegisterToken]...,
 	)
+	router.Handle(APIv1EndpointRefreshToken, refreshTokenHandler).Methods(
+		APIv1Methods[APIv1EndpointRefreshToken]...,
+	)
+	router.Handle(APIv1EndpointSessions, sessionsHandler).Methods(
+		APIv1Methods[APIv1EndpointSessions]...,
+	)
+	router.Handle(APIv1EndpointSession, sessionsHandler).Methods(
+		APIv1Methods[APIv1EndpointSession]...,
+	)
+	router.Handle(APIv1EndpointInvites, invitesHandler).Methods(
+		APIv1Methods[APIv1EndpointInvites]...,
+	)
+	router.Handle(APIv1EndpointInvite, invitesHandler).Methods(
+		APIv1Methods[APIv1EndpointInvite]...,
+	)
+	router.Handle(APIv1EndpointAccount, accountHandler).Methods(
+		APIv1Methods[APIv1EndpointAccount]...,
+	)
+	router.Handle(APIv1EndpointAccountPassword, accountHandler).Methods(
+		APIv1Methods[APIv1EndpointAccountPassword]...,
+	)
+	router.Handle(APIv1EndpointUsers, usersHandler).Methods(
+		APIv1Methods[APIv1EndpointUsers]...,
+	)
+	router.Handle(APIv1EndpointUser, usersHandler).Methods(
+		APIv1Methods[APIv1EndpointUser]...,
+	)
+	router.Handle(APIv1EndpointUserPassword, usersHandler).Methods(
+		APIv1Methods[APIv1EndpointUserPassword]...,
+	)
+	router.Handle(APIv1EndpointUserHistory, usersHandler).Methods(
+		APIv1Methods[APIv1EndpointUserHistory]...,
+	)
+	router.Handle(APIv1EndpointAPIKeys, apiKeysHandler).Methods(
+		APIv1Methods[APIv1EndpointAPIKeys]...,
+	)
+	router.Handle(APIv1EndpointAPIKey, apiKeysHandler).Methods(
+		APIv1Methods[APIv1EndpointAPIKey]...,
+	)
+	router.Handle(APIv1EndpointFileSignedURL, signedURLHandler).Methods(
+		APIv1Methods[APIv1EndpointFileSignedURL]...,
+	)
+	router.Handle(APIv1EndpointAlbumSignedURL, signedURLHandler).Methods(
+		APIv1Methods[APIv1EndpointAlbumSignedURL]...,
+	)
+	router.Handle(APIv1EndpointLockouts, lockoutsHandler).Methods(
+		APIv1Methods[APIv1EndpointLockouts]...,
+	)
+	router.Handle(APIv1EndpointHistory, historyHandler).Methods(
+		APIv1Methods[APIv1EndpointHistory]...,
+	)
+	router.Handle(APIv1EndpointHistoryContinue, historyHandler).Methods(
+		APIv1Methods[APIv1EndpointHistoryContinue]...,
+	)
+	router.Handle(APIv1EndpointCharts, statsHandler).Methods(
+		APIv1Methods[APIv1EndpointCharts]...,
+	)
+	router.Handle(APIv1EndpointYearInReview, statsHandler).Methods(
+		APIv1Methods[APIv1EndpointYearInReview]...,
+	)
+	router.Handle(APIv1EndpointScrobblers, scrobblersHandler).Methods(
+		APIv1Methods[APIv1EndpointScrobblers]...,
+	)
+	router.Handle(APIv1EndpointScrobbler, scrobblersHandler).Methods(
+		APIv1Methods[APIv1EndpointScrobbler]...,
+	)
+	router.Handle(APIv1EndpointAuditLog, auditLogHandler).Methods(
+		APIv1Methods[APIv1EndpointAuditLog]...,
+	)
+	router.Handle(APIv1EndpointAccountTOTP, totpHandler).Methods(
+		APIv1Methods[APIv1EndpointAccountTOTP]...,
+	)
+	router.Handle(APIv1EndpointAccountTOTPQRCode, totpHandler).Methods(
+		APIv1Methods[APIv1EndpointAccountTOTPQRCode]...,
+	)
+	router.Handle(APIv1EndpointAccountRecoveryCodes, totpHandler).Methods(
+		APIv1Methods[APIv1EndpointAccountRecoveryCodes]...,
+	)
+	router.Handle(APIv1EndpointPasskeys, passkeysHandler).Methods(
+		APIv1Methods[APIv1EndpointPasskeys]...,
+	)
+	router.Handle(APIv1EndpointPasskeysFinish, passkeysHandler).Methods(
+		APIv1Methods[APIv1EndpointPasskeysFinish]...,
+	)
+	router.Handle(APIv1EndpointPasskey, passkeysHandler).Methods(
+		APIv1Methods[APIv1EndpointPasskey]...,
+	)
+	router.Handle(APIv1EndpointPasskeyLoginBegin, passkeyLoginHandler).Methods(
+		APIv1Methods[APIv1EndpointPasskeyLoginBegin]...,
+	)
+	router.Handle(APIv1EndpointPasskeyLoginFinish, passkeyLoginHandler).Methods(
+		APIv1Methods[APIv1EndpointPasskeyLoginFinish]...,
+	)
+	router.Handle(APIv1EndpointOIDCLogin, oidcLoginHandler).Methods(
+		APIv1Methods[APIv1EndpointOIDCLogin]...,
+	)
+	router.Handle(APIv1EndpointOIDCCallback, oidcLoginHandler).Methods(
+		APIv1Methods[APIv1EndpointOIDCCallback]...,
+	)
+	router.Handle(APIv1EndpointPairings, pairingsHandler).Methods(
+		APIv1Methods[APIv1EndpointPairings]...,
+	)
+	router.Handle(APIv1EndpointPairing, pairingsHandler).Methods(
+		APIv1Methods[APIv1EndpointPairing]...,
+	)
+	router.Handle(APIv1EndpointPairingQRCode, pairingsHandler).Methods(
+		APIv1Methods[APIv1EndpointPairingQRCode]...,
+	)
+	router.Handle(APIv1EndpointPairClaim, pairDeviceHandler).Methods(
+		APIv1Methods[APIv1EndpointPairClaim]...,
+	)
+	router.Handle(APIv1EndpointPairToken, pairDeviceHandler).Methods(
+		APIv1Methods[APIv1EndpointPairToken]...,
+	)
 
 	router.Handle("/search/{searchQuery}", searchHandler).Methods("GET")
 	router.Handle("/search", searchHandler).Methods("GET")
@@ -138,6 +404,11 @@ func (srv *Server) serveGoroutine() {
 	router.Handle("/file/{fileID}/count", mediaFileHandlerCount).Methods("GET")
 	router.Handle("/browse", browseHandler).Methods("GET")
 
+	router.Use(NewAuditMiddleware())
+	if srv.cfg.Auth {
+		router.Use(NewAuthorizationMiddleware(APIv1Permissions))
+	}
+
 	handler := NewTerryHandler(router)
 
 	if srv.cfg.Auth {
@@ -146,12 +417,22 @@ func (srv *Server) serveGoroutine() {
 			srv.cfg.Secret,
 			srv.db,
 			[]string{
-				"/v1/login/token/",
-				"/v1/register/token/",
+				APIv1EndpointLoginToken,
+				APIv1EndpointRegisterToken,
+				APIv1EndpointRefreshToken,
+				APIv1EndpointPasskeyLoginBegin,
+				APIv1EndpointPasskeyLoginFinish,
+				APIv1EndpointOIDCLogin,
+				APIv1EndpointOIDCCallback,
+				APIv1EndpointPairClaim,
+				APIv1EndpointPairToken,
 			},
+			srv.loginThrottle,
 		)
 	}
 
+	handler = NewAuditHandler(handler, srv.db)
+
 	handler = func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx, closeRequest := context.WithCancel(srv.ctx)
@@ -227,17 +508,41 @@ func NewServer(
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	// Perform automatic database migration
-	err = db.AutoMigrate(&User{})
-	if err != nil {
+	if err := migrateDatabase(db); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	if err := ensureAdmin(db); err != nil {
+		log.Fatal("Failed to set up an administrator:", err)
+	}
+
+	webAuthn, err := newWebAuthn(cfg.WebAuthn)
+	if err != nil {
+		log.Fatal("Failed to set up WebAuthn:", err)
+	}
+
+	transcoding, err := newTranscoding(
+		cfg.Transcoding,
+		filepath.Join(filepath.Dir(databasePath), "hls-cache"),
+	)
+	if err != nil {
+		log.Fatal("Failed to set up transcoding:", err)
+	}
+
+	scrobbling := newScrobbling(ctx, cfg.Scrobbling, db, lib, cfg.ListenThreshold)
+
 	return &Server{
-		ctx:        ctx,
-		cancelFunc: cancelCtx,
-		cfg:        cfg,
-		library:    lib,
-		db:         db,
+		ctx:           ctx,
+		cancelFunc:    cancelCtx,
+		cfg:           cfg,
+		library:       lib,
+		db:            db,
+		loginThrottle: newLoginThrottle(),
+		webAuthn:      webAuthn,
+		ceremonies:    newCeremonyStore(),
+		oidc:          newOIDCLogin(ctx, cfg.OIDC, cfg.Registration),
+		transcoding:   transcoding,
+		plays:         newPlayTracker(lib, lib, scrobbling, cfg.ListenThreshold),
+		scrobbling:    scrobbling,
 	}
 }